@@ -0,0 +1,183 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/sirupsen/logrus"
+	"os"
+	"strings"
+	"time"
+)
+
+// The resource managed identities request tokens for
+const storageResource = "https://storage.azure.com/"
+
+// The well known account of the Azure Storage emulators, eg. Azurite, used by
+// the `UseDevelopmentStorage=true` connection string
+const (
+	developmentAccount  = "devstoreaccount1"
+	developmentKey      = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	developmentEndpoint = "http://127.0.0.1:10000/devstoreaccount1"
+)
+
+// ConnectionString is what funnel uses of an Azure Storage connection string
+type ConnectionString struct {
+	AccountName  string
+	AccountKey   string
+	SASToken     string
+	BlobEndpoint string
+}
+
+// ParseConnectionString parses an Azure Storage connection string, eg.
+// `DefaultEndpointsProtocol=https;AccountName=acme;AccountKey=...`, finding the
+// endpoint of its blob service
+func ParseConnectionString(connectionString string) (*ConnectionString, error) {
+	settings := make(map[string]string)
+	for _, setting := range strings.Split(connectionString, ";") {
+		if "" == strings.TrimSpace(setting) {
+			continue
+		}
+
+		parts := strings.SplitN(setting, "=", 2)
+		if 2 != len(parts) {
+			return nil, errors.New("invalid Azure Storage connection string, must be made of settings such as AccountName=name")
+		}
+
+		settings[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	if strings.EqualFold("true", settings["UseDevelopmentStorage"]) {
+		return &ConnectionString{
+			AccountName:  developmentAccount,
+			AccountKey:   developmentKey,
+			BlobEndpoint: developmentEndpoint,
+		}, nil
+	}
+
+	parsed := &ConnectionString{
+		AccountName:  settings["AccountName"],
+		AccountKey:   settings["AccountKey"],
+		SASToken:     strings.TrimPrefix(settings["SharedAccessSignature"], "?"),
+		BlobEndpoint: settings["BlobEndpoint"],
+	}
+
+	if "" == parsed.BlobEndpoint {
+		if "" == parsed.AccountName {
+			return nil, errors.New("invalid Azure Storage connection string, must have an AccountName or a BlobEndpoint")
+		}
+
+		protocol := settings["DefaultEndpointsProtocol"]
+		if "" == protocol {
+			protocol = "https"
+		}
+
+		endpointSuffix := settings["EndpointSuffix"]
+		if "" == endpointSuffix {
+			endpointSuffix = "core.windows.net"
+		}
+
+		parsed.BlobEndpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, parsed.AccountName, endpointSuffix)
+	}
+
+	if "" == parsed.AccountKey && "" == parsed.SASToken {
+		return nil, errors.New("invalid Azure Storage connection string, must have an AccountKey or a SharedAccessSignature")
+	}
+
+	return parsed, nil
+}
+
+// Find the endpoint of the blob service and the credential to authenticate
+// with, from a connection string, a SAS token or a managed identity in that
+// order. A SAS token is returned to be sent in the query string of requests.
+func authenticate(account string, logger *logrus.Logger) (string, string, azblob.Credential, error) {
+	if connectionString := os.Getenv(ConnectionStringEnvVar); "" != connectionString {
+		parsed, err := ParseConnectionString(connectionString)
+		if err != nil {
+			return "", "", nil, err
+		}
+
+		if "" != parsed.AccountKey {
+			credential, err := azblob.NewSharedKeyCredential(parsed.AccountName, parsed.AccountKey)
+			if err != nil {
+				return "", "", nil, fmt.Errorf("invalid Azure Storage account key: %w", err)
+			}
+
+			return parsed.BlobEndpoint, "", credential, nil
+		}
+
+		return parsed.BlobEndpoint, parsed.SASToken, azblob.NewAnonymousCredential(), nil
+	}
+
+	if "" == account {
+		return "", "", nil, fmt.Errorf(
+			"must specify an Azure Storage account, eg. azblob://container?account=name, or set %s",
+			ConnectionStringEnvVar,
+		)
+	}
+
+	blobEndpoint := fmt.Sprintf("https://%s.blob.core.windows.net", account)
+
+	if sasToken := os.Getenv(SASTokenEnvVar); "" != sasToken {
+		return blobEndpoint, strings.TrimPrefix(sasToken, "?"), azblob.NewAnonymousCredential(), nil
+	}
+
+	credential, err := managedIdentityCredential(os.Getenv(ClientIDEnvVar), logger)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	return blobEndpoint, "", credential, nil
+}
+
+// Authenticate with the managed identity of the machine funnel runs on, or the
+// user-assigned identity with the client ID when it is not empty. Its token is
+// refreshed ahead of expiring for as long as funnel runs.
+func managedIdentityCredential(clientID string, logger *logrus.Logger) (azblob.Credential, error) {
+	// Asking for a token retries for a long while when there is no managed
+	// identity, eg. outside of Azure, so its endpoint is probed first
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if !adal.MSIAvailable(ctx, nil) {
+		return nil, fmt.Errorf(
+			"no Azure managed identity is available, set %s or %s to authenticate instead",
+			ConnectionStringEnvVar,
+			SASTokenEnvVar,
+		)
+	}
+
+	token, err := adal.NewServicePrincipalTokenFromManagedIdentity(
+		storageResource,
+		&adal.ManagedIdentityOptions{ClientID: clientID},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use Azure managed identity: %w", err)
+	}
+
+	err = token.Refresh()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token for Azure managed identity: %w", err)
+	}
+
+	return azblob.NewTokenCredential(token.OAuthToken(), func(credential azblob.TokenCredential) time.Duration {
+		err := token.EnsureFresh()
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"error": err.Error(),
+			}).Error("Failed to refresh token for Azure managed identity, retrying in a minute")
+			return time.Minute
+		}
+
+		credential.SetToken(token.OAuthToken())
+
+		untilRefresh := time.Until(token.Token().Expires()) - 5*time.Minute
+		if untilRefresh < time.Minute {
+			return time.Minute
+		}
+
+		return untilRefresh
+	}), nil
+}
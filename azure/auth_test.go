@@ -0,0 +1,45 @@
+package azure
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestParseConnectionString(t *testing.T) {
+	Convey("Should find the blob endpoint of an account", t, func() {
+		parsed, err := ParseConnectionString("DefaultEndpointsProtocol=https;AccountName=acme;AccountKey=c29tZSBrZXk=;EndpointSuffix=core.chinacloudapi.cn")
+
+		So(err, ShouldBeNil)
+		So(parsed.AccountName, ShouldEqual, "acme")
+		So(parsed.AccountKey, ShouldEqual, "c29tZSBrZXk=")
+		So(parsed.BlobEndpoint, ShouldEqual, "https://acme.blob.core.chinacloudapi.cn")
+	})
+
+	Convey("Should keep an explicit blob endpoint and SAS token", t, func() {
+		parsed, err := ParseConnectionString("BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1;SharedAccessSignature=sv=2020-10-02&sig=abc%3D")
+
+		So(err, ShouldBeNil)
+		So(parsed.BlobEndpoint, ShouldEqual, "http://127.0.0.1:10000/devstoreaccount1")
+		So(parsed.SASToken, ShouldEqual, "sv=2020-10-02&sig=abc%3D")
+	})
+
+	Convey("Should use the emulator's account for development storage", t, func() {
+		parsed, err := ParseConnectionString("UseDevelopmentStorage=true")
+
+		So(err, ShouldBeNil)
+		So(parsed.AccountName, ShouldEqual, "devstoreaccount1")
+		So(parsed.BlobEndpoint, ShouldEqual, "http://127.0.0.1:10000/devstoreaccount1")
+	})
+
+	Convey("Should reject connection strings without credentials", t, func() {
+		_, err := ParseConnectionString("AccountName=acme")
+
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should reject malformed connection strings", t, func() {
+		_, err := ParseConnectionString("some-secret")
+
+		So(err, ShouldNotBeNil)
+	})
+}
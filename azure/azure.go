@@ -0,0 +1,423 @@
+// Package azure is a storage backend that uploads files as block blobs to a
+// container in Azure Blob Storage, for destinations such as
+// `azblob://container/prefix`
+package azure
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/timrourke/funnel/backend"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Environment variables the backend authenticates with, in order of preference.
+// Without either of them, the managed identity of the machine is used, or the
+// user-assigned identity named by `AZURE_CLIENT_ID`.
+const (
+	ConnectionStringEnvVar = "AZURE_STORAGE_CONNECTION_STRING"
+	SASTokenEnvVar         = "AZURE_STORAGE_SAS_TOKEN"
+	AccountEnvVar          = "AZURE_STORAGE_ACCOUNT"
+	ClientIDEnvVar         = "AZURE_CLIENT_ID"
+)
+
+// Access tiers blobs can be stored in
+var accessTiers = []azblob.AccessTierType{azblob.AccessTierHot, azblob.AccessTierCool, azblob.AccessTierArchive}
+
+func init() {
+	backend.Register("azblob", openBackend)
+}
+
+// BlobOptions are the properties a blob is given as it is uploaded
+type BlobOptions struct {
+	ContentType     string
+	ContentEncoding string
+	ContentMD5      []byte
+	Metadata        map[string]string
+	Tags            map[string]string
+	AccessTier      string
+}
+
+// ContainerClient is the part of the Azure Blob Storage API for a container
+// used by the backend
+type ContainerClient interface {
+	// UploadBlob writes a blob in a single request, returning the MD5 checksum
+	// the service took of its contents
+	UploadBlob(ctx context.Context, name string, body io.ReadSeeker, options BlobOptions) ([]byte, error)
+	DeleteBlob(ctx context.Context, name string) error
+	StageBlock(ctx context.Context, name string, blockID string, body io.ReadSeeker, contentMD5 []byte) error
+	CommitBlockList(ctx context.Context, name string, blockIDs []string, options BlobOptions) error
+	GetProperties(ctx context.Context) error
+}
+
+type containerClient struct {
+	containerURL azblob.ContainerURL
+}
+
+// NewContainerClient adapts the URL of a container in the Azure Storage SDK to
+// the backend
+func NewContainerClient(containerURL azblob.ContainerURL) ContainerClient {
+	return &containerClient{
+		containerURL: containerURL,
+	}
+}
+
+func (c *containerClient) UploadBlob(ctx context.Context, name string, body io.ReadSeeker, options BlobOptions) ([]byte, error) {
+	response, err := c.containerURL.NewBlockBlobURL(name).Upload(
+		ctx,
+		body,
+		blobHTTPHeaders(options),
+		options.Metadata,
+		azblob.BlobAccessConditions{},
+		azblob.AccessTierType(options.AccessTier),
+		options.Tags,
+		azblob.ClientProvidedKeyOptions{},
+		azblob.ImmutabilityPolicyOptions{},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.ContentMD5(), nil
+}
+
+func (c *containerClient) DeleteBlob(ctx context.Context, name string) error {
+	_, err := c.containerURL.NewBlockBlobURL(name).Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+
+	return err
+}
+
+func (c *containerClient) StageBlock(ctx context.Context, name string, blockID string, body io.ReadSeeker, contentMD5 []byte) error {
+	_, err := c.containerURL.NewBlockBlobURL(name).StageBlock(
+		ctx,
+		blockID,
+		body,
+		azblob.LeaseAccessConditions{},
+		contentMD5,
+		azblob.ClientProvidedKeyOptions{},
+	)
+
+	return err
+}
+
+func (c *containerClient) CommitBlockList(ctx context.Context, name string, blockIDs []string, options BlobOptions) error {
+	_, err := c.containerURL.NewBlockBlobURL(name).CommitBlockList(
+		ctx,
+		blockIDs,
+		blobHTTPHeaders(options),
+		options.Metadata,
+		azblob.BlobAccessConditions{},
+		azblob.AccessTierType(options.AccessTier),
+		options.Tags,
+		azblob.ClientProvidedKeyOptions{},
+		azblob.ImmutabilityPolicyOptions{},
+	)
+
+	return err
+}
+
+func (c *containerClient) GetProperties(ctx context.Context) error {
+	_, err := c.containerURL.GetProperties(ctx, azblob.LeaseAccessConditions{})
+
+	return err
+}
+
+func blobHTTPHeaders(options BlobOptions) azblob.BlobHTTPHeaders {
+	return azblob.BlobHTTPHeaders{
+		ContentType:     options.ContentType,
+		ContentEncoding: options.ContentEncoding,
+		ContentMD5:      options.ContentMD5,
+	}
+}
+
+type azureBackend struct {
+	client           ContainerClient
+	container        string
+	prefix           string
+	accessTier       string
+	metadata         map[string]string
+	tags             map[string]string
+	stagingThreshold int64
+	blockSize        int64
+	bodyWrappers     []backend.BodyWrapper
+}
+
+// NewBackend creates the backend for a container in Azure Blob Storage, whose
+// blob names all begin with the given prefix. Files at or above the staging
+// threshold, and anything larger than a block, are staged in blocks of the block
+// size, which are committed once all of them were uploaded. Every blob is given
+// the access tier, unless it is empty, the metadata and the index tags.
+func NewBackend(
+	client ContainerClient,
+	container string,
+	prefix string,
+	accessTier string,
+	metadata map[string]string,
+	tags map[string]string,
+	stagingThreshold int64,
+	blockSize int64,
+	bodyWrappers ...backend.BodyWrapper,
+) backend.Backend {
+	return &azureBackend{
+		client:           client,
+		container:        container,
+		prefix:           prefix,
+		accessTier:       accessTier,
+		metadata:         metadata,
+		tags:             tags,
+		stagingThreshold: stagingThreshold,
+		blockSize:        blockSize,
+		bodyWrappers:     bodyWrappers,
+	}
+}
+
+// Open the backend for a destination such as `azblob://container/prefix`. The
+// storage account is taken from the connection string, or from the
+// destination's `account` query parameter, falling back to
+// `AZURE_STORAGE_ACCOUNT`. Its `tier`, `metadata` and `tags` query parameters
+// set the access tier, metadata and index tags of every blob, eg.
+// `azblob://container?account=acme&tier=Cool&tags=team:sensors`.
+func openBackend(destination *url.URL, options backend.Options) (backend.Backend, error) {
+	container := destination.Host
+	if "" == container {
+		return nil, errors.New("must specify an Azure Blob Storage container to save files in, eg. azblob://container/prefix")
+	}
+
+	if len(options.CompressionRules) > 0 {
+		return nil, errors.New("compressing files is not supported by azblob destinations")
+	}
+
+	if nil != options.KeyWrapper {
+		return nil, errors.New("encrypting files is not supported by azblob destinations")
+	}
+
+	query := destination.Query()
+
+	accessTier, err := ParseAccessTier(query.Get("tier"))
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := backend.ParsePairs("metadata", query["metadata"])
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := backend.ParsePairs("tags", query["tags"])
+	if err != nil {
+		return nil, err
+	}
+
+	account := query.Get("account")
+	if "" == account {
+		account = os.Getenv(AccountEnvVar)
+	}
+
+	blobEndpoint, sasToken, credential, err := authenticate(account, options.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	containerURL, err := url.Parse(strings.TrimSuffix(blobEndpoint, "/") + "/" + container)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Azure Blob Storage endpoint %s: %w", blobEndpoint, err)
+	}
+	containerURL.RawQuery = sasToken
+
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{
+		Retry: azblob.RetryOptions{MaxTries: 4},
+	})
+
+	return NewBackend(
+		NewContainerClient(azblob.NewContainerURL(*containerURL, pipeline)),
+		container,
+		backend.Prefix(destination),
+		accessTier,
+		metadata,
+		tags,
+		options.MultipartThreshold,
+		options.MultipartPartSize,
+		options.BodyWrappers...,
+	), nil
+}
+
+// ParseAccessTier validates the access tier of blobs, which may be empty to
+// use the account's default access tier
+func ParseAccessTier(accessTier string) (string, error) {
+	if "" == accessTier {
+		return "", nil
+	}
+
+	var names []string
+	for _, supported := range accessTiers {
+		if strings.EqualFold(string(supported), accessTier) {
+			return string(supported), nil
+		}
+		names = append(names, string(supported))
+	}
+
+	return "", fmt.Errorf("invalid access tier %s, must be one of: %s", accessTier, strings.Join(names, ", "))
+}
+
+// Upload a file to its blob below the prefix
+func (a *azureBackend) Upload(path string, key string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	return a.write(
+		backend.JoinKey(a.prefix, key),
+		backend.WrapBody(path, file, a.bodyWrappers),
+		info.Size() >= a.stagingThreshold,
+		a.blobOptions(nil),
+	)
+}
+
+// PutObject streams an object to its blob below the prefix
+func (a *azureBackend) PutObject(object *backend.Object) error {
+	options := a.blobOptions(object.Metadata)
+	options.ContentType = object.ContentType
+	options.ContentEncoding = object.ContentEncoding
+
+	return a.write(backend.JoinKey(a.prefix, object.Key), object.Body, false, options)
+}
+
+func (a *azureBackend) blobOptions(metadata map[string]string) BlobOptions {
+	options := BlobOptions{
+		Metadata:   a.metadata,
+		Tags:       a.tags,
+		AccessTier: a.accessTier,
+	}
+
+	if len(metadata) > 0 {
+		options.Metadata = make(map[string]string)
+		for name, value := range a.metadata {
+			options.Metadata[name] = value
+		}
+		for name, value := range metadata {
+			options.Metadata[name] = value
+		}
+	}
+
+	return options
+}
+
+// Write a blob in a single request when it fits in one block, unless it must
+// be staged, or stage it block by block otherwise. One block is read into
+// memory at a time, so that each request can be retried. Azure Blob Storage
+// verifies the MD5 checksum of each staged block, while the checksum of a blob
+// written in a single request is compared with the one the service took of it.
+func (a *azureBackend) write(name string, body io.Reader, shouldStage bool, options BlobOptions) error {
+	ctx := context.Background()
+
+	block := make([]byte, a.blockSize)
+	checksum := md5.New()
+
+	n, err := io.ReadFull(body, block)
+	isLastBlock := io.EOF == err || io.ErrUnexpectedEOF == err
+	if err != nil && !isLastBlock {
+		return fmt.Errorf("failed to read blob: %s: %w", a.urlForName(name), err)
+	}
+
+	if isLastBlock && (!shouldStage || 0 == n) {
+		blobMD5 := md5.Sum(block[:n])
+		options.ContentMD5 = blobMD5[:]
+
+		uploadedMD5, err := a.client.UploadBlob(ctx, name, bytes.NewReader(block[:n]), options)
+		if err != nil {
+			return fmt.Errorf("failed to upload blob: %s: %w", a.urlForName(name), err)
+		}
+
+		return a.verifyUploadedBlob(ctx, name, options.ContentMD5, uploadedMD5)
+	}
+
+	var blockIDs []string
+	for {
+		blockID := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%010d", len(blockIDs))))
+
+		blockMD5 := md5.Sum(block[:n])
+		checksum.Write(block[:n])
+
+		err = a.client.StageBlock(ctx, name, blockID, bytes.NewReader(block[:n]), blockMD5[:])
+		if err != nil {
+			return fmt.Errorf("failed to stage block %d of blob: %s: %w", len(blockIDs), a.urlForName(name), err)
+		}
+		blockIDs = append(blockIDs, blockID)
+
+		if isLastBlock {
+			break
+		}
+
+		n, err = io.ReadFull(body, block)
+		isLastBlock = io.EOF == err || io.ErrUnexpectedEOF == err
+		if err != nil && !isLastBlock {
+			return fmt.Errorf("failed to read blob: %s: %w", a.urlForName(name), err)
+		}
+
+		if 0 == n {
+			break
+		}
+	}
+
+	options.ContentMD5 = checksum.Sum(nil)
+
+	err = a.client.CommitBlockList(ctx, name, blockIDs, options)
+	if err != nil {
+		return fmt.Errorf("failed to commit blocks of blob: %s: %w", a.urlForName(name), err)
+	}
+
+	return nil
+}
+
+// Delete a blob written in a single request whose MD5 checksum differs from the
+// one the service took of it. Services that do not return a checksum are
+// trusted.
+func (a *azureBackend) verifyUploadedBlob(ctx context.Context, name string, expected []byte, actual []byte) error {
+	if 0 == len(actual) || bytes.Equal(expected, actual) {
+		return nil
+	}
+
+	err := a.client.DeleteBlob(ctx, name)
+	if err != nil {
+		return fmt.Errorf("MD5 checksum mismatch for blob: %s, and failed to delete it: %w", a.urlForName(name), err)
+	}
+
+	return fmt.Errorf(
+		"MD5 checksum mismatch for blob: %s, expected %s but got %s",
+		a.urlForName(name),
+		base64.StdEncoding.EncodeToString(expected),
+		base64.StdEncoding.EncodeToString(actual),
+	)
+}
+
+// CheckAccess verifies that the container is accessible
+func (a *azureBackend) CheckAccess(ctx context.Context) error {
+	err := a.client.GetProperties(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to access Azure Blob Storage container %s: %w", a.container, err)
+	}
+
+	return nil
+}
+
+func (a *azureBackend) URL(key string) string {
+	return a.urlForName(backend.JoinKey(a.prefix, key))
+}
+
+func (a *azureBackend) urlForName(name string) string {
+	return fmt.Sprintf("azblob://%s/%s", a.container, name)
+}
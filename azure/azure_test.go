@@ -0,0 +1,288 @@
+package azure
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/timrourke/funnel/backend"
+	"github.com/timrourke/funnel/compress"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingContainerClient reads the whole body of each request, as the Azure
+// Blob Storage API would
+type recordingContainerClient struct {
+	uploaded      map[string][]byte
+	uploadOptions map[string]BlobOptions
+	staged        map[string][][]byte
+	committed     map[string][]string
+	commitOptions map[string]BlobOptions
+	deleted       []string
+	propertiesGot int
+	stageBlockErr error
+	corruptBodies bool
+}
+
+func newRecordingContainerClient() *recordingContainerClient {
+	return &recordingContainerClient{
+		uploaded:      map[string][]byte{},
+		uploadOptions: map[string]BlobOptions{},
+		staged:        map[string][][]byte{},
+		committed:     map[string][]string{},
+		commitOptions: map[string]BlobOptions{},
+	}
+}
+
+func (r *recordingContainerClient) UploadBlob(ctx context.Context, name string, body io.ReadSeeker, options BlobOptions) ([]byte, error) {
+	contents, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.corruptBodies {
+		contents = append(contents, '!')
+	}
+
+	r.uploaded[name] = contents
+	r.uploadOptions[name] = options
+
+	checksum := md5.Sum(contents)
+
+	return checksum[:], nil
+}
+
+func (r *recordingContainerClient) DeleteBlob(ctx context.Context, name string) error {
+	r.deleted = append(r.deleted, name)
+
+	return nil
+}
+
+func (r *recordingContainerClient) StageBlock(ctx context.Context, name string, blockID string, body io.ReadSeeker, contentMD5 []byte) error {
+	if r.stageBlockErr != nil {
+		return r.stageBlockErr
+	}
+
+	contents, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	checksum := md5.Sum(contents)
+	if !bytes.Equal(checksum[:], contentMD5) {
+		return fmt.Errorf("checksum mismatch for block %s", blockID)
+	}
+
+	r.staged[name] = append(r.staged[name], contents)
+
+	return nil
+}
+
+func (r *recordingContainerClient) CommitBlockList(ctx context.Context, name string, blockIDs []string, options BlobOptions) error {
+	r.committed[name] = blockIDs
+	r.commitOptions[name] = options
+
+	return nil
+}
+
+func (r *recordingContainerClient) GetProperties(ctx context.Context) error {
+	r.propertiesGot++
+
+	return nil
+}
+
+func TestAzureBackend(t *testing.T) {
+	source, err := ioutil.TempFile("", "somefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(source.Name())
+
+	_, err = source.WriteString("some contents")
+	source.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := map[string]string{"team": "sensors"}
+	tags := map[string]string{"source": "drop"}
+
+	Convey("Should upload small files below the prefix in a single request", t, func() {
+		client := newRecordingContainerClient()
+		azureBackend := NewBackend(client, "some-container", "some/prefix", "Cool", metadata, tags, 1024, 1024)
+
+		err := azureBackend.Upload(source.Name(), "a.txt")
+
+		So(err, ShouldBeNil)
+		So(string(client.uploaded["some/prefix/a.txt"]), ShouldEqual, "some contents")
+
+		checksum := md5.Sum([]byte("some contents"))
+		options := client.uploadOptions["some/prefix/a.txt"]
+		So(options.ContentMD5, ShouldResemble, checksum[:])
+		So(options.AccessTier, ShouldEqual, "Cool")
+		So(options.Metadata, ShouldResemble, metadata)
+		So(options.Tags, ShouldResemble, tags)
+		So(azureBackend.URL("a.txt"), ShouldEqual, "azblob://some-container/some/prefix/a.txt")
+	})
+
+	Convey("Should stage files at or above the staging threshold in blocks", t, func() {
+		client := newRecordingContainerClient()
+		azureBackend := NewBackend(client, "some-container", "", "", nil, tags, 4, 4)
+
+		err := azureBackend.Upload(source.Name(), "a.txt")
+
+		So(err, ShouldBeNil)
+		So(client.uploaded, ShouldBeEmpty)
+		So(client.staged["a.txt"], ShouldResemble, [][]byte{
+			[]byte("some"),
+			[]byte(" con"),
+			[]byte("tent"),
+			[]byte("s"),
+		})
+		So(len(client.committed["a.txt"]), ShouldEqual, 4)
+		So(client.committed["a.txt"][0], ShouldNotEqual, client.committed["a.txt"][1])
+
+		checksum := md5.Sum([]byte("some contents"))
+		So(client.commitOptions["a.txt"].ContentMD5, ShouldResemble, checksum[:])
+		So(client.commitOptions["a.txt"].Tags, ShouldResemble, tags)
+	})
+
+	Convey("Should stage objects larger than a block", t, func() {
+		client := newRecordingContainerClient()
+		azureBackend := NewBackend(client, "some-container", "", "", metadata, nil, 1024, 8)
+
+		So(azureBackend.PutObject(&backend.Object{
+			Key:         "manifest.jsonl",
+			Body:        strings.NewReader("{}"),
+			ContentType: "application/x-ndjson",
+			Metadata:    map[string]string{"kind": "manifest"},
+		}), ShouldBeNil)
+		So(azureBackend.PutObject(&backend.Object{Key: "archive.tar", Body: strings.NewReader("some contents")}), ShouldBeNil)
+
+		So(string(client.uploaded["manifest.jsonl"]), ShouldEqual, "{}")
+		So(client.uploadOptions["manifest.jsonl"].ContentType, ShouldEqual, "application/x-ndjson")
+		So(client.uploadOptions["manifest.jsonl"].Metadata, ShouldResemble, map[string]string{"team": "sensors", "kind": "manifest"})
+		So(len(client.committed["archive.tar"]), ShouldEqual, 2)
+	})
+
+	Convey("Should delete blobs whose checksum does not match", t, func() {
+		client := newRecordingContainerClient()
+		client.corruptBodies = true
+		azureBackend := NewBackend(client, "some-container", "some/prefix", "", nil, nil, 1024, 1024)
+
+		err := azureBackend.Upload(source.Name(), "a.txt")
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "MD5 checksum mismatch")
+		So(client.deleted, ShouldResemble, []string{"some/prefix/a.txt"})
+	})
+
+	Convey("Should fail without committing when a block fails to stage", t, func() {
+		client := newRecordingContainerClient()
+		client.stageBlockErr = fmt.Errorf("some error")
+		azureBackend := NewBackend(client, "some-container", "", "", nil, nil, 4, 4)
+
+		err := azureBackend.Upload(source.Name(), "a.txt")
+
+		So(err, ShouldNotBeNil)
+		So(client.committed, ShouldBeEmpty)
+	})
+
+	Convey("Should check access to the container", t, func() {
+		client := newRecordingContainerClient()
+
+		So(NewBackend(client, "some-container", "", "", nil, nil, 4, 4).CheckAccess(context.Background()), ShouldBeNil)
+		So(client.propertiesGot, ShouldEqual, 1)
+	})
+}
+
+func TestOpenBackend(t *testing.T) {
+	Convey("Should open destinations authenticated with a connection string", t, func() {
+		os.Setenv(ConnectionStringEnvVar, "UseDevelopmentStorage=true")
+		defer os.Unsetenv(ConnectionStringEnvVar)
+
+		azureBackend, err := backend.Open("azblob://some-container/some/prefix?tier=cool", backend.Options{})
+
+		So(err, ShouldBeNil)
+		So(azureBackend.URL("a.txt"), ShouldEqual, "azblob://some-container/some/prefix/a.txt")
+	})
+
+	Convey("Should fail without a container", t, func() {
+		_, err := backend.Open("azblob:///some/prefix", backend.Options{})
+
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should fail with an invalid access tier", t, func() {
+		_, err := backend.Open("azblob://some-container?tier=Frozen", backend.Options{})
+
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should refuse options the backend does not support", t, func() {
+		rules, err := compress.ParseRules("gzip")
+		So(err, ShouldBeNil)
+
+		_, err = backend.Open("azblob://some-container", backend.Options{CompressionRules: rules})
+
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestParseAccessTier(t *testing.T) {
+	Convey("Should accept access tiers in any case", t, func() {
+		accessTier, err := ParseAccessTier("archive")
+
+		So(err, ShouldBeNil)
+		So(accessTier, ShouldEqual, "Archive")
+	})
+
+	Convey("Should leave the access tier to the account when empty", t, func() {
+		accessTier, err := ParseAccessTier("")
+
+		So(err, ShouldBeNil)
+		So(accessTier, ShouldEqual, "")
+	})
+}
+
+// TestAzurite uploads to Azurite, eg. started with
+// `docker run -p 10000:10000 mcr.microsoft.com/azure-storage/azurite azurite-blob --blobHost 0.0.0.0`
+// and a container created in it, when AZURE_STORAGE_CONNECTION_STRING is
+// `UseDevelopmentStorage=true` and AZURITE_CONTAINER names the container
+func TestAzurite(t *testing.T) {
+	if "" == os.Getenv(ConnectionStringEnvVar) || "" == os.Getenv("AZURITE_CONTAINER") {
+		t.Skip("set AZURE_STORAGE_CONNECTION_STRING and AZURITE_CONTAINER to test against Azurite")
+	}
+
+	source, err := ioutil.TempFile("", "somefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(source.Name())
+
+	_, err = source.WriteString(strings.Repeat("some contents", 100000))
+	source.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := fmt.Sprintf("funnel-test-%d", time.Now().UnixNano())
+
+	Convey("Should upload files and objects to Azurite", t, func() {
+		azureBackend, err := backend.Open(
+			fmt.Sprintf("azblob://%s/%s?tier=Cool&metadata=team:sensors&tags=source:drop", os.Getenv("AZURITE_CONTAINER"), prefix),
+			backend.Options{MultipartThreshold: 1024, MultipartPartSize: 256 * 1024},
+		)
+		So(err, ShouldBeNil)
+
+		So(azureBackend.CheckAccess(context.Background()), ShouldBeNil)
+		So(azureBackend.Upload(source.Name(), "some/key.txt"), ShouldBeNil)
+		So(azureBackend.PutObject(&backend.Object{Key: "_SUCCESS", Body: strings.NewReader("")}), ShouldBeNil)
+	})
+}
@@ -0,0 +1,227 @@
+// Package backend defines the storage backends files are uploaded to, and a
+// registry of them by the scheme of a URL-style destination, eg.
+// `s3://bucket/prefix` or `file:///mnt/backup`. Each backend lives in a package
+// of its own, which registers itself when it is imported.
+package backend
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/timrourke/funnel/compress"
+	"github.com/timrourke/funnel/encrypt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Uploader uploads files to a key in a storage backend
+type Uploader interface {
+	Upload(path string, key string) error
+}
+
+// BodyWrapper decorates the reader for a file's contents before it is handed to
+// a backend as the body of an upload, eg. to limit the rate it is read at
+type BodyWrapper func(path string, body io.Reader) io.Reader
+
+// WrapBody applies body wrappers to the contents of a file in order
+func WrapBody(path string, body io.Reader, bodyWrappers []BodyWrapper) io.Reader {
+	for _, wrap := range bodyWrappers {
+		body = wrap(path, body)
+	}
+
+	return body
+}
+
+// Object is a stream of contents to store under a key, rather than a file
+type Object struct {
+	Key             string
+	Body            io.Reader
+	ContentType     string
+	ContentEncoding string
+	Metadata        map[string]string
+}
+
+// ObjectPutter stores objects that are streamed to it, eg. archives of many
+// files or manifests
+type ObjectPutter interface {
+	PutObject(object *Object) error
+}
+
+// Forgetter is implemented by backends that remember the outcome of uploading
+// a key so that retrying it is cheaper, eg. a fan-out remembers which of its
+// destinations already store a key. Callers let such a backend forget a key
+// once they will not retry uploading it.
+type Forgetter interface {
+	Forget(key string)
+}
+
+// Forget lets a backend forget a key, if it remembers anything about keys
+func Forget(b interface{}, key string) {
+	if forgetter, ok := b.(Forgetter); ok {
+		forgetter.Forget(key)
+	}
+}
+
+// Waiter is implemented by backends that keep uploading in the background, eg.
+// a fan-out retrying the destinations a file failed to upload to. Callers wait
+// for such a backend before exiting.
+type Waiter interface {
+	Wait()
+}
+
+// Wait until a backend is done uploading in the background, if it ever does
+func Wait(b interface{}) {
+	if waiter, ok := b.(Waiter); ok {
+		waiter.Wait()
+	}
+}
+
+// CompressionObserver is notified of the sizes of each file compressed while it
+// was uploaded, eg. to collect metrics
+type CompressionObserver interface {
+	ObserveCompression(algorithm string, uncompressedSize int64, compressedSize int64)
+}
+
+// Backend is a destination files and objects are uploaded to. Keys are relative
+// to the destination, eg. to the prefix of `s3://bucket/prefix`.
+type Backend interface {
+	Uploader
+	ObjectPutter
+
+	// CheckAccess verifies that the destination is reachable and writable
+	CheckAccess(ctx context.Context) error
+
+	// URL returns where a key is stored, eg. `s3://bucket/prefix/key`
+	URL(key string) string
+}
+
+// Options configure a backend beyond its destination. Backends return an error
+// when given an option they do not support, rather than ignore it.
+type Options struct {
+	Logger *logrus.Logger
+
+	// BodyWrappers are applied to each file's contents in order
+	BodyWrappers []BodyWrapper
+
+	// Region the destination is in, for backends that have regions
+	Region string
+
+	// Files at or above the multipart threshold are uploaded in parts of the
+	// part size, journaled in the journal directory so that interrupted uploads
+	// can be resumed
+	MultipartThreshold int64
+	MultipartPartSize  int64
+	JournalDir         string
+
+	// Files matching the compression rules are compressed while uploading them
+	CompressionRules     compress.Rules
+	CompressionMode      string
+	CompressionObservers []CompressionObserver
+
+	// KeyWrapper encrypts files before uploading them when it is not nil
+	KeyWrapper encrypt.KeyWrapper
+}
+
+// Factory creates a backend for a destination with its registered scheme
+type Factory func(destination *url.URL, options Options) (Backend, error)
+
+var (
+	mux       sync.Mutex
+	factories = map[string]Factory{}
+)
+
+// Register makes a backend available for destinations with the given scheme. It
+// is meant to be called from the `init` function of the backend's package.
+func Register(scheme string, factory Factory) {
+	mux.Lock()
+	defer mux.Unlock()
+
+	if _, ok := factories[scheme]; ok {
+		panic(fmt.Sprintf("backend already registered for scheme %s", scheme))
+	}
+
+	factories[scheme] = factory
+}
+
+// Schemes returns the schemes of every registered backend, sorted
+func Schemes() []string {
+	mux.Lock()
+	defer mux.Unlock()
+
+	var schemes []string
+	for scheme := range factories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+
+	return schemes
+}
+
+// Open creates the backend for a destination, eg. `s3://bucket/prefix`
+func Open(destination string, options Options) (Backend, error) {
+	destinationURL, err := url.Parse(destination)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination %s: %w", destination, err)
+	}
+
+	if "" == destinationURL.Scheme {
+		return nil, fmt.Errorf(
+			"invalid destination %s, must be a URL such as s3://bucket/prefix, supported schemes: %s",
+			destination,
+			strings.Join(Schemes(), ", "),
+		)
+	}
+
+	mux.Lock()
+	factory, ok := factories[destinationURL.Scheme]
+	mux.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf(
+			"unsupported destination scheme %s, must be one of: %s",
+			destinationURL.Scheme,
+			strings.Join(Schemes(), ", "),
+		)
+	}
+
+	return factory(destinationURL, options)
+}
+
+// Prefix returns the prefix of keys in a destination whose path is a prefix,
+// eg. `some/prefix` for `s3://bucket/some/prefix/`
+func Prefix(destination *url.URL) string {
+	return strings.Trim(destination.Path, "/")
+}
+
+// JoinKey prepends a destination's prefix to a key, leaving the key as it is
+// otherwise
+func JoinKey(prefix string, key string) string {
+	if "" == prefix {
+		return key
+	}
+
+	return prefix + "/" + strings.TrimPrefix(key, "/")
+}
+
+// ParsePairs parses options given as `name:value` pairs, eg. the metadata of
+// objects in the query parameters of a destination
+func ParsePairs(kind string, pairs []string) (map[string]string, error) {
+	if 0 == len(pairs) {
+		return nil, nil
+	}
+
+	parsed := make(map[string]string)
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, ":", 2)
+		if 2 != len(parts) || "" == strings.TrimSpace(parts[0]) {
+			return nil, fmt.Errorf("invalid %s %s, must be a pair such as name:value", kind, pair)
+		}
+
+		parsed[strings.TrimSpace(parts[0])] = parts[1]
+	}
+
+	return parsed, nil
+}
@@ -0,0 +1,71 @@
+package backend
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/url"
+	"testing"
+)
+
+func TestOpen(t *testing.T) {
+	var opened *url.URL
+	Register("test", func(destination *url.URL, options Options) (Backend, error) {
+		opened = destination
+		return &failingBackend{}, nil
+	})
+
+	Convey("Should open the backend registered for the destination's scheme", t, func() {
+		backend, err := Open("test://some-bucket/some/prefix", Options{})
+
+		So(err, ShouldBeNil)
+		So(backend, ShouldNotBeNil)
+		So(opened.Host, ShouldEqual, "some-bucket")
+		So(Prefix(opened), ShouldEqual, "some/prefix")
+	})
+
+	Convey("Should fail for destinations without a scheme", t, func() {
+		_, err := Open("some-bucket/some/prefix", Options{})
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "test")
+	})
+
+	Convey("Should fail for schemes without a registered backend", t, func() {
+		_, err := Open("ftp://some-host/some/dir", Options{})
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "unsupported destination scheme ftp")
+	})
+
+	Convey("Should refuse to register a scheme twice", t, func() {
+		So(func() {
+			Register("test", nil)
+		}, ShouldPanic)
+	})
+}
+
+func TestJoinKey(t *testing.T) {
+	Convey("Should prepend the prefix to a key", t, func() {
+		So(JoinKey("some/prefix", "a/b.txt"), ShouldEqual, "some/prefix/a/b.txt")
+		So(JoinKey("some/prefix", "/tmp/b.txt"), ShouldEqual, "some/prefix/tmp/b.txt")
+	})
+
+	Convey("Should leave keys without a prefix as they are", t, func() {
+		So(JoinKey("", "/tmp//b.txt"), ShouldEqual, "/tmp//b.txt")
+	})
+}
+
+func TestParsePairs(t *testing.T) {
+	Convey("Should parse name:value pairs", t, func() {
+		pairs, err := ParsePairs("metadata", []string{"team:sensors", "source:http://example.com"})
+
+		So(err, ShouldBeNil)
+		So(pairs, ShouldResemble, map[string]string{"team": "sensors", "source": "http://example.com"})
+	})
+
+	Convey("Should reject pairs without a name", t, func() {
+		_, err := ParsePairs("metadata", []string{"sensors"})
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "invalid metadata sensors")
+	})
+}
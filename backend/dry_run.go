@@ -0,0 +1,67 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+type dryRunBackend struct {
+	destination Backend
+	logger      *logrus.Logger
+}
+
+// NewDryRun creates a backend that only logs where each file or object would be
+// uploaded to in the destination, without uploading anything
+func NewDryRun(destination Backend, logger *logrus.Logger) Backend {
+	return &dryRunBackend{
+		destination: destination,
+		logger:      logger,
+	}
+}
+
+// Upload logs where the file would be uploaded to. It fails for files that no
+// longer exist, as a real upload would.
+func (d *dryRunBackend) Upload(path string, key string) error {
+	_, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	d.logger.WithFields(logrus.Fields{
+		"filename": path,
+		"key":      key,
+	}).Info(fmt.Sprintf("Dry run, would upload file %s to %s", path, d.destination.URL(key)))
+
+	return nil
+}
+
+// PutObject logs where the object would be uploaded to. Its body is still read
+// to the end, so that eg. an archive fails for members that no longer exist, as
+// a real upload would.
+func (d *dryRunBackend) PutObject(object *Object) error {
+	n, err := io.Copy(ioutil.Discard, object.Body)
+	if err != nil {
+		return err
+	}
+
+	d.logger.WithFields(logrus.Fields{
+		"key":  object.Key,
+		"size": n,
+	}).Info(fmt.Sprintf("Dry run, would upload object of %d bytes to %s", n, d.destination.URL(object.Key)))
+
+	return nil
+}
+
+// CheckAccess checks the access to the destination, which the uploads that are
+// only logged would need
+func (d *dryRunBackend) CheckAccess(ctx context.Context) error {
+	return d.destination.CheckAccess(ctx)
+}
+
+func (d *dryRunBackend) URL(key string) string {
+	return d.destination.URL(key)
+}
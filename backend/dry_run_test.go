@@ -0,0 +1,80 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// failingBackend fails every upload, and knows where keys would be stored
+type failingBackend struct{}
+
+func (f *failingBackend) Upload(path string, key string) error {
+	return errors.New("should not upload")
+}
+
+func (f *failingBackend) PutObject(object *Object) error {
+	return errors.New("should not upload")
+}
+
+func (f *failingBackend) CheckAccess(ctx context.Context) error {
+	return nil
+}
+
+func (f *failingBackend) URL(key string) string {
+	return "mem://some-bucket/" + key
+}
+
+type failingReader struct{}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("some error")
+}
+
+func TestDryRunBackend(t *testing.T) {
+	file, err := ioutil.TempFile("", "somefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	logs := &bytes.Buffer{}
+	logger := logrus.New()
+	logger.SetOutput(logs)
+
+	dryRun := NewDryRun(&failingBackend{}, logger)
+
+	Convey("Should log where a file would be uploaded to", t, func() {
+		err := dryRun.Upload(file.Name(), "some/key")
+
+		So(err, ShouldBeNil)
+		So(logs.String(), ShouldContainSubstring, "would upload file "+file.Name()+" to mem://some-bucket/some/key")
+	})
+
+	Convey("Should fail for files that do not exist", t, func() {
+		err := dryRun.Upload(file.Name()+"-missing", "some/key")
+
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should log where an object would be uploaded to", t, func() {
+		err := dryRun.PutObject(&Object{Key: "batch-1.tar", Body: strings.NewReader("some contents")})
+
+		So(err, ShouldBeNil)
+		So(logs.String(), ShouldContainSubstring, "would upload object of 13 bytes to mem://some-bucket/batch-1.tar")
+	})
+
+	Convey("Should fail for objects whose body fails to be read", t, func() {
+		var body io.Reader = &failingReader{}
+		err := dryRun.PutObject(&Object{Key: "batch-1.tar", Body: body})
+
+		So(err, ShouldNotBeNil)
+	})
+}
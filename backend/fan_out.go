@@ -0,0 +1,508 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/timrourke/funnel/retry"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fan-out modes, which say whether a file is uploaded to every destination at
+// once or to one destination after another
+const (
+	FanOutParallel   = "parallel"
+	FanOutSequential = "sequential"
+)
+
+// ParseFanOutMode checks a fan-out mode, which defaults to parallel
+func ParseFanOutMode(mode string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", FanOutParallel:
+		return FanOutParallel, nil
+	case FanOutSequential:
+		return FanOutSequential, nil
+	}
+
+	return "", fmt.Errorf("invalid fan-out mode %s, must be parallel or sequential", mode)
+}
+
+// Destination is one of the backends a fan-out uploads every file to. Files
+// only count as stored once they are in every required destination.
+type Destination struct {
+	Name     string
+	Backend  Backend
+	Required bool
+}
+
+// DestinationObserver is notified of the outcome of each upload to each of the
+// destinations of a fan-out, eg. to collect metrics
+type DestinationObserver interface {
+	ObserveDestination(destination string, err error)
+}
+
+// DestinationError is the failure of an upload to one destination
+type DestinationError struct {
+	Destination string
+	Err         error
+}
+
+// FanOutError is returned when a file or object failed to upload to some of
+// its destinations. Stored says whether it is in enough destinations anyway,
+// ie. every required one and at least the quorum, in which case the upload
+// succeeds and the others are retried in the background instead.
+type FanOutError struct {
+	Failed []DestinationError
+	Stored bool
+}
+
+func (f *FanOutError) Error() string {
+	var failures []string
+	for _, failed := range f.Failed {
+		failures = append(failures, fmt.Sprintf("%s: %s", failed.Destination, failed.Err))
+	}
+
+	return fmt.Sprintf("failed to upload to %d destinations: %s", len(f.Failed), strings.Join(failures, "; "))
+}
+
+func (f *FanOutError) Unwrap() error {
+	if 0 == len(f.Failed) {
+		return nil
+	}
+
+	return f.Failed[0].Err
+}
+
+// IsStored tells whether an upload that failed still left the file in enough
+// destinations, so that it is safe to delete once it will not be retried
+func IsStored(err error) bool {
+	var fanOutErr *FanOutError
+
+	return errors.As(err, &fanOutErr) && fanOutErr.Stored
+}
+
+// fanOutStatus is which destinations already store a version of a key, so that
+// retries only go to the destinations that failed. Retrying says whether the
+// fan-out retries them in the background.
+type fanOutStatus struct {
+	version  string
+	stored   []bool
+	retrying bool
+}
+
+type fanOutBackend struct {
+	destinations []Destination
+	quorum       int
+	mode         string
+	observers    []DestinationObserver
+	logger       *logrus.Logger
+
+	mux        sync.Mutex
+	statuses   map[string]*fanOutStatus
+	background sync.WaitGroup
+}
+
+// NewFanOut creates a backend that uploads every file and object to each of the
+// destinations, in parallel or sequentially as the mode says. Retrying an
+// upload only uploads to the destinations that failed before. An upload
+// succeeds once it is in every required destination, and in at least the
+// quorum of destinations in total, while the destinations that failed are
+// retried in the background.
+func NewFanOut(
+	destinations []Destination,
+	quorum int,
+	mode string,
+	logger *logrus.Logger,
+	observers ...DestinationObserver,
+) Backend {
+	return &fanOutBackend{
+		destinations: destinations,
+		quorum:       quorum,
+		mode:         mode,
+		observers:    observers,
+		logger:       logger,
+		statuses:     make(map[string]*fanOutStatus),
+	}
+}
+
+// Upload uploads a file to every destination that does not have it yet. A file
+// that changed since it was last uploaded goes to every destination again.
+func (f *fanOutBackend) Upload(path string, key string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	version := fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())
+
+	err = f.fanOut(key, version, f.pendingDestinations(key, version), func(destination Backend) error {
+		return destination.Upload(path, key)
+	})
+	if !IsStored(err) {
+		return err
+	}
+
+	// The file may be deleted as soon as the upload succeeds, so the
+	// destinations that failed are retried from a copy of it
+	copyPath, copyErr := copyForRetries(path, info)
+	if copyErr != nil {
+		return err
+	}
+
+	return f.retryInBackground(key, version, err, copyPath, func(destination Backend) error {
+		return destination.Upload(copyPath, key)
+	})
+}
+
+// PutObject puts an object in every destination that does not have it yet. Its
+// body is copied to a temporary file first, which every destination reads.
+func (f *fanOutBackend) PutObject(object *Object) error {
+	bodyFile, err := ioutil.TempFile("", "funnel-fan-out-")
+	if err != nil {
+		return err
+	}
+	defer bodyFile.Close()
+
+	checksum := sha256.New()
+
+	_, err = io.Copy(io.MultiWriter(bodyFile, checksum), object.Body)
+	if err != nil {
+		os.Remove(bodyFile.Name())
+		return fmt.Errorf("failed to read object: %s: %w", object.Key, err)
+	}
+
+	version := hex.EncodeToString(checksum.Sum(nil))
+
+	put := func(destination Backend) error {
+		body, err := os.Open(bodyFile.Name())
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		copied := *object
+		copied.Body = body
+
+		return destination.PutObject(&copied)
+	}
+
+	err = f.fanOut(object.Key, version, f.pendingDestinations(object.Key, version), put)
+	if !IsStored(err) {
+		os.Remove(bodyFile.Name())
+		return err
+	}
+
+	return f.retryInBackground(object.Key, version, err, bodyFile.Name(), put)
+}
+
+// Upload a version of a key to some of the destinations
+func (f *fanOutBackend) fanOut(key string, version string, pending []int, upload func(destination Backend) error) error {
+	errs := make([]error, len(f.destinations))
+	if FanOutSequential == f.mode {
+		for _, i := range pending {
+			errs[i] = upload(f.destinations[i].Backend)
+		}
+	} else {
+		var wg sync.WaitGroup
+		for _, i := range pending {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = upload(f.destinations[i].Backend)
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	for _, i := range pending {
+		if nil == errs[i] {
+			f.logger.WithFields(logrus.Fields{
+				"key":         key,
+				"destination": f.destinations[i].Name,
+			}).Debug(fmt.Sprintf("Uploaded %s to destination %s", key, f.destinations[i].Name))
+		} else {
+			f.logger.WithFields(logrus.Fields{
+				"key":         key,
+				"destination": f.destinations[i].Name,
+				"error":       errs[i].Error(),
+			}).Warn(fmt.Sprintf("Failed to upload %s to destination %s", key, f.destinations[i].Name))
+		}
+
+		for _, observer := range f.observers {
+			observer.ObserveDestination(f.destinations[i].Name, errs[i])
+		}
+	}
+
+	return f.record(key, version, pending, errs)
+}
+
+// Let an upload that is stored in enough destinations succeed, and keep
+// uploading it to the destinations that failed in the background, after a
+// delay that grows with each attempt. Retrying stops once every destination
+// stores it, it runs out of attempts, or a different version of the key is
+// uploaded meanwhile. The body file belongs to the retries, which remove it
+// once they stop.
+func (f *fanOutBackend) retryInBackground(
+	key string,
+	version string,
+	err error,
+	bodyPath string,
+	upload func(destination Backend) error,
+) error {
+	var destinations []string
+	for _, failed := range err.(*FanOutError).Failed {
+		destinations = append(destinations, failed.Destination)
+	}
+
+	f.logger.WithFields(logrus.Fields{
+		"key":          key,
+		"destinations": destinations,
+	}).Warn(fmt.Sprintf("Stored %s in enough destinations, retrying %s in the background", key, strings.Join(destinations, ", ")))
+
+	if !f.startRetrying(key, version) {
+		os.Remove(bodyPath)
+		return nil
+	}
+
+	f.background.Add(1)
+	go func() {
+		defer f.background.Done()
+		defer os.Remove(bodyPath)
+
+		for failures := 1; retry.ShouldRetry(failures); failures++ {
+			time.Sleep(retry.Delay(failures))
+
+			pending := f.pendingRetries(key, version)
+			if 0 == len(pending) {
+				return
+			}
+
+			if nil == f.fanOut(key, version, pending, upload) {
+				return
+			}
+		}
+
+		f.logger.WithFields(logrus.Fields{
+			"key":          key,
+			"destinations": destinations,
+		}).Error(fmt.Sprintf("Gave up on uploading %s to every destination", key))
+
+		f.stopRetrying(key, version)
+	}()
+
+	return nil
+}
+
+// Mark a version of a key as being retried in the background, unless a
+// different version of it was uploaded meanwhile
+func (f *fanOutBackend) startRetrying(key string, version string) bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	status, ok := f.statuses[key]
+	if !ok || status.version != version {
+		return false
+	}
+
+	status.retrying = true
+
+	return true
+}
+
+// Forget a version of a key that is no longer retried in the background
+func (f *fanOutBackend) stopRetrying(key string, version string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if status, ok := f.statuses[key]; ok && status.version == version {
+		delete(f.statuses, key)
+	}
+}
+
+// Find the destinations that a version of a key retried in the background
+// still has to be uploaded to, which are none once a different version of it
+// was uploaded
+func (f *fanOutBackend) pendingRetries(key string, version string) []int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	status, ok := f.statuses[key]
+	if !ok || status.version != version || !status.retrying {
+		return nil
+	}
+
+	var pending []int
+	for i, stored := range status.stored {
+		if !stored {
+			pending = append(pending, i)
+		}
+	}
+
+	return pending
+}
+
+// Find the destinations that do not store the version of a key yet
+func (f *fanOutBackend) pendingDestinations(key string, version string) []int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	status, ok := f.statuses[key]
+	if !ok || status.version != version {
+		status = &fanOutStatus{
+			version: version,
+			stored:  make([]bool, len(f.destinations)),
+		}
+		f.statuses[key] = status
+	}
+
+	var pending []int
+	for i, stored := range status.stored {
+		if !stored {
+			pending = append(pending, i)
+		}
+	}
+
+	return pending
+}
+
+// Record which destinations store the version of a key now. Keys stored in
+// every destination are forgotten, while the others are kept for retries until
+// the caller forgets them.
+func (f *fanOutBackend) record(key string, version string, pending []int, errs []error) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	status, ok := f.statuses[key]
+	if !ok || status.version != version {
+		// Another upload of the key finished or replaced its status meanwhile,
+		// which the destinations that were not pending already stored
+		status = &fanOutStatus{
+			version: version,
+			stored:  make([]bool, len(f.destinations)),
+		}
+		for i := range status.stored {
+			status.stored[i] = true
+		}
+		for _, i := range pending {
+			status.stored[i] = false
+		}
+	}
+
+	fanOutErr := &FanOutError{Stored: true}
+	numStored := 0
+	for _, i := range pending {
+		if nil == errs[i] {
+			status.stored[i] = true
+			continue
+		}
+
+		fanOutErr.Failed = append(fanOutErr.Failed, DestinationError{
+			Destination: f.destinations[i].Name,
+			Err:         errs[i],
+		})
+	}
+
+	for i, destination := range f.destinations {
+		if status.stored[i] {
+			numStored++
+		} else if destination.Required {
+			fanOutErr.Stored = false
+		}
+	}
+
+	if 0 == len(fanOutErr.Failed) {
+		delete(f.statuses, key)
+		return nil
+	}
+
+	// Nothing counts as stored before at least one destination has it, even
+	// with a quorum of 0
+	if numStored < f.quorum || 0 == numStored {
+		fanOutErr.Stored = false
+	}
+
+	return fanOutErr
+}
+
+// Forget which destinations store a key, once the caller will not retry it.
+// Keys retried in the background are only forgotten once those retries stop.
+func (f *fanOutBackend) Forget(key string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	if status, ok := f.statuses[key]; ok && status.retrying {
+		return
+	}
+
+	delete(f.statuses, key)
+}
+
+// Wait until every destination that failed was retried in the background
+func (f *fanOutBackend) Wait() {
+	f.background.Wait()
+}
+
+// CheckAccess verifies that every destination is reachable and writable
+func (f *fanOutBackend) CheckAccess(ctx context.Context) error {
+	for _, destination := range f.destinations {
+		err := destination.Backend.CheckAccess(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to access destination %s: %w", destination.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Copy a file for retrying it in the background, keeping its extension and
+// modification time, which some destinations store along with it
+func copyForRetries(path string, info os.FileInfo) (string, error) {
+	source, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer source.Close()
+
+	copied, err := ioutil.TempFile("", "funnel-fan-out-*"+filepath.Ext(path))
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(copied, source)
+	if closeErr := copied.Close(); nil == err {
+		err = closeErr
+	}
+	if nil == err {
+		err = os.Chtimes(copied.Name(), info.ModTime(), info.ModTime())
+	}
+	if nil == err {
+		// A file that changed while it was uploaded or copied is a different
+		// version, which the caller uploads again anyway
+		current, statErr := os.Stat(path)
+		if statErr != nil {
+			err = statErr
+		} else if current.Size() != info.Size() || !current.ModTime().Equal(info.ModTime()) {
+			err = fmt.Errorf("file changed while it was uploaded: %s", path)
+		}
+	}
+	if err != nil {
+		os.Remove(copied.Name())
+		return "", err
+	}
+
+	return copied.Name(), nil
+}
+
+// URL returns where a key is stored in the first destination
+func (f *fanOutBackend) URL(key string) string {
+	return f.destinations[0].Backend.URL(key)
+}
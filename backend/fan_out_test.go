@@ -0,0 +1,335 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/timrourke/funnel/retry"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingBackend records the keys and bodies uploaded to it, in the order
+// shared by every recording backend of a test, and fails while told to
+type recordingBackend struct {
+	name    string
+	order   *[]string
+	orderMu *sync.Mutex
+
+	mux      sync.Mutex
+	uploaded []string
+	bodies   map[string]string
+	fail     bool
+}
+
+func newRecordingBackend(name string, order *[]string, orderMu *sync.Mutex) *recordingBackend {
+	return &recordingBackend{
+		name:    name,
+		order:   order,
+		orderMu: orderMu,
+		bodies:  make(map[string]string),
+	}
+}
+
+func (r *recordingBackend) record(key string, body string) error {
+	r.orderMu.Lock()
+	*r.order = append(*r.order, r.name)
+	r.orderMu.Unlock()
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.fail {
+		return fmt.Errorf("%s is down", r.name)
+	}
+
+	r.uploaded = append(r.uploaded, key)
+	r.bodies[key] = body
+
+	return nil
+}
+
+func (r *recordingBackend) Upload(path string, key string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return r.record(key, string(contents))
+}
+
+func (r *recordingBackend) PutObject(object *Object) error {
+	contents, err := ioutil.ReadAll(object.Body)
+	if err != nil {
+		return err
+	}
+
+	return r.record(object.Key, string(contents))
+}
+
+func (r *recordingBackend) CheckAccess(ctx context.Context) error {
+	if r.fail {
+		return fmt.Errorf("%s is down", r.name)
+	}
+
+	return nil
+}
+
+func (r *recordingBackend) URL(key string) string {
+	return "mem://" + r.name + "/" + key
+}
+
+func (r *recordingBackend) setFailing(fail bool) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.fail = fail
+}
+
+type recordingDestinationObserver struct {
+	mux      sync.Mutex
+	outcomes map[string][]bool
+}
+
+func (r *recordingDestinationObserver) ObserveDestination(destination string, err error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.outcomes[destination] = append(r.outcomes[destination], nil == err)
+}
+
+func TestFanOutBackend(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	defaultRetryDelay := retry.BaseDelay
+	retry.BaseDelay = time.Millisecond
+	defer func() {
+		retry.BaseDelay = defaultRetryDelay
+	}()
+
+	file, err := ioutil.TempFile("", "somefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString("some contents")
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var order []string
+	var orderMu sync.Mutex
+
+	newDestinations := func() (*recordingBackend, *recordingBackend, []Destination) {
+		order = nil
+		primary := newRecordingBackend("primary", &order, &orderMu)
+		nas := newRecordingBackend("nas", &order, &orderMu)
+
+		return primary, nas, []Destination{
+			{Name: "mem://primary", Backend: primary, Required: true},
+			{Name: "mem://nas", Backend: nas},
+		}
+	}
+
+	Convey("Should upload files to every destination", t, func() {
+		primary, nas, destinations := newDestinations()
+		observer := &recordingDestinationObserver{outcomes: map[string][]bool{}}
+		fanOut := NewFanOut(destinations, 0, FanOutParallel, logger, observer)
+
+		So(fanOut.Upload(file.Name(), "a.txt"), ShouldBeNil)
+
+		So(primary.bodies["a.txt"], ShouldEqual, "some contents")
+		So(nas.bodies["a.txt"], ShouldEqual, "some contents")
+		So(observer.outcomes, ShouldResemble, map[string][]bool{"mem://primary": {true}, "mem://nas": {true}})
+		So(fanOut.(*fanOutBackend).statuses, ShouldBeEmpty)
+		So(fanOut.URL("a.txt"), ShouldEqual, "mem://primary/a.txt")
+	})
+
+	Convey("Should upload to one destination after another when sequential", t, func() {
+		_, _, destinations := newDestinations()
+		fanOut := NewFanOut(destinations, 0, FanOutSequential, logger)
+
+		So(fanOut.Upload(file.Name(), "a.txt"), ShouldBeNil)
+		So(fanOut.Upload(file.Name(), "b.txt"), ShouldBeNil)
+
+		So(order, ShouldResemble, []string{"primary", "nas", "primary", "nas"})
+	})
+
+	Convey("Should only retry the destinations that failed", t, func() {
+		primary, nas, destinations := newDestinations()
+		fanOut := NewFanOut(destinations, 2, FanOutParallel, logger)
+
+		nas.setFailing(true)
+		err := fanOut.Upload(file.Name(), "a.txt")
+
+		var fanOutErr *FanOutError
+		So(errors.As(err, &fanOutErr), ShouldBeTrue)
+		So(fanOutErr.Failed, ShouldHaveLength, 1)
+		So(fanOutErr.Failed[0].Destination, ShouldEqual, "mem://nas")
+		So(err.Error(), ShouldContainSubstring, "nas is down")
+
+		nas.setFailing(false)
+		So(fanOut.Upload(file.Name(), "a.txt"), ShouldBeNil)
+
+		So(primary.uploaded, ShouldResemble, []string{"a.txt"})
+		So(nas.uploaded, ShouldResemble, []string{"a.txt"})
+		So(fanOut.(*fanOutBackend).statuses, ShouldBeEmpty)
+	})
+
+	Convey("Should forget which destinations store a key that will not be retried", t, func() {
+		primary, _, destinations := newDestinations()
+		fanOut := NewFanOut(destinations, 1, FanOutParallel, logger)
+
+		primary.setFailing(true)
+		err := fanOut.Upload(file.Name(), "a.txt")
+		So(IsStored(err), ShouldBeFalse)
+		So(fanOut.(*fanOutBackend).statuses, ShouldHaveLength, 1)
+
+		Forget(fanOut, "a.txt")
+
+		So(fanOut.(*fanOutBackend).statuses, ShouldBeEmpty)
+	})
+
+	Convey("Should upload files that changed since they failed to every destination again", t, func() {
+		primary, nas, destinations := newDestinations()
+		fanOut := NewFanOut(destinations, 2, FanOutParallel, logger)
+
+		nas.setFailing(true)
+		So(fanOut.Upload(file.Name(), "a.txt"), ShouldNotBeNil)
+
+		later := time.Now().Add(time.Hour)
+		So(os.Chtimes(file.Name(), later, later), ShouldBeNil)
+
+		nas.setFailing(false)
+		So(fanOut.Upload(file.Name(), "a.txt"), ShouldBeNil)
+
+		So(primary.uploaded, ShouldResemble, []string{"a.txt", "a.txt"})
+		So(nas.uploaded, ShouldResemble, []string{"a.txt"})
+	})
+
+	Convey("Should only succeed once files are stored in enough destinations", t, func() {
+		primary, nas, destinations := newDestinations()
+		upload := func(quorum int) error {
+			fanOut := NewFanOut(destinations, quorum, FanOutParallel, logger)
+			defer Wait(fanOut)
+
+			return fanOut.Upload(file.Name(), "a.txt")
+		}
+
+		nas.setFailing(true)
+		So(upload(0), ShouldBeNil)
+		So(upload(1), ShouldBeNil)
+		So(IsStored(upload(2)), ShouldBeFalse)
+
+		nas.setFailing(false)
+		primary.setFailing(true)
+		So(IsStored(upload(1)), ShouldBeFalse)
+
+		destinations[0].Required = false
+		So(upload(1), ShouldBeNil)
+
+		nas.setFailing(true)
+		So(IsStored(upload(0)), ShouldBeFalse)
+	})
+
+	Convey("Should retry the destinations that failed in the background once files are stored in enough destinations", t, func() {
+		primary, nas, destinations := newDestinations()
+		fanOut := NewFanOut(destinations, 1, FanOutParallel, logger)
+
+		// Leave time to fix the destination before the first retry
+		retry.BaseDelay = 20 * time.Millisecond
+		defer func() {
+			retry.BaseDelay = time.Millisecond
+		}()
+
+		deleted, err := ioutil.TempFile("", "deleted")
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleted.WriteString("deleted contents")
+		deleted.Close()
+
+		nas.setFailing(true)
+		So(fanOut.Upload(deleted.Name(), "a.txt"), ShouldBeNil)
+
+		// The uploader deletes the file, and forgets its key, as soon as the
+		// upload succeeds
+		So(os.Remove(deleted.Name()), ShouldBeNil)
+		Forget(fanOut, "a.txt")
+		nas.setFailing(false)
+
+		Wait(fanOut)
+
+		So(primary.uploaded, ShouldResemble, []string{"a.txt"})
+		So(nas.uploaded, ShouldResemble, []string{"a.txt"})
+		So(nas.bodies["a.txt"], ShouldEqual, "deleted contents")
+		So(fanOut.(*fanOutBackend).statuses, ShouldBeEmpty)
+	})
+
+	Convey("Should give up on retrying destinations in the background once out of attempts", t, func() {
+		_, nas, destinations := newDestinations()
+		fanOut := NewFanOut(destinations, 1, FanOutParallel, logger)
+
+		nas.setFailing(true)
+		So(fanOut.PutObject(&Object{Key: "batch-1.tar", Body: strings.NewReader("some archive")}), ShouldBeNil)
+
+		Wait(fanOut)
+
+		So(nas.uploaded, ShouldBeEmpty)
+		So(fanOut.(*fanOutBackend).statuses, ShouldBeEmpty)
+	})
+
+	Convey("Should put objects in every destination, only retrying the destinations that failed", t, func() {
+		primary, nas, destinations := newDestinations()
+		fanOut := NewFanOut(destinations, 0, FanOutParallel, logger)
+
+		primary.setFailing(true)
+		So(fanOut.PutObject(&Object{Key: "batch-1.tar", Body: strings.NewReader("some archive")}), ShouldNotBeNil)
+
+		primary.setFailing(false)
+		So(fanOut.PutObject(&Object{Key: "batch-1.tar", Body: strings.NewReader("some archive")}), ShouldBeNil)
+		So(fanOut.PutObject(&Object{Key: "batch-1.tar", Body: strings.NewReader("another archive")}), ShouldBeNil)
+
+		So(primary.uploaded, ShouldResemble, []string{"batch-1.tar", "batch-1.tar"})
+		So(nas.uploaded, ShouldResemble, []string{"batch-1.tar", "batch-1.tar"})
+		So(primary.bodies["batch-1.tar"], ShouldEqual, "another archive")
+		So(nas.bodies["batch-1.tar"], ShouldEqual, "another archive")
+	})
+
+	Convey("Should check access to every destination", t, func() {
+		_, nas, destinations := newDestinations()
+		fanOut := NewFanOut(destinations, 0, FanOutParallel, logger)
+
+		So(fanOut.CheckAccess(context.Background()), ShouldBeNil)
+
+		nas.setFailing(true)
+		err := fanOut.CheckAccess(context.Background())
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "mem://nas")
+	})
+}
+
+func TestParseFanOutMode(t *testing.T) {
+	Convey("Should default to parallel uploads", t, func() {
+		mode, err := ParseFanOutMode("")
+
+		So(err, ShouldBeNil)
+		So(mode, ShouldEqual, FanOutParallel)
+	})
+
+	Convey("Should reject unknown modes", t, func() {
+		_, err := ParseFanOutMode("round-robin")
+
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,93 @@
+// Package bytesize parses and formats human-readable quantities of bytes, such
+// as "64MiB" or "1.5GB"
+package bytesize
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	// KiB is the number of bytes in a kibibyte
+	KiB int64 = 1 << (10 * (iota + 1))
+	// MiB is the number of bytes in a mebibyte
+	MiB
+	// GiB is the number of bytes in a gibibyte
+	GiB
+	// TiB is the number of bytes in a tebibyte
+	TiB
+)
+
+var units = map[string]int64{
+	"":    1,
+	"b":   1,
+	"k":   KiB,
+	"kb":  1000,
+	"kib": KiB,
+	"m":   MiB,
+	"mb":  1000 * 1000,
+	"mib": MiB,
+	"g":   GiB,
+	"gb":  1000 * 1000 * 1000,
+	"gib": GiB,
+	"t":   TiB,
+	"tb":  1000 * 1000 * 1000 * 1000,
+	"tib": TiB,
+}
+
+// Parse converts a string such as "512", "64MiB" or "1.5GB" into a number of
+// bytes. Units are case insensitive. Decimal units (KB, MB, ...) are powers of
+// 1000, binary units (KiB, MiB, ...) and single letters (K, M, ...) are powers
+// of 1024.
+func Parse(s string) (int64, error) {
+	trimmed := strings.TrimSpace(s)
+
+	i := strings.IndexFunc(trimmed, func(r rune) bool {
+		return !unicode.IsDigit(r) && r != '.'
+	})
+	if i == -1 {
+		i = len(trimmed)
+	}
+
+	number, unit := trimmed[:i], strings.ToLower(strings.TrimSpace(trimmed[i:]))
+
+	multiplier, ok := units[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid byte size %q: unknown unit %q", s, unit)
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid byte size %q: %w", s, err)
+	}
+
+	bytes := value * float64(multiplier)
+	if bytes > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid byte size %q: value too large", s)
+	}
+
+	return int64(bytes), nil
+}
+
+// Format renders a number of bytes using the largest binary unit that keeps
+// the value at or above one, rounded to one decimal place, eg. `1536` becomes
+// "1.5KiB"
+func Format(bytes int64) string {
+	if bytes < KiB && bytes > -KiB {
+		return fmt.Sprintf("%dB", bytes)
+	}
+
+	value := float64(bytes)
+	unit := ""
+	for _, unit = range []string{"KiB", "MiB", "GiB", "TiB"} {
+		value /= 1024
+		if math.Abs(value) < 1024 {
+			break
+		}
+	}
+
+	return strconv.FormatFloat(math.Round(value*10)/10, 'f', -1, 64) + unit
+}
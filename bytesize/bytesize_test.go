@@ -0,0 +1,65 @@
+package bytesize
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	Convey("Parse", t, func() {
+		Convey("should parse plain numbers as bytes", func() {
+			actual, err := Parse("512")
+
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, 512)
+		})
+
+		Convey("should parse binary units", func() {
+			actual, err := Parse("64MiB")
+
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, 64*MiB)
+		})
+
+		Convey("should parse decimal units", func() {
+			actual, err := Parse("2 MB")
+
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, 2000000)
+		})
+
+		Convey("should parse fractional values case insensitively", func() {
+			actual, err := Parse("1.5gib")
+
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, GiB+GiB/2)
+		})
+
+		Convey("should fail on unknown units", func() {
+			_, err := Parse("10 parsecs")
+
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "unknown unit")
+		})
+
+		Convey("should fail without a number", func() {
+			_, err := Parse("MiB")
+
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestFormat(t *testing.T) {
+	Convey("Format", t, func() {
+		Convey("should format small values as bytes", func() {
+			So(Format(1023), ShouldEqual, "1023B")
+		})
+
+		Convey("should format using the largest fitting unit", func() {
+			So(Format(1536), ShouldEqual, "1.5KiB")
+			So(Format(64*MiB), ShouldEqual, "64MiB")
+			So(Format(3*TiB), ShouldEqual, "3TiB")
+		})
+	})
+}
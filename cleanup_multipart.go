@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+	"github.com/timrourke/funnel/s3"
+	"time"
+)
+
+var (
+	staleMultipartPrefix    string
+	staleMultipartUploadAge time.Duration
+
+	cleanupMultipartCmd = &cobra.Command{
+		Use:     "cleanup-multipart [OPTIONS]",
+		Short:   "Abort stale incomplete multipart uploads in an AWS S3 bucket.",
+		Example: "funnel cleanup-multipart --region=us-east-1 --bucket=some-cool-bucket --prefix=some/dir/ --older-than=48h",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return ExecuteCleanupMultipart(cmd, args)
+		},
+	}
+)
+
+// ExecuteCleanupMultipart aborts incomplete multipart uploads that were left
+// behind in the bucket and are older than the configured age
+func ExecuteCleanupMultipart(cmd *cobra.Command, args []string) error {
+	err := validateBucketFlags()
+	if err != nil {
+		return err
+	}
+
+	config := aws.NewConfig().
+		WithRegion(region).
+		WithMaxRetries(3)
+
+	sess := session.Must(session.NewSession(config))
+
+	numAborted, err := s3.AbortStaleMultipartUploads(
+		awss3.New(sess),
+		bucket,
+		staleMultipartPrefix,
+		staleMultipartUploadAge,
+		logger,
+	)
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Aborted %d stale multipart uploads", numAborted)
+
+	return nil
+}
+
+func configureCleanupMultipartCmd() {
+	cleanupMultipartCmd.Flags().StringVarP(
+		&staleMultipartPrefix,
+		"prefix",
+		"p",
+		"",
+		"Only abort incomplete uploads of keys beginning with this prefix",
+	)
+
+	cleanupMultipartCmd.Flags().DurationVarP(
+		&staleMultipartUploadAge,
+		"older-than",
+		"",
+		24*time.Hour,
+		"Only abort incomplete uploads initiated at least this long ago",
+	)
+
+	cleanupMultipartCmd.DisableFlagsInUseLine = true
+
+	rootCmd.AddCommand(cleanupMultipartCmd)
+}
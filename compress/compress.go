@@ -0,0 +1,202 @@
+// Package compress streams files through gzip, zstd or brotli compression as
+// they are uploaded
+package compress
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Supported compression algorithms
+const (
+	Gzip   = "gzip"
+	Zstd   = "zstd"
+	Brotli = "brotli"
+)
+
+// Modes determine how a compressed object is marked as such
+const (
+	// ModeEncoding keeps the key and sets the object's Content-Encoding, so
+	// that HTTP clients such as browsers decompress it transparently
+	ModeEncoding = "encoding"
+
+	// ModeSuffix appends the algorithm's file extension to the key, eg. `.gz`,
+	// so that the object is stored as the compressed file it is
+	ModeSuffix = "suffix"
+)
+
+// ContentEncoding returns the value of the Content-Encoding header for objects
+// compressed with the given algorithm
+func ContentEncoding(algorithm string) string {
+	switch algorithm {
+	case Brotli:
+		return "br"
+	default:
+		return algorithm
+	}
+}
+
+// Suffix returns the file extension of files compressed with the given
+// algorithm
+func Suffix(algorithm string) string {
+	switch algorithm {
+	case Gzip:
+		return ".gz"
+	case Zstd:
+		return ".zst"
+	case Brotli:
+		return ".br"
+	default:
+		return ""
+	}
+}
+
+// ParseAlgorithm validates the name of a compression algorithm
+func ParseAlgorithm(algorithm string) (string, error) {
+	switch algorithm {
+	case Gzip, Zstd, Brotli:
+		return algorithm, nil
+	default:
+		return "", fmt.Errorf(
+			"invalid compression algorithm %s, must be one of: %s",
+			algorithm,
+			strings.Join([]string{Gzip, Zstd, Brotli}, ", "),
+		)
+	}
+}
+
+// ParseMode validates the way compressed objects are marked as such
+func ParseMode(mode string) (string, error) {
+	switch mode {
+	case ModeEncoding, ModeSuffix:
+		return mode, nil
+	default:
+		return "", fmt.Errorf(
+			"invalid compression mode %s, must be one of: %s, %s",
+			mode,
+			ModeEncoding,
+			ModeSuffix,
+		)
+	}
+}
+
+// NewWriter creates a writer that compresses everything written to it with the
+// given algorithm into w. It must be closed to flush the compressed stream.
+func NewWriter(algorithm string, w io.Writer) (io.WriteCloser, error) {
+	switch algorithm {
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	case Brotli:
+		return brotli.NewWriter(w), nil
+	default:
+		_, err := ParseAlgorithm(algorithm)
+		return nil, err
+	}
+}
+
+// NewDecompressingReader streams the decompressed contents of a source, whose
+// Content-Encoding is gzip, zstd or br. It must be closed when done with.
+func NewDecompressingReader(contentEncoding string, source io.Reader) (io.ReadCloser, error) {
+	switch contentEncoding {
+	case ContentEncoding(Gzip):
+		reader, err := gzip.NewReader(source)
+		if err != nil {
+			return nil, err
+		}
+
+		return reader, nil
+	case ContentEncoding(Zstd):
+		decoder, err := zstd.NewReader(source)
+		if err != nil {
+			return nil, err
+		}
+
+		return &zstdReadCloser{decoder}, nil
+	case ContentEncoding(Brotli):
+		return ioutil.NopCloser(brotli.NewReader(source)), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", contentEncoding)
+	}
+}
+
+// zstdReadCloser releases the resources of a zstd decoder when closed
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z *zstdReadCloser) Close() error {
+	z.Decoder.Close()
+
+	return nil
+}
+
+// Reader streams the compressed contents of another reader. It counts the bytes
+// it read and produced, so both sizes are known once it is drained.
+type Reader struct {
+	pipe             *io.PipeReader
+	done             chan struct{}
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+// NewReader starts compressing the source with the given algorithm, in the
+// background, as the returned reader is read from. The reader must be closed,
+// even when it is not read to the end.
+func NewReader(algorithm string, source io.Reader) (*Reader, error) {
+	pipeReader, pipeWriter := io.Pipe()
+
+	writer, err := NewWriter(algorithm, pipeWriter)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{
+		pipe: pipeReader,
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(r.done)
+
+		n, err := io.Copy(writer, source)
+		r.uncompressedSize = n
+
+		closeErr := writer.Close()
+		if nil == err {
+			err = closeErr
+		}
+
+		pipeWriter.CloseWithError(err)
+	}()
+
+	return r, nil
+}
+
+// Read compressed bytes
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.pipe.Read(p)
+	r.compressedSize += int64(n)
+
+	return n, err
+}
+
+// Close stops compressing, and waits for the compression to stop
+func (r *Reader) Close() error {
+	err := r.pipe.Close()
+	<-r.done
+
+	return err
+}
+
+// Sizes returns the number of bytes read from the source and the number of
+// compressed bytes read so far. They are only final after closing the reader.
+func (r *Reader) Sizes() (int64, int64) {
+	return r.uncompressedSize, r.compressedSize
+}
@@ -0,0 +1,140 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func decompress(t *testing.T, algorithm string, compressed []byte) string {
+	var reader io.Reader
+	var err error
+
+	switch algorithm {
+	case Gzip:
+		reader, err = gzip.NewReader(bytes.NewReader(compressed))
+	case Zstd:
+		reader, err = zstd.NewReader(bytes.NewReader(compressed))
+	case Brotli:
+		reader = brotli.NewReader(bytes.NewReader(compressed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decompressed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(decompressed)
+}
+
+type failingReader struct{}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("some read error")
+}
+
+func TestReader(t *testing.T) {
+	contents := strings.Repeat("some log line\n", 1000)
+
+	for _, algorithm := range []string{Gzip, Zstd, Brotli} {
+		algorithm := algorithm
+
+		Convey("Should stream compressed contents with "+algorithm, t, func() {
+			reader, err := NewReader(algorithm, strings.NewReader(contents))
+			So(err, ShouldBeNil)
+
+			compressed, err := ioutil.ReadAll(reader)
+			So(err, ShouldBeNil)
+			So(reader.Close(), ShouldBeNil)
+
+			So(decompress(t, algorithm, compressed), ShouldEqual, contents)
+
+			uncompressedSize, compressedSize := reader.Sizes()
+			So(uncompressedSize, ShouldEqual, len(contents))
+			So(compressedSize, ShouldEqual, len(compressed))
+			So(compressedSize, ShouldBeLessThan, uncompressedSize)
+		})
+	}
+
+	Convey("Should fail when the source fails", t, func() {
+		reader, err := NewReader(Gzip, &failingReader{})
+		So(err, ShouldBeNil)
+
+		_, err = ioutil.ReadAll(reader)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, "some read error")
+	})
+
+	Convey("Should stop compressing when closed early", t, func() {
+		reader, err := NewReader(Gzip, strings.NewReader(contents))
+		So(err, ShouldBeNil)
+
+		So(reader.Close(), ShouldBeNil)
+	})
+
+	Convey("Should fail for unknown algorithms", t, func() {
+		_, err := NewReader("lzma", strings.NewReader(contents))
+
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestParseMode(t *testing.T) {
+	Convey("Should parse modes", t, func() {
+		mode, err := ParseMode("suffix")
+
+		So(err, ShouldBeNil)
+		So(mode, ShouldEqual, ModeSuffix)
+
+		_, err = ParseMode("archive")
+
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestContentEncodingAndSuffix(t *testing.T) {
+	Convey("Should name the encoding and extension of each algorithm", t, func() {
+		So(ContentEncoding(Gzip), ShouldEqual, "gzip")
+		So(ContentEncoding(Brotli), ShouldEqual, "br")
+		So(Suffix(Gzip), ShouldEqual, ".gz")
+		So(Suffix(Zstd), ShouldEqual, ".zst")
+	})
+}
+
+func TestNewDecompressingReader(t *testing.T) {
+	contents := strings.Repeat("some log line\n", 1000)
+
+	for _, algorithm := range []string{Gzip, Zstd, Brotli} {
+		algorithm := algorithm
+
+		Convey("Should decompress contents compressed with "+algorithm, t, func() {
+			compressed, err := NewReader(algorithm, strings.NewReader(contents))
+			So(err, ShouldBeNil)
+			defer compressed.Close()
+
+			reader, err := NewDecompressingReader(ContentEncoding(algorithm), compressed)
+			So(err, ShouldBeNil)
+			defer reader.Close()
+
+			decompressed, err := ioutil.ReadAll(reader)
+			So(err, ShouldBeNil)
+			So(string(decompressed), ShouldEqual, contents)
+		})
+	}
+
+	Convey("Should fail for unsupported content encodings", t, func() {
+		_, err := NewDecompressingReader("deflate", strings.NewReader(contents))
+
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,60 @@
+package compress
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+)
+
+// Extensions of files whose contents are compressed already, so that
+// compressing them again would only cost time
+var compressedExtensions = map[string]bool{
+	".7z":   true,
+	".br":   true,
+	".bz2":  true,
+	".gif":  true,
+	".gz":   true,
+	".jpeg": true,
+	".jpg":  true,
+	".lz4":  true,
+	".mov":  true,
+	".mp3":  true,
+	".mp4":  true,
+	".png":  true,
+	".tgz":  true,
+	".webp": true,
+	".xz":   true,
+	".zip":  true,
+	".zst":  true,
+}
+
+// Magic bytes at the start of compressed files
+var compressedMagicBytes = [][]byte{
+	{0x1f, 0x8b},                       // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	{'B', 'Z', 'h'},                    // bzip2
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+	{'P', 'K', 0x03, 0x04},             // zip
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	{0x04, 0x22, 0x4d, 0x18},           // lz4
+}
+
+// MagicBytesLength is the number of bytes at the start of a file that are
+// enough to recognize it as compressed
+const MagicBytesLength = 6
+
+// IsCompressed reports whether a file is compressed already, by its extension
+// or the magic bytes its contents start with
+func IsCompressed(filePath string, header []byte) bool {
+	if compressedExtensions[strings.ToLower(filepath.Ext(filePath))] {
+		return true
+	}
+
+	for _, magicBytes := range compressedMagicBytes {
+		if bytes.HasPrefix(header, magicBytes) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,23 @@
+package compress
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestIsCompressed(t *testing.T) {
+	Convey("Should recognize compressed files by extension", t, func() {
+		So(IsCompressed("some/archive.tar.GZ", nil), ShouldBeTrue)
+		So(IsCompressed("photo.jpg", []byte("anything")), ShouldBeTrue)
+	})
+
+	Convey("Should recognize compressed files by magic bytes", t, func() {
+		So(IsCompressed("rotated.log.1", []byte{0x1f, 0x8b, 0x08, 0x00}), ShouldBeTrue)
+		So(IsCompressed("data", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}), ShouldBeTrue)
+	})
+
+	Convey("Should not mistake other files for compressed ones", t, func() {
+		So(IsCompressed("app.log", []byte("2024-06")), ShouldBeFalse)
+		So(IsCompressed("empty.txt", nil), ShouldBeFalse)
+	})
+}
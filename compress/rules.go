@@ -0,0 +1,72 @@
+package compress
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Rule compresses the files matching a glob pattern with an algorithm. Patterns
+// without a slash match the file's name, and patterns with one its whole path.
+type Rule struct {
+	Pattern   string
+	Algorithm string
+}
+
+// Rules pick the compression algorithm for a file, the first matching rule
+// winning
+type Rules []Rule
+
+// ParseRules parses a comma separated list of rules, such as
+// "*.log=gzip,*.json=zstd". A bare algorithm, such as "gzip", compresses every
+// file.
+func ParseRules(text string) (Rules, error) {
+	var rules Rules
+
+	for _, ruleText := range strings.Split(text, ",") {
+		ruleText = strings.TrimSpace(ruleText)
+		if "" == ruleText {
+			continue
+		}
+
+		pattern, algorithmText := "*", ruleText
+		if i := strings.LastIndex(ruleText, "="); i >= 0 {
+			pattern, algorithmText = ruleText[:i], ruleText[i+1:]
+		}
+
+		algorithm, err := ParseAlgorithm(strings.TrimSpace(algorithmText))
+		if err != nil {
+			return nil, fmt.Errorf("invalid compression rule %q: %w", ruleText, err)
+		}
+
+		pattern = strings.TrimSpace(pattern)
+		_, err = path.Match(pattern, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid compression rule %q: %w", ruleText, err)
+		}
+
+		rules = append(rules, Rule{Pattern: pattern, Algorithm: algorithm})
+	}
+
+	return rules, nil
+}
+
+// AlgorithmFor returns the algorithm to compress a file with, or an empty
+// string when no rule matches it
+func (r Rules) AlgorithmFor(filePath string) string {
+	slashPath := filepath.ToSlash(filepath.Clean(filePath))
+
+	for _, rule := range r {
+		name := path.Base(slashPath)
+		if strings.Contains(rule.Pattern, "/") {
+			name = slashPath
+		}
+
+		if ok, _ := path.Match(rule.Pattern, name); ok {
+			return rule.Algorithm
+		}
+	}
+
+	return ""
+}
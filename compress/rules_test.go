@@ -0,0 +1,40 @@
+package compress
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	Convey("Should pick the algorithm of the first matching rule", t, func() {
+		rules, err := ParseRules("*.log=gzip, logs/*/*.json=zstd, *.json=brotli")
+
+		So(err, ShouldBeNil)
+		So(rules.AlgorithmFor("/var/log/app.log"), ShouldEqual, Gzip)
+		So(rules.AlgorithmFor("./logs/2024/app.json"), ShouldEqual, Zstd)
+		So(rules.AlgorithmFor("other/app.json"), ShouldEqual, Brotli)
+		So(rules.AlgorithmFor("app.csv"), ShouldEqual, "")
+	})
+
+	Convey("Should compress every file with a bare algorithm", t, func() {
+		rules, err := ParseRules("zstd")
+
+		So(err, ShouldBeNil)
+		So(rules.AlgorithmFor("some/file.csv"), ShouldEqual, Zstd)
+	})
+
+	Convey("Should have no rules for an empty list", t, func() {
+		rules, err := ParseRules("")
+
+		So(err, ShouldBeNil)
+		So(rules, ShouldBeEmpty)
+	})
+
+	Convey("Should fail for invalid rules", t, func() {
+		_, err := ParseRules("*.log=lzma")
+		So(err, ShouldNotBeNil)
+
+		_, err = ParseRules("[.log=gzip")
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,55 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Listen binds to an address of the form "unix:/path/to/funnel.sock" or
+// "tcp:127.0.0.1:8080". Addresses without a network are treated as Unix socket
+// paths. A stale socket file left behind by a previous run is replaced, and
+// the socket is only ever accessible to the user running funnel.
+func Listen(addr string) (net.Listener, error) {
+	network, address := "unix", addr
+	if i := strings.Index(addr, ":"); i != -1 && (addr[:i] == "unix" || addr[:i] == "tcp") {
+		network, address = addr[:i], addr[i+1:]
+	}
+
+	if "" == address {
+		return nil, fmt.Errorf("invalid control address %q", addr)
+	}
+
+	if "tcp" == network {
+		return net.Listen(network, address)
+	}
+
+	info, err := os.Lstat(address)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil && info.Mode()&os.ModeSocket == 0 {
+		return nil, fmt.Errorf("control socket path %s exists and is not a socket", address)
+	}
+	if err == nil {
+		err = os.Remove(address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to remove stale control socket %s: %w", address, err)
+		}
+	}
+
+	listener, err := listenUnix(address)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(address, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict access to control socket %s: %w", address, err)
+	}
+
+	return listener, nil
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package control
+
+import (
+	"net"
+)
+
+func listenUnix(address string) (net.Listener, error) {
+	return net.Listen("unix", address)
+}
@@ -0,0 +1,85 @@
+package control
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	Convey("Should listen on a Unix socket by default", t, func() {
+		socketPath := filepath.Join(dir, "funnel.sock")
+
+		listener, err := Listen(socketPath)
+		So(err, ShouldBeNil)
+		defer listener.Close()
+
+		So(listener.Addr().Network(), ShouldEqual, "unix")
+
+		info, err := os.Stat(socketPath)
+		So(err, ShouldBeNil)
+		So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+	})
+
+	Convey("Should create the socket accessible only to its owner", t, func() {
+		socketPath := filepath.Join(dir, "private.sock")
+
+		listener, err := listenUnix(socketPath)
+		So(err, ShouldBeNil)
+		defer listener.Close()
+
+		info, err := os.Stat(socketPath)
+		So(err, ShouldBeNil)
+		So(info.Mode().Perm()&0077, ShouldEqual, 0)
+	})
+
+	Convey("Should replace a stale socket", t, func() {
+		socketPath := filepath.Join(dir, "stale.sock")
+
+		stale, err := Listen("unix:" + socketPath)
+		So(err, ShouldBeNil)
+
+		// Simulate a crash that left the socket file behind
+		stale.(interface{ SetUnlinkOnClose(bool) }).SetUnlinkOnClose(false)
+		stale.Close()
+
+		listener, err := Listen("unix:" + socketPath)
+		So(err, ShouldBeNil)
+		listener.Close()
+	})
+
+	Convey("Should refuse to replace a file that is not a socket", t, func() {
+		filePath := filepath.Join(dir, "not-a-socket")
+		err := ioutil.WriteFile(filePath, []byte("important"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = Listen(filePath)
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "is not a socket")
+	})
+
+	Convey("Should listen on TCP", t, func() {
+		listener, err := Listen("tcp:127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer listener.Close()
+
+		So(listener.Addr().Network(), ShouldEqual, "tcp")
+	})
+
+	Convey("Should fail without an address", t, func() {
+		_, err := Listen("tcp:")
+
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,25 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package control
+
+import (
+	"net"
+	"sync"
+	"syscall"
+)
+
+// umaskMux serializes changes to the process wide umask
+var umaskMux sync.Mutex
+
+// Listen on a Unix socket that is created accessible only to the user running
+// funnel, so that no other user can connect before its permissions are set
+func listenUnix(address string) (net.Listener, error) {
+	umaskMux.Lock()
+	defer umaskMux.Unlock()
+
+	oldMask := syscall.Umask(0177)
+	defer syscall.Umask(oldMask)
+
+	return net.Listen("unix", address)
+}
@@ -0,0 +1,199 @@
+// Package control serves health and readiness probes for funnel, along with a
+// small JSON API for inspecting and controlling a running uploader
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"github.com/timrourke/funnel/upload"
+	"net/http"
+	"time"
+)
+
+// readinessTimeout bounds how long a readiness probe waits on its check
+const readinessTimeout = 5 * time.Second
+
+// ReadinessCheck reports whether funnel is able to do its job, eg. whether its
+// destination is reachable with valid credentials
+type ReadinessCheck func(ctx context.Context) error
+
+type server struct {
+	controller upload.Controller
+	isReady    ReadinessCheck
+	logger     *logrus.Logger
+}
+
+// Status summarizes the state of a running uploader
+type Status struct {
+	Paused      bool `json:"paused"`
+	Concurrency int  `json:"concurrency"`
+	Queued      int  `json:"queued"`
+	InFlight    int  `json:"inFlight"`
+	Failed      int  `json:"failed"`
+}
+
+type concurrencyRequest struct {
+	Concurrency int `json:"concurrency"`
+}
+
+type retryResponse struct {
+	Retried int `json:"retried"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewHandler creates the HTTP handler serving these routes:
+//
+//	GET  /healthz              liveness probe
+//	GET  /readyz               readiness probe
+//	GET  /api/status           a summary of the uploader's state
+//	GET  /api/jobs             queued, in flight and recently failed jobs
+//	POST /api/pause            stop picking up new jobs
+//	POST /api/resume           start picking up new jobs again
+//	POST /api/retry-failed     enqueue recently failed jobs again
+//	GET  /api/concurrency      the number of upload workers
+//	PUT  /api/concurrency      change the number of upload workers
+func NewHandler(
+	controller upload.Controller,
+	isReady ReadinessCheck,
+	logger *logrus.Logger,
+) http.Handler {
+	s := &server{
+		controller: controller,
+		isReady:    isReady,
+		logger:     logger,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.method(http.MethodGet, s.healthz))
+	mux.HandleFunc("/readyz", s.method(http.MethodGet, s.readyz))
+	mux.HandleFunc("/api/status", s.method(http.MethodGet, s.status))
+	mux.HandleFunc("/api/jobs", s.method(http.MethodGet, s.jobs))
+	mux.HandleFunc("/api/pause", s.method(http.MethodPost, s.pause))
+	mux.HandleFunc("/api/resume", s.method(http.MethodPost, s.resume))
+	mux.HandleFunc("/api/retry-failed", s.method(http.MethodPost, s.retryFailed))
+	mux.HandleFunc("/api/concurrency", s.concurrency)
+
+	return mux
+}
+
+func (s *server) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+func (s *server) readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	err := s.isReady(ctx)
+	if err != nil {
+		s.logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Warn("Readiness check failed")
+		s.writeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+func (s *server) status(w http.ResponseWriter, r *http.Request) {
+	jobs := s.controller.Jobs()
+
+	s.writeJSON(w, http.StatusOK, Status{
+		Paused:      s.controller.IsPaused(),
+		Concurrency: s.controller.Concurrency(),
+		Queued:      len(jobs.Queued),
+		InFlight:    len(jobs.InFlight),
+		Failed:      len(jobs.Failed),
+	})
+}
+
+func (s *server) jobs(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, s.controller.Jobs())
+}
+
+func (s *server) pause(w http.ResponseWriter, r *http.Request) {
+	s.controller.Pause()
+	s.logger.Info("Paused uploads")
+	s.status(w, r)
+}
+
+func (s *server) resume(w http.ResponseWriter, r *http.Request) {
+	s.controller.Resume()
+	s.logger.Info("Resumed uploads")
+	s.status(w, r)
+}
+
+func (s *server) retryFailed(w http.ResponseWriter, r *http.Request) {
+	numRetried, err := s.controller.RetryFailed()
+	if err != nil {
+		s.writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+
+	s.logger.Infof("Retrying %d failed uploads", numRetried)
+	s.writeJSON(w, http.StatusOK, retryResponse{Retried: numRetried})
+}
+
+func (s *server) concurrency(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.writeJSON(w, http.StatusOK, concurrencyRequest{Concurrency: s.controller.Concurrency()})
+	case http.MethodPut, http.MethodPost:
+		var request concurrencyRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+			return
+		}
+
+		err = s.controller.SetConcurrency(request.Concurrency)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		s.logger.Infof("Changed number of concurrent uploads to %d", request.Concurrency)
+		s.writeJSON(w, http.StatusOK, concurrencyRequest{Concurrency: s.controller.Concurrency()})
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// Restrict a handler to a single HTTP method
+func (s *server) method(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func (s *server) writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		s.logger.WithFields(logrus.Fields{
+			"error": err.Error(),
+		}).Error("Failed to write control API response")
+	}
+}
+
+func (s *server) writeError(w http.ResponseWriter, status int, message string) {
+	s.writeJSON(w, status, errorResponse{Error: message})
+}
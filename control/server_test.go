@@ -0,0 +1,191 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/timrourke/funnel/upload"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type stubController struct {
+	paused      bool
+	concurrency int
+	jobs        upload.Jobs
+	retryErr    error
+	numRetried  int
+}
+
+// Pause is a stubbed implementation of `upload.Controller.Pause`
+func (s *stubController) Pause() {
+	s.paused = true
+}
+
+// Resume is a stubbed implementation of `upload.Controller.Resume`
+func (s *stubController) Resume() {
+	s.paused = false
+}
+
+// IsPaused is a stubbed implementation of `upload.Controller.IsPaused`
+func (s *stubController) IsPaused() bool {
+	return s.paused
+}
+
+// Concurrency is a stubbed implementation of `upload.Controller.Concurrency`
+func (s *stubController) Concurrency() int {
+	return s.concurrency
+}
+
+// Jobs is a stubbed implementation of `upload.Controller.Jobs`
+func (s *stubController) Jobs() upload.Jobs {
+	return s.jobs
+}
+
+// RetryFailed is a stubbed implementation of `upload.Controller.RetryFailed`
+func (s *stubController) RetryFailed() (int, error) {
+	return s.numRetried, s.retryErr
+}
+
+// SetConcurrency is a stubbed implementation of `upload.Controller.SetConcurrency`
+func (s *stubController) SetConcurrency(numConcurrentUploads int) error {
+	if numConcurrentUploads <= 0 {
+		return errors.New("number of concurrent uploads must be within the range 1-100")
+	}
+
+	s.concurrency = numConcurrentUploads
+	return nil
+}
+
+func serve(handler http.Handler, method string, target string, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(method, target, strings.NewReader(body)))
+
+	return recorder
+}
+
+func TestNewHandler(t *testing.T) {
+	ready := func(ctx context.Context) error {
+		return nil
+	}
+
+	Convey("Probes", t, func() {
+		Convey("Should report liveness", func() {
+			handler := NewHandler(&stubController{}, ready, logrus.New())
+
+			response := serve(handler, http.MethodGet, "/healthz", "")
+
+			So(response.Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("Should report readiness", func() {
+			handler := NewHandler(&stubController{}, ready, logrus.New())
+
+			response := serve(handler, http.MethodGet, "/readyz", "")
+
+			So(response.Code, ShouldEqual, http.StatusOK)
+		})
+
+		Convey("Should report not ready when the check fails", func() {
+			notReady := func(ctx context.Context) error {
+				return errors.New("failed to access bucket some-bucket")
+			}
+			handler := NewHandler(&stubController{}, notReady, logrus.New())
+
+			response := serve(handler, http.MethodGet, "/readyz", "")
+
+			So(response.Code, ShouldEqual, http.StatusServiceUnavailable)
+			So(response.Body.String(), ShouldContainSubstring, "failed to access bucket some-bucket")
+		})
+	})
+
+	Convey("API", t, func() {
+		controller := &stubController{
+			concurrency: 10,
+			jobs: upload.Jobs{
+				Queued:   []upload.JobInfo{{ID: 2, Path: "queued"}},
+				InFlight: []upload.JobInfo{{ID: 1, Path: "in-flight"}},
+				Failed:   []upload.JobInfo{},
+			},
+			numRetried: 3,
+		}
+		handler := NewHandler(controller, ready, logrus.New())
+
+		Convey("Should list jobs", func() {
+			response := serve(handler, http.MethodGet, "/api/jobs", "")
+
+			So(response.Code, ShouldEqual, http.StatusOK)
+
+			var jobs upload.Jobs
+			err := json.Unmarshal(response.Body.Bytes(), &jobs)
+			So(err, ShouldBeNil)
+			So(jobs.Queued[0].Path, ShouldEqual, "queued")
+			So(jobs.InFlight[0].Path, ShouldEqual, "in-flight")
+		})
+
+		Convey("Should pause and resume", func() {
+			response := serve(handler, http.MethodPost, "/api/pause", "")
+
+			So(response.Code, ShouldEqual, http.StatusOK)
+			So(controller.paused, ShouldBeTrue)
+			So(response.Body.String(), ShouldContainSubstring, `"paused":true`)
+
+			response = serve(handler, http.MethodPost, "/api/resume", "")
+
+			So(response.Code, ShouldEqual, http.StatusOK)
+			So(controller.paused, ShouldBeFalse)
+		})
+
+		Convey("Should only pause on POST", func() {
+			response := serve(handler, http.MethodGet, "/api/pause", "")
+
+			So(response.Code, ShouldEqual, http.StatusMethodNotAllowed)
+			So(controller.paused, ShouldBeFalse)
+		})
+
+		Convey("Should retry failed jobs", func() {
+			response := serve(handler, http.MethodPost, "/api/retry-failed", "")
+
+			So(response.Code, ShouldEqual, http.StatusOK)
+			So(response.Body.String(), ShouldContainSubstring, `"retried":3`)
+		})
+
+		Convey("Should report failure to retry", func() {
+			controller.retryErr = errors.New("cannot retry failed uploads when no uploads are running")
+
+			response := serve(handler, http.MethodPost, "/api/retry-failed", "")
+
+			So(response.Code, ShouldEqual, http.StatusConflict)
+		})
+
+		Convey("Should change concurrency", func() {
+			response := serve(handler, http.MethodPut, "/api/concurrency", `{"concurrency": 20}`)
+
+			So(response.Code, ShouldEqual, http.StatusOK)
+			So(controller.concurrency, ShouldEqual, 20)
+			So(response.Body.String(), ShouldContainSubstring, `"concurrency":20`)
+		})
+
+		Convey("Should reject invalid concurrency", func() {
+			response := serve(handler, http.MethodPut, "/api/concurrency", `{"concurrency": 0}`)
+
+			So(response.Code, ShouldEqual, http.StatusBadRequest)
+			So(controller.concurrency, ShouldEqual, 10)
+		})
+
+		Convey("Should summarize status", func() {
+			response := serve(handler, http.MethodGet, "/api/status", "")
+
+			So(response.Code, ShouldEqual, http.StatusOK)
+
+			var status Status
+			err := json.Unmarshal(response.Body.Bytes(), &status)
+			So(err, ShouldBeNil)
+			So(status, ShouldResemble, Status{Concurrency: 10, Queued: 1, InFlight: 1})
+		})
+	})
+}
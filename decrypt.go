@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+	"github.com/timrourke/funnel/encrypt"
+	"github.com/timrourke/funnel/s3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var (
+	decryptAgeIdentityFile string
+	decryptKeyFile         string
+	decryptOutput          string
+
+	decryptCmd = &cobra.Command{
+		Use:     "decrypt [OPTIONS] KEY",
+		Short:   "Download an object that was encrypted on upload, and decrypt it.",
+		Example: "funnel decrypt --region=us-east-1 --bucket=some-cool-bucket --age-identity=key.txt -o text.txt some/key",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return ExecuteDecrypt(cmd, args)
+		},
+	}
+)
+
+// ExecuteDecrypt downloads an object that was encrypted on upload and writes its
+// plaintext to the output file, or stdout
+func ExecuteDecrypt(cmd *cobra.Command, args []string) error {
+	err := validateBucketFlags()
+	if err != nil {
+		return err
+	}
+
+	keyUnwrapper, err := newKeyUnwrapper()
+	if err != nil {
+		return err
+	}
+
+	config := aws.NewConfig().
+		WithRegion(region).
+		WithMaxRetries(3)
+
+	sess := session.Must(session.NewSession(config))
+
+	if "" == decryptOutput || "-" == decryptOutput {
+		return s3.DownloadDecrypted(awss3.New(sess), bucket, args[0], keyUnwrapper, cmd.OutOrStdout())
+	}
+
+	// Write to a temporary file first, so that a failure to decrypt does not
+	// leave a partial plaintext at the output path
+	tempFile, err := ioutil.TempFile(filepath.Dir(decryptOutput), "."+filepath.Base(decryptOutput)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	err = s3.DownloadDecrypted(awss3.New(sess), bucket, args[0], keyUnwrapper, tempFile)
+	closeErr := tempFile.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	return os.Rename(tempFile.Name(), decryptOutput)
+}
+
+func newKeyUnwrapper() (encrypt.KeyUnwrapper, error) {
+	if "" != decryptAgeIdentityFile && "" != decryptKeyFile {
+		return nil, errors.New("must decrypt either with an age identity or with a key file, not both")
+	}
+
+	if "" != decryptAgeIdentityFile {
+		return encrypt.NewAgeKeyUnwrapper(decryptAgeIdentityFile)
+	}
+
+	if "" != decryptKeyFile {
+		key, err := encrypt.LoadKeyFile(decryptKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return encrypt.NewKeyFileUnwrapper(key), nil
+	}
+
+	return nil, errors.New("must provide an age identity or a key file to decrypt with")
+}
+
+func configureDecryptCmd() {
+	decryptCmd.Flags().StringVarP(
+		&decryptAgeIdentityFile,
+		"age-identity",
+		"i",
+		"",
+		"File with the age identity the object's data key was wrapped for",
+	)
+
+	decryptCmd.Flags().StringVarP(
+		&decryptKeyFile,
+		"key-file",
+		"",
+		"",
+		"File with the 32 byte hex key the object's data key was wrapped with",
+	)
+
+	decryptCmd.Flags().StringVarP(
+		&decryptOutput,
+		"output",
+		"o",
+		"-",
+		"File to write the decrypted object to, or \"-\" for stdout",
+	)
+
+	decryptCmd.DisableFlagsInUseLine = true
+
+	rootCmd.AddCommand(decryptCmd)
+}
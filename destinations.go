@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/timrourke/funnel/backend"
+	"net/url"
+	"strings"
+)
+
+// Whether any of the destinations is in AWS S3
+func hasS3Destination() bool {
+	for _, destination := range append(destinationURLs(), nonBlank(optionalDestinations)...) {
+		destinationURL, err := url.Parse(strings.TrimSpace(destination))
+		if err == nil && "s3" == destinationURL.Scheme {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The URLs of the destinations every file must be saved in, which default to
+// the bucket in AWS S3 given with its own flag
+func destinationURLs() []string {
+	urls := nonBlank(destinations)
+
+	if 0 == len(urls) && "" != strings.TrimSpace(bucket) {
+		urls = append(urls, "s3://"+bucket)
+	}
+
+	return urls
+}
+
+// The values of a repeated flag that are not blank
+func nonBlank(values []string) []string {
+	var nonBlankValues []string
+	for _, value := range values {
+		if "" != strings.TrimSpace(value) {
+			nonBlankValues = append(nonBlankValues, value)
+		}
+	}
+
+	return nonBlankValues
+}
+
+// Open the backend of each destination, which are fanned out to when there is
+// more than one. A dry run wraps each destination, so that every one of them
+// logs where files would be uploaded to. The destination body wrapper, when
+// given, adds a body wrapper of its own to each destination, eg. to count the
+// bytes each destination reads from a file.
+func newDestinationBackend(
+	options backend.Options,
+	destinationBodyWrapper func(destination string) backend.BodyWrapper,
+	observers []backend.DestinationObserver,
+) (backend.Backend, error) {
+	urls := destinationURLs()
+
+	var fanOutDestinations []backend.Destination
+	names := make(map[string]bool)
+	for i, destination := range append(urls, nonBlank(optionalDestinations)...) {
+		name := destinationName(destination)
+		if names[name] {
+			return nil, fmt.Errorf("must not save files in the same destination twice: %s", name)
+		}
+		names[name] = true
+
+		destinationOptions := options
+		if nil != destinationBodyWrapper {
+			destinationOptions.BodyWrappers = append(
+				append([]backend.BodyWrapper{}, options.BodyWrappers...),
+				destinationBodyWrapper(name),
+			)
+		}
+
+		destinationBackend, err := backend.Open(destination, destinationOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		if shouldDryRun {
+			destinationBackend = backend.NewDryRun(destinationBackend, logger)
+		}
+
+		fanOutDestinations = append(fanOutDestinations, backend.Destination{
+			Name:     name,
+			Backend:  destinationBackend,
+			Required: i < len(urls),
+		})
+	}
+
+	if destinationQuorum < 0 || destinationQuorum > len(fanOutDestinations) {
+		return nil, fmt.Errorf("destination quorum must be within the range 0-%d", len(fanOutDestinations))
+	}
+
+	if 0 == len(urls) && 0 == destinationQuorum {
+		return nil, errors.New("must require a destination, or a destination quorum of at least 1, for files to count as saved")
+	}
+
+	if 1 == len(fanOutDestinations) {
+		return fanOutDestinations[0].Backend, nil
+	}
+
+	mode, err := backend.ParseFanOutMode(fanOutMode)
+	if err != nil {
+		return nil, err
+	}
+
+	return backend.NewFanOut(fanOutDestinations, destinationQuorum, mode, logger, observers...), nil
+}
+
+// Name a destination in logs and metrics by its URL, without query parameters
+// such as credentials
+func destinationName(destination string) string {
+	destinationURL, err := url.Parse(destination)
+	if err != nil {
+		return destination
+	}
+
+	destinationURL.RawQuery = ""
+
+	return destinationURL.String()
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestHasS3Destination(t *testing.T) {
+	Convey("Should tell whether any destination is in AWS S3", t, func() {
+		defer func() { bucket, destinations, optionalDestinations = "", nil, nil }()
+
+		destinations = []string{"file:///mnt/backup"}
+		So(hasS3Destination(), ShouldBeFalse)
+
+		optionalDestinations = []string{"s3://some-bucket/some/prefix?region=us-east-1"}
+		So(hasS3Destination(), ShouldBeTrue)
+
+		destinations, optionalDestinations, bucket = nil, nil, "some-bucket"
+		So(hasS3Destination(), ShouldBeTrue)
+	})
+}
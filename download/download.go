@@ -0,0 +1,367 @@
+// Package download defines a service for restoring the objects below a prefix
+// to local paths, the reverse of the `upload` package. Objects are downloaded
+// by a pool of workers and retried like uploads are. The work of listing and
+// fetching objects is delegated to an object store, eg. the one in the `s3`
+// package.
+package download
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/timrourke/funnel/retry"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errStopped fails the objects that were given up on by stopping a download
+var errStopped = errors.New("download was stopped")
+
+// Object is an object found below a prefix
+type Object struct {
+	Key  string
+	Size int64
+	ETag string
+
+	// Archived objects must be restored, eg. from Glacier, before they can be
+	// downloaded
+	Archived bool
+}
+
+// ObjectStore lists, restores and downloads objects
+type ObjectStore interface {
+	// ListObjects calls fn with every object whose key begins with the prefix
+	ListObjects(prefix string, fn func(object Object) error) error
+
+	// Restore requests an archived object to be restored, unless that was
+	// requested already, and tells whether it can be downloaded yet
+	Restore(object Object) (bool, error)
+
+	// Download writes an object to a local path, which is only replaced once
+	// the whole object was downloaded and verified
+	Download(object Object, path string) error
+}
+
+// Downloader downloads every object below a prefix to local paths
+type Downloader interface {
+	DownloadPrefix(prefix string) error
+	Stop()
+}
+
+type downloader struct {
+	store                  ObjectStore
+	pathMapper             PathMapper
+	numConcurrentDownloads int
+	shouldOverwrite        bool
+	shouldRestoreArchived  bool
+	restorePollInterval    time.Duration
+	restoreTimeout         time.Duration
+	logger                 *logrus.Logger
+
+	stopped  chan struct{}
+	stopOnce sync.Once
+
+	mux           sync.Mutex
+	numDownloaded int
+	numSkipped    int
+	numFailed     int
+}
+
+// NewDownloader creates a new service to download objects to the local paths
+// the path mapper maps their keys to. Files that exist already are skipped
+// unless they should be overwritten. Archived objects are only downloaded when
+// they should be restored, in which case their restores are requested and
+// checked on again at the poll interval until they can be downloaded, or fail
+// once they were not restored within the timeout.
+func NewDownloader(
+	store ObjectStore,
+	pathMapper PathMapper,
+	numConcurrentDownloads int,
+	shouldOverwrite bool,
+	shouldRestoreArchived bool,
+	restorePollInterval time.Duration,
+	restoreTimeout time.Duration,
+	logger *logrus.Logger,
+) Downloader {
+	return &downloader{
+		store:                  store,
+		pathMapper:             pathMapper,
+		numConcurrentDownloads: numConcurrentDownloads,
+		shouldOverwrite:        shouldOverwrite,
+		shouldRestoreArchived:  shouldRestoreArchived,
+		restorePollInterval:    restorePollInterval,
+		restoreTimeout:         restoreTimeout,
+		logger:                 logger,
+		stopped:                make(chan struct{}),
+	}
+}
+
+// Stop gives up on the objects that are not listed yet, or waiting to be
+// retried or restored, failing them. Objects being downloaded are allowed to
+// finish.
+func (d *downloader) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.stopped)
+	})
+}
+
+type fileDownloadJob struct {
+	object    Object
+	path      string
+	errors    []error
+	restored  bool
+	waiting   bool
+	startedAt time.Time
+
+	// When the job began waiting for its object to be restored
+	waitingSince time.Time
+}
+
+// DownloadPrefix downloads every object whose key begins with the prefix. It
+// fails when listing the objects fails or any of them failed to download.
+func (d *downloader) DownloadPrefix(prefix string) error {
+	var wg sync.WaitGroup
+
+	d.mux.Lock()
+	d.numDownloaded, d.numSkipped, d.numFailed = 0, 0, 0
+	d.mux.Unlock()
+
+	pending := make(chan *fileDownloadJob)
+	quit := make(chan struct{})
+	defer close(quit)
+
+	for i := 0; i < d.numConcurrentDownloads; i++ {
+		go d.handlePending(pending, quit, &wg)
+	}
+
+	// Keys of the objects downloaded to each path, as two objects downloaded to
+	// the same path would overwrite each other
+	keysByPath := make(map[string]string)
+
+	numObjects := 0
+	listErr := d.store.ListObjects(prefix, func(object Object) error {
+		select {
+		case <-d.stopped:
+			return errStopped
+		default:
+		}
+
+		// Keys ending with a slash are placeholders for directories
+		if strings.HasSuffix(object.Key, "/") {
+			return nil
+		}
+
+		numObjects++
+
+		path, err := d.pathMapper.PathForKey(object.Key)
+		if err != nil {
+			d.fail(&fileDownloadJob{object: object, errors: []error{err}, startedAt: time.Now()})
+			return nil
+		}
+
+		if "" == path {
+			d.skip(object, "", fmt.Sprintf("Skipped object %s, its key does not map to a path", object.Key))
+			return nil
+		}
+
+		if otherKey, ok := keysByPath[path]; ok {
+			d.fail(&fileDownloadJob{
+				object:    object,
+				path:      path,
+				errors:    []error{fmt.Errorf("object %s maps to the same path %s as object %s", object.Key, path, otherKey)},
+				startedAt: time.Now(),
+			})
+			return nil
+		}
+		keysByPath[path] = object.Key
+
+		if !d.shouldOverwrite {
+			if _, err := os.Stat(path); err == nil {
+				d.skip(object, path, fmt.Sprintf("Skipped object %s, file %s exists already", object.Key, path))
+				return nil
+			}
+		}
+
+		wg.Add(1)
+		pending <- &fileDownloadJob{
+			object:    object,
+			path:      path,
+			errors:    []error{},
+			startedAt: time.Now(),
+		}
+
+		return nil
+	})
+
+	wg.Wait()
+
+	d.mux.Lock()
+	numDownloaded, numSkipped, numFailed := d.numDownloaded, d.numSkipped, d.numFailed
+	d.mux.Unlock()
+
+	d.logger.WithFields(logrus.Fields{
+		"prefix":     prefix,
+		"objects":    numObjects,
+		"downloaded": numDownloaded,
+		"skipped":    numSkipped,
+		"failed":     numFailed,
+	}).Info(fmt.Sprintf("Downloaded %d of %d objects below %s", numDownloaded, numObjects, prefix))
+
+	if errors.Is(listErr, errStopped) {
+		return fmt.Errorf("stopped listing objects below %s before downloading all of them", prefix)
+	}
+
+	if listErr != nil {
+		return fmt.Errorf("failed to list objects below %s: %w", prefix, listErr)
+	}
+
+	if numFailed > 0 {
+		return fmt.Errorf("failed to download %d of %d objects below %s", numFailed, numObjects, prefix)
+	}
+
+	return nil
+}
+
+// Attempt to download each pending object, until told to quit
+func (d *downloader) handlePending(pending chan *fileDownloadJob, quit <-chan struct{}, wg *sync.WaitGroup) {
+	for {
+		select {
+		case <-quit:
+			return
+		case job := <-pending:
+			if d.handleJob(job, pending, wg) {
+				wg.Done()
+			}
+		}
+	}
+}
+
+// Attempt to download a single object, restoring it first when it is archived.
+// It returns whether the object is done with, rather than queued again.
+func (d *downloader) handleJob(job *fileDownloadJob, pending chan *fileDownloadJob, wg *sync.WaitGroup) bool {
+	if job.object.Archived && !job.restored {
+		if !d.shouldRestoreArchived {
+			job.errors = append(job.errors, fmt.Errorf("object is archived and must be restored before downloading it: %s", job.object.Key))
+			d.fail(job)
+			return true
+		}
+
+		available, err := d.store.Restore(job.object)
+		if err != nil {
+			return d.retry(job, pending, wg, fmt.Errorf("failed to restore object: %s: %w", job.object.Key, err))
+		}
+
+		if !available {
+			if !job.waiting {
+				job.waiting = true
+				job.waitingSince = time.Now()
+				d.logger.WithFields(logrus.Fields{
+					"key":      job.object.Key,
+					"filename": job.path,
+				}).Info(fmt.Sprintf("Waiting for archived object %s to be restored", job.object.Key))
+			}
+
+			if time.Since(job.waitingSince) >= d.restoreTimeout {
+				job.errors = append(job.errors, fmt.Errorf("object was not restored within %s: %s", d.restoreTimeout, job.object.Key))
+				d.fail(job)
+				return true
+			}
+
+			d.requeueAfter(d.restorePollInterval, job, pending, wg)
+			return false
+		}
+
+		job.restored = true
+	}
+
+	err := d.store.Download(job.object, job.path)
+	if err != nil {
+		return d.retry(job, pending, wg, err)
+	}
+
+	now := time.Now()
+	downloadDuration := now.Sub(job.startedAt)
+
+	d.logger.WithFields(logrus.Fields{
+		"key":                 job.object.Key,
+		"filename":            job.path,
+		"size":                job.object.Size,
+		"startedAt":           job.startedAt.Format(time.RFC3339),
+		"completedAt":         now.Format(time.RFC3339),
+		"durationPretty":      downloadDuration.String(),
+		"durationNanoseconds": downloadDuration.Nanoseconds(),
+	}).Info(fmt.Sprintf("Downloaded object %s to %s", job.object.Key, job.path))
+
+	d.mux.Lock()
+	d.numDownloaded++
+	d.mux.Unlock()
+
+	return true
+}
+
+// Queue a job that failed again after a delay that grows with each attempt,
+// until it runs out of attempts
+func (d *downloader) retry(job *fileDownloadJob, pending chan *fileDownloadJob, wg *sync.WaitGroup, err error) bool {
+	job.errors = append(job.errors, err)
+
+	if retry.ShouldRetry(len(job.errors)) {
+		delay := retry.Delay(len(job.errors))
+
+		d.logger.WithFields(logrus.Fields{
+			"key":      job.object.Key,
+			"filename": job.path,
+			"error":    err.Error(),
+			"retryIn":  delay.String(),
+		}).Warn(fmt.Sprintf("Failed to download object %s, trying again in %s", job.object.Key, delay))
+
+		d.requeueAfter(delay, job, pending, wg)
+		return false
+	}
+
+	d.fail(job)
+	return true
+}
+
+// Queue a job again once a delay passed. A job whose delay is cut short by
+// stopping is failed instead.
+func (d *downloader) requeueAfter(delay time.Duration, job *fileDownloadJob, pending chan *fileDownloadJob, wg *sync.WaitGroup) {
+	retry.After(delay, d.stopped, func() {
+		pending <- job
+	}, func() {
+		job.errors = append(job.errors, errStopped)
+		d.fail(job)
+		wg.Done()
+	})
+}
+
+func (d *downloader) fail(job *fileDownloadJob) {
+	var errorStrings []string
+	for _, err := range job.errors {
+		errorStrings = append(errorStrings, err.Error())
+	}
+
+	d.logger.WithFields(logrus.Fields{
+		"key":       job.object.Key,
+		"filename":  job.path,
+		"startedAt": job.startedAt.Format(time.RFC3339),
+		"failedAt":  time.Now().Format(time.RFC3339),
+		"errors":    errorStrings,
+	}).Error(fmt.Sprintf("Failed to download object %s", job.object.Key))
+
+	d.mux.Lock()
+	d.numFailed++
+	d.mux.Unlock()
+}
+
+func (d *downloader) skip(object Object, path string, message string) {
+	d.logger.WithFields(logrus.Fields{
+		"key":      object.Key,
+		"filename": path,
+	}).Info(message)
+
+	d.mux.Lock()
+	d.numSkipped++
+	d.mux.Unlock()
+}
@@ -0,0 +1,273 @@
+package download
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/timrourke/funnel/retry"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeObjectStore serves objects from memory, failing each download as many
+// times as told to and making archived objects available after some checks
+type fakeObjectStore struct {
+	objects       []Object
+	contents      map[string]string
+	failures      map[string]int
+	pendingChecks map[string]int
+	listErr       error
+	mux           sync.Mutex
+	downloads     map[string]int
+	restores      map[string]int
+}
+
+func newFakeObjectStore(contents map[string]string) *fakeObjectStore {
+	store := &fakeObjectStore{
+		contents:      contents,
+		failures:      map[string]int{},
+		pendingChecks: map[string]int{},
+		downloads:     map[string]int{},
+		restores:      map[string]int{},
+	}
+	for key, body := range contents {
+		store.objects = append(store.objects, Object{Key: key, Size: int64(len(body))})
+	}
+
+	return store
+}
+
+func (f *fakeObjectStore) ListObjects(prefix string, fn func(object Object) error) error {
+	for _, object := range f.objects {
+		if err := fn(object); err != nil {
+			return err
+		}
+	}
+
+	return f.listErr
+}
+
+func (f *fakeObjectStore) Restore(object Object) (bool, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.restores[object.Key]++
+
+	return f.restores[object.Key] > f.pendingChecks[object.Key], nil
+}
+
+func (f *fakeObjectStore) Download(object Object, path string) error {
+	f.mux.Lock()
+	f.downloads[object.Key]++
+	attempt := f.downloads[object.Key]
+	f.mux.Unlock()
+
+	if attempt <= f.failures[object.Key] {
+		return errors.New("connection reset")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, []byte(f.contents[object.Key]), 0644)
+}
+
+func TestDownloadPrefix(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	defaultRetryDelay := retry.BaseDelay
+	retry.BaseDelay = time.Millisecond
+	defer func() {
+		retry.BaseDelay = defaultRetryDelay
+	}()
+
+	newOutputDir := func() string {
+		outputDir, err := ioutil.TempDir("", "funnel-download")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return outputDir
+	}
+
+	Convey("Should download every object below a prefix", t, func() {
+		outputDir := newOutputDir()
+		defer os.RemoveAll(outputDir)
+
+		store := newFakeObjectStore(map[string]string{
+			"backups/a.txt":     "some contents",
+			"backups/sub/b.txt": "other contents",
+			"backups/sub/":      "",
+		})
+		downloader := NewDownloader(store, NewPrefixStripper(outputDir, "backups/"), 2, false, false, time.Millisecond, time.Hour, logger)
+
+		So(downloader.DownloadPrefix("backups/"), ShouldBeNil)
+
+		contents, err := ioutil.ReadFile(filepath.Join(outputDir, "a.txt"))
+		So(err, ShouldBeNil)
+		So(string(contents), ShouldEqual, "some contents")
+
+		contents, err = ioutil.ReadFile(filepath.Join(outputDir, "sub", "b.txt"))
+		So(err, ShouldBeNil)
+		So(string(contents), ShouldEqual, "other contents")
+
+		So(store.downloads, ShouldNotContainKey, "backups/sub/")
+	})
+
+	Convey("Should retry downloads that failed", t, func() {
+		outputDir := newOutputDir()
+		defer os.RemoveAll(outputDir)
+
+		store := newFakeObjectStore(map[string]string{"a.txt": "some contents"})
+		store.failures["a.txt"] = retry.MaxAttempts - 1
+		downloader := NewDownloader(store, NewPrefixStripper(outputDir, ""), 1, false, false, time.Millisecond, time.Hour, logger)
+
+		So(downloader.DownloadPrefix(""), ShouldBeNil)
+		So(store.downloads["a.txt"], ShouldEqual, retry.MaxAttempts)
+	})
+
+	Convey("Should wait longer before each retry", t, func() {
+		outputDir := newOutputDir()
+		defer os.RemoveAll(outputDir)
+
+		store := newFakeObjectStore(map[string]string{"a.txt": "some contents"})
+		store.failures["a.txt"] = retry.MaxAttempts - 1
+		downloader := NewDownloader(store, NewPrefixStripper(outputDir, ""), 1, false, false, time.Millisecond, time.Hour, logger)
+
+		startedAt := time.Now()
+
+		So(downloader.DownloadPrefix(""), ShouldBeNil)
+		So(time.Since(startedAt), ShouldBeGreaterThanOrEqualTo, (1+2+4+8)*time.Millisecond)
+	})
+
+	Convey("Should fail once a download ran out of attempts", t, func() {
+		outputDir := newOutputDir()
+		defer os.RemoveAll(outputDir)
+
+		store := newFakeObjectStore(map[string]string{"a.txt": "some contents"})
+		store.failures["a.txt"] = retry.MaxAttempts
+		downloader := NewDownloader(store, NewPrefixStripper(outputDir, ""), 1, false, false, time.Millisecond, time.Hour, logger)
+
+		err := downloader.DownloadPrefix("")
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "failed to download 1 of 1 objects")
+		So(store.downloads["a.txt"], ShouldEqual, retry.MaxAttempts)
+	})
+
+	Convey("Should fail objects that map to the same path as another object", t, func() {
+		outputDir := newOutputDir()
+		defer os.RemoveAll(outputDir)
+
+		store := newFakeObjectStore(map[string]string{
+			"logs/web-1/access.log": "some contents",
+			"logs/web-2/access.log": "other contents",
+		})
+		mapper, err := NewReverseTemplate(outputDir, "logs/{host}/{file}", "{file}")
+		So(err, ShouldBeNil)
+
+		downloader := NewDownloader(store, mapper, 1, true, false, time.Millisecond, time.Hour, logger)
+
+		err = downloader.DownloadPrefix("logs/")
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "failed to download 1 of 2 objects")
+		So(store.downloads["logs/web-1/access.log"]+store.downloads["logs/web-2/access.log"], ShouldEqual, 1)
+	})
+
+	Convey("Should skip files that exist already unless told to overwrite them", t, func() {
+		outputDir := newOutputDir()
+		defer os.RemoveAll(outputDir)
+
+		existing := filepath.Join(outputDir, "a.txt")
+		So(ioutil.WriteFile(existing, []byte("local contents"), 0644), ShouldBeNil)
+
+		store := newFakeObjectStore(map[string]string{"a.txt": "some contents"})
+
+		So(NewDownloader(store, NewPrefixStripper(outputDir, ""), 1, false, false, time.Millisecond, time.Hour, logger).DownloadPrefix(""), ShouldBeNil)
+		contents, _ := ioutil.ReadFile(existing)
+		So(string(contents), ShouldEqual, "local contents")
+
+		So(NewDownloader(store, NewPrefixStripper(outputDir, ""), 1, true, false, time.Millisecond, time.Hour, logger).DownloadPrefix(""), ShouldBeNil)
+		contents, _ = ioutil.ReadFile(existing)
+		So(string(contents), ShouldEqual, "some contents")
+	})
+
+	Convey("Should fail on archived objects unless told to restore them", t, func() {
+		outputDir := newOutputDir()
+		defer os.RemoveAll(outputDir)
+
+		store := newFakeObjectStore(map[string]string{"a.txt": "some contents"})
+		store.objects[0].Archived = true
+		downloader := NewDownloader(store, NewPrefixStripper(outputDir, ""), 1, false, false, time.Millisecond, time.Hour, logger)
+
+		So(downloader.DownloadPrefix(""), ShouldNotBeNil)
+		So(store.downloads["a.txt"], ShouldEqual, 0)
+		So(store.restores["a.txt"], ShouldEqual, 0)
+	})
+
+	Convey("Should wait for archived objects to be restored before downloading them", t, func() {
+		outputDir := newOutputDir()
+		defer os.RemoveAll(outputDir)
+
+		store := newFakeObjectStore(map[string]string{"a.txt": "some contents"})
+		store.objects[0].Archived = true
+		store.pendingChecks["a.txt"] = 3
+		downloader := NewDownloader(store, NewPrefixStripper(outputDir, ""), 1, false, true, time.Millisecond, time.Hour, logger)
+
+		So(downloader.DownloadPrefix(""), ShouldBeNil)
+		So(store.restores["a.txt"], ShouldEqual, 4)
+		So(store.downloads["a.txt"], ShouldEqual, 1)
+	})
+
+	Convey("Should fail archived objects that were not restored in time", t, func() {
+		outputDir := newOutputDir()
+		defer os.RemoveAll(outputDir)
+
+		store := newFakeObjectStore(map[string]string{"a.txt": "some contents"})
+		store.objects[0].Archived = true
+		store.pendingChecks["a.txt"] = 1000000
+		downloader := NewDownloader(store, NewPrefixStripper(outputDir, ""), 1, false, true, time.Millisecond, 20*time.Millisecond, logger)
+
+		So(downloader.DownloadPrefix(""), ShouldNotBeNil)
+		So(store.downloads["a.txt"], ShouldEqual, 0)
+	})
+
+	Convey("Should stop waiting for archived objects to be restored once stopped", t, func() {
+		outputDir := newOutputDir()
+		defer os.RemoveAll(outputDir)
+
+		store := newFakeObjectStore(map[string]string{"a.txt": "some contents"})
+		store.objects[0].Archived = true
+		store.pendingChecks["a.txt"] = 1000000
+		downloader := NewDownloader(store, NewPrefixStripper(outputDir, ""), 1, false, true, time.Hour, time.Hour, logger)
+
+		time.AfterFunc(20*time.Millisecond, downloader.Stop)
+
+		err := downloader.DownloadPrefix("")
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "failed to download 1 of 1 objects")
+		So(store.downloads["a.txt"], ShouldEqual, 0)
+	})
+
+	Convey("Should fail when listing objects fails", t, func() {
+		outputDir := newOutputDir()
+		defer os.RemoveAll(outputDir)
+
+		store := newFakeObjectStore(map[string]string{})
+		store.listErr = errors.New("access denied")
+		downloader := NewDownloader(store, NewPrefixStripper(outputDir, ""), 1, false, false, time.Millisecond, time.Hour, logger)
+
+		err := downloader.DownloadPrefix("backups/")
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "access denied")
+	})
+}
@@ -0,0 +1,138 @@
+package download
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// PathMapper maps the key of an object back to the local path to download it
+// to. An empty path means the object is not to be downloaded.
+type PathMapper interface {
+	PathForKey(key string) (string, error)
+}
+
+type prefixStripper struct {
+	outputDir string
+	prefix    string
+}
+
+// NewPrefixStripper creates a path mapper that downloads each object to the
+// rest of its key after the prefix, below the output directory, eg. the key
+// `backups/2024/a.txt` to `restored/2024/a.txt` for the prefix `backups/`
+func NewPrefixStripper(outputDir string, prefix string) PathMapper {
+	return &prefixStripper{
+		outputDir: outputDir,
+		prefix:    prefix,
+	}
+}
+
+func (p *prefixStripper) PathForKey(key string) (string, error) {
+	relativePath := strings.TrimPrefix(key, p.prefix)
+
+	// An object whose key is the prefix itself keeps its name
+	if "" == relativePath {
+		relativePath = path.Base(key)
+	}
+
+	return joinBelow(p.outputDir, key, relativePath)
+}
+
+// placeholderPattern matches the placeholders of key patterns, eg. `{host}`
+// for a single segment of a key or `{path...}` for the rest of it
+var placeholderPattern = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)(\.\.\.)?\}`)
+
+type reverseTemplate struct {
+	outputDir    string
+	keyPattern   *regexp.Regexp
+	pathTemplate string
+}
+
+// NewReverseTemplate creates a path mapper that matches keys against a pattern
+// with placeholders, and fills the ones it captured into a path template below
+// the output directory, eg. the key `logs/web-1/2024/app.log` matches
+// `logs/{host}/{year}/{file...}`, and goes to `{host}/{file}` as `web-1/app.log`.
+// Objects whose keys do not match the pattern are not downloaded.
+func NewReverseTemplate(outputDir string, keyPattern string, pathTemplate string) (PathMapper, error) {
+	var expression strings.Builder
+	names := make(map[string]bool)
+
+	expression.WriteString("^")
+	rest := keyPattern
+	for {
+		location := placeholderPattern.FindStringSubmatchIndex(rest)
+		if nil == location {
+			expression.WriteString(regexp.QuoteMeta(rest))
+			break
+		}
+
+		expression.WriteString(regexp.QuoteMeta(rest[:location[0]]))
+
+		name := rest[location[2]:location[3]]
+		if names[name] {
+			return nil, fmt.Errorf("invalid key pattern %s, placeholder {%s} is used more than once", keyPattern, name)
+		}
+		names[name] = true
+
+		if -1 == location[4] {
+			expression.WriteString("(?P<" + name + ">[^/]+)")
+		} else {
+			expression.WriteString("(?P<" + name + ">.+)")
+		}
+
+		rest = rest[location[1]:]
+	}
+	expression.WriteString("$")
+
+	for _, match := range placeholderPattern.FindAllStringSubmatch(pathTemplate, -1) {
+		if !names[match[1]] {
+			return nil, fmt.Errorf("invalid path template %s, placeholder {%s} is not in the key pattern %s", pathTemplate, match[1], keyPattern)
+		}
+	}
+
+	compiled, err := regexp.Compile(expression.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid key pattern %s: %w", keyPattern, err)
+	}
+
+	return &reverseTemplate{
+		outputDir:    outputDir,
+		keyPattern:   compiled,
+		pathTemplate: pathTemplate,
+	}, nil
+}
+
+func (r *reverseTemplate) PathForKey(key string) (string, error) {
+	match := r.keyPattern.FindStringSubmatch(key)
+	if nil == match {
+		return "", nil
+	}
+
+	captured := make(map[string]string)
+	for i, name := range r.keyPattern.SubexpNames() {
+		if "" != name {
+			captured[name] = match[i]
+		}
+	}
+
+	relativePath := placeholderPattern.ReplaceAllStringFunc(r.pathTemplate, func(placeholder string) string {
+		return captured[placeholderPattern.FindStringSubmatch(placeholder)[1]]
+	})
+
+	return joinBelow(r.outputDir, key, relativePath)
+}
+
+// Join a path that a key maps to onto the output directory, refusing paths
+// that would escape it, eg. for the key `../etc/passwd`
+func joinBelow(outputDir string, key string, relativePath string) (string, error) {
+	target := filepath.Join(outputDir, filepath.FromSlash(relativePath))
+
+	relativeToOutput, err := filepath.Rel(outputDir, target)
+	if err != nil || "." == relativeToOutput || ".." == relativeToOutput || strings.HasPrefix(relativeToOutput, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("key does not map to a file below the output directory: %s", key)
+	}
+
+	return target, nil
+}
@@ -0,0 +1,85 @@
+package download
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrefixStripper(t *testing.T) {
+	Convey("Should map keys to the rest of them after the prefix", t, func() {
+		mapper := NewPrefixStripper("restored", "backups/")
+
+		path, err := mapper.PathForKey("backups/2024/a.txt")
+
+		So(err, ShouldBeNil)
+		So(path, ShouldEqual, filepath.Join("restored", "2024", "a.txt"))
+	})
+
+	Convey("Should keep the name of an object whose key is the prefix", t, func() {
+		path, err := NewPrefixStripper("restored", "backups/a.txt").PathForKey("backups/a.txt")
+
+		So(err, ShouldBeNil)
+		So(path, ShouldEqual, filepath.Join("restored", "a.txt"))
+	})
+
+	Convey("Should refuse keys that escape the output directory", t, func() {
+		_, err := NewPrefixStripper("restored", "backups/").PathForKey("backups/../../etc/passwd")
+
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestReverseTemplate(t *testing.T) {
+	Convey("Should fill the placeholders a key matched into the path template", t, func() {
+		mapper, err := NewReverseTemplate("restored", "logs/{host}/{year}/{file...}", "{host}/{file}")
+		So(err, ShouldBeNil)
+
+		path, err := mapper.PathForKey("logs/web-1/2024/nginx/access.log")
+
+		So(err, ShouldBeNil)
+		So(path, ShouldEqual, filepath.Join("restored", "web-1", "nginx", "access.log"))
+	})
+
+	Convey("Should not download objects whose keys do not match", t, func() {
+		mapper, err := NewReverseTemplate("restored", "logs/{host}/{file}", "{host}/{file}")
+		So(err, ShouldBeNil)
+
+		path, err := mapper.PathForKey("logs/web-1/nginx/access.log")
+
+		So(err, ShouldBeNil)
+		So(path, ShouldEqual, "")
+	})
+
+	Convey("Should match the rest of the key literally", t, func() {
+		mapper, err := NewReverseTemplate("restored", "logs/{file}.gz", "{file}")
+		So(err, ShouldBeNil)
+
+		path, _ := mapper.PathForKey("logs/app.log.gz")
+		So(path, ShouldEqual, filepath.Join("restored", "app.log"))
+
+		path, _ = mapper.PathForKey("logs/app.log-gz")
+		So(path, ShouldEqual, "")
+	})
+
+	Convey("Should reject path templates with placeholders the key pattern lacks", t, func() {
+		_, err := NewReverseTemplate("restored", "logs/{file}", "{host}/{file}")
+
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should reject key patterns that use a placeholder twice", t, func() {
+		_, err := NewReverseTemplate("restored", "{file}/{file}", "{file}")
+
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should refuse keys that escape the output directory", t, func() {
+		mapper, err := NewReverseTemplate("restored", "logs/{file...}", "{file}")
+		So(err, ShouldBeNil)
+
+		_, err = mapper.PathForKey("logs/../../etc/passwd")
+
+		So(err, ShouldNotBeNil)
+	})
+}
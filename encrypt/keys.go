@@ -0,0 +1,189 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"filippo.io/age"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Ways of wrapping data keys
+const (
+	// KeyWrappingAge encrypts data keys to age recipients
+	KeyWrappingAge = "age"
+
+	// KeyWrappingKeyFile encrypts data keys with AES-256-GCM, using a key read
+	// from a local file
+	KeyWrappingKeyFile = "AES-256-GCM-KEYFILE"
+)
+
+// KeyWrapper encrypts the data key of a stream so it can be stored alongside
+// the stream
+type KeyWrapper interface {
+	KeyWrapping() string
+	Wrap(dataKey []byte) ([]byte, error)
+}
+
+// KeyUnwrapper decrypts the data key of a stream
+type KeyUnwrapper interface {
+	Unwrap(keyWrapping string, wrappedKey []byte) ([]byte, error)
+}
+
+type ageKeyWrapper struct {
+	recipients []age.Recipient
+	identities []age.Identity
+}
+
+// NewAgeKeyWrapper wraps data keys for the given age recipients, eg.
+// `age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p`
+func NewAgeKeyWrapper(recipients []string) (KeyWrapper, error) {
+	wrapper := &ageKeyWrapper{}
+
+	for _, recipient := range recipients {
+		parsed, err := age.ParseX25519Recipient(strings.TrimSpace(recipient))
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipient: %w", err)
+		}
+
+		wrapper.recipients = append(wrapper.recipients, parsed)
+	}
+
+	if 0 == len(wrapper.recipients) {
+		return nil, errors.New("must provide at least one age recipient")
+	}
+
+	return wrapper, nil
+}
+
+// NewAgeKeyUnwrapper unwraps data keys with the age identities in a file, as
+// generated by `age-keygen`
+func NewAgeKeyUnwrapper(identityFile string) (KeyUnwrapper, error) {
+	file, err := os.Open(identityFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	identities, err := age.ParseIdentities(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid age identity file: %s: %w", identityFile, err)
+	}
+
+	return &ageKeyWrapper{identities: identities}, nil
+}
+
+func (a *ageKeyWrapper) KeyWrapping() string {
+	return KeyWrappingAge
+}
+
+func (a *ageKeyWrapper) Wrap(dataKey []byte) ([]byte, error) {
+	var wrapped bytes.Buffer
+
+	writer, err := age.Encrypt(&wrapped, a.recipients...)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = writer.Write(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return wrapped.Bytes(), nil
+}
+
+func (a *ageKeyWrapper) Unwrap(keyWrapping string, wrappedKey []byte) ([]byte, error) {
+	if keyWrapping != KeyWrappingAge {
+		return nil, fmt.Errorf("data key is wrapped with %s, not %s", keyWrapping, KeyWrappingAge)
+	}
+
+	reader, err := age.Decrypt(bytes.NewReader(wrappedKey), a.identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+
+	return ioutil.ReadAll(reader)
+}
+
+type keyFileWrapper struct {
+	key []byte
+}
+
+// LoadKeyFile reads a key for wrapping data keys from a file holding 32 bytes
+// in hex, as generated by `openssl rand -hex 32`
+func LoadKeyFile(keyFile string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(contents)))
+	if err != nil || len(key) != DataKeySize {
+		return nil, fmt.Errorf("key file must hold 32 bytes in hex: %s", keyFile)
+	}
+
+	return key, nil
+}
+
+// NewKeyFileWrapper wraps data keys with a key loaded from a key file
+func NewKeyFileWrapper(key []byte) KeyWrapper {
+	return &keyFileWrapper{key: key}
+}
+
+// NewKeyFileUnwrapper unwraps data keys with a key loaded from a key file
+func NewKeyFileUnwrapper(key []byte) KeyUnwrapper {
+	return &keyFileWrapper{key: key}
+}
+
+func (k *keyFileWrapper) KeyWrapping() string {
+	return KeyWrappingKeyFile
+}
+
+func (k *keyFileWrapper) Wrap(dataKey []byte) ([]byte, error) {
+	aead, err := newAEAD(k.key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+func (k *keyFileWrapper) Unwrap(keyWrapping string, wrappedKey []byte) ([]byte, error) {
+	if keyWrapping != KeyWrappingKeyFile {
+		return nil, fmt.Errorf("data key is wrapped with %s, not %s", keyWrapping, KeyWrappingKeyFile)
+	}
+
+	aead, err := newAEAD(k.key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrappedKey) < aead.NonceSize() {
+		return nil, errors.New("failed to unwrap data key: wrapped key is truncated")
+	}
+
+	nonce, sealed := wrappedKey[:aead.NonceSize()], wrappedKey[aead.NonceSize():]
+
+	dataKey, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, errors.New("failed to unwrap data key, the key file is wrong")
+	}
+
+	return dataKey, nil
+}
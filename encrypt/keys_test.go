@@ -0,0 +1,110 @@
+package encrypt
+
+import (
+	"filippo.io/age"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func writeTempFile(t *testing.T, contents string) string {
+	file, err := ioutil.TempFile("", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return file.Name()
+}
+
+func TestAgeKeyWrapper(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identityFile := writeTempFile(t, "# some comment\n"+identity.String()+"\n")
+	defer os.Remove(identityFile)
+
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Should unwrap a data key wrapped for an age recipient", t, func() {
+		wrapper, err := NewAgeKeyWrapper([]string{identity.Recipient().String()})
+		So(err, ShouldBeNil)
+
+		wrappedKey, err := wrapper.Wrap(dataKey)
+		So(err, ShouldBeNil)
+
+		unwrapper, err := NewAgeKeyUnwrapper(identityFile)
+		So(err, ShouldBeNil)
+
+		unwrappedKey, err := unwrapper.Unwrap(wrapper.KeyWrapping(), wrappedKey)
+		So(err, ShouldBeNil)
+		So(unwrappedKey, ShouldResemble, dataKey)
+
+		Convey("Should fail for another way of wrapping", func() {
+			_, err := unwrapper.Unwrap(KeyWrappingKeyFile, wrappedKey)
+
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Should fail for invalid recipients", t, func() {
+		_, err := NewAgeKeyWrapper([]string{"age1notarecipient"})
+		So(err, ShouldNotBeNil)
+
+		_, err = NewAgeKeyWrapper(nil)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestKeyFileWrapper(t *testing.T) {
+	keyFile := writeTempFile(t, "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n")
+	defer os.Remove(keyFile)
+
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Should unwrap a data key wrapped with a key file", t, func() {
+		key, err := LoadKeyFile(keyFile)
+		So(err, ShouldBeNil)
+
+		wrappedKey, err := NewKeyFileWrapper(key).Wrap(dataKey)
+		So(err, ShouldBeNil)
+
+		unwrappedKey, err := NewKeyFileUnwrapper(key).Unwrap(KeyWrappingKeyFile, wrappedKey)
+		So(err, ShouldBeNil)
+		So(unwrappedKey, ShouldResemble, dataKey)
+
+		Convey("Should fail with another key", func() {
+			otherKey := append([]byte{}, key...)
+			otherKey[0] ^= 1
+
+			_, err := NewKeyFileUnwrapper(otherKey).Unwrap(KeyWrappingKeyFile, wrappedKey)
+
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Should fail for invalid key files", t, func() {
+		invalidKeyFile := writeTempFile(t, "not hex")
+		defer os.Remove(invalidKeyFile)
+
+		_, err := LoadKeyFile(invalidKeyFile)
+		So(err, ShouldNotBeNil)
+
+		_, err = LoadKeyFile("/does/not/exist")
+		So(err, ShouldNotBeNil)
+	})
+}
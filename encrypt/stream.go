@@ -0,0 +1,169 @@
+// Package encrypt encrypts files on the client before they are uploaded, with a
+// data key of their own that is wrapped with an age recipient or a local key
+// file
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Algorithm names the format of encrypted streams: AES-256-GCM over chunks of
+// 64KiB, each sealed with a nonce made of its index and whether it is the last
+// chunk, so that chunks cannot be reordered, dropped or truncated unnoticed
+const Algorithm = "AES-256-GCM-STREAM-64K"
+
+// ChunkSize is the size of the plaintext in every chunk but the last
+const ChunkSize = 64 * 1024
+
+// DataKeySize is the size of the key each stream is encrypted with
+const DataKeySize = 32
+
+// NewDataKey generates a random key to encrypt a single stream with
+func NewDataKey() ([]byte, error) {
+	dataKey := make([]byte, DataKeySize)
+
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return dataKey, nil
+}
+
+// NewEncryptingReader streams the encryption of the source with the data key,
+// holding a single chunk in memory at a time
+func NewEncryptingReader(source io.Reader, dataKey []byte) (io.Reader, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamReader{
+		aead:      aead,
+		source:    source,
+		chunkSize: ChunkSize,
+		seal:      true,
+	}, nil
+}
+
+// NewDecryptingReader streams the decryption of a source encrypted with the
+// data key. Reading fails when the stream was tampered with or truncated.
+func NewDecryptingReader(source io.Reader, dataKey []byte) (io.Reader, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamReader{
+		aead:      aead,
+		source:    source,
+		chunkSize: ChunkSize + aead.Overhead(),
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != DataKeySize {
+		return nil, errors.New("data key must be 32 bytes long")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// streamReader seals or opens a stream one chunk at a time. It reads one byte
+// past each chunk to learn whether it is the last one.
+type streamReader struct {
+	aead      cipher.AEAD
+	source    io.Reader
+	chunkSize int
+	seal      bool
+	counter   uint64
+	buf       []byte
+	carried   int
+	out       []byte
+	done      bool
+	err       error
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for 0 == len(s.out) {
+		if s.err != nil {
+			return 0, s.err
+		}
+
+		if s.done {
+			return 0, io.EOF
+		}
+
+		s.out, s.err = s.nextChunk()
+	}
+
+	n := copy(p, s.out)
+	s.out = s.out[n:]
+
+	return n, nil
+}
+
+func (s *streamReader) nextChunk() ([]byte, error) {
+	if nil == s.buf {
+		s.buf = make([]byte, s.chunkSize+1)
+	}
+
+	n, err := io.ReadFull(s.source, s.buf[s.carried:])
+	n += s.carried
+	s.carried = 0
+
+	last := false
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		last = true
+	default:
+		return nil, err
+	}
+
+	chunk := s.buf[:n]
+	if !last {
+		chunk = s.buf[:s.chunkSize]
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], s.counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+
+	var out []byte
+	if s.seal {
+		out = s.aead.Seal(nil, nonce, chunk, nil)
+	} else {
+		if len(chunk) < s.aead.Overhead() {
+			return nil, errors.New("encrypted stream is truncated")
+		}
+
+		out, err = s.aead.Open(nil, nonce, chunk, nil)
+		if err != nil {
+			return nil, errors.New("failed to decrypt stream, it was tampered with or the key is wrong")
+		}
+	}
+
+	if last {
+		s.done = true
+	} else {
+		s.buf[0] = s.buf[s.chunkSize]
+		s.carried = 1
+	}
+
+	s.counter++
+
+	return out, nil
+}
@@ -0,0 +1,93 @@
+package encrypt
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"testing"
+)
+
+func encryptBytes(t *testing.T, plaintext []byte, dataKey []byte) []byte {
+	reader, err := NewEncryptingReader(bytes.NewReader(plaintext), dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ciphertext
+}
+
+func decryptBytes(ciphertext []byte, dataKey []byte) ([]byte, error) {
+	reader, err := NewDecryptingReader(bytes.NewReader(ciphertext), dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(reader)
+}
+
+func TestStream(t *testing.T) {
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 100}
+
+	for _, size := range sizes {
+		plaintext := bytes.Repeat([]byte("x"), size)
+
+		Convey("Should round trip a stream", t, func() {
+			ciphertext := encryptBytes(t, plaintext, dataKey)
+
+			numChunks := size/ChunkSize + 1
+			if size > 0 && 0 == size%ChunkSize {
+				numChunks--
+			}
+			So(len(ciphertext), ShouldEqual, size+numChunks*16)
+
+			decrypted, err := decryptBytes(ciphertext, dataKey)
+
+			So(err, ShouldBeNil)
+			So(bytes.Equal(decrypted, plaintext), ShouldBeTrue)
+		})
+	}
+
+	plaintext := bytes.Repeat([]byte("x"), 2*ChunkSize+10)
+	ciphertext := encryptBytes(t, plaintext, dataKey)
+
+	Convey("Should fail with the wrong key", t, func() {
+		otherKey, _ := NewDataKey()
+
+		_, err := decryptBytes(ciphertext, otherKey)
+
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should fail for tampered streams", t, func() {
+		tampered := append([]byte{}, ciphertext...)
+		tampered[10] ^= 1
+
+		_, err := decryptBytes(tampered, dataKey)
+
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should fail for streams truncated at a chunk boundary", t, func() {
+		_, err := decryptBytes(ciphertext[:ChunkSize+16], dataKey)
+		So(err, ShouldNotBeNil)
+
+		_, err = decryptBytes(ciphertext[:0], dataKey)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should fail for keys of the wrong size", t, func() {
+		_, err := NewEncryptingReader(bytes.NewReader(plaintext), dataKey[:16])
+
+		So(err, ShouldNotBeNil)
+	})
+}
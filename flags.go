@@ -0,0 +1,331 @@
+package main
+
+import (
+	"github.com/timrourke/funnel/backend"
+	"github.com/timrourke/funnel/compress"
+	"github.com/timrourke/funnel/tpl"
+	"github.com/timrourke/funnel/upload"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func configureRootCmd() {
+	rootCmd.PersistentFlags().StringVarP(
+		&region,
+		"region",
+		"r",
+		"",
+		"The AWS region your S3 bucket is in, eg. \"us-east-1\"",
+	)
+	if "" == strings.TrimSpace(region) {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+
+	rootCmd.PersistentFlags().StringVarP(
+		&bucket,
+		"bucket",
+		"b",
+		"",
+		"The AWS S3 bucket you want to save files to",
+	)
+
+	rootCmd.Flags().StringArrayVarP(
+		&destinations,
+		"destination",
+		"d",
+		nil,
+		"Where to save files, as a URL such as \"s3://bucket/prefix\", \"gs://bucket/prefix\", \"azblob://container/prefix\", \"sftp://user@host/incoming\" or \"file:///mnt/backup\", defaults to the bucket in AWS S3 (can be repeated to save files in each)",
+	)
+
+	rootCmd.Flags().StringArrayVarP(
+		&optionalDestinations,
+		"optional-destination",
+		"",
+		nil,
+		"Another destination to save files in, which files are not required to be in before they are deleted (can be repeated)",
+	)
+
+	rootCmd.Flags().IntVarP(
+		&destinationQuorum,
+		"destination-quorum",
+		"",
+		0,
+		"Least number of destinations, including the required ones, files must be saved in before they are deleted",
+	)
+
+	rootCmd.Flags().StringVarP(
+		&fanOutMode,
+		"fan-out",
+		"",
+		backend.FanOutParallel,
+		"How to save files in more than one destination: parallel or sequential",
+	)
+
+	rootCmd.PersistentFlags().BoolVarP(
+		&shouldWatchPaths,
+		"watch",
+		"w",
+		false,
+		"Whether to watch a path for changes",
+	)
+
+	rootCmd.PersistentFlags().IntVarP(
+		&numConcurrentUploads,
+		"num-concurrent-uploads",
+		"n",
+		10,
+		"Number of concurrent uploads",
+	)
+
+	rootCmd.PersistentFlags().BoolVarP(
+		&shouldDeleteFileAfterUpload,
+		"delete-file-after-upload",
+		"",
+		false,
+		"Whether to delete the uploaded file after a successful upload",
+	)
+
+	rootCmd.PersistentFlags().StringVarP(
+		&s3ObjectKeyTemplate,
+		"s3-object-key-template",
+		"t",
+		"{{ filePath }}",
+		"The layout template to use for defining the key of an uploaded file, or @file to read it from a file",
+	)
+
+	rootCmd.PersistentFlags().StringVarP(
+		&keyUnsafeCharacters,
+		"key-unsafe-characters",
+		"",
+		string(tpl.KeepUnsafeCharacters),
+		"What to do with characters in keys that are not safe in S3: keep, replace (with \"_\") or reject",
+	)
+
+	rootCmd.PersistentFlags().StringArrayVarP(
+		&templateVars,
+		"var",
+		"",
+		nil,
+		"A variable for the key template in the form key=value, available as {{ var \"key\" }} (can be repeated)",
+	)
+
+	rootCmd.PersistentFlags().StringSliceVarP(
+		&allowedTemplateEnv,
+		"allow-env",
+		"",
+		nil,
+		"Names of environment variables the key template may read with {{ env \"NAME\" }}, eg. \"DEPLOY_ENV,CI_*\"",
+	)
+
+	rootCmd.Flags().StringVarP(
+		&collisionPolicy,
+		"on-key-collision",
+		"",
+		string(upload.FailOnCollision),
+		"What to do with a file whose key is already used by another file: fail, skip, suffix, hash-suffix or overwrite",
+	)
+
+	rootCmd.Flags().BoolVarP(
+		&shouldDryRun,
+		"dry-run",
+		"",
+		false,
+		"Show the key each file would be uploaded to and report key collisions, without uploading or deleting anything",
+	)
+
+	rootCmd.Flags().StringVarP(
+		&multipartThreshold,
+		"multipart-threshold",
+		"",
+		"100MiB",
+		"Files at least this large are uploaded in resumable parts, eg. \"100MiB\"",
+	)
+
+	rootCmd.Flags().StringVarP(
+		&multipartPartSize,
+		"multipart-part-size",
+		"",
+		"16MiB",
+		"Size of each part of a resumable multipart upload, eg. \"16MiB\"",
+	)
+
+	rootCmd.Flags().StringVarP(
+		&multipartJournalDir,
+		"multipart-journal-dir",
+		"",
+		defaultMultipartJournalDir(),
+		"Directory in which to record the progress of resumable multipart uploads",
+	)
+
+	rootCmd.Flags().BoolVarP(
+		&shouldShowProgress,
+		"progress",
+		"",
+		false,
+		"Whether to show the progress of uploads, as a live view on a terminal or as log events otherwise",
+	)
+
+	rootCmd.Flags().DurationVarP(
+		&progressInterval,
+		"progress-interval",
+		"",
+		0,
+		"How often to show the progress of uploads (default 1s on a terminal, 10s otherwise)",
+	)
+
+	rootCmd.Flags().StringVarP(
+		&metricsAddr,
+		"metrics-addr",
+		"",
+		"",
+		"Address to serve Prometheus metrics on at /metrics, eg. \":9090\"",
+	)
+
+	rootCmd.Flags().BoolVarP(
+		&shouldServeControlAPI,
+		"control",
+		"",
+		false,
+		"Whether to serve health probes and an API for controlling uploads",
+	)
+
+	rootCmd.Flags().StringVarP(
+		&controlAddr,
+		"control-addr",
+		"",
+		"unix:"+filepath.Join(os.TempDir(), "funnel.sock"),
+		"Address to serve health probes and the control API on, eg. \"unix:/run/funnel.sock\" or \"tcp:127.0.0.1:8081\"",
+	)
+
+	rootCmd.Flags().StringVarP(
+		&maxBandwidth,
+		"max-bandwidth",
+		"",
+		"unlimited",
+		"Total upload bandwidth shared by all concurrent uploads, eg. \"20MiB/s\"",
+	)
+
+	rootCmd.Flags().StringVarP(
+		&maxBandwidthPerFile,
+		"max-bandwidth-per-file",
+		"",
+		"unlimited",
+		"Upload bandwidth allowed for each individual file, eg. \"2MiB/s\"",
+	)
+
+	rootCmd.Flags().StringVarP(
+		&bandwidthSchedule,
+		"bandwidth-schedule",
+		"",
+		"",
+		"Times of day with their own max bandwidth, eg. \"09:00-17:00=5MiB/s,17:00-09:00=unlimited\"",
+	)
+
+	rootCmd.Flags().StringVarP(
+		&compressionRules,
+		"compress",
+		"",
+		"",
+		"Compress files while uploading them, by glob pattern, eg. \"*.log=gzip,*.json=zstd\", or \"gzip\" for every file (algorithms: gzip, zstd, brotli)",
+	)
+
+	rootCmd.Flags().StringVarP(
+		&compressionMode,
+		"compression-mode",
+		"",
+		compress.ModeEncoding,
+		"How to mark compressed objects: encoding (set Content-Encoding, for serving) or suffix (append eg. \".gz\" to the key, for archiving)",
+	)
+
+	rootCmd.Flags().StringArrayVarP(
+		&encryptAgeRecipients,
+		"encrypt-age-recipient",
+		"",
+		nil,
+		"Encrypt files before uploading them, with a data key wrapped for this age recipient, eg. \"age1...\" (can be repeated)",
+	)
+
+	rootCmd.Flags().StringVarP(
+		&encryptKeyFile,
+		"encrypt-key-file",
+		"",
+		"",
+		"Encrypt files before uploading them, with a data key wrapped with the 32 byte hex key in this file",
+	)
+
+	rootCmd.Flags().StringVarP(
+		&batchFormat,
+		"batch",
+		"",
+		"",
+		"Bundle files into archives before uploading them, in this format: tar, tar.gz or zip",
+	)
+
+	rootCmd.Flags().BoolVarP(
+		&batchGroupByDir,
+		"batch-group-by-dir",
+		"",
+		false,
+		"Only bundle files from the same directory into an archive",
+	)
+
+	rootCmd.Flags().IntVarP(
+		&batchMaxFiles,
+		"batch-max-files",
+		"",
+		0,
+		"Most files to bundle into an archive, 0 for no limit",
+	)
+
+	rootCmd.Flags().StringVarP(
+		&batchMaxSize,
+		"batch-max-size",
+		"",
+		"0",
+		"Largest total size of the files bundled into an archive, eg. \"64MiB\", 0 for no limit",
+	)
+
+	rootCmd.Flags().DurationVarP(
+		&batchMaxWait,
+		"batch-max-wait",
+		"",
+		0,
+		"Longest time to wait for more files before uploading an archive, eg. \"30s\", 0 for no limit",
+	)
+
+	rootCmd.Flags().StringVarP(
+		&manifestFormat,
+		"manifest",
+		"",
+		"",
+		"Upload a manifest of the uploaded files at the end of the run, in this format: jsonl or csv",
+	)
+
+	rootCmd.Flags().StringVarP(
+		&manifestKeyTemplate,
+		"manifest-key-template",
+		"",
+		tpl.DefaultManifestKeyTemplate,
+		"The layout template for the keys of manifests, or @file to read it from a file; a _SUCCESS marker is uploaded next to each manifest whose files all succeeded",
+	)
+
+	rootCmd.Flags().DurationVarP(
+		&manifestInterval,
+		"manifest-interval",
+		"",
+		0,
+		"Upload a manifest of the files uploaded in each interval, eg. \"15m\", required when watching paths",
+	)
+
+	rootCmd.DisableFlagsInUseLine = true
+}
+
+func defaultMultipartJournalDir() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+
+	return filepath.Join(cacheDir, "funnel", "multipart")
+}
@@ -0,0 +1,340 @@
+// Package gcs is a storage backend that uploads files to a bucket in Google
+// Cloud Storage, for destinations such as `gs://bucket/prefix`
+package gcs
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/timrourke/funnel/backend"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/api/storage/v1"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// EmulatorHostEnvVar names the environment variable that points the backend
+// at an emulator instead of Google Cloud Storage, eg. `localhost:4443` for
+// fake-gcs-server, as it does for Google's own client libraries
+const EmulatorHostEnvVar = "STORAGE_EMULATOR_HOST"
+
+// Storage classes objects can be stored in
+var storageClasses = []string{"STANDARD", "NEARLINE", "COLDLINE", "ARCHIVE"}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func init() {
+	backend.Register("gs", openBackend)
+}
+
+// GCSClient is the part of the Google Cloud Storage JSON API used by the
+// backend
+type GCSClient interface {
+	// InsertObject uploads the media of an object in chunks of the given
+	// size, resuming after failed chunks, or in a single request when the
+	// chunk size is zero
+	InsertObject(ctx context.Context, object *storage.Object, media io.Reader, chunkSize int) (*storage.Object, error)
+	DeleteObject(ctx context.Context, bucket string, name string) error
+	GetBucket(ctx context.Context, bucket string) error
+}
+
+type gcsClient struct {
+	service *storage.Service
+}
+
+// NewGCSClient adapts the generated client of the Google Cloud Storage JSON
+// API to the backend
+func NewGCSClient(service *storage.Service) GCSClient {
+	return &gcsClient{
+		service: service,
+	}
+}
+
+func (g *gcsClient) InsertObject(ctx context.Context, object *storage.Object, media io.Reader, chunkSize int) (*storage.Object, error) {
+	return g.service.Objects.Insert(object.Bucket, object).
+		Media(media, googleapi.ChunkSize(chunkSize)).
+		Context(ctx).
+		Do()
+}
+
+func (g *gcsClient) DeleteObject(ctx context.Context, bucket string, name string) error {
+	return g.service.Objects.Delete(bucket, name).Context(ctx).Do()
+}
+
+func (g *gcsClient) GetBucket(ctx context.Context, bucket string) error {
+	_, err := g.service.Buckets.Get(bucket).Context(ctx).Do()
+
+	return err
+}
+
+type gcsBackend struct {
+	client             GCSClient
+	toBucket           string
+	prefix             string
+	storageClass       string
+	metadata           map[string]string
+	resumableThreshold int64
+	chunkSize          int
+	logger             *logrus.Logger
+	bodyWrappers       []backend.BodyWrapper
+}
+
+// NewBackend creates the backend for a bucket in Google Cloud Storage, whose
+// keys all begin with the given prefix. Files at or above the resumable
+// threshold, and objects of unknown size, are uploaded in chunks of the chunk
+// size. Every object is given the storage class, unless it is empty, and the
+// metadata.
+func NewBackend(
+	client GCSClient,
+	toBucket string,
+	prefix string,
+	storageClass string,
+	metadata map[string]string,
+	resumableThreshold int64,
+	chunkSize int,
+	logger *logrus.Logger,
+	bodyWrappers ...backend.BodyWrapper,
+) backend.Backend {
+	return &gcsBackend{
+		client:             client,
+		toBucket:           toBucket,
+		prefix:             prefix,
+		storageClass:       storageClass,
+		metadata:           metadata,
+		resumableThreshold: resumableThreshold,
+		chunkSize:          chunkSize,
+		logger:             logger,
+		bodyWrappers:       bodyWrappers,
+	}
+}
+
+// Open the backend for a destination such as `gs://bucket/prefix`. Credentials
+// are found the same way as by Google's client libraries, unless the
+// destination names a service account key file in its `credentials` query
+// parameter. Its `storageClass` and `metadata` query parameters set the storage
+// class and custom metadata of every object, eg.
+// `gs://bucket?storageClass=NEARLINE&metadata=team:sensors`.
+func openBackend(destination *url.URL, options backend.Options) (backend.Backend, error) {
+	toBucket := destination.Host
+	if "" == toBucket {
+		return nil, errors.New("must specify a Google Cloud Storage bucket to save files in, eg. gs://bucket/prefix")
+	}
+
+	if len(options.CompressionRules) > 0 {
+		return nil, errors.New("compressing files is not supported by gs destinations")
+	}
+
+	if nil != options.KeyWrapper {
+		return nil, errors.New("encrypting files is not supported by gs destinations")
+	}
+
+	query := destination.Query()
+
+	storageClass, err := ParseStorageClass(query.Get("storageClass"))
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, err := backend.ParsePairs("metadata", query["metadata"])
+	if err != nil {
+		return nil, err
+	}
+
+	var clientOptions []option.ClientOption
+	if emulatorHost := os.Getenv(EmulatorHostEnvVar); "" != emulatorHost {
+		if !strings.Contains(emulatorHost, "://") {
+			emulatorHost = "http://" + emulatorHost
+		}
+
+		clientOptions = append(
+			clientOptions,
+			option.WithEndpoint(strings.TrimSuffix(emulatorHost, "/")+"/storage/v1/"),
+			option.WithoutAuthentication(),
+		)
+	} else {
+		clientOptions = append(clientOptions, option.WithScopes(storage.DevstorageReadWriteScope))
+
+		if credentials := query.Get("credentials"); "" != credentials {
+			clientOptions = append(clientOptions, option.WithCredentialsFile(credentials))
+		}
+	}
+
+	service, err := storage.NewService(context.Background(), clientOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Google Cloud Storage client: %w", err)
+	}
+
+	return NewBackend(
+		NewGCSClient(service),
+		toBucket,
+		backend.Prefix(destination),
+		storageClass,
+		metadata,
+		options.MultipartThreshold,
+		int(options.MultipartPartSize),
+		options.Logger,
+		options.BodyWrappers...,
+	), nil
+}
+
+// ParseStorageClass validates the storage class of objects, which may be empty
+// to use the bucket's default storage class
+func ParseStorageClass(storageClass string) (string, error) {
+	if "" == storageClass {
+		return "", nil
+	}
+
+	for _, supported := range storageClasses {
+		if strings.EqualFold(supported, storageClass) {
+			return supported, nil
+		}
+	}
+
+	return "", fmt.Errorf(
+		"invalid storage class %s, must be one of: %s",
+		storageClass,
+		strings.Join(storageClasses, ", "),
+	)
+}
+
+// Upload a file to its key below the prefix. The file's CRC32C checksum is
+// taken before uploading it, so that Google Cloud Storage refuses the upload
+// when the contents it received differ.
+func (g *gcsBackend) Upload(path string, key string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	checksum := crc32.New(crc32cTable)
+	_, err = io.Copy(checksum, file)
+	if err != nil {
+		return fmt.Errorf("failed to checksum file: %s: %w", path, err)
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	chunkSize := 0
+	if info.Size() >= g.resumableThreshold {
+		chunkSize = g.chunkSize
+	}
+
+	object := g.newObject(key)
+	object.Crc32c = encodeCRC32C(checksum.Sum32())
+
+	return g.insertThenVerify(object, backend.WrapBody(path, file, g.bodyWrappers), chunkSize, checksum)
+}
+
+// PutObject streams an object to its key below the prefix. Its size is not
+// known ahead, so it is uploaded in resumable chunks, and its CRC32C checksum
+// is taken while streaming it.
+func (g *gcsBackend) PutObject(object *backend.Object) error {
+	toInsert := g.newObject(object.Key)
+	toInsert.ContentType = object.ContentType
+	toInsert.ContentEncoding = object.ContentEncoding
+
+	if len(object.Metadata) > 0 {
+		metadata := make(map[string]string)
+		for name, value := range g.metadata {
+			metadata[name] = value
+		}
+		for name, value := range object.Metadata {
+			metadata[name] = value
+		}
+		toInsert.Metadata = metadata
+	}
+
+	checksum := crc32.New(crc32cTable)
+	body := io.TeeReader(object.Body, checksum)
+
+	return g.insertThenVerify(toInsert, body, g.chunkSize, checksum)
+}
+
+func (g *gcsBackend) newObject(key string) *storage.Object {
+	return &storage.Object{
+		Bucket:       g.toBucket,
+		Name:         backend.JoinKey(g.prefix, key),
+		StorageClass: g.storageClass,
+		Metadata:     g.metadata,
+	}
+}
+
+// Upload an object, then compare the CRC32C checksum Google Cloud Storage took
+// of it with the one of the contents sent, deleting the object when they differ.
+// The checksum is read once the body was sent.
+func (g *gcsBackend) insertThenVerify(object *storage.Object, body io.Reader, chunkSize int, checksum hash.Hash32) error {
+	ctx := context.Background()
+
+	inserted, err := g.client.InsertObject(ctx, object, body, chunkSize)
+	if err != nil {
+		return fmt.Errorf("failed to upload object: gs://%s/%s: %w", object.Bucket, object.Name, err)
+	}
+
+	expected := encodeCRC32C(checksum.Sum32())
+	if nil != inserted && expected == inserted.Crc32c {
+		return nil
+	}
+
+	actual := ""
+	if nil != inserted {
+		actual = inserted.Crc32c
+	}
+
+	g.logger.WithFields(logrus.Fields{
+		"bucket":   object.Bucket,
+		"key":      object.Name,
+		"expected": expected,
+		"actual":   actual,
+	}).Error(fmt.Sprintf("CRC32C checksum mismatch for object %s, deleting it", object.Name))
+
+	err = g.client.DeleteObject(ctx, object.Bucket, object.Name)
+	if err != nil {
+		return fmt.Errorf(
+			"CRC32C checksum mismatch for object: %s, and failed to delete it: %w",
+			object.Name,
+			err,
+		)
+	}
+
+	return fmt.Errorf("CRC32C checksum mismatch for object: %s, expected %s but got %s", object.Name, expected, actual)
+}
+
+// CheckAccess verifies that the bucket is accessible
+func (g *gcsBackend) CheckAccess(ctx context.Context) error {
+	err := g.client.GetBucket(ctx, g.toBucket)
+	if err != nil {
+		return fmt.Errorf("failed to access Google Cloud Storage bucket %s: %w", g.toBucket, err)
+	}
+
+	return nil
+}
+
+func (g *gcsBackend) URL(key string) string {
+	return fmt.Sprintf("gs://%s/%s", g.toBucket, backend.JoinKey(g.prefix, key))
+}
+
+// Encode a CRC32C checksum as Google Cloud Storage does, as the base64 of its
+// big-endian bytes
+func encodeCRC32C(checksum uint32) string {
+	encoded := make([]byte, 4)
+	binary.BigEndian.PutUint32(encoded, checksum)
+
+	return base64.StdEncoding.EncodeToString(encoded)
+}
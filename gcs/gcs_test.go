@@ -0,0 +1,229 @@
+package gcs
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/timrourke/funnel/backend"
+	"github.com/timrourke/funnel/compress"
+	"google.golang.org/api/storage/v1"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingGCSClient reads the whole media of each object as the JSON API
+// would, answering with the checksum it took of it
+type recordingGCSClient struct {
+	objects       []*storage.Object
+	bodies        [][]byte
+	chunkSizes    []int
+	deleted       []string
+	bucketsGot    []string
+	corruptBodies bool
+	err           error
+}
+
+func (r *recordingGCSClient) InsertObject(ctx context.Context, object *storage.Object, media io.Reader, chunkSize int) (*storage.Object, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	body, err := ioutil.ReadAll(media)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.corruptBodies {
+		body = append(body, '!')
+	}
+
+	r.objects = append(r.objects, object)
+	r.bodies = append(r.bodies, body)
+	r.chunkSizes = append(r.chunkSizes, chunkSize)
+
+	inserted := *object
+	inserted.Crc32c = encodeCRC32C(crc32.Checksum(body, crc32cTable))
+
+	return &inserted, nil
+}
+
+func (r *recordingGCSClient) DeleteObject(ctx context.Context, bucket string, name string) error {
+	r.deleted = append(r.deleted, bucket+"/"+name)
+
+	return nil
+}
+
+func (r *recordingGCSClient) GetBucket(ctx context.Context, bucket string) error {
+	r.bucketsGot = append(r.bucketsGot, bucket)
+
+	return r.err
+}
+
+func TestGCSBackend(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	source, err := ioutil.TempFile("", "somefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(source.Name())
+
+	_, err = source.WriteString("some contents")
+	source.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata := map[string]string{"team": "sensors"}
+
+	Convey("Should upload files below the prefix with their checksum, storage class and metadata", t, func() {
+		client := &recordingGCSClient{}
+		gcsBackend := NewBackend(client, "some-bucket", "some/prefix", "NEARLINE", metadata, 1024, 256*1024, logger)
+
+		err := gcsBackend.Upload(source.Name(), "a.txt")
+
+		So(err, ShouldBeNil)
+		So(len(client.objects), ShouldEqual, 1)
+		So(client.objects[0].Bucket, ShouldEqual, "some-bucket")
+		So(client.objects[0].Name, ShouldEqual, "some/prefix/a.txt")
+		So(client.objects[0].StorageClass, ShouldEqual, "NEARLINE")
+		So(client.objects[0].Metadata, ShouldResemble, metadata)
+		So(client.objects[0].Crc32c, ShouldEqual, encodeCRC32C(crc32.Checksum([]byte("some contents"), crc32cTable)))
+		So(string(client.bodies[0]), ShouldEqual, "some contents")
+		So(gcsBackend.URL("a.txt"), ShouldEqual, "gs://some-bucket/some/prefix/a.txt")
+	})
+
+	Convey("Should upload files at or above the resumable threshold in chunks", t, func() {
+		client := &recordingGCSClient{}
+
+		So(NewBackend(client, "some-bucket", "", "", nil, 1024, 256*1024, logger).Upload(source.Name(), "a.txt"), ShouldBeNil)
+		So(NewBackend(client, "some-bucket", "", "", nil, 4, 256*1024, logger).Upload(source.Name(), "a.txt"), ShouldBeNil)
+
+		So(client.chunkSizes, ShouldResemble, []int{0, 256 * 1024})
+	})
+
+	Convey("Should stream objects with their content type and metadata", t, func() {
+		client := &recordingGCSClient{}
+		gcsBackend := NewBackend(client, "some-bucket", "some/prefix", "", metadata, 1024, 256*1024, logger)
+
+		err := gcsBackend.PutObject(&backend.Object{
+			Key:         "manifest.jsonl",
+			Body:        strings.NewReader("{}"),
+			ContentType: "application/x-ndjson",
+			Metadata:    map[string]string{"some-name": "some-value"},
+		})
+
+		So(err, ShouldBeNil)
+		So(client.objects[0].Name, ShouldEqual, "some/prefix/manifest.jsonl")
+		So(client.objects[0].ContentType, ShouldEqual, "application/x-ndjson")
+		So(client.objects[0].Metadata, ShouldResemble, map[string]string{"team": "sensors", "some-name": "some-value"})
+		So(client.chunkSizes, ShouldResemble, []int{256 * 1024})
+		So(string(client.bodies[0]), ShouldEqual, "{}")
+	})
+
+	Convey("Should delete objects whose checksum does not match", t, func() {
+		client := &recordingGCSClient{corruptBodies: true}
+		gcsBackend := NewBackend(client, "some-bucket", "some/prefix", "", nil, 1024, 256*1024, logger)
+
+		err := gcsBackend.PutObject(&backend.Object{Key: "manifest.jsonl", Body: strings.NewReader("{}")})
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "CRC32C checksum mismatch")
+		So(client.deleted, ShouldResemble, []string{"some-bucket/some/prefix/manifest.jsonl"})
+	})
+
+	Convey("Should check access to the bucket", t, func() {
+		client := &recordingGCSClient{}
+		gcsBackend := NewBackend(client, "some-bucket", "", "", nil, 1024, 256*1024, logger)
+
+		err := gcsBackend.CheckAccess(context.Background())
+
+		So(err, ShouldBeNil)
+		So(client.bucketsGot, ShouldResemble, []string{"some-bucket"})
+	})
+}
+
+func TestOpenBackend(t *testing.T) {
+	Convey("Should fail without a bucket", t, func() {
+		_, err := backend.Open("gs:///some/prefix", backend.Options{})
+
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should fail with an invalid storage class", t, func() {
+		_, err := backend.Open("gs://some-bucket?storageClass=FROZEN", backend.Options{})
+
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should refuse options the backend does not support", t, func() {
+		rules, err := compress.ParseRules("gzip")
+		So(err, ShouldBeNil)
+
+		_, err = backend.Open("gs://some-bucket", backend.Options{CompressionRules: rules})
+
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestParseStorageClass(t *testing.T) {
+	Convey("Should accept storage classes in any case", t, func() {
+		storageClass, err := ParseStorageClass("coldline")
+
+		So(err, ShouldBeNil)
+		So(storageClass, ShouldEqual, "COLDLINE")
+	})
+
+	Convey("Should leave the storage class to the bucket when empty", t, func() {
+		storageClass, err := ParseStorageClass("")
+
+		So(err, ShouldBeNil)
+		So(storageClass, ShouldEqual, "")
+	})
+}
+
+// TestEmulator uploads to fake-gcs-server, eg. started with
+// `docker run -p 4443:4443 fsouza/fake-gcs-server -scheme http` and a bucket
+// created in it, when STORAGE_EMULATOR_HOST=localhost:4443 and
+// GCS_EMULATOR_BUCKET name the emulator and bucket
+func TestEmulator(t *testing.T) {
+	if "" == os.Getenv(EmulatorHostEnvVar) || "" == os.Getenv("GCS_EMULATOR_BUCKET") {
+		t.Skip("set STORAGE_EMULATOR_HOST and GCS_EMULATOR_BUCKET to test against fake-gcs-server")
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	source, err := ioutil.TempFile("", "somefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(source.Name())
+
+	_, err = source.WriteString(strings.Repeat("some contents", 100000))
+	source.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := fmt.Sprintf("funnel-test-%d", time.Now().UnixNano())
+
+	Convey("Should upload files and objects to the emulator", t, func() {
+		gcsBackend, err := backend.Open(
+			fmt.Sprintf("gs://%s/%s?storageClass=NEARLINE&metadata=team:sensors", os.Getenv("GCS_EMULATOR_BUCKET"), prefix),
+			backend.Options{Logger: logger, MultipartThreshold: 1024, MultipartPartSize: 256 * 1024},
+		)
+		So(err, ShouldBeNil)
+
+		So(gcsBackend.CheckAccess(context.Background()), ShouldBeNil)
+		So(gcsBackend.Upload(source.Name(), "some/key.txt"), ShouldBeNil)
+		So(gcsBackend.PutObject(&backend.Object{Key: "_SUCCESS", Body: strings.NewReader("")}), ShouldBeNil)
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/timrourke/funnel/tpl"
+	"github.com/timrourke/funnel/upload"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var keyCmd = &cobra.Command{
+	Use:     "key [OPTIONS] PATHS",
+	Short:   "Show the key each file would be uploaded to, without uploading anything.",
+	Example: "funnel key -t '{{ modTimeWithFormat \"2006/01/02\" }}/{{ fileName }}' /some/directory",
+	Args:    cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return ExecuteKey(cmd, args)
+	},
+}
+
+// ExecuteKey prints the key each file in the given paths would be uploaded to
+func ExecuteKey(cmd *cobra.Command, args []string) error {
+	runContext, err := newRunContext()
+	if err != nil {
+		return err
+	}
+
+	keyTemplate, err := newKeyTemplate(runContext)
+	if err != nil {
+		return err
+	}
+
+	return previewKeys(keyTemplate, args, cmd.OutOrStdout())
+}
+
+// Write a line with the path and key of each file in the given paths, in the
+// order they would be uploaded in. Each file's root path is chosen the way the
+// uploader chooses it, so that the keys are the ones files would be uploaded to.
+// Every file is tried even when some fail, and the first failure is returned.
+func previewKeys(keyTemplate tpl.KeyTemplate, paths []string, out io.Writer) error {
+	var firstErr error
+
+	roots := upload.RootPaths(paths)
+
+	preview := func(filePath string) {
+		key, err := keyTemplate.KeyForFileInRoot(upload.RootForPath(roots, filePath), filePath)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"filename": filePath,
+				"error":    err.Error(),
+			}).Error("Failed to generate S3 object key")
+			if nil == firstErr {
+				firstErr = err
+			}
+			return
+		}
+
+		fmt.Fprintf(out, "%s\t%s\n", filePath, key)
+	}
+
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			preview(p)
+			continue
+		}
+
+		err = filepath.Walk(p, func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if !info.IsDir() {
+				preview(filePath)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return firstErr
+}
+
+func configureKeyCmd() {
+	keyCmd.DisableFlagsInUseLine = true
+
+	rootCmd.AddCommand(keyCmd)
+}
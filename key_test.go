@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/timrourke/funnel/tpl"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreviewKeys(t *testing.T) {
+	Convey("Should print the key of every file in the given paths", t, func() {
+		dirname, err := ioutil.TempDir("", "somedir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dirname)
+
+		err = os.Mkdir(filepath.Join(dirname, "nested"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, name := range []string{"a.txt", "nested/b.txt"} {
+			err = ioutil.WriteFile(filepath.Join(dirname, name), nil, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		keyTemplate, err := tpl.NewKeyTemplate("keys/{{ relativeToRoot }}", nil, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := &bytes.Buffer{}
+
+		err = previewKeys(
+			keyTemplate,
+			[]string{dirname, filepath.Join(dirname, "nested", "b.txt")},
+			out,
+		)
+
+		So(err, ShouldBeNil)
+		// Both files are relative to the most specific root they were found
+		// in, like when uploading them
+		So(out.String(), ShouldEqual, filepath.Join(dirname, "a.txt")+"\tkeys/a.txt\n"+
+			filepath.Join(dirname, "nested", "b.txt")+"\tkeys/b.txt\n"+
+			filepath.Join(dirname, "nested", "b.txt")+"\tkeys/b.txt\n")
+	})
+
+	Convey("Should fail for paths that do not exist", t, func() {
+		keyTemplate, err := tpl.NewKeyTemplate("{{ fileName }}", nil, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = previewKeys(keyTemplate, []string{"does-not-exist"}, &bytes.Buffer{})
+
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,154 @@
+// Package localfs is a storage backend that copies files into a directory on
+// the local filesystem, eg. a mounted backup volume or a staging directory on
+// an air-gapped machine, for destinations such as `file:///mnt/backup`
+package localfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/timrourke/funnel/backend"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	backend.Register("file", openBackend)
+}
+
+type localBackend struct {
+	root         string
+	bodyWrappers []backend.BodyWrapper
+	logger       *logrus.Logger
+}
+
+// NewBackend creates a backend that stores each key as a file below the root
+// directory. Body wrappers are applied to each file's contents in order.
+func NewBackend(root string, logger *logrus.Logger, bodyWrappers ...backend.BodyWrapper) backend.Backend {
+	return &localBackend{
+		root:         root,
+		bodyWrappers: bodyWrappers,
+		logger:       logger,
+	}
+}
+
+// Open the backend for a destination such as `file:///mnt/backup`
+func openBackend(destination *url.URL, options backend.Options) (backend.Backend, error) {
+	if "" != destination.Host && "localhost" != destination.Host {
+		return nil, fmt.Errorf("file destinations must be on this host, eg. file:///mnt/backup, not on %s", destination.Host)
+	}
+
+	if "" == destination.Path {
+		return nil, errors.New("must specify a directory to save files in, eg. file:///mnt/backup")
+	}
+
+	if len(options.CompressionRules) > 0 {
+		return nil, errors.New("compressing files is not supported by file destinations")
+	}
+
+	if nil != options.KeyWrapper {
+		return nil, errors.New("encrypting files is not supported by file destinations")
+	}
+
+	return NewBackend(filepath.FromSlash(destination.Path), options.Logger, options.BodyWrappers...), nil
+}
+
+// Upload copies a file to the path of its key below the root directory
+func (l *localBackend) Upload(path string, key string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return l.write(key, backend.WrapBody(path, file, l.bodyWrappers))
+}
+
+// PutObject writes an object to the path of its key below the root directory.
+// Its content type, encoding and metadata are not kept.
+func (l *localBackend) PutObject(object *backend.Object) error {
+	return l.write(object.Key, object.Body)
+}
+
+// Write to a temporary file next to the key's path first, which is renamed to
+// it once complete, so that a partially written file never appears at the
+// key's path
+func (l *localBackend) write(key string, body io.Reader) error {
+	target, err := l.pathForKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create directory for key: %s: %w", key, err)
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(target), "."+filepath.Base(target)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create file for key: %s: %w", key, err)
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = io.Copy(temp, body)
+	if err == nil {
+		err = temp.Sync()
+	}
+
+	closeErr := temp.Close()
+	if nil == err {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write file for key: %s: %w", key, err)
+	}
+
+	err = os.Rename(temp.Name(), target)
+	if err != nil {
+		return fmt.Errorf("failed to write file for key: %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// Find the path of a key below the root directory, refusing keys that would
+// escape it, eg. `../etc/passwd`
+func (l *localBackend) pathForKey(key string) (string, error) {
+	target := filepath.Join(l.root, filepath.FromSlash(key))
+
+	relativePath, err := filepath.Rel(l.root, target)
+	if err != nil || "." == relativePath || ".." == relativePath || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("key is not a file below the destination directory: %s", key)
+	}
+
+	return target, nil
+}
+
+// CheckAccess verifies that the root directory exists and is writable
+func (l *localBackend) CheckAccess(ctx context.Context) error {
+	info, err := os.Stat(l.root)
+	if err != nil {
+		return fmt.Errorf("failed to access directory %s: %w", l.root, err)
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("failed to access directory %s: not a directory", l.root)
+	}
+
+	probe, err := ioutil.TempFile(l.root, ".funnel-access-*")
+	if err != nil {
+		return fmt.Errorf("failed to write to directory %s: %w", l.root, err)
+	}
+	probe.Close()
+
+	return os.Remove(probe.Name())
+}
+
+func (l *localBackend) URL(key string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(filepath.Join(l.root, filepath.FromSlash(key)))}).String()
+}
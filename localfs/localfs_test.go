@@ -0,0 +1,118 @@
+package localfs
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/timrourke/funnel/backend"
+	"github.com/timrourke/funnel/compress"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalBackend(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	source, err := ioutil.TempFile("", "somefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(source.Name())
+
+	_, err = source.WriteString("some contents")
+	source.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Should copy a file to the path of its key, creating its directories", t, func() {
+		root, err := ioutil.TempDir("", "backup")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(root)
+
+		var wrapped []string
+		local := NewBackend(root, logger, func(path string, body io.Reader) io.Reader {
+			wrapped = append(wrapped, path)
+			return body
+		})
+
+		err = local.Upload(source.Name(), "some/nested/key.txt")
+
+		So(err, ShouldBeNil)
+		So(wrapped, ShouldResemble, []string{source.Name()})
+
+		contents, err := ioutil.ReadFile(filepath.Join(root, "some", "nested", "key.txt"))
+		So(err, ShouldBeNil)
+		So(string(contents), ShouldEqual, "some contents")
+
+		entries, err := ioutil.ReadDir(filepath.Join(root, "some", "nested"))
+		So(err, ShouldBeNil)
+		So(len(entries), ShouldEqual, 1)
+	})
+
+	Convey("Should write an object to the path of its key", t, func() {
+		root, err := ioutil.TempDir("", "backup")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(root)
+
+		local := NewBackend(root, logger)
+
+		err = local.PutObject(&backend.Object{Key: "_SUCCESS", Body: strings.NewReader("")})
+
+		So(err, ShouldBeNil)
+		_, err = os.Stat(filepath.Join(root, "_SUCCESS"))
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Should refuse keys that escape the destination directory", t, func() {
+		root, err := ioutil.TempDir("", "backup")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(root)
+
+		local := NewBackend(filepath.Join(root, "inner"), logger)
+
+		err = local.Upload(source.Name(), "../escaped.txt")
+
+		So(err, ShouldNotBeNil)
+		_, err = os.Stat(filepath.Join(root, "escaped.txt"))
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+
+	Convey("Should check that the destination directory is writable", t, func() {
+		root, err := ioutil.TempDir("", "backup")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(root)
+
+		So(NewBackend(root, logger).CheckAccess(context.Background()), ShouldBeNil)
+		So(NewBackend(filepath.Join(root, "missing"), logger).CheckAccess(context.Background()), ShouldNotBeNil)
+	})
+}
+
+func TestOpenBackend(t *testing.T) {
+	Convey("Should open file destinations", t, func() {
+		local, err := backend.Open("file:///mnt/backup", backend.Options{})
+
+		So(err, ShouldBeNil)
+		So(local.URL("some/key.txt"), ShouldEqual, "file:///mnt/backup/some/key.txt")
+	})
+
+	Convey("Should refuse file destinations on other hosts", t, func() {
+		_, err := backend.Open("file://some-host/mnt/backup", backend.Options{})
+
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should refuse options the backend does not support", t, func() {
+		rules, err := compress.ParseRules("gzip")
+		So(err, ShouldBeNil)
+
+		_, err = backend.Open("file:///mnt/backup", backend.Options{CompressionRules: rules})
+
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -2,20 +2,63 @@ package main
 
 import (
 	"errors"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
+	"fmt"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"github.com/timrourke/funnel/s3"
+	_ "github.com/timrourke/funnel/azure"
+	"github.com/timrourke/funnel/backend"
+	"github.com/timrourke/funnel/bytesize"
+	"github.com/timrourke/funnel/compress"
+	"github.com/timrourke/funnel/control"
+	"github.com/timrourke/funnel/encrypt"
+	_ "github.com/timrourke/funnel/gcs"
+	_ "github.com/timrourke/funnel/localfs"
+	"github.com/timrourke/funnel/manifest"
+	"github.com/timrourke/funnel/progress"
+	_ "github.com/timrourke/funnel/sftp"
+	"github.com/timrourke/funnel/throttle"
 	"github.com/timrourke/funnel/tpl"
 	"github.com/timrourke/funnel/upload"
 	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"net"
+	"net/http"
 	"os"
 	"strings"
+	"time"
 )
 
 func validateCommandLineFlags() error {
+	// Without any destination URLs, files are saved in the AWS S3 bucket given
+	// with its own flag, in the region given with its own flag
+	if 0 == len(nonBlank(destinations)) && 0 == len(nonBlank(optionalDestinations)) {
+		err := validateBucketFlags()
+		if err != nil {
+			return err
+		}
+	}
+
+	if numConcurrentUploads <= 0 || numConcurrentUploads > 100 {
+		return errors.New("number of concurrent uploads must be within the range 1-100")
+	}
+
+	// Encrypted and compressed files are streamed through the S3 upload
+	// manager, which cannot resume them
+	if hasS3Destination() {
+		if len(encryptAgeRecipients) > 0 || "" != encryptKeyFile {
+			logger.Warn("Encrypted files are not uploaded to S3 in resumable multipart uploads, whatever their size")
+		} else if "" != strings.TrimSpace(compressionRules) {
+			logger.Warn("Compressed files are not uploaded to S3 in resumable multipart uploads, whatever their size")
+		}
+	}
+
+	return nil
+}
+
+func validateBucketFlags() error {
 	if "" == strings.TrimSpace(region) {
 		return errors.New("must provide an AWS region where your S3 bucket exists")
 	}
@@ -24,33 +67,259 @@ func validateCommandLineFlags() error {
 		return errors.New("must specify an AWS S3 bucket to save files in")
 	}
 
-	if numConcurrentUploads <= 0 || numConcurrentUploads > 100 {
-		return errors.New("number of concurrent uploads must be within the range 1-100")
+	return nil
+}
+
+func parseMultipartFlags() (int64, int64, error) {
+	threshold, err := bytesize.Parse(multipartThreshold)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid multipart threshold: %w", err)
 	}
 
-	return nil
+	partSize, err := bytesize.Parse(multipartPartSize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid multipart part size: %w", err)
+	}
+
+	if partSize < s3manager.MinUploadPartSize {
+		return 0, 0, fmt.Errorf(
+			"multipart part size must be at least %s",
+			bytesize.Format(s3manager.MinUploadPartSize),
+		)
+	}
+
+	return threshold, partSize, nil
+}
+
+// Create the context of this run, with the variables and environment variables
+// the user made available to its templates
+func newRunContext() (*tpl.RunContext, error) {
+	vars, err := tpl.ParseVars(templateVars)
+	if err != nil {
+		return nil, err
+	}
+
+	return tpl.NewRunContext(vars, allowedTemplateEnv)
+}
+
+// Create the key template for this run. Every key it generates is normalized
+// into one that is safe to use in S3.
+func newKeyTemplate(runContext *tpl.RunContext) (tpl.KeyTemplate, error) {
+	unsafeCharacterPolicy, err := tpl.ParseUnsafeCharacterPolicy(keyUnsafeCharacters)
+	if err != nil {
+		return nil, err
+	}
+
+	templateText, err := tpl.ReadTemplateText(s3ObjectKeyTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	warnings, err := tpl.LintTemplate(templateText)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, warning := range warnings {
+		logger.WithFields(logrus.Fields{
+			"template": templateText,
+		}).Warn(warning)
+	}
+
+	keyTemplate, err := tpl.NewKeyTemplate(templateText, runContext, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return tpl.NewNormalizingKeyTemplate(keyTemplate, unsafeCharacterPolicy), nil
 }
 
 var (
+	bandwidthSchedule           string
+	allowedTemplateEnv          []string
+	batchFormat                 string
+	batchGroupByDir             bool
+	batchMaxFiles               int
+	batchMaxSize                string
+	batchMaxWait                time.Duration
 	bucket                      string
+	collisionPolicy             string
+	destinationQuorum           int
+	destinations                []string
+	compressionMode             string
+	compressionRules            string
+	controlAddr                 string
+	encryptAgeRecipients        []string
+	encryptKeyFile              string
+	fanOutMode                  string
+	keyUnsafeCharacters         string
 	logger                      = logrus.New()
+	manifestFormat              string
+	manifestInterval            time.Duration
+	manifestKeyTemplate         string
+	maxBandwidth                string
+	maxBandwidthPerFile         string
+	metricsAddr                 string
+	multipartJournalDir         string
+	multipartPartSize           string
+	multipartThreshold          string
 	numConcurrentUploads        int
+	optionalDestinations        []string
+	progressInterval            time.Duration
 	s3ObjectKeyTemplate         string
 	shouldDeleteFileAfterUpload bool
+	shouldDryRun                bool
+	shouldServeControlAPI       bool
+	shouldShowProgress          bool
 	shouldWatchPaths            bool
 	region                      string
+	templateVars                []string
 
 	rootCmd = &cobra.Command{
 		Use:     "funnel [OPTIONS] [PATHS]",
 		Short:   "Funnel is a tool for quickly saving files to AWS S3.",
 		Example: "funnel --region=us-east-1 --bucket=some-cool-bucket /some/directory",
 		Version: "0.0.1",
+		// Paths are arguments too, which cobra would otherwise mistake for
+		// unknown subcommands now that the root command has subcommands
+		Args: cobra.ArbitraryArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			return Execute(cmd, args)
 		},
 	}
 )
 
+// Build the body wrappers that throttle reading files for upload. The global
+// limiter is shared by every upload worker, while each file gets a limiter of
+// its own for the per-file cap.
+func bandwidthBodyWrappers() ([]backend.BodyWrapper, error) {
+	var bodyWrappers []backend.BodyWrapper
+
+	globalRate, err := throttle.ParseRate(maxBandwidth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid max bandwidth: %w", err)
+	}
+
+	schedule, err := throttle.ParseSchedule(globalRate, bandwidthSchedule)
+	if err != nil {
+		return nil, err
+	}
+
+	if globalRate > 0 || "" != strings.TrimSpace(bandwidthSchedule) {
+		globalLimiter := throttle.NewLimiter(schedule)
+		bodyWrappers = append(bodyWrappers, func(path string, body io.Reader) io.Reader {
+			return globalLimiter.Reader(body)
+		})
+	}
+
+	perFileRate, err := throttle.ParseRate(maxBandwidthPerFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid max bandwidth per file: %w", err)
+	}
+
+	if perFileRate > 0 {
+		bodyWrappers = append(bodyWrappers, func(path string, body io.Reader) io.Reader {
+			return throttle.NewLimiter(throttle.NewSchedule(perFileRate)).Reader(body)
+		})
+	}
+
+	return bodyWrappers, nil
+}
+
+// Create the writer of manifests describing the files uploaded in this run, or
+// nil when no manifests are written. Manifests are uploaded like files are, so
+// they are encrypted too when files are.
+func newManifestWriter(runContext *tpl.RunContext, objectPutter backend.ObjectPutter) (*manifest.Writer, error) {
+	if "" == manifestFormat {
+		return nil, nil
+	}
+
+	format, err := manifest.ParseFormat(manifestFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	if shouldWatchPaths && manifestInterval <= 0 {
+		return nil, errors.New("must set a manifest interval when watching paths")
+	}
+
+	if shouldDryRun {
+		logger.Warn("Dry run, not writing manifests")
+		return nil, nil
+	}
+
+	templateText, err := tpl.ReadTemplateText(manifestKeyTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	keyTemplate, err := tpl.NewManifestKeyTemplate(templateText, runContext, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest.NewWriter(format, keyTemplate, objectPutter, manifestInterval, logger), nil
+}
+
+// Build the policy for bundling files into archives. Batching is off when no
+// archive format is given.
+func newBatchPolicy() (upload.BatchPolicy, error) {
+	if "" == batchFormat {
+		return upload.BatchPolicy{}, nil
+	}
+
+	format, err := upload.ParseArchiveFormat(batchFormat)
+	if err != nil {
+		return upload.BatchPolicy{}, err
+	}
+
+	maxBytes, err := bytesize.Parse(batchMaxSize)
+	if err != nil {
+		return upload.BatchPolicy{}, fmt.Errorf("invalid batch max size: %w", err)
+	}
+
+	if batchMaxFiles < 0 || batchMaxWait < 0 {
+		return upload.BatchPolicy{}, errors.New("batch limits must not be negative")
+	}
+
+	// While watching, files keep coming, so a batch must be closed by a limit
+	// rather than by running out of files
+	if shouldWatchPaths && 0 == batchMaxFiles && 0 == maxBytes && 0 == batchMaxWait {
+		return upload.BatchPolicy{}, errors.New("must limit batches by files, size or wait time when watching paths")
+	}
+
+	return upload.BatchPolicy{
+		Format:     format,
+		GroupByDir: batchGroupByDir,
+		MaxFiles:   batchMaxFiles,
+		MaxBytes:   maxBytes,
+		MaxWait:    batchMaxWait,
+	}, nil
+}
+
+// Create the key wrapper for encrypting files before they are uploaded, or nil
+// when files are uploaded as they are
+func newKeyWrapper() (encrypt.KeyWrapper, error) {
+	if len(encryptAgeRecipients) > 0 && "" != encryptKeyFile {
+		return nil, errors.New("must encrypt either to age recipients or with a key file, not both")
+	}
+
+	if len(encryptAgeRecipients) > 0 {
+		return encrypt.NewAgeKeyWrapper(encryptAgeRecipients)
+	}
+
+	if "" != encryptKeyFile {
+		key, err := encrypt.LoadKeyFile(encryptKeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return encrypt.NewKeyFileWrapper(key), nil
+	}
+
+	return nil, nil
+}
+
 // Execute configures the application and executes the root cobra command
 func Execute(cmd *cobra.Command, args []string) error {
 	err := validateCommandLineFlags()
@@ -58,97 +327,256 @@ func Execute(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	config := aws.NewConfig().
-		WithRegion(region).
-		WithMaxRetries(3)
+	keyWrapper, err := newKeyWrapper()
+	if err != nil {
+		return err
+	}
+
+	threshold, partSize, err := parseMultipartFlags()
+	if err != nil {
+		return err
+	}
+
+	bodyWrappers, err := bandwidthBodyWrappers()
+	if err != nil {
+		return err
+	}
+
+	rules, err := compress.ParseRules(compressionRules)
+	if err != nil {
+		return err
+	}
+
+	mode, err := compress.ParseMode(compressionMode)
+	if err != nil {
+		return err
+	}
+
+	var observers []upload.Observer
+	var compressionObservers []backend.CompressionObserver
+	var destinationObservers []backend.DestinationObserver
+	var archiveBodyWrappers = bodyWrappers
+	var destinationBodyWrapper func(destination string) backend.BodyWrapper
+	if shouldShowProgress {
+		reporter := newProgressReporter()
+		// Archives are built once, above the destinations, while each
+		// destination reads every file it uploads on its own
+		archiveBodyWrappers = append(archiveBodyWrappers, reporter.Track)
+		destinationBodyWrapper = func(destination string) backend.BodyWrapper {
+			return reporter.TrackDestination(destination)
+		}
+		observers = append(observers, reporter)
+
+		reporter.Start()
+		defer reporter.Stop()
+	}
+
+	if "" != strings.TrimSpace(metricsAddr) {
+		metrics, err := upload.NewMetrics(prometheus.DefaultRegisterer)
+		if err != nil {
+			return err
+		}
+		observers = append(observers, metrics)
+		compressionObservers = append(compressionObservers, metrics)
+		destinationObservers = append(destinationObservers, metrics)
+
+		err = serveMetrics(metricsAddr)
+		if err != nil {
+			return err
+		}
+	}
+
+	// A dry run goes through the whole upload pipeline, including detecting
+	// key collisions, but leaves both the destinations and the local files
+	// alone
+	destinationBackend, err := newDestinationBackend(backend.Options{
+		Logger:               logger,
+		BodyWrappers:         bodyWrappers,
+		Region:               region,
+		MultipartThreshold:   threshold,
+		MultipartPartSize:    partSize,
+		JournalDir:           multipartJournalDir,
+		CompressionRules:     rules,
+		CompressionMode:      mode,
+		CompressionObservers: compressionObservers,
+		KeyWrapper:           keyWrapper,
+	}, destinationBodyWrapper, destinationObservers)
+	if err != nil {
+		return err
+	}
+
+	// Destinations that failed while a file was stored in enough of them are
+	// retried in the background, which must finish before exiting
+	defer backend.Wait(destinationBackend)
+
+	runContext, err := newRunContext()
+	if err != nil {
+		return err
+	}
+
+	keyTemplate, err := newKeyTemplate(runContext)
+	if err != nil {
+		return err
+	}
+
+	manifestWriter, err := newManifestWriter(runContext, destinationBackend)
+	if err != nil {
+		return err
+	}
 
-	sess := session.Must(session.NewSession(config))
+	if nil != manifestWriter {
+		observers = append(observers, manifestWriter)
+	}
+
+	onKeyCollision, err := upload.ParseCollisionPolicy(collisionPolicy)
+	if err != nil {
+		return err
+	}
 
-	s3UploadManager := s3manager.NewUploader(sess)
+	batchPolicy, err := newBatchPolicy()
+	if err != nil {
+		return err
+	}
 
-	s3Uploader := s3.NewS3Uploader(s3UploadManager, bucket, logger)
+	var uploader upload.Uploader
+	if "" != batchPolicy.Format {
+		uploader = upload.NewBatchingUploader(
+			shouldDeleteFileAfterUpload && !shouldDryRun,
+			shouldWatchPaths,
+			numConcurrentUploads,
+			upload.NewArchiveUploader(destinationBackend, logger, archiveBodyWrappers...),
+			batchPolicy,
+			keyTemplate,
+			onKeyCollision,
+			logger,
+			observers...,
+		)
+	} else {
+		uploader = upload.NewUploader(
+			shouldDeleteFileAfterUpload && !shouldDryRun,
+			shouldWatchPaths,
+			numConcurrentUploads,
+			destinationBackend,
+			keyTemplate,
+			onKeyCollision,
+			logger,
+			observers...,
+		)
+	}
 
-	keyTemplate, err := tpl.NewKeyTemplate(s3ObjectKeyTemplate, logger)
+	if shouldServeControlAPI {
+		err = serveControlAPI(controlAddr, uploader, destinationBackend.CheckAccess)
+		if err != nil {
+			return err
+		}
+	}
+
+	if nil == manifestWriter {
+		return uploader.UploadFilesFromPathToBucket(args)
+	}
+
+	manifestWriter.Start()
+	err = uploader.UploadFilesFromPathToBucket(args)
+	manifestWriter.Stop()
 	if err != nil {
 		return err
 	}
 
-	uploader := upload.NewUploader(
-		shouldDeleteFileAfterUpload,
-		shouldWatchPaths,
-		numConcurrentUploads,
-		s3Uploader,
-		keyTemplate,
-		logger,
-	)
+	return manifestWriter.Flush()
+}
+
+// Serve Prometheus metrics over HTTP in the background. Listening happens up
+// front so that a bad address fails the command immediately.
+func serveMetrics(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for metrics requests on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		err := http.Serve(listener, mux)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"addr":  addr,
+				"error": err.Error(),
+			}).Error("Metrics server stopped")
+		}
+	}()
+
+	logger.WithFields(logrus.Fields{
+		"addr": listener.Addr().String(),
+	}).Info("Serving Prometheus metrics at /metrics")
+
+	return nil
+}
+
+// Serve health probes and the control API in the background
+func serveControlAPI(addr string, controller upload.Controller, isReady control.ReadinessCheck) error {
+	listener, err := control.Listen(addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for control API requests on %s: %w", addr, err)
+	}
+
+	handler := control.NewHandler(controller, isReady, logger)
+
+	go func() {
+		err := http.Serve(listener, handler)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"addr":  addr,
+				"error": err.Error(),
+			}).Error("Control API server stopped")
+		}
+	}()
+
+	logger.WithFields(logrus.Fields{
+		"addr": listener.Addr().String(),
+	}).Info("Serving health probes and control API")
 
-	return uploader.UploadFilesFromPathToBucket(args)
+	return nil
 }
 
-func configureLogger() {
-	if !terminal.IsTerminal(int(os.Stdout.Fd())) {
-		logger.SetFormatter(&logrus.JSONFormatter{})
+// Create a progress reporter that draws a live view on a terminal, and logs
+// progress events less frequently otherwise
+func newProgressReporter() *progress.Reporter {
+	isTerminal := stdoutIsTerminal()
+
+	interval := progressInterval
+	if interval <= 0 && isTerminal {
+		interval = time.Second
+	}
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	reporter := progress.NewReporter(os.Stdout, isTerminal, interval, logger)
+	if isTerminal {
+		logger.SetOutput(reporter.LogWriter(logger.Out))
 	}
+
+	return reporter
 }
 
-func configureRootCmd() {
-	rootCmd.PersistentFlags().StringVarP(
-		&region,
-		"region",
-		"r",
-		"",
-		"The AWS region your S3 bucket is in, eg. \"us-east-1\"",
-	)
-	if "" == strings.TrimSpace(region) {
-		region = os.Getenv("AWS_DEFAULT_REGION")
-	}
-
-	rootCmd.PersistentFlags().StringVarP(
-		&bucket,
-		"bucket",
-		"b",
-		"",
-		"The AWS S3 bucket you want to save files to",
-	)
-
-	rootCmd.PersistentFlags().BoolVarP(
-		&shouldWatchPaths,
-		"watch",
-		"w",
-		false,
-		"Whether to watch a path for changes",
-	)
-
-	rootCmd.PersistentFlags().IntVarP(
-		&numConcurrentUploads,
-		"num-concurrent-uploads",
-		"n",
-		10,
-		"Number of concurrent uploads",
-	)
-
-	rootCmd.PersistentFlags().BoolVarP(
-		&shouldDeleteFileAfterUpload,
-		"delete-file-after-upload",
-		"",
-		false,
-		"Whether to delete the uploaded file after a successful upload",
-	)
-
-	rootCmd.PersistentFlags().StringVarP(
-		&s3ObjectKeyTemplate,
-		"s3-object-key-template",
-		"t",
-		"{{ filePath }}",
-		"The layout template to use for defining the key of an uploaded file",
-	)
-
-	rootCmd.DisableFlagsInUseLine = true
+func stdoutIsTerminal() bool {
+	return terminal.IsTerminal(int(os.Stdout.Fd()))
+}
+
+func configureLogger() {
+	if !stdoutIsTerminal() {
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	}
 }
 
 func init() {
 	configureLogger()
 	configureRootCmd()
+	configureCleanupMultipartCmd()
+	configureDecryptCmd()
+	configureRestoreCmd()
+	configureKeyCmd()
 }
 
 func main() {
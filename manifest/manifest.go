@@ -0,0 +1,344 @@
+// Package manifest uploads objects describing the files uploaded in a run, so
+// that consumers downstream know when a batch of files is complete and what it
+// contained
+package manifest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/timrourke/funnel/backend"
+	"github.com/timrourke/funnel/tpl"
+	"github.com/timrourke/funnel/upload"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Formats of manifests
+const (
+	FormatJSONL = "jsonl"
+	FormatCSV   = "csv"
+)
+
+// SuccessMarker is the name of the empty object uploaded next to a manifest
+// when every file it covers was uploaded
+const SuccessMarker = "_SUCCESS"
+
+// ParseFormat validates the format of manifests
+func ParseFormat(format string) (string, error) {
+	switch format {
+	case FormatJSONL, FormatCSV:
+		return format, nil
+	default:
+		return "", fmt.Errorf("invalid manifest format %s, must be one of: %s, %s", format, FormatJSONL, FormatCSV)
+	}
+}
+
+// Entry describes a single uploaded file
+type Entry struct {
+	Key        string    `json:"key"`
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	SHA256     string    `json:"sha256"`
+	ModTime    time.Time `json:"modTime"`
+	StartedAt  time.Time `json:"startedAt"`
+	UploadedAt time.Time `json:"uploadedAt"`
+}
+
+var csvHeader = []string{"key", "path", "size", "sha256", "modTime", "startedAt", "uploadedAt"}
+
+// fileChecksum is what is known of a file's contents as its upload starts
+type fileChecksum struct {
+	sha256  string
+	modTime time.Time
+}
+
+// Writer observes the upload pipeline and collects an entry for every uploaded
+// file, which are written as a manifest whenever it is flushed. Each manifest
+// covers the files that finished since the previous one.
+type Writer struct {
+	mux          sync.Mutex
+	format       string
+	keyTemplate  tpl.ManifestKeyTemplate
+	objectPutter backend.ObjectPutter
+	interval     time.Duration
+	logger       *logrus.Logger
+	checksums    map[uint64]fileChecksum
+	entries      []Entry
+	numFailed    int
+	numManifests int
+	stop         chan struct{}
+	stopped      chan struct{}
+}
+
+// NewWriter creates a manifest writer. When the interval is positive, a
+// manifest is written every interval between `Start` and `Stop`, eg. while
+// watching paths.
+func NewWriter(
+	format string,
+	keyTemplate tpl.ManifestKeyTemplate,
+	objectPutter backend.ObjectPutter,
+	interval time.Duration,
+	logger *logrus.Logger,
+) *Writer {
+	return &Writer{
+		format:       format,
+		keyTemplate:  keyTemplate,
+		objectPutter: objectPutter,
+		interval:     interval,
+		logger:       logger,
+		checksums:    make(map[uint64]fileChecksum),
+	}
+}
+
+// Observe collects the entries of uploaded files. The checksum of a file is
+// taken as its upload starts, while it is sure to still exist, which reads the
+// file once more on the upload worker's goroutine.
+func (w *Writer) Observe(event upload.Event) {
+	switch event.Type {
+	case upload.FileUploadStarted:
+		if "" == event.Key || w.hasChecksum(event.JobID) {
+			return
+		}
+
+		checksum, err := checksumFile(event.Path)
+		if err != nil {
+			w.logger.WithFields(logrus.Fields{
+				"filename": event.Path,
+				"error":    err.Error(),
+			}).Warn(fmt.Sprintf("Failed to checksum file for manifest: %s", event.Path))
+		}
+
+		w.mux.Lock()
+		w.checksums[event.JobID] = checksum
+		w.mux.Unlock()
+	case upload.FileUploaded:
+		w.mux.Lock()
+		checksum := w.checksums[event.JobID]
+		delete(w.checksums, event.JobID)
+		w.entries = append(w.entries, Entry{
+			Key:        event.Key,
+			Path:       event.Path,
+			Size:       event.Size,
+			SHA256:     checksum.sha256,
+			ModTime:    checksum.modTime,
+			StartedAt:  event.StartedAt,
+			UploadedAt: event.At,
+		})
+		w.mux.Unlock()
+	case upload.FileUploadFailed:
+		w.mux.Lock()
+		delete(w.checksums, event.JobID)
+		w.numFailed++
+		w.mux.Unlock()
+	case upload.FileKeyFailed:
+		w.mux.Lock()
+		w.numFailed++
+		w.mux.Unlock()
+	}
+}
+
+func (w *Writer) hasChecksum(jobID uint64) bool {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	_, ok := w.checksums[jobID]
+	return ok
+}
+
+// Start writing a manifest every interval until `Stop` is called. Without an
+// interval, manifests are only written when flushed.
+func (w *Writer) Start() {
+	if w.interval <= 0 {
+		return
+	}
+
+	w.stop = make(chan struct{})
+	w.stopped = make(chan struct{})
+
+	go func() {
+		defer close(w.stopped)
+
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if w.isEmpty() {
+					continue
+				}
+
+				err := w.Flush()
+				if err != nil {
+					w.logger.WithFields(logrus.Fields{
+						"error": err.Error(),
+					}).Error("Failed to write manifest")
+				}
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop writing a manifest every interval
+func (w *Writer) Stop() {
+	if nil == w.stop {
+		return
+	}
+
+	close(w.stop)
+	<-w.stopped
+}
+
+func (w *Writer) isEmpty() bool {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	return 0 == len(w.entries) && 0 == w.numFailed
+}
+
+// Flush writes a manifest of the files that finished since the previous one,
+// followed by a `_SUCCESS` marker in the same directory when none of them
+// failed. Files still being uploaded go into the next manifest.
+func (w *Writer) Flush() error {
+	w.mux.Lock()
+	entries := w.entries
+	numFailed := w.numFailed
+	w.entries = nil
+	w.numFailed = 0
+	w.numManifests++
+	number := w.numManifests
+	w.mux.Unlock()
+
+	key, err := w.keyTemplate.KeyForManifest(number, w.format)
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	contentType, err := w.encode(&body, entries)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %s: %w", key, err)
+	}
+
+	// Manifests are not retried, so a backend need not remember them
+	err = w.objectPutter.PutObject(&backend.Object{
+		Key:         key,
+		Body:        &body,
+		ContentType: contentType,
+	})
+	backend.Forget(w.objectPutter, key)
+	if err != nil {
+		return fmt.Errorf("failed to upload manifest: %s: %w", key, err)
+	}
+
+	w.logger.WithFields(logrus.Fields{
+		"key":    key,
+		"files":  len(entries),
+		"failed": numFailed,
+	}).Info(fmt.Sprintf("Uploaded manifest %s of %d files", key, len(entries)))
+
+	if numFailed > 0 {
+		w.logger.WithFields(logrus.Fields{
+			"key":    key,
+			"failed": numFailed,
+		}).Warn(fmt.Sprintf("Not marking manifest %s as successful, %d files failed to upload", key, numFailed))
+		return nil
+	}
+
+	markerKey := path.Join(path.Dir(key), SuccessMarker)
+	err = w.objectPutter.PutObject(&backend.Object{
+		Key:  markerKey,
+		Body: &bytes.Buffer{},
+	})
+	backend.Forget(w.objectPutter, markerKey)
+	if err != nil {
+		return fmt.Errorf("failed to upload success marker: %s: %w", markerKey, err)
+	}
+
+	return nil
+}
+
+// Encode the entries in the writer's format, returning its content type
+func (w *Writer) encode(out io.Writer, entries []Entry) (string, error) {
+	if FormatCSV == w.format {
+		writer := csv.NewWriter(out)
+
+		err := writer.Write(csvHeader)
+		if err != nil {
+			return "", err
+		}
+
+		for _, entry := range entries {
+			err = writer.Write([]string{
+				entry.Key,
+				entry.Path,
+				strconv.FormatInt(entry.Size, 10),
+				entry.SHA256,
+				formatTime(entry.ModTime),
+				formatTime(entry.StartedAt),
+				formatTime(entry.UploadedAt),
+			})
+			if err != nil {
+				return "", err
+			}
+		}
+		writer.Flush()
+
+		return "text/csv", writer.Error()
+	}
+
+	encoder := json.NewEncoder(out)
+	for _, entry := range entries {
+		err := encoder.Encode(entry)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return "application/x-ndjson", nil
+}
+
+// Format a time for CSV manifests as JSON Lines manifests would, leaving unknown
+// times empty
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format(time.RFC3339Nano)
+}
+
+func checksumFile(filePath string) (fileChecksum, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fileChecksum{}, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fileChecksum{}, err
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return fileChecksum{}, err
+	}
+
+	return fileChecksum{
+		sha256:  hex.EncodeToString(hash.Sum(nil)),
+		modTime: info.ModTime().UTC(),
+	}, nil
+}
@@ -0,0 +1,207 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/timrourke/funnel/backend"
+	"github.com/timrourke/funnel/tpl"
+	"github.com/timrourke/funnel/upload"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingObjectPutter reads the whole body of each object, as a backend would
+type recordingObjectPutter struct {
+	mux    sync.Mutex
+	keys   []string
+	bodies map[string][]byte
+	err    error
+}
+
+func (r *recordingObjectPutter) PutObject(object *backend.Object) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+
+	body, err := ioutil.ReadAll(object.Body)
+	if err != nil {
+		return err
+	}
+
+	r.keys = append(r.keys, object.Key)
+	if nil == r.bodies {
+		r.bodies = map[string][]byte{}
+	}
+	r.bodies[object.Key] = body
+
+	return nil
+}
+
+func (r *recordingObjectPutter) uploadedKeys() []string {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return append([]string{}, r.keys...)
+}
+
+func TestWriter(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	file, err := ioutil.TempFile("", "sensor*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString("{}")
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyTemplate, err := tpl.NewManifestKeyTemplate("manifests/{{ manifestNumber }}/manifest.{{ manifestFormat }}", nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startedAt := time.Date(2024, 6, 11, 10, 15, 0, 0, time.UTC)
+	uploadedAt := startedAt.Add(time.Second)
+
+	uploadFile := func(writer *Writer, jobID uint64, path string, key string) {
+		writer.Observe(upload.Event{Type: upload.FileEnqueued, JobID: jobID, Path: path, Size: 2, Key: key})
+		writer.Observe(upload.Event{Type: upload.FileUploadStarted, JobID: jobID, Path: path, Size: 2, Key: key})
+		writer.Observe(upload.Event{
+			Type:      upload.FileUploaded,
+			JobID:     jobID,
+			Path:      path,
+			Size:      2,
+			Key:       key,
+			StartedAt: startedAt,
+			At:        uploadedAt,
+		})
+	}
+
+	Convey("Should upload a JSON Lines manifest of uploaded files and a success marker", t, func() {
+		putter := &recordingObjectPutter{}
+		writer := NewWriter(FormatJSONL, keyTemplate, putter, 0, logger)
+
+		uploadFile(writer, 1, file.Name(), "sensors/a.json")
+
+		err := writer.Flush()
+
+		So(err, ShouldBeNil)
+		So(putter.uploadedKeys(), ShouldResemble, []string{"manifests/1/manifest.jsonl", "manifests/1/_SUCCESS"})
+
+		var entry Entry
+		err = json.Unmarshal(putter.bodies["manifests/1/manifest.jsonl"], &entry)
+		So(err, ShouldBeNil)
+		So(entry.Key, ShouldEqual, "sensors/a.json")
+		So(entry.Path, ShouldEqual, file.Name())
+		So(entry.Size, ShouldEqual, 2)
+		So(entry.SHA256, ShouldEqual, "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a")
+		So(entry.ModTime.IsZero(), ShouldBeFalse)
+		So(entry.StartedAt, ShouldEqual, startedAt)
+		So(entry.UploadedAt, ShouldEqual, uploadedAt)
+	})
+
+	Convey("Should upload a CSV manifest", t, func() {
+		putter := &recordingObjectPutter{}
+		writer := NewWriter(FormatCSV, keyTemplate, putter, 0, logger)
+
+		uploadFile(writer, 1, file.Name(), "sensors/a.json")
+
+		err := writer.Flush()
+
+		So(err, ShouldBeNil)
+
+		records, err := csv.NewReader(bytes.NewReader(putter.bodies["manifests/1/manifest.csv"])).ReadAll()
+		So(err, ShouldBeNil)
+		So(len(records), ShouldEqual, 2)
+		So(records[0], ShouldResemble, csvHeader)
+		So(records[1][0], ShouldEqual, "sensors/a.json")
+		So(records[1][2], ShouldEqual, "2")
+		So(records[1][5], ShouldEqual, "2024-06-11T10:15:00Z")
+	})
+
+	Convey("Should not upload a success marker when any file failed", t, func() {
+		putter := &recordingObjectPutter{}
+		writer := NewWriter(FormatJSONL, keyTemplate, putter, 0, logger)
+
+		uploadFile(writer, 1, file.Name(), "sensors/a.json")
+		writer.Observe(upload.Event{Type: upload.FileUploadStarted, JobID: 2, Path: file.Name(), Key: "sensors/b.json"})
+		writer.Observe(upload.Event{Type: upload.FileUploadFailed, JobID: 2, Path: file.Name(), Key: "sensors/b.json"})
+
+		err := writer.Flush()
+
+		So(err, ShouldBeNil)
+		So(putter.uploadedKeys(), ShouldResemble, []string{"manifests/1/manifest.jsonl"})
+	})
+
+	Convey("Should cover only the files finished since the previous manifest", t, func() {
+		putter := &recordingObjectPutter{}
+		writer := NewWriter(FormatJSONL, keyTemplate, putter, 0, logger)
+
+		uploadFile(writer, 1, file.Name(), "sensors/a.json")
+		So(writer.Flush(), ShouldBeNil)
+
+		uploadFile(writer, 2, file.Name(), "sensors/b.json")
+		So(writer.Flush(), ShouldBeNil)
+
+		So(string(putter.bodies["manifests/2/manifest.jsonl"]), ShouldContainSubstring, "sensors/b.json")
+		So(string(putter.bodies["manifests/2/manifest.jsonl"]), ShouldNotContainSubstring, "sensors/a.json")
+	})
+
+	Convey("Should write a manifest every interval once files were uploaded", t, func() {
+		putter := &recordingObjectPutter{}
+		writer := NewWriter(FormatJSONL, keyTemplate, putter, 10*time.Millisecond, logger)
+
+		writer.Start()
+		time.Sleep(50 * time.Millisecond)
+		So(putter.uploadedKeys(), ShouldBeEmpty)
+
+		uploadFile(writer, 1, file.Name(), "sensors/a.json")
+		time.Sleep(50 * time.Millisecond)
+		writer.Stop()
+
+		So(putter.uploadedKeys(), ShouldResemble, []string{"manifests/1/manifest.jsonl", "manifests/1/_SUCCESS"})
+	})
+
+	Convey("Should fail when the manifest fails to upload", t, func() {
+		putter := &recordingObjectPutter{err: errors.New("some error")}
+		writer := NewWriter(FormatJSONL, keyTemplate, putter, 0, logger)
+
+		err := writer.Flush()
+
+		So(err, ShouldNotBeNil)
+		So(strings.Contains(err.Error(), "manifests/1/manifest.jsonl"), ShouldBeTrue)
+	})
+}
+
+func TestParseFormat(t *testing.T) {
+	Convey("Should accept supported manifest formats", t, func() {
+		for _, format := range []string{FormatJSONL, FormatCSV} {
+			parsed, err := ParseFormat(format)
+
+			So(err, ShouldBeNil)
+			So(parsed, ShouldEqual, format)
+		}
+	})
+
+	Convey("Should reject unsupported manifest formats", t, func() {
+		_, err := ParseFormat("xml")
+
+		So(err, ShouldNotBeNil)
+	})
+}
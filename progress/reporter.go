@@ -0,0 +1,359 @@
+// Package progress reports how far along uploads are, as a live view when
+// funnel's output is a terminal and as periodic log events when it is not
+package progress
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/timrourke/funnel/bytesize"
+	"github.com/timrourke/funnel/upload"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reporter counts the bytes read from each file as it is uploaded and
+// periodically renders the progress of active files and of the run overall
+type Reporter struct {
+	mux         sync.Mutex
+	out         io.Writer
+	isTerminal  bool
+	logger      *logrus.Logger
+	interval    time.Duration
+	startedAt   time.Time
+	active      map[string]*fileProgress
+	filesTotal  int
+	filesDone   int
+	filesFailed int
+	bytesDone   int64
+	linesDrawn  int
+	stop        chan struct{}
+	stopped     chan struct{}
+	now         func() time.Time
+}
+
+// fileProgress counts the bytes read from a file by each destination it is
+// uploaded to, which all read the whole file
+type fileProgress struct {
+	path         string
+	size         int64
+	destinations map[string]*int64
+	startedAt    time.Time
+}
+
+// The bytes read from a file, averaged over the destinations reading it.
+// Callers must hold the reporter's lock.
+func (f *fileProgress) bytesRead() int64 {
+	if 0 == len(f.destinations) {
+		return 0
+	}
+
+	var total int64
+	for _, bytesRead := range f.destinations {
+		total += atomic.LoadInt64(bytesRead)
+	}
+
+	return total / int64(len(f.destinations))
+}
+
+// Snapshot is the state of all uploads at one point in time
+type Snapshot struct {
+	FilesTotal         int                `json:"filesTotal"`
+	FilesDone          int                `json:"filesDone"`
+	FilesFailed        int                `json:"filesFailed"`
+	BytesUploaded      int64              `json:"bytesUploaded"`
+	BytesPerSecond     float64            `json:"bytesPerSecond"`
+	Elapsed            time.Duration      `json:"elapsedNanoseconds"`
+	ActiveFileProgress []FileProgressInfo `json:"active"`
+}
+
+// FileProgressInfo is the state of a single file being uploaded
+type FileProgressInfo struct {
+	Path           string        `json:"filename"`
+	Size           int64         `json:"size"`
+	BytesUploaded  int64         `json:"bytesUploaded"`
+	Percent        float64       `json:"percent"`
+	BytesPerSecond float64       `json:"bytesPerSecond"`
+	ETA            time.Duration `json:"etaNanoseconds"`
+}
+
+// NewReporter creates a progress reporter. When `isTerminal` is true, progress
+// is drawn as a multi-line view on `out` that is redrawn in place. Otherwise,
+// progress is logged as structured events.
+func NewReporter(
+	out io.Writer,
+	isTerminal bool,
+	interval time.Duration,
+	logger *logrus.Logger,
+) *Reporter {
+	return &Reporter{
+		out:        out,
+		isTerminal: isTerminal,
+		logger:     logger,
+		interval:   interval,
+		active:     make(map[string]*fileProgress),
+		now:        time.Now,
+	}
+}
+
+// Start rendering progress every interval until `Stop` is called
+func (r *Reporter) Start() {
+	r.mux.Lock()
+	r.startedAt = r.now()
+	r.stop = make(chan struct{})
+	r.stopped = make(chan struct{})
+	r.mux.Unlock()
+
+	go func() {
+		defer close(r.stopped)
+
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				r.render()
+			case <-r.stop:
+				r.render()
+				return
+			}
+		}
+	}()
+}
+
+// Stop rendering progress, after rendering it one final time
+func (r *Reporter) Stop() {
+	close(r.stop)
+	<-r.stopped
+}
+
+// Track wraps the body of a file being uploaded so that the bytes read from it
+// are counted. It has the signature of a `backend.BodyWrapper`.
+func (r *Reporter) Track(path string, body io.Reader) io.Reader {
+	return r.track("", path, body)
+}
+
+// TrackDestination returns a body wrapper like `Track` for one of several
+// destinations a file is uploaded to. A file's progress is averaged over the
+// destinations reading it, so that it never exceeds the file's size.
+func (r *Reporter) TrackDestination(destination string) func(path string, body io.Reader) io.Reader {
+	return func(path string, body io.Reader) io.Reader {
+		return r.track(destination, path, body)
+	}
+}
+
+func (r *Reporter) track(destination string, path string, body io.Reader) io.Reader {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	progress, ok := r.active[path]
+	if !ok {
+		progress = &fileProgress{
+			path:         path,
+			destinations: make(map[string]*int64),
+			startedAt:    r.now(),
+		}
+		if info, err := os.Stat(path); err == nil {
+			progress.size = info.Size()
+		}
+		r.active[path] = progress
+	}
+
+	bytesRead, ok := progress.destinations[destination]
+	if !ok {
+		bytesRead = new(int64)
+		progress.destinations[destination] = bytesRead
+	}
+
+	return &countingReader{reader: body, bytesRead: bytesRead}
+}
+
+// Observe keeps count of the files enqueued, finished and failed, and stops
+// tracking files once their upload attempt is over
+func (r *Reporter) Observe(event upload.Event) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	switch event.Type {
+	case upload.FileEnqueued:
+		r.filesTotal++
+	case upload.FileUploaded:
+		r.filesDone++
+		if progress, ok := r.active[event.Path]; ok {
+			r.bytesDone += progress.bytesRead()
+		}
+		delete(r.active, event.Path)
+	case upload.FileUploadRetried:
+		delete(r.active, event.Path)
+	case upload.FileUploadFailed:
+		r.filesFailed++
+		delete(r.active, event.Path)
+	case upload.FileKeyFailed:
+		r.filesFailed++
+	}
+}
+
+// LogWriter wraps the writer log lines are written to, so that on a terminal
+// the progress view is erased before each log line and redrawn below it rather
+// than being scrambled by it
+func (r *Reporter) LogWriter(w io.Writer) io.Writer {
+	return &logWriter{writer: w, reporter: r}
+}
+
+// Snapshot captures the current progress of all uploads
+func (r *Reporter) Snapshot() Snapshot {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return r.snapshot()
+}
+
+func (r *Reporter) snapshot() Snapshot {
+	now := r.now()
+	snapshot := Snapshot{
+		FilesTotal:    r.filesTotal,
+		FilesDone:     r.filesDone,
+		FilesFailed:   r.filesFailed,
+		BytesUploaded: r.bytesDone,
+		Elapsed:       now.Sub(r.startedAt),
+	}
+
+	for _, progress := range r.active {
+		bytesRead := progress.bytesRead()
+		info := FileProgressInfo{
+			Path:          progress.path,
+			Size:          progress.size,
+			BytesUploaded: bytesRead,
+		}
+
+		if progress.size > 0 {
+			info.Percent = 100 * float64(bytesRead) / float64(progress.size)
+		}
+
+		if elapsed := now.Sub(progress.startedAt).Seconds(); elapsed > 0 {
+			info.BytesPerSecond = float64(bytesRead) / elapsed
+		}
+
+		if info.BytesPerSecond > 0 && progress.size > bytesRead {
+			info.ETA = time.Duration(float64(progress.size-bytesRead) / info.BytesPerSecond * float64(time.Second))
+		}
+
+		snapshot.BytesUploaded += bytesRead
+		snapshot.ActiveFileProgress = append(snapshot.ActiveFileProgress, info)
+	}
+
+	sort.Slice(snapshot.ActiveFileProgress, func(i, j int) bool {
+		return snapshot.ActiveFileProgress[i].Path < snapshot.ActiveFileProgress[j].Path
+	})
+
+	if seconds := snapshot.Elapsed.Seconds(); seconds > 0 {
+		snapshot.BytesPerSecond = float64(snapshot.BytesUploaded) / seconds
+	}
+
+	return snapshot
+}
+
+func (r *Reporter) render() {
+	r.mux.Lock()
+	snapshot := r.snapshot()
+
+	if r.isTerminal {
+		r.erase()
+
+		lines := FormatSnapshot(snapshot)
+		fmt.Fprint(r.out, strings.Join(lines, "\n")+"\n")
+		r.linesDrawn = len(lines)
+	}
+
+	r.mux.Unlock()
+
+	if r.isTerminal {
+		return
+	}
+
+	r.logger.WithFields(logrus.Fields{
+		"filesTotal":     snapshot.FilesTotal,
+		"filesDone":      snapshot.FilesDone,
+		"filesFailed":    snapshot.FilesFailed,
+		"bytesUploaded":  snapshot.BytesUploaded,
+		"bytesPerSecond": snapshot.BytesPerSecond,
+		"active":         snapshot.ActiveFileProgress,
+	}).Info("Upload progress")
+}
+
+// Move the cursor up over the previously drawn view and clear it. Callers must
+// hold the reporter's lock.
+func (r *Reporter) erase() {
+	if r.linesDrawn > 0 {
+		fmt.Fprintf(r.out, "\033[%dA\033[J", r.linesDrawn)
+		r.linesDrawn = 0
+	}
+}
+
+// FormatSnapshot renders a snapshot as lines of text: one per active file,
+// followed by a summary of the run overall
+func FormatSnapshot(snapshot Snapshot) []string {
+	var lines []string
+
+	for _, info := range snapshot.ActiveFileProgress {
+		eta := "--"
+		if info.ETA > 0 {
+			eta = info.ETA.Round(time.Second).String()
+		}
+
+		lines = append(lines, fmt.Sprintf(
+			"%s  %5.1f%%  %s/s  ETA %s",
+			info.Path,
+			info.Percent,
+			bytesize.Format(int64(info.BytesPerSecond)),
+			eta,
+		))
+	}
+
+	lines = append(lines, fmt.Sprintf(
+		"%d/%d files done, %d failed, %s uploaded, %s/s",
+		snapshot.FilesDone,
+		snapshot.FilesTotal,
+		snapshot.FilesFailed,
+		bytesize.Format(snapshot.BytesUploaded),
+		bytesize.Format(int64(snapshot.BytesPerSecond)),
+	))
+
+	return lines
+}
+
+type countingReader struct {
+	reader    io.Reader
+	bytesRead *int64
+}
+
+// Read reads from the underlying reader, counting the bytes read
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	atomic.AddInt64(c.bytesRead, int64(n))
+
+	return n, err
+}
+
+type logWriter struct {
+	writer   io.Writer
+	reporter *Reporter
+}
+
+// Write erases the progress view before writing a log line. The view is drawn
+// again on the next tick.
+func (l *logWriter) Write(p []byte) (int, error) {
+	l.reporter.mux.Lock()
+	defer l.reporter.mux.Unlock()
+
+	if l.reporter.isTerminal {
+		l.reporter.erase()
+	}
+
+	return l.writer.Write(p)
+}
@@ -0,0 +1,195 @@
+package progress
+
+import (
+	"bytes"
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/timrourke/funnel/backend"
+	"github.com/timrourke/funnel/localfs"
+	"github.com/timrourke/funnel/upload"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReporter(t *testing.T) {
+	file, err := ioutil.TempFile("", "somefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(make([]byte, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	newReporter := func(out *bytes.Buffer, isTerminal bool) (*Reporter, *time.Time) {
+		now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+		reporter := NewReporter(out, isTerminal, time.Hour, logrus.New())
+		reporter.now = func() time.Time {
+			return now
+		}
+		reporter.startedAt = now
+
+		return reporter, &now
+	}
+
+	Convey("Should report progress of an active file", t, func() {
+		reporter, now := newReporter(&bytes.Buffer{}, true)
+
+		reporter.Observe(upload.Event{Type: upload.FileEnqueued, Path: file.Name()})
+		reporter.Observe(upload.Event{Type: upload.FileEnqueued, Path: "other"})
+
+		body := reporter.Track(file.Name(), strings.NewReader(strings.Repeat("a", 250)))
+		_, err := ioutil.ReadAll(body)
+		So(err, ShouldBeNil)
+
+		*now = now.Add(time.Second)
+
+		snapshot := reporter.Snapshot()
+
+		So(snapshot.FilesTotal, ShouldEqual, 2)
+		So(snapshot.FilesDone, ShouldEqual, 0)
+		So(snapshot.BytesUploaded, ShouldEqual, 250)
+		So(len(snapshot.ActiveFileProgress), ShouldEqual, 1)
+
+		active := snapshot.ActiveFileProgress[0]
+		So(active.Path, ShouldEqual, file.Name())
+		So(active.Size, ShouldEqual, 1000)
+		So(active.Percent, ShouldEqual, 25)
+		So(active.BytesPerSecond, ShouldEqual, 250)
+		So(active.ETA, ShouldEqual, 3*time.Second)
+
+		Convey("Should count a file as done once uploaded", func() {
+			reporter.Observe(upload.Event{Type: upload.FileUploaded, Path: file.Name()})
+
+			snapshot := reporter.Snapshot()
+
+			So(snapshot.FilesDone, ShouldEqual, 1)
+			So(snapshot.BytesUploaded, ShouldEqual, 250)
+			So(snapshot.ActiveFileProgress, ShouldBeEmpty)
+		})
+
+		Convey("Should forget bytes read by an attempt that is retried", func() {
+			reporter.Observe(upload.Event{Type: upload.FileUploadRetried, Path: file.Name()})
+
+			snapshot := reporter.Snapshot()
+
+			So(snapshot.BytesUploaded, ShouldEqual, 0)
+			So(snapshot.ActiveFileProgress, ShouldBeEmpty)
+		})
+
+		Convey("Should count failed files", func() {
+			reporter.Observe(upload.Event{Type: upload.FileUploadFailed, Path: file.Name()})
+
+			snapshot := reporter.Snapshot()
+
+			So(snapshot.FilesFailed, ShouldEqual, 1)
+			So(snapshot.FilesDone, ShouldEqual, 0)
+		})
+	})
+
+	Convey("Should count a file uploaded to several destinations once", t, func() {
+		reporter, _ := newReporter(&bytes.Buffer{}, true)
+
+		firstDir, err := ioutil.TempDir("", "first")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(firstDir)
+
+		secondDir, err := ioutil.TempDir("", "second")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(secondDir)
+
+		fanOut := backend.NewFanOut([]backend.Destination{
+			{Name: "first", Backend: localfs.NewBackend(firstDir, logrus.New(), reporter.TrackDestination("first")), Required: true},
+			{Name: "second", Backend: localfs.NewBackend(secondDir, logrus.New(), reporter.TrackDestination("second")), Required: true},
+		}, 2, backend.FanOutParallel, logrus.New())
+
+		reporter.Observe(upload.Event{Type: upload.FileEnqueued, Path: file.Name()})
+
+		err = fanOut.Upload(file.Name(), "somefile")
+		So(err, ShouldBeNil)
+
+		active := reporter.Snapshot().ActiveFileProgress
+		So(active, ShouldHaveLength, 1)
+		So(active[0].BytesUploaded, ShouldEqual, 1000)
+		So(active[0].Percent, ShouldEqual, 100)
+
+		reporter.Observe(upload.Event{Type: upload.FileUploaded, Path: file.Name()})
+
+		So(reporter.bytesDone, ShouldEqual, 1000)
+		So(reporter.Snapshot().BytesUploaded, ShouldEqual, 1000)
+	})
+
+	Convey("Should redraw the view in place on a terminal", t, func() {
+		out := &bytes.Buffer{}
+		reporter, _ := newReporter(out, true)
+
+		reporter.render()
+		reporter.render()
+
+		So(out.String(), ShouldEqual, "0/0 files done, 0 failed, 0B uploaded, 0B/s\n"+
+			"\033[1A\033[J"+
+			"0/0 files done, 0 failed, 0B uploaded, 0B/s\n")
+	})
+
+	Convey("Should erase the view before writing log lines on a terminal", t, func() {
+		out := &bytes.Buffer{}
+		reporter, _ := newReporter(out, true)
+		logs := &bytes.Buffer{}
+
+		reporter.render()
+		_, err := reporter.LogWriter(logs).Write([]byte("some log line\n"))
+
+		So(err, ShouldBeNil)
+		So(logs.String(), ShouldEqual, "some log line\n")
+		So(out.String(), ShouldEndWith, "\033[1A\033[J")
+	})
+
+	Convey("Should log progress events when not on a terminal", t, func() {
+		out := &bytes.Buffer{}
+		logs := &bytes.Buffer{}
+		reporter, _ := newReporter(out, false)
+		reporter.logger.SetOutput(logs)
+		reporter.logger.SetFormatter(&logrus.JSONFormatter{})
+
+		reporter.render()
+
+		So(out.String(), ShouldBeEmpty)
+		So(logs.String(), ShouldContainSubstring, `"msg":"Upload progress"`)
+		So(logs.String(), ShouldContainSubstring, `"filesTotal":0`)
+	})
+}
+
+func TestFormatSnapshot(t *testing.T) {
+	Convey("Should render a line per active file and a summary", t, func() {
+		lines := FormatSnapshot(Snapshot{
+			FilesTotal:     3,
+			FilesDone:      1,
+			BytesUploaded:  3 * 1024 * 1024,
+			BytesPerSecond: 1024 * 1024,
+			ActiveFileProgress: []FileProgressInfo{
+				{
+					Path:           "some/file",
+					Percent:        50,
+					BytesPerSecond: 2048,
+					ETA:            12 * time.Second,
+				},
+			},
+		})
+
+		So(lines, ShouldResemble, []string{
+			"some/file   50.0%  2KiB/s  ETA 12s",
+			"1/3 files done, 0 failed, 3MiB uploaded, 1MiB/s",
+		})
+	})
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+	"github.com/timrourke/funnel/download"
+	"github.com/timrourke/funnel/encrypt"
+	"github.com/timrourke/funnel/s3"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	restoreDays           int64
+	restoreKeyPattern     string
+	restoreOutputDir      string
+	restorePathTemplate   string
+	restorePollInterval   time.Duration
+	restoreTimeout        time.Duration
+	restoreTier           string
+	shouldOverwriteFiles  bool
+	shouldRestoreArchived bool
+	shouldStripPrefix     bool
+
+	restoreCmd = &cobra.Command{
+		Use:     "restore [OPTIONS] PREFIX",
+		Aliases: []string{"get"},
+		Short:   "Download the objects below a prefix in an AWS S3 bucket back to local paths.",
+		Example: "funnel restore --region=us-east-1 --bucket=some-cool-bucket --strip-prefix -o /some/directory backups/2024/",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return ExecuteRestore(cmd, args)
+		},
+	}
+)
+
+// ExecuteRestore downloads every object below a prefix in the bucket to the
+// local path its key maps back to
+func ExecuteRestore(cmd *cobra.Command, args []string) error {
+	err := validateBucketFlags()
+	if err != nil {
+		return err
+	}
+
+	if numConcurrentUploads <= 0 || numConcurrentUploads > 100 {
+		return errors.New("number of concurrent downloads must be within the range 1-100")
+	}
+
+	prefix := args[0]
+
+	pathMapper, err := newPathMapper(prefix)
+	if err != nil {
+		return err
+	}
+
+	tier, err := parseRestoreTier(restoreTier)
+	if err != nil {
+		return err
+	}
+
+	if restoreDays < 1 {
+		return errors.New("must keep restored objects for at least 1 day")
+	}
+
+	if restoreTimeout <= 0 {
+		return errors.New("must wait for archived objects to be restored for longer than 0s")
+	}
+
+	// Objects that were not encrypted on upload can be downloaded without a key
+	var keyUnwrapper encrypt.KeyUnwrapper
+	if "" != decryptAgeIdentityFile || "" != decryptKeyFile {
+		keyUnwrapper, err = newKeyUnwrapper()
+		if err != nil {
+			return err
+		}
+	}
+
+	bodyWrappers, err := bandwidthBodyWrappers()
+	if err != nil {
+		return err
+	}
+
+	config := aws.NewConfig().
+		WithRegion(region).
+		WithMaxRetries(3)
+
+	sess := session.Must(session.NewSession(config))
+
+	store := s3.NewS3ObjectStore(
+		awss3.New(sess),
+		bucket,
+		keyUnwrapper,
+		restoreDays,
+		tier,
+		logger,
+		bodyWrappers...,
+	)
+
+	downloader := download.NewDownloader(
+		store,
+		pathMapper,
+		numConcurrentUploads,
+		shouldOverwriteFiles,
+		shouldRestoreArchived,
+		restorePollInterval,
+		restoreTimeout,
+		logger,
+	)
+
+	// Interrupting a restore gives up on the objects still waiting to be
+	// restored or retried, rather than leaving them waiting for hours
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupted)
+	go func() {
+		if _, ok := <-interrupted; ok {
+			logger.Warn("Stopping the restore, objects that are not downloaded yet will fail")
+			downloader.Stop()
+		}
+	}()
+
+	return downloader.DownloadPrefix(prefix)
+}
+
+// Create the path mapper that maps keys back to local paths below the output
+// directory, either with a reverse template or by stripping the prefix
+func newPathMapper(prefix string) (download.PathMapper, error) {
+	if "" == restoreKeyPattern && "" == restorePathTemplate {
+		if shouldStripPrefix {
+			return download.NewPrefixStripper(restoreOutputDir, prefix), nil
+		}
+
+		return download.NewPrefixStripper(restoreOutputDir, ""), nil
+	}
+
+	if "" == restoreKeyPattern || "" == restorePathTemplate {
+		return nil, errors.New("must provide both a key pattern and a path template to map keys to paths with")
+	}
+
+	if shouldStripPrefix {
+		return nil, errors.New("must either strip the prefix or map keys to paths with a template, not both")
+	}
+
+	return download.NewReverseTemplate(restoreOutputDir, restoreKeyPattern, restorePathTemplate)
+}
+
+// Check a Glacier retrieval tier, ignoring case
+func parseRestoreTier(tier string) (string, error) {
+	for _, valid := range []string{awss3.TierStandard, awss3.TierBulk, awss3.TierExpedited} {
+		if strings.EqualFold(strings.TrimSpace(tier), valid) {
+			return valid, nil
+		}
+	}
+
+	return "", fmt.Errorf("invalid restore tier %s, must be Standard, Bulk or Expedited", tier)
+}
+
+func configureRestoreCmd() {
+	restoreCmd.Flags().StringVarP(
+		&restoreOutputDir,
+		"output",
+		"o",
+		".",
+		"Directory to download objects into",
+	)
+
+	restoreCmd.Flags().BoolVarP(
+		&shouldStripPrefix,
+		"strip-prefix",
+		"",
+		false,
+		"Whether to strip the prefix from keys, eg. to download \"backups/2024/a.txt\" to \"a.txt\" for the prefix \"backups/2024/\"",
+	)
+
+	restoreCmd.Flags().StringVarP(
+		&restoreKeyPattern,
+		"key-pattern",
+		"",
+		"",
+		"Pattern keys must match to be downloaded, with placeholders for the path template, eg. \"logs/{host}/{year}/{file...}\"",
+	)
+
+	restoreCmd.Flags().StringVarP(
+		&restorePathTemplate,
+		"path-template",
+		"",
+		"",
+		"Path to download objects matching the key pattern to, below the output directory, eg. \"{host}/{file}\"",
+	)
+
+	restoreCmd.Flags().BoolVarP(
+		&shouldOverwriteFiles,
+		"overwrite",
+		"",
+		false,
+		"Whether to overwrite files that exist already, which are skipped otherwise",
+	)
+
+	restoreCmd.Flags().BoolVarP(
+		&shouldRestoreArchived,
+		"restore-archived",
+		"",
+		false,
+		"Whether to request restores of objects archived in Glacier, and wait for them to download them",
+	)
+
+	restoreCmd.Flags().Int64VarP(
+		&restoreDays,
+		"restore-days",
+		"",
+		7,
+		"Number of days restored archived objects are kept available for",
+	)
+
+	restoreCmd.Flags().StringVarP(
+		&restoreTier,
+		"restore-tier",
+		"",
+		awss3.TierStandard,
+		"Retrieval tier to restore archived objects with: Standard, Bulk or Expedited",
+	)
+
+	restoreCmd.Flags().DurationVarP(
+		&restorePollInterval,
+		"restore-poll-interval",
+		"",
+		5*time.Minute,
+		"How often to check whether archived objects were restored yet",
+	)
+
+	restoreCmd.Flags().DurationVarP(
+		&restoreTimeout,
+		"restore-timeout",
+		"",
+		48*time.Hour,
+		"How long to wait for archived objects to be restored before failing them",
+	)
+
+	restoreCmd.Flags().StringVarP(
+		&decryptAgeIdentityFile,
+		"age-identity",
+		"i",
+		"",
+		"File with the age identity the data keys of encrypted objects were wrapped for",
+	)
+
+	restoreCmd.Flags().StringVarP(
+		&decryptKeyFile,
+		"key-file",
+		"",
+		"",
+		"File with the 32 byte hex key the data keys of encrypted objects were wrapped with",
+	)
+
+	restoreCmd.Flags().StringVarP(
+		&maxBandwidth,
+		"max-bandwidth",
+		"",
+		"unlimited",
+		"Total download bandwidth shared by all concurrent downloads, eg. \"20MiB/s\"",
+	)
+
+	restoreCmd.Flags().StringVarP(
+		&maxBandwidthPerFile,
+		"max-bandwidth-per-file",
+		"",
+		"unlimited",
+		"Download bandwidth allowed for each individual file, eg. \"2MiB/s\"",
+	)
+
+	restoreCmd.DisableFlagsInUseLine = true
+
+	rootCmd.AddCommand(restoreCmd)
+}
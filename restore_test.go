@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/service/s3"
+	. "github.com/smartystreets/goconvey/convey"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewPathMapper(t *testing.T) {
+	Convey("Should map keys to paths by stripping the prefix only when told to", t, func() {
+		restoreOutputDir = "restored"
+		defer func() { restoreOutputDir, shouldStripPrefix = ".", false }()
+
+		mapper, err := newPathMapper("backups/")
+		So(err, ShouldBeNil)
+
+		path, _ := mapper.PathForKey("backups/a.txt")
+		So(path, ShouldEqual, filepath.Join("restored", "backups", "a.txt"))
+
+		shouldStripPrefix = true
+		mapper, err = newPathMapper("backups/")
+		So(err, ShouldBeNil)
+
+		path, _ = mapper.PathForKey("backups/a.txt")
+		So(path, ShouldEqual, filepath.Join("restored", "a.txt"))
+	})
+
+	Convey("Should require both a key pattern and a path template", t, func() {
+		restoreKeyPattern = "logs/{file}"
+		defer func() { restoreKeyPattern = "" }()
+
+		_, err := newPathMapper("logs/")
+
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestParseRestoreTier(t *testing.T) {
+	Convey("Should accept retrieval tiers in any case", t, func() {
+		tier, err := parseRestoreTier("bulk")
+
+		So(err, ShouldBeNil)
+		So(tier, ShouldEqual, s3.TierBulk)
+	})
+
+	Convey("Should reject unknown retrieval tiers", t, func() {
+		_, err := parseRestoreTier("Instant")
+
+		So(err, ShouldNotBeNil)
+	})
+}
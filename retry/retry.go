@@ -0,0 +1,49 @@
+// Package retry defines how funnel tries failed work again, shared by uploads
+// and downloads: a few attempts, each after a delay twice as long as the one
+// before it
+package retry
+
+import (
+	"time"
+)
+
+// MaxAttempts is the number of attempts at a piece of work before giving up
+// on it
+const MaxAttempts = 5
+
+// BaseDelay is the delay before the first retry, which doubles with each
+// attempt after it
+var BaseDelay = time.Second
+
+// ShouldRetry tells whether work that failed a number of times has any
+// attempts left
+func ShouldRetry(failures int) bool {
+	return failures < MaxAttempts
+}
+
+// Delay returns how long to wait before trying work again that failed a number
+// of times
+func Delay(failures int) time.Duration {
+	if failures < 1 {
+		return 0
+	}
+
+	return BaseDelay << uint(failures-1)
+}
+
+// After calls fn once a delay passed, or cancel instead when quit is closed
+// first. It returns right away. A nil quit channel never cancels, in which
+// case cancel may be nil.
+func After(delay time.Duration, quit <-chan struct{}, fn func(), cancel func()) {
+	go func() {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			fn()
+		case <-quit:
+			cancel()
+		}
+	}()
+}
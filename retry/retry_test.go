@@ -0,0 +1,61 @@
+package retry
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestShouldRetry(t *testing.T) {
+	Convey("Should retry until the attempts run out", t, func() {
+		So(ShouldRetry(1), ShouldBeTrue)
+		So(ShouldRetry(MaxAttempts-1), ShouldBeTrue)
+		So(ShouldRetry(MaxAttempts), ShouldBeFalse)
+	})
+}
+
+func TestDelay(t *testing.T) {
+	Convey("Should double the delay with each attempt", t, func() {
+		So(Delay(1), ShouldEqual, BaseDelay)
+		So(Delay(2), ShouldEqual, 2*BaseDelay)
+		So(Delay(4), ShouldEqual, 8*BaseDelay)
+	})
+}
+
+func TestAfter(t *testing.T) {
+	Convey("Should call the function once the delay passed", t, func() {
+		called := make(chan string, 1)
+
+		After(time.Millisecond, make(chan struct{}), func() {
+			called <- "fn"
+		}, func() {
+			called <- "cancel"
+		})
+
+		So(<-called, ShouldEqual, "fn")
+	})
+
+	Convey("Should cancel instead when told to quit first", t, func() {
+		called := make(chan string, 1)
+		quit := make(chan struct{})
+		close(quit)
+
+		After(time.Hour, quit, func() {
+			called <- "fn"
+		}, func() {
+			called <- "cancel"
+		})
+
+		So(<-called, ShouldEqual, "cancel")
+	})
+
+	Convey("Should never cancel without a quit channel", t, func() {
+		called := make(chan string, 1)
+
+		After(time.Millisecond, nil, func() {
+			called <- "fn"
+		}, nil)
+
+		So(<-called, ShouldEqual, "fn")
+	})
+}
@@ -0,0 +1,155 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/timrourke/funnel/backend"
+	"net/url"
+	"strings"
+)
+
+func init() {
+	backend.Register("s3", openBackend)
+}
+
+type s3Backend struct {
+	s3Uploader      S3Uploader
+	s3UploadManager S3ManagerUploader
+	s3Client        S3BucketHeader
+	toBucket        string
+	prefix          string
+}
+
+// NewBackend creates the backend for a bucket in AWS S3, whose keys all begin
+// with the given prefix. Files are uploaded with the S3 uploader, while objects
+// are streamed through the upload manager.
+func NewBackend(
+	s3Uploader S3Uploader,
+	s3UploadManager S3ManagerUploader,
+	s3Client S3BucketHeader,
+	toBucket string,
+	prefix string,
+) backend.Backend {
+	return &s3Backend{
+		s3Uploader:      s3Uploader,
+		s3UploadManager: s3UploadManager,
+		s3Client:        s3Client,
+		toBucket:        toBucket,
+		prefix:          prefix,
+	}
+}
+
+// Open the backend for a destination such as `s3://bucket/prefix`. The region
+// is taken from the destination's `region` query parameter, eg.
+// `s3://bucket?region=us-east-1`, falling back to the region option.
+func openBackend(destination *url.URL, options backend.Options) (backend.Backend, error) {
+	toBucket := destination.Host
+	if "" == toBucket {
+		return nil, errors.New("must specify an AWS S3 bucket to save files in, eg. s3://bucket/prefix")
+	}
+
+	region := destination.Query().Get("region")
+	if "" == region {
+		region = options.Region
+	}
+	if "" == strings.TrimSpace(region) {
+		return nil, errors.New("must provide an AWS region where your S3 bucket exists")
+	}
+
+	config := aws.NewConfig().
+		WithRegion(region).
+		WithMaxRetries(3)
+
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %w", err)
+	}
+
+	var s3UploadManager S3ManagerUploader = s3manager.NewUploader(sess)
+	if nil != options.KeyWrapper {
+		s3UploadManager = NewEncryptingS3ManagerUploader(s3UploadManager, options.KeyWrapper)
+	}
+
+	journal, err := NewFileJournal(options.JournalDir)
+	if err != nil {
+		return nil, err
+	}
+
+	s3Client := awss3.New(sess)
+
+	s3Uploader := NewResumableS3Uploader(
+		s3UploadManager,
+		s3Client,
+		journal,
+		toBucket,
+		options.MultipartThreshold,
+		options.MultipartPartSize,
+		options.Logger,
+		options.BodyWrappers...,
+	)
+
+	// Resumable multipart uploads send parts of the file as they are, so
+	// encrypted files are streamed through the upload manager instead
+	if nil != options.KeyWrapper {
+		s3Uploader = NewS3Uploader(s3UploadManager, toBucket, options.Logger, options.BodyWrappers...)
+	}
+
+	if len(options.CompressionRules) > 0 {
+		s3Uploader = NewCompressingS3Uploader(
+			s3UploadManager,
+			s3Uploader,
+			toBucket,
+			options.CompressionRules,
+			options.CompressionMode,
+			options.CompressionObservers,
+			options.Logger,
+			options.BodyWrappers...,
+		)
+	}
+
+	return NewBackend(s3Uploader, s3UploadManager, s3Client, toBucket, backend.Prefix(destination)), nil
+}
+
+// Upload a file to its key below the prefix
+func (s *s3Backend) Upload(path string, key string) error {
+	return s.s3Uploader.Upload(path, backend.JoinKey(s.prefix, key))
+}
+
+// PutObject streams an object to its key below the prefix
+func (s *s3Backend) PutObject(object *backend.Object) error {
+	input := &s3manager.UploadInput{
+		Body:   object.Body,
+		Bucket: aws.String(s.toBucket),
+		Key:    aws.String(backend.JoinKey(s.prefix, object.Key)),
+	}
+
+	if "" != object.ContentType {
+		input.ContentType = aws.String(object.ContentType)
+	}
+
+	if "" != object.ContentEncoding {
+		input.ContentEncoding = aws.String(object.ContentEncoding)
+	}
+
+	if len(object.Metadata) > 0 {
+		input.Metadata = aws.StringMap(object.Metadata)
+	}
+
+	_, err := s.s3UploadManager.Upload(input)
+
+	return err
+}
+
+// CheckAccess verifies that the bucket is accessible
+func (s *s3Backend) CheckAccess(ctx context.Context) error {
+	return CheckBucketAccess(ctx, s.s3Client, s.toBucket)
+}
+
+func (s *s3Backend) URL(key string) string {
+	return fmt.Sprintf("s3://%s/%s", s.toBucket, backend.JoinKey(s.prefix, key))
+}
@@ -0,0 +1,82 @@
+package s3
+
+import (
+	"context"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/timrourke/funnel/backend"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestS3Backend(t *testing.T) {
+	Convey("Should upload files below the prefix", t, func() {
+		uploader := &recordingS3Uploader{}
+		s3Backend := NewBackend(uploader, &readingS3ManagerUploader{}, &stubS3BucketHeader{}, "some-bucket", "some/prefix")
+
+		err := s3Backend.Upload("/tmp/a.txt", "a.txt")
+
+		So(err, ShouldBeNil)
+		So(uploader.keys, ShouldResemble, []string{"some/prefix/a.txt"})
+		So(s3Backend.URL("a.txt"), ShouldEqual, "s3://some-bucket/some/prefix/a.txt")
+	})
+
+	Convey("Should stream objects below the prefix through the upload manager", t, func() {
+		manager := &readingS3ManagerUploader{}
+		s3Backend := NewBackend(&recordingS3Uploader{}, manager, &stubS3BucketHeader{}, "some-bucket", "some/prefix")
+
+		err := s3Backend.PutObject(&backend.Object{
+			Key:         "manifest.jsonl",
+			Body:        strings.NewReader("{}"),
+			ContentType: "application/x-ndjson",
+			Metadata:    map[string]string{"some-name": "some-value"},
+		})
+
+		So(err, ShouldBeNil)
+		So(len(manager.inputsPassed), ShouldEqual, 1)
+		So(*manager.inputsPassed[0].Bucket, ShouldEqual, "some-bucket")
+		So(*manager.inputsPassed[0].Key, ShouldEqual, "some/prefix/manifest.jsonl")
+		So(*manager.inputsPassed[0].ContentType, ShouldEqual, "application/x-ndjson")
+		So(manager.inputsPassed[0].ContentEncoding, ShouldBeNil)
+		So(*manager.inputsPassed[0].Metadata["some-name"], ShouldEqual, "some-value")
+		So(string(manager.bodies[0]), ShouldEqual, "{}")
+	})
+
+	Convey("Should check access to the bucket", t, func() {
+		header := &stubS3BucketHeader{}
+		s3Backend := NewBackend(&recordingS3Uploader{}, &readingS3ManagerUploader{}, header, "some-bucket", "")
+
+		err := s3Backend.CheckAccess(context.Background())
+
+		So(err, ShouldBeNil)
+		So(header.bucketsHeaded, ShouldResemble, []string{"some-bucket"})
+	})
+}
+
+func TestOpenBackend(t *testing.T) {
+	journalDir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(journalDir)
+
+	Convey("Should open S3 destinations with a region", t, func() {
+		s3Backend, err := backend.Open("s3://some-bucket/some/prefix?region=us-east-1", backend.Options{JournalDir: journalDir})
+
+		So(err, ShouldBeNil)
+		So(s3Backend.URL("a.txt"), ShouldEqual, "s3://some-bucket/some/prefix/a.txt")
+	})
+
+	Convey("Should fail without a region", t, func() {
+		_, err := backend.Open("s3://some-bucket", backend.Options{JournalDir: journalDir})
+
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should fail without a bucket", t, func() {
+		_, err := backend.Open("s3:///some/prefix", backend.Options{Region: "us-east-1", JournalDir: journalDir})
+
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,32 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3BucketHeader knows how to check that a bucket exists and is accessible
+// with the current credentials
+type S3BucketHeader interface {
+	HeadBucketWithContext(
+		ctx aws.Context,
+		input *awss3.HeadBucketInput,
+		options ...request.Option,
+	) (*awss3.HeadBucketOutput, error)
+}
+
+// CheckBucketAccess verifies that S3 is reachable, and that the credentials in
+// use are valid and allowed to access the bucket
+func CheckBucketAccess(ctx context.Context, s3Client S3BucketHeader, bucket string) error {
+	_, err := s3Client.HeadBucketWithContext(ctx, &awss3.HeadBucketInput{
+		Bucket: aws.String(bucket),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to access bucket %s: %w", bucket, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+type stubS3BucketHeader struct {
+	bucketsHeaded []string
+	err           error
+}
+
+// HeadBucketWithContext is a stubbed implementation of `s3.S3.HeadBucketWithContext`
+func (s *stubS3BucketHeader) HeadBucketWithContext(
+	ctx aws.Context,
+	input *awss3.HeadBucketInput,
+	options ...request.Option,
+) (*awss3.HeadBucketOutput, error) {
+	s.bucketsHeaded = append(s.bucketsHeaded, *input.Bucket)
+	return &awss3.HeadBucketOutput{}, s.err
+}
+
+func TestCheckBucketAccess(t *testing.T) {
+	Convey("Should succeed when the bucket is accessible", t, func() {
+		stub := &stubS3BucketHeader{}
+
+		err := CheckBucketAccess(context.Background(), stub, "some-bucket")
+
+		So(err, ShouldBeNil)
+		So(stub.bucketsHeaded, ShouldResemble, []string{"some-bucket"})
+	})
+
+	Convey("Should fail when the bucket is not accessible", t, func() {
+		expectedError := errors.New("access denied")
+		stub := &stubS3BucketHeader{err: expectedError}
+
+		err := CheckBucketAccess(context.Background(), stub, "some-bucket")
+
+		So(err, ShouldNotBeNil)
+		So(errors.Is(err, expectedError), ShouldBeTrue)
+		So(err.Error(), ShouldContainSubstring, "some-bucket")
+	})
+}
@@ -0,0 +1,66 @@
+package s3
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// AbortStaleMultipartUploads aborts every incomplete multipart upload under the
+// given key prefix that was initiated longer ago than `olderThan`, so that the
+// parts of uploads that will never be resumed stop accruing storage charges. It
+// returns the number of uploads aborted.
+func AbortStaleMultipartUploads(
+	s3Client S3MultipartClient,
+	bucket string,
+	prefix string,
+	olderThan time.Duration,
+	logger *logrus.Logger,
+) (int, error) {
+	cutoff := time.Now().Add(-olderThan)
+	numAborted := 0
+
+	input := &awss3.ListMultipartUploadsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	for {
+		output, err := s3Client.ListMultipartUploads(input)
+		if err != nil {
+			return numAborted, err
+		}
+
+		for _, upload := range output.Uploads {
+			initiated := aws.TimeValue(upload.Initiated)
+			if initiated.After(cutoff) {
+				continue
+			}
+
+			_, err := s3Client.AbortMultipartUpload(&awss3.AbortMultipartUploadInput{
+				Bucket:   aws.String(bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil {
+				return numAborted, err
+			}
+
+			logger.WithFields(logrus.Fields{
+				"key":       aws.StringValue(upload.Key),
+				"uploadId":  aws.StringValue(upload.UploadId),
+				"initiated": initiated.Format(time.RFC3339),
+			}).Info("Aborted stale multipart upload")
+
+			numAborted++
+		}
+
+		if !aws.BoolValue(output.IsTruncated) {
+			return numAborted, nil
+		}
+
+		input.KeyMarker = output.NextKeyMarker
+		input.UploadIdMarker = output.NextUploadIdMarker
+	}
+}
@@ -0,0 +1,34 @@
+package s3
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestAbortStaleMultipartUploads(t *testing.T) {
+	Convey("Should abort only uploads older than the cutoff", t, func() {
+		client := newStubS3MultipartClient()
+		client.listedUploads = []*awss3.MultipartUpload{
+			{
+				Key:       aws.String("prefix/old"),
+				UploadId:  aws.String("old-upload"),
+				Initiated: aws.Time(time.Now().Add(-48 * time.Hour)),
+			},
+			{
+				Key:       aws.String("prefix/new"),
+				UploadId:  aws.String("new-upload"),
+				Initiated: aws.Time(time.Now()),
+			},
+		}
+
+		numAborted, err := AbortStaleMultipartUploads(client, "some-bucket", "prefix/", 24*time.Hour, logrus.New())
+
+		So(err, ShouldBeNil)
+		So(numAborted, ShouldEqual, 1)
+		So(client.abortedUploads, ShouldResemble, []string{"old-upload"})
+	})
+}
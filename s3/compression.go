@@ -0,0 +1,131 @@
+package s3
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/sirupsen/logrus"
+	"github.com/timrourke/funnel/backend"
+	"github.com/timrourke/funnel/compress"
+	"io"
+	"os"
+)
+
+type compressingS3Uploader struct {
+	s3UploadManager      S3ManagerUploader
+	uncompressedUploader S3Uploader
+	toBucket             string
+	rules                compress.Rules
+	mode                 string
+	observers            []backend.CompressionObserver
+	bodyWrappers         []backend.BodyWrapper
+	logger               *logrus.Logger
+}
+
+// NewCompressingS3Uploader creates an uploader that streams the files matching
+// the compression rules through their compression algorithm as they are
+// uploaded. In the encoding mode the object's Content-Encoding is set, while in
+// the suffix mode the algorithm's file extension is appended to the key. Files
+// that match no rule, or that are compressed already, are handed to the
+// uncompressed uploader instead. Body wrappers are applied to each file's
+// uncompressed contents.
+func NewCompressingS3Uploader(
+	s3UploadManager S3ManagerUploader,
+	uncompressedUploader S3Uploader,
+	toBucket string,
+	rules compress.Rules,
+	mode string,
+	observers []backend.CompressionObserver,
+	logger *logrus.Logger,
+	bodyWrappers ...backend.BodyWrapper,
+) S3Uploader {
+	return &compressingS3Uploader{
+		s3UploadManager:      s3UploadManager,
+		uncompressedUploader: uncompressedUploader,
+		toBucket:             toBucket,
+		rules:                rules,
+		mode:                 mode,
+		observers:            observers,
+		bodyWrappers:         bodyWrappers,
+		logger:               logger,
+	}
+}
+
+// Upload a file with a given path to AWS S3, compressing it on the way if a
+// rule says so
+func (c *compressingS3Uploader) Upload(path string, key string) error {
+	algorithm := c.rules.AlgorithmFor(path)
+	if "" == algorithm {
+		return c.uncompressedUploader.Upload(path, key)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return c.uncompressedUploader.Upload(path, key)
+	}
+	defer file.Close()
+
+	header := make([]byte, compress.MagicBytesLength)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("failed to read file: %s: %w", path, err)
+	}
+
+	if compress.IsCompressed(path, header[:n]) {
+		c.logger.WithFields(logrus.Fields{
+			"filename": path,
+		}).Debug("Not compressing file that is compressed already")
+
+		return c.uncompressedUploader.Upload(path, key)
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %s: %w", path, err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to read file: %s: %w", path, err)
+	}
+
+	body, err := compress.NewReader(algorithm, backend.WrapBody(path, file, c.bodyWrappers))
+	if err != nil {
+		return err
+	}
+
+	input := &s3manager.UploadInput{
+		Body:     body,
+		Bucket:   aws.String(c.toBucket),
+		Key:      aws.String(key),
+		Metadata: fileMetadata(info),
+	}
+
+	if c.mode == compress.ModeSuffix {
+		input.Key = aws.String(key + compress.Suffix(algorithm))
+	} else {
+		input.ContentEncoding = aws.String(compress.ContentEncoding(algorithm))
+	}
+
+	_, err = c.s3UploadManager.Upload(input)
+	body.Close()
+	if err != nil {
+		return err
+	}
+
+	uncompressedSize, compressedSize := body.Sizes()
+
+	c.logger.WithFields(logrus.Fields{
+		"filename":         path,
+		"key":              aws.StringValue(input.Key),
+		"algorithm":        algorithm,
+		"uncompressedSize": uncompressedSize,
+		"compressedSize":   compressedSize,
+	}).Info("Compressed file")
+
+	for _, observer := range c.observers {
+		observer.ObserveCompression(algorithm, uncompressedSize, compressedSize)
+	}
+
+	return nil
+}
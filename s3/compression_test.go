@@ -0,0 +1,216 @@
+package s3
+
+import (
+	"compress/gzip"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/timrourke/funnel/backend"
+	"github.com/timrourke/funnel/compress"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// readingS3ManagerUploader reads the whole body of each upload, as the AWS SDK
+// would
+type readingS3ManagerUploader struct {
+	inputsPassed []*s3manager.UploadInput
+	bodies       [][]byte
+	err          error
+}
+
+func (r *readingS3ManagerUploader) Upload(input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	r.inputsPassed = append(r.inputsPassed, input)
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.bodies = append(r.bodies, body)
+
+	return &s3manager.UploadOutput{}, nil
+}
+
+// recordingS3Uploader records the files handed to it
+type recordingS3Uploader struct {
+	keys []string
+}
+
+func (r *recordingS3Uploader) Upload(path string, key string) error {
+	r.keys = append(r.keys, key)
+
+	return nil
+}
+
+type compressionSizes struct {
+	algorithm        string
+	uncompressedSize int64
+	compressedSize   int64
+}
+
+type recordingCompressionObserver struct {
+	observed []compressionSizes
+}
+
+func (r *recordingCompressionObserver) ObserveCompression(algorithm string, uncompressedSize int64, compressedSize int64) {
+	r.observed = append(r.observed, compressionSizes{algorithm, uncompressedSize, compressedSize})
+}
+
+func TestCompressingS3Uploader_Upload(t *testing.T) {
+	contents := strings.Repeat("some log line\n", 1000)
+
+	file, err := ioutil.TempFile("", "app*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(contents)
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := compress.ParseRules("*.log=gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Should upload compressed contents with a Content-Encoding", t, func() {
+		stub := &readingS3ManagerUploader{}
+		observer := &recordingCompressionObserver{}
+		uncompressed := &recordingS3Uploader{}
+
+		uploader := NewCompressingS3Uploader(
+			stub,
+			uncompressed,
+			"some-bucket",
+			rules,
+			compress.ModeEncoding,
+			[]backend.CompressionObserver{observer},
+			logrus.New(),
+		)
+
+		err := uploader.Upload(file.Name(), "some/key.log")
+
+		So(err, ShouldBeNil)
+		So(uncompressed.keys, ShouldBeEmpty)
+		So(aws.StringValue(stub.inputsPassed[0].Key), ShouldEqual, "some/key.log")
+		So(aws.StringValue(stub.inputsPassed[0].ContentEncoding), ShouldEqual, "gzip")
+
+		reader, err := gzip.NewReader(strings.NewReader(string(stub.bodies[0])))
+		So(err, ShouldBeNil)
+		decompressed, err := ioutil.ReadAll(reader)
+		So(err, ShouldBeNil)
+		So(string(decompressed), ShouldEqual, contents)
+
+		So(observer.observed, ShouldResemble, []compressionSizes{
+			{compress.Gzip, int64(len(contents)), int64(len(stub.bodies[0]))},
+		})
+	})
+
+	Convey("Should append the algorithm's suffix to the key", t, func() {
+		stub := &readingS3ManagerUploader{}
+
+		uploader := NewCompressingS3Uploader(
+			stub,
+			&recordingS3Uploader{},
+			"some-bucket",
+			rules,
+			compress.ModeSuffix,
+			nil,
+			logrus.New(),
+		)
+
+		err := uploader.Upload(file.Name(), "some/key.log")
+
+		So(err, ShouldBeNil)
+		So(aws.StringValue(stub.inputsPassed[0].Key), ShouldEqual, "some/key.log.gz")
+		So(stub.inputsPassed[0].ContentEncoding, ShouldBeNil)
+	})
+
+	Convey("Should pass the uncompressed contents through body wrappers", t, func() {
+		var wrapped []byte
+		bodyWrapper := func(path string, body io.Reader) io.Reader {
+			contents, _ := ioutil.ReadAll(body)
+			wrapped = contents
+			return strings.NewReader(string(contents))
+		}
+
+		uploader := NewCompressingS3Uploader(
+			&readingS3ManagerUploader{},
+			&recordingS3Uploader{},
+			"some-bucket",
+			rules,
+			compress.ModeEncoding,
+			nil,
+			logrus.New(),
+			bodyWrapper,
+		)
+
+		err := uploader.Upload(file.Name(), "some/key.log")
+
+		So(err, ShouldBeNil)
+		So(string(wrapped), ShouldEqual, contents)
+	})
+
+	Convey("Should hand over files matching no rule or compressed already", t, func() {
+		gzipped, err := ioutil.TempFile("", "rotated*.log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(gzipped.Name())
+
+		writer := gzip.NewWriter(gzipped)
+		writer.Write([]byte(contents))
+		writer.Close()
+		gzipped.Close()
+
+		stub := &readingS3ManagerUploader{}
+		uncompressed := &recordingS3Uploader{}
+
+		uploader := NewCompressingS3Uploader(
+			stub,
+			uncompressed,
+			"some-bucket",
+			rules,
+			compress.ModeEncoding,
+			nil,
+			logrus.New(),
+		)
+
+		So(uploader.Upload("/dev/null", "null"), ShouldBeNil)
+		So(uploader.Upload(gzipped.Name(), "rotated.log"), ShouldBeNil)
+
+		So(uncompressed.keys, ShouldResemble, []string{"null", "rotated.log"})
+		So(stub.inputsPassed, ShouldBeEmpty)
+	})
+
+	Convey("Should fail when the upload fails", t, func() {
+		observer := &recordingCompressionObserver{}
+
+		uploader := NewCompressingS3Uploader(
+			&readingS3ManagerUploader{err: errors.New("some upload error")},
+			&recordingS3Uploader{},
+			"some-bucket",
+			rules,
+			compress.ModeEncoding,
+			[]backend.CompressionObserver{observer},
+			logrus.New(),
+		)
+
+		err := uploader.Upload(file.Name(), "some/key.log")
+
+		So(err, ShouldNotBeNil)
+		So(observer.observed, ShouldBeEmpty)
+	})
+}
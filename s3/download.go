@@ -0,0 +1,360 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sirupsen/logrus"
+	"github.com/timrourke/funnel/backend"
+	"github.com/timrourke/funnel/compress"
+	"github.com/timrourke/funnel/download"
+	"github.com/timrourke/funnel/encrypt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage classes whose objects must be restored before they can be downloaded
+var archivedStorageClasses = map[string]bool{
+	awss3.StorageClassGlacier:     true,
+	awss3.StorageClassDeepArchive: true,
+}
+
+// S3DownloadClient knows how to list, restore and download objects in AWS S3.
+// Like `S3ObjectGetter`, it narrows the dependency on the `s3.S3` concrete type
+// so that simple test doubles can stand in for it.
+type S3DownloadClient interface {
+	ListObjectsV2Pages(input *awss3.ListObjectsV2Input, fn func(*awss3.ListObjectsV2Output, bool) bool) error
+	HeadObject(input *awss3.HeadObjectInput) (*awss3.HeadObjectOutput, error)
+	GetObjectWithContext(ctx aws.Context, input *awss3.GetObjectInput, options ...request.Option) (*awss3.GetObjectOutput, error)
+	RestoreObject(input *awss3.RestoreObjectInput) (*awss3.RestoreObjectOutput, error)
+}
+
+type s3ObjectStore struct {
+	s3Client     S3DownloadClient
+	fromBucket   string
+	keyUnwrapper encrypt.KeyUnwrapper
+	restoreDays  int64
+	restoreTier  string
+	bodyWrappers []backend.BodyWrapper
+	logger       *logrus.Logger
+}
+
+// NewS3ObjectStore creates an object store that downloads objects from a bucket
+// in AWS S3, restoring what was done to them on upload: objects encrypted on
+// upload are decrypted with the key unwrapper, compressed ones are
+// decompressed, and files get back their modification times. Archived objects
+// are restored for the given number of days, in the given retrieval tier. Body
+// wrappers are applied to each object's contents in order, eg. to limit the
+// rate they are downloaded at.
+func NewS3ObjectStore(
+	s3Client S3DownloadClient,
+	fromBucket string,
+	keyUnwrapper encrypt.KeyUnwrapper,
+	restoreDays int64,
+	restoreTier string,
+	logger *logrus.Logger,
+	bodyWrappers ...backend.BodyWrapper,
+) download.ObjectStore {
+	return &s3ObjectStore{
+		s3Client:     s3Client,
+		fromBucket:   fromBucket,
+		keyUnwrapper: keyUnwrapper,
+		restoreDays:  restoreDays,
+		restoreTier:  restoreTier,
+		bodyWrappers: bodyWrappers,
+		logger:       logger,
+	}
+}
+
+// ListObjects lists the objects below a prefix, page by page
+func (s *s3ObjectStore) ListObjects(prefix string, fn func(object download.Object) error) error {
+	var fnErr error
+
+	err := s.s3Client.ListObjectsV2Pages(&awss3.ListObjectsV2Input{
+		Bucket: aws.String(s.fromBucket),
+		Prefix: aws.String(prefix),
+	}, func(output *awss3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range output.Contents {
+			fnErr = fn(download.Object{
+				Key:      aws.StringValue(object.Key),
+				Size:     aws.Int64Value(object.Size),
+				ETag:     aws.StringValue(object.ETag),
+				Archived: archivedStorageClasses[aws.StringValue(object.StorageClass)],
+			})
+			if fnErr != nil {
+				return false
+			}
+		}
+
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	return fnErr
+}
+
+// Restore requests a restore of an archived object, unless one is in progress
+// or done already, in which case the object can be downloaded
+func (s *s3ObjectStore) Restore(object download.Object) (bool, error) {
+	output, err := s.s3Client.HeadObject(&awss3.HeadObjectInput{
+		Bucket: aws.String(s.fromBucket),
+		Key:    aws.String(object.Key),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// The x-amz-restore header says whether a restore is still in progress,
+	// eg. `ongoing-request="false", expiry-date="..."` once it is done
+	if restore := aws.StringValue(output.Restore); "" != restore {
+		return !strings.Contains(restore, `ongoing-request="true"`), nil
+	}
+
+	if !archivedStorageClasses[aws.StringValue(output.StorageClass)] {
+		return true, nil
+	}
+
+	_, err = s.s3Client.RestoreObject(&awss3.RestoreObjectInput{
+		Bucket: aws.String(s.fromBucket),
+		Key:    aws.String(object.Key),
+		RestoreRequest: &awss3.RestoreRequest{
+			Days: aws.Int64(s.restoreDays),
+			GlacierJobParameters: &awss3.GlacierJobParameters{
+				Tier: aws.String(s.restoreTier),
+			},
+		},
+	})
+
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && "RestoreAlreadyInProgress" == awsErr.Code() {
+		return false, nil
+	}
+	if errors.As(err, &awsErr) && awss3.ErrCodeObjectAlreadyInActiveTierError == awsErr.Code() {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"key":  object.Key,
+		"days": s.restoreDays,
+		"tier": s.restoreTier,
+	}).Info(fmt.Sprintf("Requested restore of archived object %s", object.Key))
+
+	return false, nil
+}
+
+// Download writes an object to a temporary file next to the path, which is
+// renamed to it once the object's checksum was verified
+func (s *s3ObjectStore) Download(object download.Object, path string) error {
+	checksum, err := s.etagHashFor(object)
+	if err != nil {
+		return err
+	}
+
+	input := &awss3.GetObjectInput{
+		Bucket: aws.String(s.fromBucket),
+		Key:    aws.String(object.Key),
+	}
+	if "" != object.ETag {
+		input.IfMatch = aws.String(object.ETag)
+	}
+
+	output, err := s.s3Client.GetObjectWithContext(aws.BackgroundContext(), input, withIdentityEncoding)
+	if err != nil {
+		return fmt.Errorf("failed to download object: %s: %w", object.Key, err)
+	}
+	defer output.Body.Close()
+
+	// The ETag of objects encrypted with KMS or customer keys is no checksum
+	// of their contents
+	if "" != aws.StringValue(output.SSECustomerAlgorithm) || awss3.ServerSideEncryptionAwsKms == aws.StringValue(output.ServerSideEncryption) {
+		checksum = nil
+	}
+
+	var stored io.Reader = backend.WrapBody(path, output.Body, s.bodyWrappers)
+	if nil != checksum {
+		stored = io.TeeReader(stored, checksum)
+	}
+
+	contents, err := s.restoredBody(output, stored, object.Key)
+	if err != nil {
+		return err
+	}
+	defer contents.Close()
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create directory for file: %s: %w", path, err)
+	}
+
+	tempFile, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %s: %w", path, err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = io.Copy(tempFile, contents)
+
+	// Whatever the decoders did not need still counts towards the checksum
+	if nil == err {
+		_, err = io.Copy(ioutil.Discard, stored)
+	}
+
+	closeErr := tempFile.Close()
+	if nil == err {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download object: %s: %w", object.Key, err)
+	}
+
+	if nil != checksum {
+		etag := strings.Trim(aws.StringValue(output.ETag), `"`)
+		if actual := checksum.etag(); actual != etag {
+			return fmt.Errorf("checksum mismatch for object %s, expected ETag %s but downloaded %s", object.Key, etag, actual)
+		}
+	}
+
+	modTime := aws.TimeValue(output.LastModified)
+	if value := metadataValue(output.Metadata, metadataModTime); "" != value {
+		parsed, err := time.Parse(time.RFC3339Nano, value)
+		if err == nil {
+			modTime = parsed
+		}
+	}
+
+	if !modTime.IsZero() {
+		err = os.Chtimes(tempFile.Name(), modTime, modTime)
+		if err != nil {
+			return fmt.Errorf("failed to set modification time of file: %s: %w", path, err)
+		}
+	}
+
+	return os.Rename(tempFile.Name(), path)
+}
+
+// Undo the encryption and compression of an object's stored body
+func (s *s3ObjectStore) restoredBody(output *awss3.GetObjectOutput, stored io.Reader, key string) (io.ReadCloser, error) {
+	if "" != metadataValue(output.Metadata, metadataEncryption) {
+		if nil == s.keyUnwrapper {
+			return nil, fmt.Errorf("object was encrypted on upload, an age identity or key file is needed to decrypt it: %s", key)
+		}
+
+		return decryptedBody(output.Metadata, stored, key, s.keyUnwrapper)
+	}
+
+	if contentEncoding := aws.StringValue(output.ContentEncoding); "" != contentEncoding {
+		decompressed, err := compress.NewDecompressingReader(contentEncoding, stored)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress object: %s: %w", key, err)
+		}
+
+		return decompressed, nil
+	}
+
+	return ioutil.NopCloser(stored), nil
+}
+
+// Create the hash to verify an object's ETag with. The ETag of an object that
+// was uploaded in parts is the MD5 of the MD5s of its parts, whose size is the
+// size of its first part.
+func (s *s3ObjectStore) etagHashFor(object download.Object) (*etagHash, error) {
+	etag := strings.Trim(object.ETag, `"`)
+
+	parts := strings.SplitN(etag, "-", 2)
+	if _, err := hex.DecodeString(parts[0]); err != nil || md5.Size*2 != len(parts[0]) {
+		return nil, nil
+	}
+
+	if 1 == len(parts) {
+		return newETagHash(0), nil
+	}
+
+	output, err := s.s3Client.HeadObject(&awss3.HeadObjectInput{
+		Bucket:     aws.String(s.fromBucket),
+		Key:        aws.String(object.Key),
+		PartNumber: aws.Int64(1),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find part size of object: %s: %w", object.Key, err)
+	}
+
+	return newETagHash(aws.Int64Value(output.ContentLength)), nil
+}
+
+// Ask for objects as they are stored. Otherwise the HTTP client decompresses
+// objects with a Content-Encoding of gzip itself, and their checksum fails.
+func withIdentityEncoding(r *request.Request) {
+	r.HTTPRequest.Header.Set("Accept-Encoding", "identity")
+}
+
+// etagHash computes the ETag S3 gives an object, from its contents uploaded
+// either at once or in parts of the part size
+type etagHash struct {
+	partSize  int64
+	part      hash.Hash
+	partBytes int64
+	partSums  []byte
+	numParts  int
+}
+
+func newETagHash(partSize int64) *etagHash {
+	return &etagHash{
+		partSize: partSize,
+		part:     md5.New(),
+	}
+}
+
+func (e *etagHash) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for e.partSize > 0 && e.partBytes+int64(len(p)) > e.partSize {
+		rest := e.partSize - e.partBytes
+		e.part.Write(p[:rest])
+		e.finishPart()
+		p = p[rest:]
+	}
+
+	e.part.Write(p)
+	e.partBytes += int64(len(p))
+
+	return n, nil
+}
+
+func (e *etagHash) finishPart() {
+	e.partSums = append(e.partSums, e.part.Sum(nil)...)
+	e.numParts++
+	e.part.Reset()
+	e.partBytes = 0
+}
+
+// The ETag of everything written so far
+func (e *etagHash) etag() string {
+	if 0 == e.partSize {
+		return hex.EncodeToString(e.part.Sum(nil))
+	}
+
+	partSums, numParts := e.partSums, e.numParts
+	if e.partBytes > 0 || 0 == numParts {
+		partSums = append(partSums, e.part.Sum(nil)...)
+		numParts++
+	}
+
+	sum := md5.Sum(partSums)
+
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), numParts)
+}
@@ -0,0 +1,301 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/timrourke/funnel/compress"
+	"github.com/timrourke/funnel/download"
+	"github.com/timrourke/funnel/encrypt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storedObject is an object as a stub S3 client stores it
+type storedObject struct {
+	body            []byte
+	etag            string
+	partSize        int64
+	metadata        map[string]*string
+	contentEncoding string
+	storageClass    string
+	restore         string
+}
+
+// stubS3DownloadClient serves objects from memory
+type stubS3DownloadClient struct {
+	objects         map[string]*storedObject
+	restoresPassed  []*awss3.RestoreObjectInput
+	restoreErr      error
+	getInputsPassed []*awss3.GetObjectInput
+}
+
+func (s *stubS3DownloadClient) ListObjectsV2Pages(input *awss3.ListObjectsV2Input, fn func(*awss3.ListObjectsV2Output, bool) bool) error {
+	output := &awss3.ListObjectsV2Output{}
+	for key, object := range s.objects {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) {
+			output.Contents = append(output.Contents, &awss3.Object{
+				Key:          aws.String(key),
+				Size:         aws.Int64(int64(len(object.body))),
+				ETag:         aws.String(`"` + object.etag + `"`),
+				StorageClass: aws.String(object.storageClass),
+			})
+		}
+	}
+
+	fn(output, true)
+
+	return nil
+}
+
+func (s *stubS3DownloadClient) HeadObject(input *awss3.HeadObjectInput) (*awss3.HeadObjectOutput, error) {
+	object, ok := s.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, errors.New("no such key")
+	}
+
+	output := &awss3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(object.body))),
+		StorageClass:  aws.String(object.storageClass),
+	}
+	if nil != input.PartNumber {
+		output.ContentLength = aws.Int64(object.partSize)
+	}
+	if "" != object.restore {
+		output.Restore = aws.String(object.restore)
+	}
+
+	return output, nil
+}
+
+func (s *stubS3DownloadClient) GetObjectWithContext(ctx aws.Context, input *awss3.GetObjectInput, options ...request.Option) (*awss3.GetObjectOutput, error) {
+	s.getInputsPassed = append(s.getInputsPassed, input)
+
+	object, ok := s.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, errors.New("no such key")
+	}
+
+	output := &awss3.GetObjectOutput{
+		Body:         ioutil.NopCloser(bytes.NewReader(object.body)),
+		ETag:         aws.String(`"` + object.etag + `"`),
+		LastModified: aws.Time(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)),
+		Metadata:     object.metadata,
+	}
+	if "" != object.contentEncoding {
+		output.ContentEncoding = aws.String(object.contentEncoding)
+	}
+
+	return output, nil
+}
+
+func (s *stubS3DownloadClient) RestoreObject(input *awss3.RestoreObjectInput) (*awss3.RestoreObjectOutput, error) {
+	s.restoresPassed = append(s.restoresPassed, input)
+
+	return &awss3.RestoreObjectOutput{}, s.restoreErr
+}
+
+func md5ETag(body []byte) string {
+	sum := md5.Sum(body)
+
+	return hex.EncodeToString(sum[:])
+}
+
+func TestS3ObjectStore(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	contents := []byte(strings.Repeat("some line\n", 1000))
+
+	outputDir, err := ioutil.TempDir("", "funnel-s3-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outputDir)
+
+	Convey("Should download objects and restore their modification times", t, func() {
+		modTime := time.Date(2019, 5, 6, 7, 8, 9, 123456789, time.UTC)
+		stub := &stubS3DownloadClient{objects: map[string]*storedObject{
+			"some/key": {
+				body:     contents,
+				etag:     md5ETag(contents),
+				metadata: map[string]*string{"Funnel-Mtime": aws.String(modTime.Format(time.RFC3339Nano))},
+			},
+		}}
+		store := NewS3ObjectStore(stub, "some-bucket", nil, 7, awss3.TierStandard, logger)
+		path := filepath.Join(outputDir, "nested", "file.txt")
+
+		err := store.Download(download.Object{Key: "some/key", ETag: `"` + md5ETag(contents) + `"`}, path)
+
+		So(err, ShouldBeNil)
+		downloaded, _ := ioutil.ReadFile(path)
+		So(downloaded, ShouldResemble, contents)
+
+		info, _ := os.Stat(path)
+		So(info.ModTime().Equal(modTime), ShouldBeTrue)
+		So(aws.StringValue(stub.getInputsPassed[0].IfMatch), ShouldEqual, `"`+md5ETag(contents)+`"`)
+	})
+
+	Convey("Should refuse objects whose contents do not match their ETags", t, func() {
+		stub := &stubS3DownloadClient{objects: map[string]*storedObject{
+			"some/key": {body: contents, etag: md5ETag([]byte("other contents"))},
+		}}
+		store := NewS3ObjectStore(stub, "some-bucket", nil, 7, awss3.TierStandard, logger)
+		path := filepath.Join(outputDir, "mismatch.txt")
+
+		err := store.Download(download.Object{Key: "some/key", ETag: md5ETag([]byte("other contents"))}, path)
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "checksum mismatch")
+
+		_, err = os.Stat(path)
+		So(os.IsNotExist(err), ShouldBeTrue)
+	})
+
+	Convey("Should verify the ETags of objects uploaded in parts", t, func() {
+		partSize := int64(4096)
+
+		var partSums []byte
+		for offset := int64(0); offset < int64(len(contents)); offset += partSize {
+			end := offset + partSize
+			if end > int64(len(contents)) {
+				end = int64(len(contents))
+			}
+			sum := md5.Sum(contents[offset:end])
+			partSums = append(partSums, sum[:]...)
+		}
+		etag := fmt.Sprintf("%s-%d", md5ETag(partSums), 3)
+
+		stub := &stubS3DownloadClient{objects: map[string]*storedObject{
+			"some/key": {body: contents, etag: etag, partSize: partSize},
+		}}
+		store := NewS3ObjectStore(stub, "some-bucket", nil, 7, awss3.TierStandard, logger)
+
+		So(store.Download(download.Object{Key: "some/key", ETag: etag}, filepath.Join(outputDir, "parts.txt")), ShouldBeNil)
+	})
+
+	Convey("Should decompress objects compressed on upload", t, func() {
+		var compressed bytes.Buffer
+		writer, err := compress.NewWriter(compress.Gzip, &compressed)
+		So(err, ShouldBeNil)
+		writer.Write(contents)
+		writer.Close()
+
+		stub := &stubS3DownloadClient{objects: map[string]*storedObject{
+			"some/key.gz": {
+				body:            compressed.Bytes(),
+				etag:            md5ETag(compressed.Bytes()),
+				contentEncoding: compress.ContentEncoding(compress.Gzip),
+			},
+		}}
+		store := NewS3ObjectStore(stub, "some-bucket", nil, 7, awss3.TierStandard, logger)
+		path := filepath.Join(outputDir, "compressed.txt")
+
+		So(store.Download(download.Object{Key: "some/key.gz", ETag: md5ETag(compressed.Bytes())}, path), ShouldBeNil)
+
+		downloaded, _ := ioutil.ReadFile(path)
+		So(downloaded, ShouldResemble, contents)
+	})
+
+	Convey("Should decrypt objects encrypted on upload", t, func() {
+		key := bytes.Repeat([]byte{7}, encrypt.DataKeySize)
+
+		uploaded := &readingS3ManagerUploader{}
+		_, err := NewEncryptingS3ManagerUploader(uploaded, encrypt.NewKeyFileWrapper(key)).Upload(&s3manager.UploadInput{
+			Body:   bytes.NewReader(contents),
+			Bucket: aws.String("some-bucket"),
+			Key:    aws.String("some/secret"),
+		})
+		So(err, ShouldBeNil)
+
+		stub := &stubS3DownloadClient{objects: map[string]*storedObject{
+			"some/secret": {
+				body:     uploaded.bodies[0],
+				etag:     md5ETag(uploaded.bodies[0]),
+				metadata: uploaded.inputsPassed[0].Metadata,
+			},
+		}}
+		object := download.Object{Key: "some/secret", ETag: md5ETag(uploaded.bodies[0])}
+		path := filepath.Join(outputDir, "secret.txt")
+
+		err = NewS3ObjectStore(stub, "some-bucket", nil, 7, awss3.TierStandard, logger).Download(object, path)
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "needed to decrypt it")
+
+		err = NewS3ObjectStore(stub, "some-bucket", encrypt.NewKeyFileUnwrapper(key), 7, awss3.TierStandard, logger).Download(object, path)
+		So(err, ShouldBeNil)
+
+		downloaded, _ := ioutil.ReadFile(path)
+		So(downloaded, ShouldResemble, contents)
+	})
+
+	Convey("Should list archived objects as such", t, func() {
+		stub := &stubS3DownloadClient{objects: map[string]*storedObject{
+			"some/archived": {body: contents, storageClass: awss3.StorageClassGlacier},
+			"other/key":     {body: contents, storageClass: awss3.StorageClassStandard},
+		}}
+		store := NewS3ObjectStore(stub, "some-bucket", nil, 7, awss3.TierStandard, logger)
+
+		var objects []download.Object
+		err := store.ListObjects("some/", func(object download.Object) error {
+			objects = append(objects, object)
+			return nil
+		})
+
+		So(err, ShouldBeNil)
+		So(objects, ShouldHaveLength, 1)
+		So(objects[0].Key, ShouldEqual, "some/archived")
+		So(objects[0].Archived, ShouldBeTrue)
+	})
+
+	Convey("Should request restores of archived objects until they are restored", t, func() {
+		archived := &storedObject{body: contents, storageClass: awss3.StorageClassDeepArchive}
+		stub := &stubS3DownloadClient{objects: map[string]*storedObject{"some/archived": archived}}
+		store := NewS3ObjectStore(stub, "some-bucket", nil, 3, awss3.TierBulk, logger)
+		object := download.Object{Key: "some/archived", Archived: true}
+
+		available, err := store.Restore(object)
+		So(err, ShouldBeNil)
+		So(available, ShouldBeFalse)
+		So(stub.restoresPassed, ShouldHaveLength, 1)
+		So(aws.Int64Value(stub.restoresPassed[0].RestoreRequest.Days), ShouldEqual, 3)
+		So(aws.StringValue(stub.restoresPassed[0].RestoreRequest.GlacierJobParameters.Tier), ShouldEqual, awss3.TierBulk)
+
+		archived.restore = `ongoing-request="true"`
+		available, err = store.Restore(object)
+		So(err, ShouldBeNil)
+		So(available, ShouldBeFalse)
+
+		archived.restore = `ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`
+		available, err = store.Restore(object)
+		So(err, ShouldBeNil)
+		So(available, ShouldBeTrue)
+		So(stub.restoresPassed, ShouldHaveLength, 1)
+	})
+
+	Convey("Should wait for restores that are in progress already", t, func() {
+		stub := &stubS3DownloadClient{
+			objects:    map[string]*storedObject{"some/archived": {body: contents, storageClass: awss3.StorageClassGlacier}},
+			restoreErr: awserr.New("RestoreAlreadyInProgress", "restore in progress", nil),
+		}
+		store := NewS3ObjectStore(stub, "some-bucket", nil, 7, awss3.TierStandard, logger)
+
+		available, err := store.Restore(download.Object{Key: "some/archived", Archived: true})
+
+		So(err, ShouldBeNil)
+		So(available, ShouldBeFalse)
+	})
+}
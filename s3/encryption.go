@@ -0,0 +1,177 @@
+package s3
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/timrourke/funnel/compress"
+	"github.com/timrourke/funnel/encrypt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Metadata of objects encrypted on the client, which is everything but the data
+// key's wrapping key needed to decrypt them
+const (
+	metadataEncryption      = "funnel-encryption"
+	metadataKeyWrapping     = "funnel-key-wrapping"
+	metadataWrappedKey      = "funnel-wrapped-key"
+	metadataContentEncoding = "funnel-content-encoding"
+)
+
+// S3ObjectGetter knows how to download objects from AWS S3. Like
+// `S3ManagerUploader`, it narrows the dependency on the `s3.S3` concrete type so
+// that simple test doubles can stand in for it
+type S3ObjectGetter interface {
+	GetObject(input *awss3.GetObjectInput) (*awss3.GetObjectOutput, error)
+}
+
+type encryptingS3ManagerUploader struct {
+	s3UploadManager S3ManagerUploader
+	keyWrapper      encrypt.KeyWrapper
+}
+
+// NewEncryptingS3ManagerUploader creates an upload manager that encrypts the
+// body of every upload with a data key of its own before handing it on, and
+// stores the wrapped data key in the object's metadata. Encryption is streamed
+// one chunk at a time, so it works with the multipart uploads of the AWS SDK
+// without holding whole files in memory.
+func NewEncryptingS3ManagerUploader(s3UploadManager S3ManagerUploader, keyWrapper encrypt.KeyWrapper) S3ManagerUploader {
+	return &encryptingS3ManagerUploader{
+		s3UploadManager: s3UploadManager,
+		keyWrapper:      keyWrapper,
+	}
+}
+
+// Upload encrypts the body of the upload input. A Content-Encoding no longer
+// applies to the encrypted body, so it is moved into the metadata to be
+// restored on decryption.
+func (e *encryptingS3ManagerUploader) Upload(
+	input *s3manager.UploadInput,
+	options ...func(*s3manager.Uploader),
+) (*s3manager.UploadOutput, error) {
+	dataKey, err := encrypt.NewDataKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	wrappedKey, err := e.keyWrapper.Wrap(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	body, err := encrypt.NewEncryptingReader(input.Body, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	encryptedInput := *input
+	encryptedInput.Body = body
+	encryptedInput.ContentEncoding = nil
+	encryptedInput.Metadata = map[string]*string{}
+	for name, value := range input.Metadata {
+		encryptedInput.Metadata[name] = value
+	}
+
+	encryptedInput.Metadata[metadataEncryption] = aws.String(encrypt.Algorithm)
+	encryptedInput.Metadata[metadataKeyWrapping] = aws.String(e.keyWrapper.KeyWrapping())
+	encryptedInput.Metadata[metadataWrappedKey] = aws.String(base64.StdEncoding.EncodeToString(wrappedKey))
+	if nil != input.ContentEncoding {
+		encryptedInput.Metadata[metadataContentEncoding] = input.ContentEncoding
+	}
+
+	return e.s3UploadManager.Upload(&encryptedInput, options...)
+}
+
+// DownloadDecrypted downloads an object that was encrypted on upload, writing
+// its plaintext to w. Objects that were compressed with a Content-Encoding are
+// decompressed too, restoring the original file.
+func DownloadDecrypted(
+	s3Client S3ObjectGetter,
+	fromBucket string,
+	key string,
+	keyUnwrapper encrypt.KeyUnwrapper,
+	w io.Writer,
+) error {
+	output, err := s3Client.GetObject(&awss3.GetObjectInput{
+		Bucket: aws.String(fromBucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to download object: %s: %w", key, err)
+	}
+	defer output.Body.Close()
+
+	plaintext, err := decryptedBody(output.Metadata, output.Body, key, keyUnwrapper)
+	if err != nil {
+		return err
+	}
+	defer plaintext.Close()
+
+	_, err = io.Copy(w, plaintext)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt object: %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// Decrypt the body of an object that was encrypted on upload, with the data key
+// wrapped in its metadata. Bodies that were compressed before they were
+// encrypted are decompressed too.
+func decryptedBody(
+	metadata map[string]*string,
+	body io.Reader,
+	key string,
+	keyUnwrapper encrypt.KeyUnwrapper,
+) (io.ReadCloser, error) {
+	algorithm := metadataValue(metadata, metadataEncryption)
+	if "" == algorithm {
+		return nil, fmt.Errorf("object was not encrypted by funnel: %s", key)
+	}
+
+	if algorithm != encrypt.Algorithm {
+		return nil, fmt.Errorf("object was encrypted with unsupported algorithm %s: %s", algorithm, key)
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(metadataValue(metadata, metadataWrappedKey))
+	if err != nil {
+		return nil, fmt.Errorf("object has an invalid wrapped data key: %s: %w", key, err)
+	}
+
+	dataKey, err := keyUnwrapper.Unwrap(metadataValue(metadata, metadataKeyWrapping), wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt object: %s: %w", key, err)
+	}
+
+	plaintext, err := encrypt.NewDecryptingReader(body, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if contentEncoding := metadataValue(metadata, metadataContentEncoding); "" != contentEncoding {
+		decompressed, err := compress.NewDecompressingReader(contentEncoding, plaintext)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress object: %s: %w", key, err)
+		}
+
+		return decompressed, nil
+	}
+
+	return ioutil.NopCloser(plaintext), nil
+}
+
+// Look up object metadata by name. The AWS SDK canonicalizes the names of
+// downloaded metadata like HTTP headers, eg. `Funnel-Encryption`.
+func metadataValue(metadata map[string]*string, name string) string {
+	for metadataName, value := range metadata {
+		if strings.EqualFold(metadataName, name) {
+			return aws.StringValue(value)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,141 @@
+package s3
+
+import (
+	"bytes"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/timrourke/funnel/compress"
+	"github.com/timrourke/funnel/encrypt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// funcS3ObjectGetter adapts a function to the `S3ObjectGetter` interface
+type funcS3ObjectGetter func(input *awss3.GetObjectInput) (*awss3.GetObjectOutput, error)
+
+func (f funcS3ObjectGetter) GetObject(input *awss3.GetObjectInput) (*awss3.GetObjectOutput, error) {
+	return f(input)
+}
+
+// Serve the objects uploaded through an upload manager, with their metadata
+// canonicalized as the AWS SDK does
+func uploadedObjectGetter(uploaded *readingS3ManagerUploader) S3ObjectGetter {
+	return funcS3ObjectGetter(func(input *awss3.GetObjectInput) (*awss3.GetObjectOutput, error) {
+		for i, uploadInput := range uploaded.inputsPassed {
+			if aws.StringValue(uploadInput.Key) != aws.StringValue(input.Key) {
+				continue
+			}
+
+			metadata := map[string]*string{}
+			for name, value := range uploadInput.Metadata {
+				metadata[strings.Title(name)] = value
+			}
+
+			return &awss3.GetObjectOutput{
+				Body:     ioutil.NopCloser(bytes.NewReader(uploaded.bodies[i])),
+				Metadata: metadata,
+			}, nil
+		}
+
+		return nil, errors.New("no such key")
+	})
+}
+
+func TestEncryptingS3ManagerUploader(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, encrypt.DataKeySize)
+	contents := strings.Repeat("some secret line\n", 10000)
+
+	Convey("Should upload encrypted contents that can be downloaded decrypted", t, func() {
+		stub := &readingS3ManagerUploader{}
+		uploader := NewEncryptingS3ManagerUploader(stub, encrypt.NewKeyFileWrapper(key))
+
+		_, err := uploader.Upload(&s3manager.UploadInput{
+			Body:     strings.NewReader(contents),
+			Bucket:   aws.String("some-bucket"),
+			Key:      aws.String("some/key"),
+			Metadata: map[string]*string{"other": aws.String("value")},
+		})
+
+		So(err, ShouldBeNil)
+		So(string(stub.bodies[0]), ShouldNotContainSubstring, "secret")
+
+		metadata := stub.inputsPassed[0].Metadata
+		So(aws.StringValue(metadata["funnel-encryption"]), ShouldEqual, encrypt.Algorithm)
+		So(aws.StringValue(metadata["funnel-key-wrapping"]), ShouldEqual, encrypt.KeyWrappingKeyFile)
+		So(aws.StringValue(metadata["other"]), ShouldEqual, "value")
+
+		var plaintext bytes.Buffer
+		err = DownloadDecrypted(
+			uploadedObjectGetter(stub),
+			"some-bucket",
+			"some/key",
+			encrypt.NewKeyFileUnwrapper(key),
+			&plaintext,
+		)
+
+		So(err, ShouldBeNil)
+		So(plaintext.String(), ShouldEqual, contents)
+
+		Convey("Should fail to decrypt with another key", func() {
+			otherKey := bytes.Repeat([]byte{8}, encrypt.DataKeySize)
+
+			err := DownloadDecrypted(
+				uploadedObjectGetter(stub),
+				"some-bucket",
+				"some/key",
+				encrypt.NewKeyFileUnwrapper(otherKey),
+				ioutil.Discard,
+			)
+
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Should restore the Content-Encoding of compressed files on decryption", t, func() {
+		stub := &readingS3ManagerUploader{}
+		uploader := NewEncryptingS3ManagerUploader(stub, encrypt.NewKeyFileWrapper(key))
+
+		compressed, err := compress.NewReader(compress.Gzip, strings.NewReader(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer compressed.Close()
+
+		_, err = uploader.Upload(&s3manager.UploadInput{
+			Body:            compressed,
+			Bucket:          aws.String("some-bucket"),
+			ContentEncoding: aws.String("gzip"),
+			Key:             aws.String("some/key.log"),
+		})
+
+		So(err, ShouldBeNil)
+		So(stub.inputsPassed[0].ContentEncoding, ShouldBeNil)
+
+		var plaintext bytes.Buffer
+		err = DownloadDecrypted(
+			uploadedObjectGetter(stub),
+			"some-bucket",
+			"some/key.log",
+			encrypt.NewKeyFileUnwrapper(key),
+			&plaintext,
+		)
+
+		So(err, ShouldBeNil)
+		So(plaintext.String(), ShouldEqual, contents)
+	})
+
+	Convey("Should fail to decrypt objects that were not encrypted", t, func() {
+		getter := funcS3ObjectGetter(func(input *awss3.GetObjectInput) (*awss3.GetObjectOutput, error) {
+			return &awss3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader(contents))}, nil
+		})
+
+		err := DownloadDecrypted(getter, "some-bucket", "some/key", encrypt.NewKeyFileUnwrapper(key), ioutil.Discard)
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "not encrypted")
+	})
+}
@@ -0,0 +1,153 @@
+package s3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Journal persists the state of in-progress multipart uploads to local disk, so
+// that an upload interrupted by a crash or restart can be resumed rather than
+// started over from the first byte
+type Journal interface {
+	Load(bucket string, key string, path string) (*JournalEntry, error)
+	Save(entry *JournalEntry) error
+	Delete(entry *JournalEntry) error
+}
+
+// JournalEntry records a multipart upload of a single local file, along with
+// every part known to have been uploaded successfully
+type JournalEntry struct {
+	Bucket   string        `json:"bucket"`
+	Key      string        `json:"key"`
+	Path     string        `json:"path"`
+	Size     int64         `json:"size"`
+	ModTime  time.Time     `json:"modTime"`
+	UploadID string        `json:"uploadId"`
+	PartSize int64         `json:"partSize"`
+	Parts    []JournalPart `json:"parts"`
+}
+
+// JournalPart is a single completed part of a multipart upload
+type JournalPart struct {
+	PartNumber int64  `json:"partNumber"`
+	ETag       string `json:"etag"`
+}
+
+type fileJournal struct {
+	mux sync.Mutex
+	dir string
+}
+
+// NewFileJournal creates a journal that stores one JSON document per
+// multipart upload in the given directory
+func NewFileJournal(dir string) (Journal, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileJournal{dir: dir}, nil
+}
+
+// Load returns the journal entry for a file being uploaded to a given bucket
+// and key, or nil if no upload of that file is in progress
+func (j *fileJournal) Load(bucket string, key string, path string) (*JournalEntry, error) {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	entryPath, err := j.entryPath(bucket, key, path)
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := ioutil.ReadFile(entryPath)
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &JournalEntry{}
+	err = json.Unmarshal(contents, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// Save atomically writes the journal entry to disk, replacing any previous
+// state recorded for the same upload
+func (j *fileJournal) Save(entry *JournalEntry) error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	entryPath, err := j.entryPath(entry.Bucket, entry.Key, entry.Path)
+	if err != nil {
+		return err
+	}
+
+	contents, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(j.dir, ".entry-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	_, err = tmpFile.Write(contents)
+	if err != nil {
+		tmpFile.Close()
+		return err
+	}
+
+	err = tmpFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), entryPath)
+}
+
+// Delete removes the journal entry once its upload is either completed or
+// abandoned
+func (j *fileJournal) Delete(entry *JournalEntry) error {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	entryPath, err := j.entryPath(entry.Bucket, entry.Key, entry.Path)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(entryPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// Entries are named after a digest of their identifying fields so that keys and
+// paths containing arbitrary characters map to safe file names
+func (j *fileJournal) entryPath(bucket string, key string, path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	digest := sha256.Sum256([]byte(bucket + "\x00" + key + "\x00" + absPath))
+
+	return filepath.Join(j.dir, hex.EncodeToString(digest[:])+".json"), nil
+}
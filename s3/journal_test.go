@@ -0,0 +1,73 @@
+package s3
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	journal, err := NewFileJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Should load nothing for an unknown upload", t, func() {
+		entry, err := journal.Load("some-bucket", "some-key", "/some/path")
+
+		So(err, ShouldBeNil)
+		So(entry, ShouldBeNil)
+	})
+
+	Convey("Should load a saved entry", t, func() {
+		expected := &JournalEntry{
+			Bucket:   "some-bucket",
+			Key:      "some-key",
+			Path:     "/some/path",
+			Size:     1024,
+			ModTime:  time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+			UploadID: "some-upload-id",
+			PartSize: 512,
+			Parts:    []JournalPart{{PartNumber: 1, ETag: `"abc"`}},
+		}
+
+		err := journal.Save(expected)
+		So(err, ShouldBeNil)
+
+		actual, err := journal.Load("some-bucket", "some-key", "/some/path")
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldResemble, expected)
+
+		Convey("Should not load the entry for a different key", func() {
+			actual, err := journal.Load("some-bucket", "other-key", "/some/path")
+
+			So(err, ShouldBeNil)
+			So(actual, ShouldBeNil)
+		})
+
+		Convey("Should forget a deleted entry", func() {
+			err := journal.Delete(expected)
+			So(err, ShouldBeNil)
+
+			actual, err := journal.Load("some-bucket", "some-key", "/some/path")
+
+			So(err, ShouldBeNil)
+			So(actual, ShouldBeNil)
+		})
+	})
+
+	Convey("Should tolerate deleting an entry that was never saved", t, func() {
+		err := journal.Delete(&JournalEntry{Bucket: "b", Key: "k", Path: "p"})
+
+		So(err, ShouldBeNil)
+	})
+}
@@ -0,0 +1,400 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sirupsen/logrus"
+	"github.com/timrourke/funnel/backend"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// maxParts is the largest number of parts S3 accepts for one multipart upload
+const maxParts = 10000
+
+// S3MultipartClient knows how to drive multipart uploads through the low level
+// S3 API. Like `S3ManagerUploader`, it narrows the dependency on the `s3.S3`
+// concrete type so that simple test doubles can stand in for it
+type S3MultipartClient interface {
+	AbortMultipartUpload(input *awss3.AbortMultipartUploadInput) (*awss3.AbortMultipartUploadOutput, error)
+	CompleteMultipartUpload(input *awss3.CompleteMultipartUploadInput) (*awss3.CompleteMultipartUploadOutput, error)
+	CreateMultipartUpload(input *awss3.CreateMultipartUploadInput) (*awss3.CreateMultipartUploadOutput, error)
+	ListMultipartUploads(input *awss3.ListMultipartUploadsInput) (*awss3.ListMultipartUploadsOutput, error)
+	ListParts(input *awss3.ListPartsInput) (*awss3.ListPartsOutput, error)
+	UploadPart(input *awss3.UploadPartInput) (*awss3.UploadPartOutput, error)
+}
+
+type resumableS3Uploader struct {
+	smallFileUploader  S3Uploader
+	s3Client           S3MultipartClient
+	journal            Journal
+	toBucket           string
+	multipartThreshold int64
+	partSize           int64
+	bodyWrappers       []backend.BodyWrapper
+	logger             *logrus.Logger
+}
+
+// NewResumableS3Uploader creates an uploader that sends files at or above the
+// multipart threshold as journaled multipart uploads. If funnel stops partway
+// through such a file, the next attempt to upload it resumes from the last part
+// S3 confirmed instead of starting over. Smaller files are uploaded as usual.
+func NewResumableS3Uploader(
+	s3UploadManager S3ManagerUploader,
+	s3Client S3MultipartClient,
+	journal Journal,
+	toBucket string,
+	multipartThreshold int64,
+	partSize int64,
+	logger *logrus.Logger,
+	bodyWrappers ...backend.BodyWrapper,
+) S3Uploader {
+	return &resumableS3Uploader{
+		smallFileUploader:  NewS3Uploader(s3UploadManager, toBucket, logger, bodyWrappers...),
+		s3Client:           s3Client,
+		journal:            journal,
+		toBucket:           toBucket,
+		multipartThreshold: multipartThreshold,
+		partSize:           partSize,
+		bodyWrappers:       bodyWrappers,
+		logger:             logger,
+	}
+}
+
+// Upload a file with a given path to AWS S3, resuming a previously interrupted
+// multipart upload of the same file if one was journaled
+func (r *resumableS3Uploader) Upload(path string, key string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return r.smallFileUploader.Upload(path, key)
+	}
+
+	// A file that fits in a single part, including an empty one, gains nothing
+	// from a multipart upload, which S3 refuses to complete without parts
+	if info.Size() < r.multipartThreshold || info.Size() <= partSizeForFile(r.partSize, info.Size()) {
+		return r.smallFileUploader.Upload(path, key)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		r.logger.WithFields(logrus.Fields{
+			"filename": path,
+			"error":    err.Error(),
+		}).Error("Failed to open file")
+		return err
+	}
+	defer file.Close()
+
+	entry, err := r.resumeOrCreate(path, key, info)
+	if err != nil {
+		return err
+	}
+
+	completedParts := make(map[int64]string, len(entry.Parts))
+	for _, part := range entry.Parts {
+		completedParts[part.PartNumber] = part.ETag
+	}
+
+	// The body wrappers, eg. a per-file bandwidth limit, apply once to the whole
+	// upload and read its parts one after another
+	currentPart := &partsReader{}
+	wrapped := backend.WrapBody(path, currentPart, r.bodyWrappers)
+
+	numParts := (entry.Size + entry.PartSize - 1) / entry.PartSize
+	for partNumber := int64(1); partNumber <= numParts; partNumber++ {
+		if _, ok := completedParts[partNumber]; ok {
+			continue
+		}
+
+		offset := (partNumber - 1) * entry.PartSize
+		length := entry.PartSize
+		if offset+length > entry.Size {
+			length = entry.Size - offset
+		}
+
+		body, err := r.readPart(currentPart, wrapped, file, offset, length)
+		if err != nil {
+			return fmt.Errorf("failed to read part %d of %s: %w", partNumber, path, err)
+		}
+
+		output, err := r.s3Client.UploadPart(&awss3.UploadPartInput{
+			Body:          body,
+			Bucket:        aws.String(entry.Bucket),
+			ContentLength: aws.Int64(length),
+			Key:           aws.String(entry.Key),
+			PartNumber:    aws.Int64(partNumber),
+			UploadId:      aws.String(entry.UploadID),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upload part %d of %s: %w", partNumber, path, err)
+		}
+
+		entry.Parts = append(entry.Parts, JournalPart{
+			PartNumber: partNumber,
+			ETag:       aws.StringValue(output.ETag),
+		})
+
+		err = r.journal.Save(entry)
+		if err != nil {
+			return fmt.Errorf("failed to journal part %d of %s: %w", partNumber, path, err)
+		}
+	}
+
+	sort.Slice(entry.Parts, func(i, j int) bool {
+		return entry.Parts[i].PartNumber < entry.Parts[j].PartNumber
+	})
+
+	var parts []*awss3.CompletedPart
+	for _, part := range entry.Parts {
+		parts = append(parts, &awss3.CompletedPart{
+			ETag:       aws.String(part.ETag),
+			PartNumber: aws.Int64(part.PartNumber),
+		})
+	}
+
+	_, err = r.s3Client.CompleteMultipartUpload(&awss3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(entry.Bucket),
+		Key:             aws.String(entry.Key),
+		MultipartUpload: &awss3.CompletedMultipartUpload{Parts: parts},
+		UploadId:        aws.String(entry.UploadID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete multipart upload of %s: %w", path, err)
+	}
+
+	return r.journal.Delete(entry)
+}
+
+// Read one part of the file through the body wrappers, without holding the
+// part in memory
+func (r *resumableS3Uploader) readPart(parts *partsReader, wrapped io.Reader, file *os.File, offset int64, length int64) (io.ReadSeeker, error) {
+	section := io.NewSectionReader(file, offset, length)
+	if len(r.bodyWrappers) == 0 {
+		return section, nil
+	}
+
+	parts.part = io.NewSectionReader(file, offset, length)
+
+	return &partBody{section: section, wrapped: wrapped}, nil
+}
+
+// partsReader reads the part of a file that is being uploaded at the moment
+type partsReader struct {
+	part io.Reader
+}
+
+func (p *partsReader) Read(buf []byte) (int, error) {
+	return p.part.Read(buf)
+}
+
+// partBody streams one part of a file, reading each of its bytes through the
+// body wrappers once. The SDK seeks back and reads a part again, eg. to sign it
+// and to retry it, which then reads the bytes the wrappers saw before straight
+// from the file.
+type partBody struct {
+	section *io.SectionReader
+	wrapped io.Reader
+
+	// The position in the part, and how far into it the wrappers read
+	position int64
+	seen     int64
+}
+
+func (p *partBody) Read(buf []byte) (int, error) {
+	if p.position >= p.section.Size() {
+		return 0, io.EOF
+	}
+
+	if p.position < p.seen {
+		if int64(len(buf)) > p.seen-p.position {
+			buf = buf[:p.seen-p.position]
+		}
+
+		n, err := p.section.ReadAt(buf, p.position)
+		p.position += int64(n)
+		if err == io.EOF && n == len(buf) {
+			err = nil
+		}
+
+		return n, err
+	}
+
+	// Skipping ahead still reads the skipped bytes through the wrappers, as
+	// they read the part from start to end
+	if p.position > p.seen {
+		skipped, err := io.CopyN(ioutil.Discard, p.wrapped, p.position-p.seen)
+		p.seen += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := p.wrapped.Read(buf)
+	p.position += int64(n)
+	p.seen += int64(n)
+
+	return n, err
+}
+
+func (p *partBody) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += p.position
+	case io.SeekEnd:
+		offset += p.section.Size()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	p.position = offset
+
+	return offset, nil
+}
+
+// Find a journaled upload of this exact file that S3 still knows about, or
+// start a new multipart upload when there is nothing to resume
+func (r *resumableS3Uploader) resumeOrCreate(path string, key string, info os.FileInfo) (*JournalEntry, error) {
+	entry, err := r.journal.Load(r.toBucket, key, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read multipart journal for %s: %w", path, err)
+	}
+
+	if entry != nil && (entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime())) {
+		r.logger.WithFields(logrus.Fields{
+			"filename": path,
+			"uploadId": entry.UploadID,
+		}).Info("File changed since its multipart upload began, starting over")
+
+		r.abandon(entry)
+		entry = nil
+	}
+
+	if entry != nil {
+		remoteParts, err := r.listParts(entry)
+		if err == nil {
+			var confirmedParts []JournalPart
+			for _, part := range entry.Parts {
+				if remoteParts[part.PartNumber] == part.ETag {
+					confirmedParts = append(confirmedParts, part)
+				}
+			}
+			entry.Parts = confirmedParts
+
+			r.logger.WithFields(logrus.Fields{
+				"filename":       path,
+				"uploadId":       entry.UploadID,
+				"completedParts": len(entry.Parts),
+			}).Info("Resuming multipart upload")
+
+			return entry, nil
+		}
+
+		r.logger.WithFields(logrus.Fields{
+			"filename": path,
+			"uploadId": entry.UploadID,
+			"error":    err.Error(),
+		}).Warn("Unable to resume multipart upload, starting over")
+
+		r.abandon(entry)
+	}
+
+	output, err := r.s3Client.CreateMultipartUpload(&awss3.CreateMultipartUploadInput{
+		Bucket:   aws.String(r.toBucket),
+		Key:      aws.String(key),
+		Metadata: fileMetadata(info),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create multipart upload for %s: %w", path, err)
+	}
+
+	entry = &JournalEntry{
+		Bucket:   r.toBucket,
+		Key:      key,
+		Path:     path,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		UploadID: aws.StringValue(output.UploadId),
+		PartSize: partSizeForFile(r.partSize, info.Size()),
+	}
+
+	err = r.journal.Save(entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to journal multipart upload for %s: %w", path, err)
+	}
+
+	return entry, nil
+}
+
+// List every part S3 has stored for a multipart upload, keyed by part number
+func (r *resumableS3Uploader) listParts(entry *JournalEntry) (map[int64]string, error) {
+	parts := make(map[int64]string)
+	input := &awss3.ListPartsInput{
+		Bucket:   aws.String(entry.Bucket),
+		Key:      aws.String(entry.Key),
+		UploadId: aws.String(entry.UploadID),
+	}
+
+	for {
+		output, err := r.s3Client.ListParts(input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, part := range output.Parts {
+			parts[aws.Int64Value(part.PartNumber)] = aws.StringValue(part.ETag)
+		}
+
+		if !aws.BoolValue(output.IsTruncated) {
+			return parts, nil
+		}
+
+		input.PartNumberMarker = output.NextPartNumberMarker
+	}
+}
+
+// Abort an upload that can no longer be resumed so its parts stop accruing
+// storage charges, and forget about it locally
+func (r *resumableS3Uploader) abandon(entry *JournalEntry) {
+	_, err := r.s3Client.AbortMultipartUpload(&awss3.AbortMultipartUploadInput{
+		Bucket:   aws.String(entry.Bucket),
+		Key:      aws.String(entry.Key),
+		UploadId: aws.String(entry.UploadID),
+	})
+	var awsErr awserr.Error
+	if err != nil && !(errors.As(err, &awsErr) && awsErr.Code() == awss3.ErrCodeNoSuchUpload) {
+		r.logger.WithFields(logrus.Fields{
+			"filename": entry.Path,
+			"uploadId": entry.UploadID,
+			"error":    err.Error(),
+		}).Warn("Failed to abort multipart upload")
+	}
+
+	err = r.journal.Delete(entry)
+	if err != nil {
+		r.logger.WithFields(logrus.Fields{
+			"filename": entry.Path,
+			"error":    err.Error(),
+		}).Warn("Failed to remove multipart journal entry")
+	}
+}
+
+// Grow the configured part size when needed to keep very large files within the
+// maximum number of parts S3 allows
+func partSizeForFile(partSize int64, fileSize int64) int64 {
+	minPartSize := (fileSize + maxParts - 1) / maxParts
+	if partSize < minPartSize {
+		return minPartSize
+	}
+
+	return partSize
+}
@@ -0,0 +1,407 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// stubS3MultipartClient keeps uploaded parts in memory and can be told to fail
+// uploading a specific part number. Like the SDK, it reads the body of each
+// part twice, once to sign it and once to send it.
+type stubS3MultipartClient struct {
+	uploads         map[string]map[int64]string
+	uploadedParts   []int64
+	partBodies      []string
+	completedParts  []*awss3.CompletedPart
+	abortedUploads  []string
+	failOnPart      int64
+	listedUploads   []*awss3.MultipartUpload
+	nextUploadIDNum int
+}
+
+func newStubS3MultipartClient() *stubS3MultipartClient {
+	return &stubS3MultipartClient{uploads: make(map[string]map[int64]string)}
+}
+
+func (s *stubS3MultipartClient) AbortMultipartUpload(input *awss3.AbortMultipartUploadInput) (*awss3.AbortMultipartUploadOutput, error) {
+	s.abortedUploads = append(s.abortedUploads, *input.UploadId)
+	delete(s.uploads, *input.UploadId)
+	return &awss3.AbortMultipartUploadOutput{}, nil
+}
+
+func (s *stubS3MultipartClient) CompleteMultipartUpload(input *awss3.CompleteMultipartUploadInput) (*awss3.CompleteMultipartUploadOutput, error) {
+	s.completedParts = input.MultipartUpload.Parts
+	return &awss3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (s *stubS3MultipartClient) CreateMultipartUpload(input *awss3.CreateMultipartUploadInput) (*awss3.CreateMultipartUploadOutput, error) {
+	s.nextUploadIDNum++
+	uploadID := fmt.Sprintf("upload-%d", s.nextUploadIDNum)
+	s.uploads[uploadID] = make(map[int64]string)
+	return &awss3.CreateMultipartUploadOutput{UploadId: aws.String(uploadID)}, nil
+}
+
+func (s *stubS3MultipartClient) ListMultipartUploads(input *awss3.ListMultipartUploadsInput) (*awss3.ListMultipartUploadsOutput, error) {
+	return &awss3.ListMultipartUploadsOutput{
+		Uploads:     s.listedUploads,
+		IsTruncated: aws.Bool(false),
+	}, nil
+}
+
+func (s *stubS3MultipartClient) ListParts(input *awss3.ListPartsInput) (*awss3.ListPartsOutput, error) {
+	parts, ok := s.uploads[*input.UploadId]
+	if !ok {
+		return nil, awserr.New(awss3.ErrCodeNoSuchUpload, "no such upload", nil)
+	}
+
+	output := &awss3.ListPartsOutput{IsTruncated: aws.Bool(false)}
+	for partNumber, etag := range parts {
+		output.Parts = append(output.Parts, &awss3.Part{
+			ETag:       aws.String(etag),
+			PartNumber: aws.Int64(partNumber),
+		})
+	}
+
+	return output, nil
+}
+
+func (s *stubS3MultipartClient) UploadPart(input *awss3.UploadPartInput) (*awss3.UploadPartOutput, error) {
+	if *input.PartNumber == s.failOnPart {
+		return nil, errors.New("connection reset")
+	}
+
+	if _, err := io.Copy(ioutil.Discard, input.Body); err != nil {
+		return nil, err
+	}
+	if _, err := input.Body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	s.partBodies = append(s.partBodies, string(body))
+
+	etag := fmt.Sprintf(`"etag-%d"`, *input.PartNumber)
+	s.uploads[*input.UploadId][*input.PartNumber] = etag
+	s.uploadedParts = append(s.uploadedParts, *input.PartNumber)
+
+	return &awss3.UploadPartOutput{ETag: aws.String(etag)}, nil
+}
+
+func TestResumableS3Uploader_Upload(t *testing.T) {
+	file, err := ioutil.TempFile("", "largefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString("0123456789")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	newJournal := func() (Journal, string) {
+		dir, err := ioutil.TempDir("", "journal")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		journal, err := NewFileJournal(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return journal, dir
+	}
+
+	Convey("Should upload small files without multipart", t, func() {
+		journal, dir := newJournal()
+		defer os.RemoveAll(dir)
+
+		manager := &stubS3ManagerUploader{
+			expectedReturnValues: []*s3manager.UploadOutput{nil},
+			expectedErrorValues:  []error{nil},
+		}
+		client := newStubS3MultipartClient()
+
+		uploader := NewResumableS3Uploader(manager, client, journal, "some-bucket", 100, 4, logrus.New())
+
+		err := uploader.Upload(file.Name(), "some-key")
+
+		So(err, ShouldBeNil)
+		So(len(manager.inputsPassed), ShouldEqual, 1)
+		So(client.uploadedParts, ShouldBeEmpty)
+	})
+
+	Convey("Should upload empty files without multipart, whatever the threshold", t, func() {
+		journal, dir := newJournal()
+		defer os.RemoveAll(dir)
+
+		emptyFile, err := ioutil.TempFile("", "emptyfile")
+		if err != nil {
+			t.Fatal(err)
+		}
+		emptyFile.Close()
+		defer os.Remove(emptyFile.Name())
+
+		manager := &stubS3ManagerUploader{
+			expectedReturnValues: []*s3manager.UploadOutput{nil},
+			expectedErrorValues:  []error{nil},
+		}
+		client := newStubS3MultipartClient()
+
+		uploader := NewResumableS3Uploader(manager, client, journal, "some-bucket", 0, 4, logrus.New())
+
+		err = uploader.Upload(emptyFile.Name(), "some-key")
+
+		So(err, ShouldBeNil)
+		So(len(manager.inputsPassed), ShouldEqual, 1)
+		So(client.uploadedParts, ShouldBeEmpty)
+		So(client.completedParts, ShouldBeEmpty)
+	})
+
+	Convey("Should upload large files in parts", t, func() {
+		journal, dir := newJournal()
+		defer os.RemoveAll(dir)
+
+		client := newStubS3MultipartClient()
+
+		uploader := NewResumableS3Uploader(&stubS3ManagerUploader{}, client, journal, "some-bucket", 5, 4, logrus.New())
+
+		err := uploader.Upload(file.Name(), "some-key")
+
+		So(err, ShouldBeNil)
+		So(client.uploadedParts, ShouldResemble, []int64{1, 2, 3})
+		So(len(client.completedParts), ShouldEqual, 3)
+
+		Convey("Should forget the upload once complete", func() {
+			entry, err := journal.Load("some-bucket", "some-key", file.Name())
+
+			So(err, ShouldBeNil)
+			So(entry, ShouldBeNil)
+		})
+	})
+
+	Convey("Should wrap the body of a file once for all of its parts", t, func() {
+		journal, dir := newJournal()
+		defer os.RemoveAll(dir)
+
+		client := newStubS3MultipartClient()
+
+		wraps := 0
+		bytesRead := 0
+		counter := func(path string, body io.Reader) io.Reader {
+			wraps++
+			return funcReader(func(p []byte) (int, error) {
+				n, err := body.Read(p)
+				bytesRead += n
+				return n, err
+			})
+		}
+
+		uploader := NewResumableS3Uploader(&stubS3ManagerUploader{}, client, journal, "some-bucket", 5, 4, logrus.New(), counter)
+
+		err := uploader.Upload(file.Name(), "some-key")
+
+		So(err, ShouldBeNil)
+		So(client.uploadedParts, ShouldResemble, []int64{1, 2, 3})
+		So(wraps, ShouldEqual, 1)
+		So(bytesRead, ShouldEqual, 10)
+		So(client.partBodies, ShouldResemble, []string{"0123", "4567", "89"})
+	})
+
+	Convey("Should resume an interrupted upload from the last good part", t, func() {
+		journal, dir := newJournal()
+		defer os.RemoveAll(dir)
+
+		client := newStubS3MultipartClient()
+		client.failOnPart = 3
+
+		uploader := NewResumableS3Uploader(&stubS3ManagerUploader{}, client, journal, "some-bucket", 5, 4, logrus.New())
+
+		err := uploader.Upload(file.Name(), "some-key")
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "failed to upload part 3")
+
+		entry, err := journal.Load("some-bucket", "some-key", file.Name())
+		So(err, ShouldBeNil)
+		So(len(entry.Parts), ShouldEqual, 2)
+
+		// A fresh uploader stands in for a restarted process
+		client.failOnPart = 0
+		client.uploadedParts = nil
+		uploader = NewResumableS3Uploader(&stubS3ManagerUploader{}, client, journal, "some-bucket", 5, 4, logrus.New())
+
+		err = uploader.Upload(file.Name(), "some-key")
+
+		So(err, ShouldBeNil)
+		So(client.uploadedParts, ShouldResemble, []int64{3})
+		So(len(client.completedParts), ShouldEqual, 3)
+		So(*client.completedParts[0].PartNumber, ShouldEqual, 1)
+	})
+
+	Convey("Should start over if S3 no longer knows about the upload", t, func() {
+		journal, dir := newJournal()
+		defer os.RemoveAll(dir)
+
+		info, err := os.Stat(file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = journal.Save(&JournalEntry{
+			Bucket:   "some-bucket",
+			Key:      "some-key",
+			Path:     file.Name(),
+			Size:     info.Size(),
+			ModTime:  info.ModTime(),
+			UploadID: "long-gone",
+			PartSize: 4,
+			Parts:    []JournalPart{{PartNumber: 1, ETag: `"etag-1"`}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client := newStubS3MultipartClient()
+
+		uploader := NewResumableS3Uploader(&stubS3ManagerUploader{}, client, journal, "some-bucket", 5, 4, logrus.New())
+
+		err = uploader.Upload(file.Name(), "some-key")
+
+		So(err, ShouldBeNil)
+		So(client.uploadedParts, ShouldResemble, []int64{1, 2, 3})
+	})
+
+	Convey("Should start over if the file changed since the upload began", t, func() {
+		journal, dir := newJournal()
+		defer os.RemoveAll(dir)
+
+		client := newStubS3MultipartClient()
+		staleUpload, _ := client.CreateMultipartUpload(&awss3.CreateMultipartUploadInput{})
+
+		err := journal.Save(&JournalEntry{
+			Bucket:   "some-bucket",
+			Key:      "some-key",
+			Path:     file.Name(),
+			Size:     10,
+			ModTime:  time.Now().Add(-time.Hour),
+			UploadID: *staleUpload.UploadId,
+			PartSize: 4,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		uploader := NewResumableS3Uploader(&stubS3ManagerUploader{}, client, journal, "some-bucket", 5, 4, logrus.New())
+
+		err = uploader.Upload(file.Name(), "some-key")
+
+		So(err, ShouldBeNil)
+		So(client.abortedUploads, ShouldResemble, []string{*staleUpload.UploadId})
+		So(client.uploadedParts, ShouldResemble, []int64{1, 2, 3})
+	})
+}
+
+func TestPartBody(t *testing.T) {
+	file, err := ioutil.TempFile("", "part")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	_, err = file.WriteString("0123456789")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newPartBody := func() (*partBody, *int) {
+		bytesRead := 0
+		wrapped := funcReader(func(p []byte) (int, error) {
+			n, err := io.NewSectionReader(file, 2+int64(bytesRead), 6-int64(bytesRead)).Read(p)
+			bytesRead += n
+			return n, err
+		})
+
+		return &partBody{section: io.NewSectionReader(file, 2, 6), wrapped: wrapped}, &bytesRead
+	}
+
+	Convey("Should read the part through the wrappers once, however often it is read", t, func() {
+		body, bytesRead := newPartBody()
+
+		first, err := ioutil.ReadAll(body)
+		So(err, ShouldBeNil)
+
+		position, err := body.Seek(0, io.SeekStart)
+		So(err, ShouldBeNil)
+		So(position, ShouldEqual, 0)
+
+		second, err := ioutil.ReadAll(body)
+		So(err, ShouldBeNil)
+
+		So(string(first), ShouldEqual, "234567")
+		So(string(second), ShouldEqual, "234567")
+		So(*bytesRead, ShouldEqual, 6)
+	})
+
+	Convey("Should tell the length of the part by seeking to its end", t, func() {
+		body, bytesRead := newPartBody()
+
+		length, err := body.Seek(0, io.SeekEnd)
+
+		So(err, ShouldBeNil)
+		So(length, ShouldEqual, 6)
+		So(*bytesRead, ShouldEqual, 0)
+	})
+
+	Convey("Should read skipped bytes through the wrappers when seeking ahead", t, func() {
+		body, bytesRead := newPartBody()
+
+		_, err := body.Seek(4, io.SeekStart)
+		So(err, ShouldBeNil)
+
+		rest, err := ioutil.ReadAll(body)
+		So(err, ShouldBeNil)
+		So(string(rest), ShouldEqual, "67")
+		So(*bytesRead, ShouldEqual, 6)
+
+		_, err = body.Seek(-6, io.SeekCurrent)
+		So(err, ShouldBeNil)
+
+		all, err := ioutil.ReadAll(body)
+		So(err, ShouldBeNil)
+		So(string(all), ShouldEqual, "234567")
+		So(*bytesRead, ShouldEqual, 6)
+	})
+}
+
+func TestPartSizeForFile(t *testing.T) {
+	Convey("Should keep the configured part size when it fits", t, func() {
+		So(partSizeForFile(8, 100), ShouldEqual, 8)
+	})
+
+	Convey("Should grow the part size to stay within the part limit", t, func() {
+		So(partSizeForFile(1, 50000), ShouldEqual, 5)
+	})
+}
+
+type funcReader func(p []byte) (int, error)
+
+func (f funcReader) Read(p []byte) (int, error) {
+	return f(p)
+}
@@ -7,9 +7,22 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/sirupsen/logrus"
+	"github.com/timrourke/funnel/backend"
 	"os"
+	"time"
 )
 
+// Metadata every file is uploaded with, so that restoring it can set its
+// modification time again
+const metadataModTime = "funnel-mtime"
+
+// The metadata of an uploaded file, from its file info
+func fileMetadata(info os.FileInfo) map[string]*string {
+	return map[string]*string{
+		metadataModTime: aws.String(info.ModTime().UTC().Format(time.RFC3339Nano)),
+	}
+}
+
 // S3Uploader uploads files to AWS S3
 type S3Uploader interface {
 	Upload(path string, key string) error
@@ -28,6 +41,7 @@ type S3ManagerUploader interface {
 type s3Uploader struct {
 	toBucket        string
 	s3UploadManager S3ManagerUploader
+	bodyWrappers    []backend.BodyWrapper
 	logger          *logrus.Logger
 }
 
@@ -39,7 +53,7 @@ func (s *s3Uploader) Upload(path string, key string) error {
 			"filename": path,
 			"error":    err.Error(),
 		}).Warnf(
-			"Tried uploading file that does not exist, did another worker upload and then delete it?: %s: %w",
+			"Tried uploading file that does not exist, did another worker upload and then delete it?: %s: %v",
 			path,
 			err,
 		)
@@ -49,15 +63,21 @@ func (s *s3Uploader) Upload(path string, key string) error {
 		s.logger.WithFields(logrus.Fields{
 			"filename": path,
 			"error":    err.Error(),
-		}).Errorf("Failed to open file: %s: %w", path, err)
+		}).Errorf("Failed to open file: %s: %v", path, err)
 		return err
 	}
 	defer file.Close()
 
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
 	input := &s3manager.UploadInput{
-		Body:   file,
-		Bucket: aws.String(s.toBucket),
-		Key:    aws.String(key),
+		Body:     backend.WrapBody(path, file, s.bodyWrappers),
+		Bucket:   aws.String(s.toBucket),
+		Key:      aws.String(key),
+		Metadata: fileMetadata(info),
 	}
 
 	_, err = s.s3UploadManager.Upload(input)
@@ -69,15 +89,17 @@ func (s *s3Uploader) Upload(path string, key string) error {
 }
 
 // NewS3Uploader creates a new uploader service for a given destination bucket
-// in AWS S3
+// in AWS S3. Body wrappers are applied to each file's contents in order.
 func NewS3Uploader(
 	s3UploadManager S3ManagerUploader,
 	toBucket string,
 	logger *logrus.Logger,
+	bodyWrappers ...backend.BodyWrapper,
 ) S3Uploader {
 	return &s3Uploader{
 		toBucket:        toBucket,
 		s3UploadManager: s3UploadManager,
+		bodyWrappers:    bodyWrappers,
 		logger:          logger,
 	}
 }
@@ -5,9 +5,12 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/sirupsen/logrus"
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/timrourke/funnel/backend"
+	"io"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 )
 
 type stubS3ManagerUploader struct {
@@ -61,6 +64,12 @@ func TestS3Uploader_Upload(t *testing.T) {
 			So(*inputPassed.Key, ShouldEqual, expectedPath)
 		})
 
+		Convey("Should keep the file's modification time in its metadata", func() {
+			info, err := os.Stat(expectedPath)
+			So(err, ShouldBeNil)
+			So(*inputPassed.Metadata[metadataModTime], ShouldEqual, info.ModTime().UTC().Format(time.RFC3339Nano))
+		})
+
 		Convey("Should close file after upload", func() {
 			_, err = ioutil.ReadAll(inputPassed.Body)
 			So(err, ShouldNotBeNil)
@@ -69,6 +78,29 @@ func TestS3Uploader_Upload(t *testing.T) {
 		})
 	})
 
+	Convey("Should pass the file's contents through body wrappers in order", t, func() {
+		stub := &stubS3ManagerUploader{
+			inputsPassed:         nil,
+			expectedReturnValues: []*s3manager.UploadOutput{nil},
+			expectedErrorValues:  []error{nil},
+		}
+
+		var wrappedPaths []string
+		wrapper := func(name string) backend.BodyWrapper {
+			return func(path string, body io.Reader) io.Reader {
+				wrappedPaths = append(wrappedPaths, name+":"+path)
+				return body
+			}
+		}
+
+		uploader := NewS3Uploader(stub, "some-bucket", logrus.New(), wrapper("first"), wrapper("second"))
+
+		err := uploader.Upload("/dev/null", "unimportant")
+
+		So(err, ShouldBeNil)
+		So(wrappedPaths, ShouldResemble, []string{"first:/dev/null", "second:/dev/null"})
+	})
+
 	Convey("Should fail to upload nonexistent file path", t, func() {
 		stub := &stubS3ManagerUploader{
 			inputsPassed:         nil,
@@ -0,0 +1,158 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+)
+
+// Environment variables with the secrets to authenticate with, which are kept
+// out of destinations as those are logged
+const (
+	PasswordEnvVar           = "SFTP_PASSWORD"
+	IdentityFileEnvVar       = "SFTP_IDENTITY_FILE"
+	IdentityPassphraseEnvVar = "SFTP_IDENTITY_PASSPHRASE"
+)
+
+// NewClientConfig creates the SSH configuration for a destination such as
+// `sftp://user@host/incoming?identity=/path/to/key&knownHosts=/path/to/known_hosts`.
+// The user defaults to the current one. It authenticates with the private key
+// in the `identity` query parameter, falling back to `SFTP_IDENTITY_FILE`,
+// and with the password in `SFTP_PASSWORD`, whichever are given. The host's
+// key is verified against the `knownHosts` file, `~/.ssh/known_hosts` by
+// default, for the host at the address, eg. `host:22`.
+func NewClientConfig(destination *url.URL, address string) (*ssh.ClientConfig, error) {
+	if _, ok := destination.User.Password(); ok {
+		return nil, fmt.Errorf("must not put passwords in sftp destinations, set %s instead", PasswordEnvVar)
+	}
+
+	username := destination.User.Username()
+	if "" == username {
+		current, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the current user for sftp destination: %w", err)
+		}
+		username = current.Username
+	}
+
+	query := destination.Query()
+
+	var authMethods []ssh.AuthMethod
+
+	identityFile := query.Get("identity")
+	if "" == identityFile {
+		identityFile = os.Getenv(IdentityFileEnvVar)
+	}
+
+	if "" != identityFile {
+		signer, err := loadIdentity(identityFile, os.Getenv(IdentityPassphraseEnvVar))
+		if err != nil {
+			return nil, err
+		}
+
+		authMethods = append(authMethods, ssh.PublicKeys(signer))
+	}
+
+	if password := os.Getenv(PasswordEnvVar); "" != password {
+		authMethods = append(authMethods, ssh.Password(password))
+	}
+
+	if 0 == len(authMethods) {
+		return nil, fmt.Errorf(
+			"must give a private key or a password for sftp destinations, eg. sftp://user@host/incoming?identity=/path/to/key, or set %s",
+			PasswordEnvVar,
+		)
+	}
+
+	knownHostsFile := query.Get("knownHosts")
+	if "" == knownHostsFile {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find known_hosts file for sftp destination: %w", err)
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known_hosts file %s: %w", knownHostsFile, err)
+	}
+
+	return &ssh.ClientConfig{
+		User:              username,
+		Auth:              authMethods,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: knownHostKeyAlgorithms(hostKeyCallback, address),
+		Timeout:           30 * time.Second,
+	}, nil
+}
+
+// placeholderKey is matched against known_hosts to find which keys are known
+// for a host
+type placeholderKey struct{}
+
+func (p placeholderKey) Type() string {
+	return "placeholder"
+}
+
+func (p placeholderKey) Marshal() []byte {
+	return []byte{}
+}
+
+func (p placeholderKey) Verify(data []byte, sig *ssh.Signature) error {
+	return errors.New("placeholder key cannot verify signatures")
+}
+
+// Find the algorithms of the keys known for a host, so that the host is asked
+// for one of them. Otherwise the SSH client negotiates the algorithm it prefers
+// itself, and refuses hosts whose key of that algorithm is not in known_hosts.
+func knownHostKeyAlgorithms(hostKeyCallback ssh.HostKeyCallback, address string) []string {
+	var keyErr *knownhosts.KeyError
+
+	err := hostKeyCallback(address, &net.TCPAddr{IP: net.IPv4zero}, placeholderKey{})
+	if !errors.As(err, &keyErr) || 0 == len(keyErr.Want) {
+		return nil
+	}
+
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		if ssh.KeyAlgoRSA == known.Key.Type() {
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algorithms = append(algorithms, known.Key.Type())
+	}
+
+	return algorithms
+}
+
+func loadIdentity(identityFile string, passphrase string) (ssh.Signer, error) {
+	contents, err := ioutil.ReadFile(identityFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key %s: %w", identityFile, err)
+	}
+
+	var signer ssh.Signer
+	if "" == passphrase {
+		signer, err = ssh.ParsePrivateKey(contents)
+	} else {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(contents, []byte(passphrase))
+	}
+
+	var missingPassphrase *ssh.PassphraseMissingError
+	if errors.As(err, &missingPassphrase) {
+		return nil, fmt.Errorf("private key %s is encrypted, set %s to decrypt it", identityFile, IdentityPassphraseEnvVar)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key %s: %w", identityFile, err)
+	}
+
+	return signer, nil
+}
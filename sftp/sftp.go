@@ -0,0 +1,289 @@
+// Package sftp is a storage backend that copies files to a directory on a
+// remote host over SFTP, eg. for partners that only accept files that way, for
+// destinations such as `sftp://user@host:22/incoming`
+package sftp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	pkgsftp "github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"github.com/timrourke/funnel/backend"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+func init() {
+	backend.Register("sftp", openBackend)
+}
+
+type sftpBackend struct {
+	mux          sync.Mutex
+	address      string
+	config       *ssh.ClientConfig
+	root         string
+	sshClient    *ssh.Client
+	client       *pkgsftp.Client
+	bodyWrappers []backend.BodyWrapper
+	logger       *logrus.Logger
+}
+
+// NewBackend creates a backend that stores each key as a file below the root
+// directory on the host at the address, eg. `host:22`. The connection is made
+// when it is first needed, and made again after it was lost.
+func NewBackend(
+	address string,
+	config *ssh.ClientConfig,
+	root string,
+	logger *logrus.Logger,
+	bodyWrappers ...backend.BodyWrapper,
+) backend.Backend {
+	return &sftpBackend{
+		address:      address,
+		config:       config,
+		root:         root,
+		bodyWrappers: bodyWrappers,
+		logger:       logger,
+	}
+}
+
+// Open the backend for a destination such as `sftp://user@host:22/incoming`
+func openBackend(destination *url.URL, options backend.Options) (backend.Backend, error) {
+	if "" == destination.Hostname() {
+		return nil, errors.New("must specify a host to save files on, eg. sftp://user@host/incoming")
+	}
+
+	if "" == destination.Path {
+		return nil, errors.New("must specify a directory to save files in, eg. sftp://user@host/incoming")
+	}
+
+	if len(options.CompressionRules) > 0 {
+		return nil, errors.New("compressing files is not supported by sftp destinations")
+	}
+
+	if nil != options.KeyWrapper {
+		return nil, errors.New("encrypting files is not supported by sftp destinations")
+	}
+
+	port := destination.Port()
+	if "" == port {
+		port = "22"
+	}
+	address := net.JoinHostPort(destination.Hostname(), port)
+
+	config, err := NewClientConfig(destination, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBackend(
+		address,
+		config,
+		destination.Path,
+		options.Logger,
+		options.BodyWrappers...,
+	), nil
+}
+
+// Connect to the host unless already connected. The connection is forgotten
+// once it closes, so that the next upload, eg. the retry of a failed one,
+// connects again.
+func (s *sftpBackend) connect() (*pkgsftp.Client, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if nil != s.client {
+		return s.client, nil
+	}
+
+	sshClient, err := ssh.Dial("tcp", s.address, s.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", s.address, err)
+	}
+
+	client, err := pkgsftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, fmt.Errorf("failed to start SFTP session on %s: %w", s.address, err)
+	}
+
+	go func() {
+		err := sshClient.Wait()
+
+		client.Close()
+
+		s.mux.Lock()
+		if s.client == client {
+			s.sshClient = nil
+			s.client = nil
+		}
+		s.mux.Unlock()
+
+		s.logger.WithFields(logrus.Fields{
+			"address": s.address,
+			"error":   fmt.Sprint(err),
+		}).Debug(fmt.Sprintf("Connection to %s closed", s.address))
+	}()
+
+	s.sshClient = sshClient
+	s.client = client
+
+	return client, nil
+}
+
+// Upload copies a file to the path of its key below the root directory
+func (s *sftpBackend) Upload(path string, key string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return s.write(key, backend.WrapBody(path, file, s.bodyWrappers))
+}
+
+// PutObject writes an object to the path of its key below the root directory.
+// Its content type, encoding and metadata are not kept.
+func (s *sftpBackend) PutObject(object *backend.Object) error {
+	return s.write(object.Key, object.Body)
+}
+
+// Write to a temporary file next to the key's path first, which is renamed to
+// it once complete, so that partners never pick up a partially written file
+func (s *sftpBackend) write(key string, body io.Reader) error {
+	target, err := s.pathForKey(key)
+	if err != nil {
+		return err
+	}
+
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	err = client.MkdirAll(path.Dir(target))
+	if err != nil {
+		return fmt.Errorf("failed to create directory for key: %s: %w", key, err)
+	}
+
+	suffix, err := randomSuffix()
+	if err != nil {
+		return err
+	}
+
+	temp := path.Join(path.Dir(target), fmt.Sprintf(".%s.%s.tmp", path.Base(target), suffix))
+
+	remoteFile, err := client.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return fmt.Errorf("failed to create file for key: %s: %w", key, err)
+	}
+
+	_, err = io.Copy(remoteFile, body)
+
+	closeErr := remoteFile.Close()
+	if nil == err {
+		err = closeErr
+	}
+	if err != nil {
+		client.Remove(temp)
+		return fmt.Errorf("failed to write file for key: %s: %w", key, err)
+	}
+
+	// Plain SFTP renames refuse to replace an existing file, which the
+	// posix-rename extension of OpenSSH does atomically
+	err = client.PosixRename(temp, target)
+	if err != nil {
+		client.Remove(target)
+		err = client.Rename(temp, target)
+	}
+	if err != nil {
+		client.Remove(temp)
+		return fmt.Errorf("failed to write file for key: %s: %w", key, err)
+	}
+
+	return nil
+}
+
+// Find the path of a key below the root directory, refusing keys that would
+// escape it, eg. `../etc/passwd`
+func (s *sftpBackend) pathForKey(key string) (string, error) {
+	target := path.Join(s.root, key)
+
+	root := path.Clean(s.root)
+	if "/" != root {
+		root += "/"
+	}
+
+	if !strings.HasPrefix(target, root) || target == path.Clean(s.root) {
+		return "", fmt.Errorf("key is not a file below the destination directory: %s", key)
+	}
+
+	return target, nil
+}
+
+// CheckAccess verifies that the root directory exists and is writable
+func (s *sftpBackend) CheckAccess(ctx context.Context) error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	info, err := client.Stat(s.root)
+	if err != nil {
+		return fmt.Errorf("failed to access directory %s on %s: %w", s.root, s.address, err)
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("failed to access directory %s on %s: not a directory", s.root, s.address)
+	}
+
+	suffix, err := randomSuffix()
+	if err != nil {
+		return err
+	}
+
+	probe := path.Join(s.root, ".funnel-access-"+suffix)
+
+	probeFile, err := client.OpenFile(probe, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return fmt.Errorf("failed to write to directory %s on %s: %w", s.root, s.address, err)
+	}
+	probeFile.Close()
+
+	return client.Remove(probe)
+}
+
+func (s *sftpBackend) URL(key string) string {
+	destination := url.URL{
+		Scheme: "sftp",
+		Host:   s.address,
+		Path:   path.Join(s.root, key),
+	}
+
+	if "" != s.config.User {
+		destination.User = url.User(s.config.User)
+	}
+
+	return destination.String()
+}
+
+// Generate a random suffix for the names of temporary files
+func randomSuffix() (string, error) {
+	var b [8]byte
+
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b[:]), nil
+}
@@ -0,0 +1,97 @@
+// Package throttle limits the rate at which bytes are read from the files being
+// uploaded, so that funnel does not saturate the network link it shares with
+// other traffic
+package throttle
+
+import (
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// maxReadSize caps a single read through a throttled reader, so that a large
+// buffer handed to `Read` does not let one reader spend a whole burst at once
+const maxReadSize = 32 * 1024
+
+// Limiter is a token bucket shared by any number of readers. Tokens are bytes,
+// refilled at the rate the limiter's schedule allows for the current time of
+// day, and the bucket holds at most one second's worth of them.
+type Limiter struct {
+	mux      sync.Mutex
+	schedule *Schedule
+	tokens   float64
+	last     time.Time
+	now      func() time.Time
+	sleep    func(time.Duration)
+}
+
+// NewLimiter creates a token bucket enforcing the rates in a schedule
+func NewLimiter(schedule *Schedule) *Limiter {
+	return &Limiter{
+		schedule: schedule,
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+// WaitN blocks until `n` bytes may be transferred without exceeding the current
+// rate limit
+func (l *Limiter) WaitN(n int) {
+	l.mux.Lock()
+
+	now := l.now()
+	rate := float64(l.schedule.RateAt(now))
+	if rate <= 0 {
+		l.last = now
+		l.mux.Unlock()
+		return
+	}
+
+	if l.last.IsZero() {
+		l.tokens = rate
+	} else {
+		l.tokens = math.Min(rate, l.tokens+now.Sub(l.last).Seconds()*rate)
+	}
+	l.last = now
+
+	// Tokens may go negative, in which case this caller waits for the deficit
+	// to refill and later callers queue up behind it
+	l.tokens -= float64(n)
+
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / rate * float64(time.Second))
+	}
+
+	l.mux.Unlock()
+
+	if wait > 0 {
+		l.sleep(wait)
+	}
+}
+
+// Reader wraps a reader so that reading from it draws from this limiter
+func (l *Limiter) Reader(r io.Reader) io.Reader {
+	return &reader{reader: r, limiter: l}
+}
+
+type reader struct {
+	reader  io.Reader
+	limiter *Limiter
+}
+
+// Read reads from the underlying reader, then waits until the limiter allows
+// the bytes read to be passed on
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > maxReadSize {
+		p = p[:maxReadSize]
+	}
+
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.limiter.WaitN(n)
+	}
+
+	return n, err
+}
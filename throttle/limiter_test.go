@@ -0,0 +1,74 @@
+package throttle
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// newFakeClockLimiter creates a limiter whose clock only advances while it
+// sleeps, and which records every sleep
+func newFakeClockLimiter(schedule *Schedule) (*Limiter, *[]time.Duration) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	var sleeps []time.Duration
+
+	limiter := NewLimiter(schedule)
+	limiter.now = func() time.Time {
+		return now
+	}
+	limiter.sleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+		now = now.Add(d)
+	}
+
+	return limiter, &sleeps
+}
+
+func TestLimiter_WaitN(t *testing.T) {
+	Convey("Should not wait within the initial burst", t, func() {
+		limiter, sleeps := newFakeClockLimiter(NewSchedule(1000))
+
+		limiter.WaitN(1000)
+
+		So(*sleeps, ShouldBeEmpty)
+	})
+
+	Convey("Should wait for tokens to refill once the burst is spent", t, func() {
+		limiter, sleeps := newFakeClockLimiter(NewSchedule(1000))
+
+		limiter.WaitN(1000)
+		limiter.WaitN(500)
+
+		So(*sleeps, ShouldResemble, []time.Duration{500 * time.Millisecond})
+	})
+
+	Convey("Should never wait when unlimited", t, func() {
+		limiter, sleeps := newFakeClockLimiter(NewSchedule(0))
+
+		limiter.WaitN(1 << 30)
+		limiter.WaitN(1 << 30)
+
+		So(*sleeps, ShouldBeEmpty)
+	})
+}
+
+func TestLimiter_Reader(t *testing.T) {
+	Convey("Should pass every byte through at the limited rate", t, func() {
+		limiter, sleeps := newFakeClockLimiter(NewSchedule(1000))
+		expected := bytes.Repeat([]byte("a"), 3000)
+
+		actual, err := ioutil.ReadAll(limiter.Reader(bytes.NewReader(expected)))
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldResemble, expected)
+
+		var waited time.Duration
+		for _, sleep := range *sleeps {
+			waited += sleep
+		}
+
+		So(waited, ShouldEqual, 2*time.Second)
+	})
+}
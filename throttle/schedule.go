@@ -0,0 +1,121 @@
+package throttle
+
+import (
+	"fmt"
+	"github.com/timrourke/funnel/bytesize"
+	"strings"
+	"time"
+)
+
+// Schedule determines the bandwidth limit in effect at a given time of day. A
+// rate of zero means unlimited.
+type Schedule struct {
+	defaultRate int64
+	windows     []Window
+}
+
+// Window applies a rate limit, in bytes per second, between two times of day.
+// Windows whose end is at or before their start wrap around midnight.
+type Window struct {
+	StartMinute int
+	EndMinute   int
+	Rate        int64
+}
+
+// NewSchedule creates a schedule that applies the first matching window, or the
+// default rate outside of every window
+func NewSchedule(defaultRate int64, windows ...Window) *Schedule {
+	return &Schedule{
+		defaultRate: defaultRate,
+		windows:     windows,
+	}
+}
+
+// ParseSchedule parses a comma separated list of windows, such as
+// "09:00-17:00=5MiB/s,17:00-09:00=50MiB/s", falling back to the default rate
+// outside of the listed windows
+func ParseSchedule(defaultRate int64, text string) (*Schedule, error) {
+	schedule := NewSchedule(defaultRate)
+
+	for _, windowText := range strings.Split(text, ",") {
+		windowText = strings.TrimSpace(windowText)
+		if "" == windowText {
+			continue
+		}
+
+		parts := strings.SplitN(windowText, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid bandwidth schedule window %q: expected HH:MM-HH:MM=RATE", windowText)
+		}
+
+		times := strings.SplitN(parts[0], "-", 2)
+		if len(times) != 2 {
+			return nil, fmt.Errorf("invalid bandwidth schedule window %q: expected HH:MM-HH:MM=RATE", windowText)
+		}
+
+		start, err := parseTimeOfDay(times[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bandwidth schedule window %q: %w", windowText, err)
+		}
+
+		end, err := parseTimeOfDay(times[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bandwidth schedule window %q: %w", windowText, err)
+		}
+
+		rate, err := ParseRate(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bandwidth schedule window %q: %w", windowText, err)
+		}
+
+		schedule.windows = append(schedule.windows, Window{
+			StartMinute: start,
+			EndMinute:   end,
+			Rate:        rate,
+		})
+	}
+
+	return schedule, nil
+}
+
+// ParseRate parses a rate such as "20MiB/s" into bytes per second. The "/s"
+// suffix is optional, and "unlimited" parses as zero.
+func ParseRate(text string) (int64, error) {
+	trimmed := strings.TrimSpace(text)
+	if strings.EqualFold(trimmed, "unlimited") {
+		return 0, nil
+	}
+
+	return bytesize.Parse(strings.TrimSuffix(trimmed, "/s"))
+}
+
+// RateAt returns the rate limit in effect at the given time, in bytes per
+// second
+func (s *Schedule) RateAt(t time.Time) int64 {
+	minute := t.Hour()*60 + t.Minute()
+
+	for _, window := range s.windows {
+		if window.contains(minute) {
+			return window.Rate
+		}
+	}
+
+	return s.defaultRate
+}
+
+func (w Window) contains(minute int) bool {
+	if w.StartMinute < w.EndMinute {
+		return minute >= w.StartMinute && minute < w.EndMinute
+	}
+
+	return minute >= w.StartMinute || minute < w.EndMinute
+}
+
+func parseTimeOfDay(text string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(text))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", text)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
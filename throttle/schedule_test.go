@@ -0,0 +1,67 @@
+package throttle
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/timrourke/funnel/bytesize"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	Convey("Should parse rates per second", t, func() {
+		actual, err := ParseRate("20MiB/s")
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, 20*bytesize.MiB)
+	})
+
+	Convey("Should parse rates without a unit of time", t, func() {
+		actual, err := ParseRate("512KiB")
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, 512*bytesize.KiB)
+	})
+
+	Convey("Should parse unlimited as zero", t, func() {
+		actual, err := ParseRate("unlimited")
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, 0)
+	})
+}
+
+func TestParseSchedule(t *testing.T) {
+	at := func(hour int, minute int) time.Time {
+		return time.Date(2020, 1, 1, hour, minute, 0, 0, time.Local)
+	}
+
+	Convey("Should apply windows by time of day", t, func() {
+		schedule, err := ParseSchedule(100, "09:00-17:00=5MiB/s, 22:00-06:00=unlimited")
+
+		So(err, ShouldBeNil)
+		So(schedule.RateAt(at(8, 59)), ShouldEqual, 100)
+		So(schedule.RateAt(at(9, 0)), ShouldEqual, 5*bytesize.MiB)
+		So(schedule.RateAt(at(16, 59)), ShouldEqual, 5*bytesize.MiB)
+		So(schedule.RateAt(at(17, 0)), ShouldEqual, 100)
+		So(schedule.RateAt(at(23, 30)), ShouldEqual, 0)
+		So(schedule.RateAt(at(3, 0)), ShouldEqual, 0)
+	})
+
+	Convey("Should use the default rate for an empty schedule", t, func() {
+		schedule, err := ParseSchedule(100, "")
+
+		So(err, ShouldBeNil)
+		So(schedule.RateAt(at(12, 0)), ShouldEqual, 100)
+	})
+
+	Convey("Should fail on malformed windows", t, func() {
+		_, err := ParseSchedule(0, "09:00=5MiB/s")
+		So(err, ShouldNotBeNil)
+
+		_, err = ParseSchedule(0, "9am-5pm=5MiB/s")
+		So(err, ShouldNotBeNil)
+
+		_, err = ParseSchedule(0, "09:00-17:00=fast")
+		So(err, ShouldNotBeNil)
+	})
+}
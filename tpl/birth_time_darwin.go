@@ -0,0 +1,17 @@
+package tpl
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+func fileBirthTime(filePath string, fileInfo os.FileInfo) (time.Time, error) {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, errors.New("birth time not available")
+	}
+
+	return time.Unix(stat.Birthtimespec.Unix()), nil
+}
@@ -0,0 +1,25 @@
+package tpl
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"os"
+	"time"
+)
+
+// Linux only exposes birth time through statx(2), and only on filesystems
+// that record it
+func fileBirthTime(filePath string, fileInfo os.FileInfo) (time.Time, error) {
+	var stat unix.Statx_t
+
+	err := unix.Statx(unix.AT_FDCWD, filePath, 0, unix.STATX_BTIME, &stat)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if stat.Mask&unix.STATX_BTIME == 0 {
+		return time.Time{}, errors.New("filesystem does not record birth time")
+	}
+
+	return time.Unix(stat.Btime.Sec, int64(stat.Btime.Nsec)), nil
+}
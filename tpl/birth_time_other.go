@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package tpl
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+func fileBirthTime(filePath string, fileInfo os.FileInfo) (time.Time, error) {
+	return time.Time{}, errors.New("birth time not supported on this platform")
+}
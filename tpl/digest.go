@@ -0,0 +1,115 @@
+package tpl
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// DigestEncodingHex encodes digests as lowercase hexadecimal
+	DigestEncodingHex = "hex"
+	// DigestEncodingBase32 encodes digests as unpadded, lowercase base32
+	DigestEncodingBase32 = "base32"
+)
+
+var digestAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"xxhash": func() hash.Hash { return xxhash.New() },
+}
+
+var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Digest returns the digest of the file's contents using the given algorithm,
+// encoded with the given encoding and truncated to `length` characters if
+// `length` is greater than zero. The file is only read once per algorithm, no
+// matter how many times its digest is asked for.
+func (t *tplFileData) Digest(algorithm, encoding string, length int) (string, error) {
+	sum, err := t.digestSum(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	var encoded string
+	switch encoding {
+	case DigestEncodingHex:
+		encoded = hex.EncodeToString(sum)
+	case DigestEncodingBase32:
+		encoded = strings.ToLower(base32Encoding.EncodeToString(sum))
+	default:
+		return "", fmt.Errorf("unknown digest encoding: %s", encoding)
+	}
+
+	if length < 0 {
+		return "", fmt.Errorf("invalid digest length: %d", length)
+	}
+
+	if length > 0 && length < len(encoded) {
+		encoded = encoded[:length]
+	}
+
+	return encoded, nil
+}
+
+func (t *tplFileData) digestSum(algorithm string) ([]byte, error) {
+	if sum, ok := t.digests[algorithm]; ok {
+		return sum, nil
+	}
+
+	newHash, ok := digestAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown digest algorithm: %s", algorithm)
+	}
+
+	file, err := os.Open(t.filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file for hashing: %s: %w", t.filePath, err)
+	}
+	defer file.Close()
+
+	h := newHash()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash file: %s: %w", t.filePath, err)
+	}
+
+	if t.digests == nil {
+		t.digests = make(map[string][]byte)
+	}
+	t.digests[algorithm] = h.Sum(nil)
+
+	return t.digests[algorithm], nil
+}
+
+// Build the template function for a digest algorithm. It takes an optional
+// encoding and an optional length, in either order, eg. `{{ sha256 }}`,
+// `{{ sha256 "base32" }}` or `{{ sha256 "hex" 12 }}`.
+func digestFunc(data *tplFileData, algorithm string) func(options ...interface{}) (string, error) {
+	return func(options ...interface{}) (string, error) {
+		encoding := DigestEncodingHex
+		length := 0
+
+		for _, option := range options {
+			switch value := option.(type) {
+			case string:
+				encoding = value
+			case int:
+				length = value
+			default:
+				return "", fmt.Errorf("invalid option for %s: %v", algorithm, option)
+			}
+		}
+
+		return data.Digest(algorithm, encoding, length)
+	}
+}
@@ -0,0 +1,135 @@
+package tpl
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestTplFileData_Digest(t *testing.T) {
+	filePath := path.Join(os.TempDir(), "somefile.bin")
+	err := ioutil.WriteFile(filePath, []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filePath)
+
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newTplFileData := func() *tplFileData {
+		return &tplFileData{
+			filePath: filePath,
+			fileInfo: fileInfo,
+		}
+	}
+
+	Convey("Should hash file contents in hex", t, func() {
+		tplFileData := newTplFileData()
+
+		expected := map[string]string{
+			"md5":    "5d41402abc4b2a76b9719d911017c592",
+			"sha1":   "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d",
+			"sha256": "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+			"xxhash": "26c7827d889f6da3",
+		}
+
+		for algorithm, digest := range expected {
+			actual, err := tplFileData.Digest(algorithm, DigestEncodingHex, 0)
+
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, digest)
+		}
+	})
+
+	Convey("Should hash file contents in base32", t, func() {
+		actual, err := newTplFileData().Digest("md5", DigestEncodingBase32, 0)
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, "lvauakv4jmvhnolrtwiraf6fsi")
+	})
+
+	Convey("Should truncate digests", t, func() {
+		actual, err := newTplFileData().Digest("sha256", DigestEncodingHex, 12)
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, "2cf24dba5fb0")
+	})
+
+	Convey("Should only read the file once per algorithm", t, func() {
+		tplFileData := newTplFileData()
+
+		first, err := tplFileData.Digest("sha1", DigestEncodingHex, 0)
+		So(err, ShouldBeNil)
+
+		err = ioutil.WriteFile(filePath, []byte("changed"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ioutil.WriteFile(filePath, []byte("hello"), 0644)
+
+		second, err := tplFileData.Digest("sha1", DigestEncodingHex, 0)
+
+		So(err, ShouldBeNil)
+		So(second, ShouldEqual, first)
+	})
+
+	Convey("Should fail for unknown algorithms and encodings", t, func() {
+		_, err := newTplFileData().Digest("crc32", DigestEncodingHex, 0)
+		So(err, ShouldNotBeNil)
+
+		_, err = newTplFileData().Digest("md5", "base64", 0)
+		So(err, ShouldNotBeNil)
+
+		_, err = newTplFileData().Digest("md5", DigestEncodingHex, -1)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should fail if the file cannot be read", t, func() {
+		tplFileData := &tplFileData{filePath: path.Join(os.TempDir(), "does-not-exist")}
+
+		_, err := tplFileData.Digest("md5", DigestEncodingHex, 0)
+
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestKeyTemplate_Digest(t *testing.T) {
+	filePath := path.Join(os.TempDir(), "somefile.bin")
+	err := ioutil.WriteFile(filePath, []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filePath)
+
+	Convey("Should interpolate digests with optional encoding and length", t, func() {
+		tpl, err := NewKeyTemplate(
+			`{{ sha256 "hex" 2 }}/{{ sha256 }}{{ fileExtension }}|{{ md5 8 "base32" }}|{{ xxhash }}|{{ sha1 6 }}`,
+			nil,
+			&logger,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := tpl.KeyForFile(filePath)
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, "2c/2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824.bin|lvauakv4|26c7827d889f6da3|aaf4c6")
+	})
+
+	Convey("Should fail for invalid options", t, func() {
+		tpl, err := NewKeyTemplate(`{{ md5 1.5 }}`, nil, &logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = tpl.KeyForFile(filePath)
+
+		So(err, ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,238 @@
+package tpl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// The EXIF tags funnel reads
+const (
+	exifTagModel              = 0x0110
+	exifTagExifIFDPointer     = 0x8769
+	exifTagDateTimeOriginal   = 0x9003
+	exifTagOffsetTimeOriginal = 0x9011
+)
+
+const (
+	exifTypeASCII = 2
+	exifTypeLong  = 4
+
+	exifDateTimeLayout = "2006:01:02 15:04:05"
+
+	// Limits that keep a corrupt file from making funnel read too much of it
+	maxExifIFDEntries = 1000
+	maxExifValueBytes = 64 * 1024
+)
+
+var errNoExif = errors.New("file has no EXIF metadata")
+
+// exifData holds the few EXIF values available to key templates
+type exifData struct {
+	model              string
+	dateTimeOriginal   string
+	offsetTimeOriginal string
+}
+
+// Read the EXIF metadata of a JPEG or TIFF file
+func readExif(filePath string) (*exifData, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 4)
+	_, err = io.ReadFull(file, header)
+	if err != nil {
+		return nil, errNoExif
+	}
+
+	switch {
+	case header[0] == 0xFF && header[1] == 0xD8:
+		return readJPEGExif(file)
+	case bytes.Equal(header, []byte("II*\x00")) || bytes.Equal(header, []byte("MM\x00*")):
+		return readTIFFExif(file)
+	default:
+		return nil, errors.New("file is neither a JPEG nor a TIFF")
+	}
+}
+
+// Find the APP1 segment holding EXIF metadata among the segments at the start
+// of a JPEG file, which is the TIFF structure that follows `Exif\0\0`
+func readJPEGExif(file io.ReadSeeker) (*exifData, error) {
+	_, err := file.Seek(2, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		marker := make([]byte, 4)
+		_, err := io.ReadFull(file, marker)
+		if err != nil {
+			return nil, errNoExif
+		}
+
+		// Metadata segments come before the image data, which starts at the
+		// start of scan marker
+		if marker[0] != 0xFF || marker[1] == 0xDA || marker[1] == 0xD9 {
+			return nil, errNoExif
+		}
+
+		length := int64(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return nil, errNoExif
+		}
+
+		if marker[1] != 0xE1 {
+			_, err = file.Seek(length, io.SeekCurrent)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		segment := make([]byte, length)
+		_, err = io.ReadFull(file, segment)
+		if err != nil {
+			return nil, errNoExif
+		}
+
+		if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return readTIFFExif(bytes.NewReader(segment[6:]))
+		}
+	}
+}
+
+// Read EXIF values from the TIFF structure that holds them. Values are found by
+// their offset from the start of the structure.
+func readTIFFExif(r io.ReaderAt) (*exifData, error) {
+	header := make([]byte, 8)
+	_, err := r.ReadAt(header, 0)
+	if err != nil {
+		return nil, errNoExif
+	}
+
+	var byteOrder binary.ByteOrder
+	switch string(header[:2]) {
+	case "II":
+		byteOrder = binary.LittleEndian
+	case "MM":
+		byteOrder = binary.BigEndian
+	default:
+		return nil, errNoExif
+	}
+
+	reader := &tiffReader{r: r, byteOrder: byteOrder}
+	data := &exifData{}
+
+	ifd0, err := reader.readIFD(int64(byteOrder.Uint32(header[4:])))
+	if err != nil {
+		return nil, err
+	}
+
+	if entry, ok := ifd0[exifTagModel]; ok {
+		data.model, _ = reader.readASCII(entry)
+	}
+
+	if entry, ok := ifd0[exifTagExifIFDPointer]; ok && entry.valueType == exifTypeLong {
+		exifIFD, err := reader.readIFD(int64(byteOrder.Uint32(entry.value)))
+		if err != nil {
+			return nil, err
+		}
+
+		if entry, ok := exifIFD[exifTagDateTimeOriginal]; ok {
+			data.dateTimeOriginal, _ = reader.readASCII(entry)
+		}
+
+		if entry, ok := exifIFD[exifTagOffsetTimeOriginal]; ok {
+			data.offsetTimeOriginal, _ = reader.readASCII(entry)
+		}
+	}
+
+	return data, nil
+}
+
+type tiffReader struct {
+	r         io.ReaderAt
+	byteOrder binary.ByteOrder
+}
+
+type ifdEntry struct {
+	valueType uint16
+	count     uint32
+	value     []byte
+}
+
+// Read the entries of an image file directory, by tag
+func (t *tiffReader) readIFD(offset int64) (map[uint16]ifdEntry, error) {
+	countBytes := make([]byte, 2)
+	_, err := t.r.ReadAt(countBytes, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read EXIF directory: %w", err)
+	}
+
+	count := int(t.byteOrder.Uint16(countBytes))
+	if count > maxExifIFDEntries {
+		return nil, fmt.Errorf("EXIF directory has too many entries: %d", count)
+	}
+
+	entryBytes := make([]byte, 12*count)
+	_, err = t.r.ReadAt(entryBytes, offset+2)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read EXIF directory: %w", err)
+	}
+
+	entries := make(map[uint16]ifdEntry, count)
+	for i := 0; i < count; i++ {
+		b := entryBytes[12*i : 12*(i+1)]
+		entries[t.byteOrder.Uint16(b[0:2])] = ifdEntry{
+			valueType: t.byteOrder.Uint16(b[2:4]),
+			count:     t.byteOrder.Uint32(b[4:8]),
+			value:     b[8:12],
+		}
+	}
+
+	return entries, nil
+}
+
+// Read an ASCII value, which is stored in the entry itself when it fits in four
+// bytes and at an offset otherwise
+func (t *tiffReader) readASCII(entry ifdEntry) (string, error) {
+	if entry.valueType != exifTypeASCII || entry.count > maxExifValueBytes {
+		return "", errors.New("EXIF value is not a string")
+	}
+
+	value := entry.value[:minInt(int(entry.count), 4)]
+	if entry.count > 4 {
+		value = make([]byte, entry.count)
+		_, err := t.r.ReadAt(value, int64(t.byteOrder.Uint32(entry.value)))
+		if err != nil {
+			return "", fmt.Errorf("failed to read EXIF value: %w", err)
+		}
+	}
+
+	return strings.TrimSpace(strings.TrimRight(string(value), "\x00")), nil
+}
+
+// Parse the time a photo was taken, in the time zone EXIF records for it, or
+// as if it were UTC when EXIF does not record one
+func (e *exifData) capturedAt() (time.Time, error) {
+	if "" == e.dateTimeOriginal {
+		return time.Time{}, errors.New("EXIF metadata has no DateTimeOriginal")
+	}
+
+	if "" != e.offsetTimeOriginal {
+		capturedAt, err := time.Parse(exifDateTimeLayout+"-07:00", e.dateTimeOriginal+e.offsetTimeOriginal)
+		if err == nil {
+			return capturedAt, nil
+		}
+	}
+
+	return time.Parse(exifDateTimeLayout, e.dateTimeOriginal)
+}
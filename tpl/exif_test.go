@@ -0,0 +1,167 @@
+package tpl
+
+import (
+	"bytes"
+	"encoding/binary"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type testIFDEntry struct {
+	tag       uint16
+	valueType uint16
+	value     []byte
+}
+
+// Build a TIFF structure with an IFD0 holding the camera model and a pointer to
+// an EXIF IFD holding the capture time
+func buildTestTIFF(byteOrder binary.ByteOrder, model, dateTimeOriginal, offsetTimeOriginal string) []byte {
+	var buf bytes.Buffer
+	if byteOrder == binary.LittleEndian {
+		buf.WriteString("II*\x00")
+	} else {
+		buf.WriteString("MM\x00*")
+	}
+	binary.Write(&buf, byteOrder, uint32(8))
+
+	ifd0 := []testIFDEntry{
+		{exifTagModel, exifTypeASCII, []byte(model + "\x00")},
+		{exifTagExifIFDPointer, exifTypeLong, nil},
+	}
+	exifIFD := []testIFDEntry{
+		{exifTagDateTimeOriginal, exifTypeASCII, []byte(dateTimeOriginal + "\x00")},
+	}
+	if "" != offsetTimeOriginal {
+		exifIFD = append(exifIFD, testIFDEntry{exifTagOffsetTimeOriginal, exifTypeASCII, []byte(offsetTimeOriginal + "\x00")})
+	}
+
+	ifdSize := func(entries []testIFDEntry) int {
+		return 2 + 12*len(entries) + 4
+	}
+
+	// Values that do not fit in their entry follow both directories
+	ifd0Offset := 8
+	exifIFDOffset := ifd0Offset + ifdSize(ifd0)
+	valuesOffset := exifIFDOffset + ifdSize(exifIFD)
+
+	var values bytes.Buffer
+	writeIFD := func(entries []testIFDEntry) {
+		binary.Write(&buf, byteOrder, uint16(len(entries)))
+		for _, entry := range entries {
+			binary.Write(&buf, byteOrder, entry.tag)
+			binary.Write(&buf, byteOrder, entry.valueType)
+
+			if entry.valueType == exifTypeLong {
+				binary.Write(&buf, byteOrder, uint32(1))
+				binary.Write(&buf, byteOrder, uint32(exifIFDOffset))
+				continue
+			}
+
+			binary.Write(&buf, byteOrder, uint32(len(entry.value)))
+			if len(entry.value) <= 4 {
+				buf.Write(append(entry.value, make([]byte, 4-len(entry.value))...))
+				continue
+			}
+			binary.Write(&buf, byteOrder, uint32(valuesOffset+values.Len()))
+			values.Write(entry.value)
+		}
+		binary.Write(&buf, byteOrder, uint32(0))
+	}
+
+	writeIFD(ifd0)
+	writeIFD(exifIFD)
+	buf.Write(values.Bytes())
+
+	return buf.Bytes()
+}
+
+// Wrap a TIFF structure in the APP1 segment of a JPEG, after another segment
+func buildTestJPEG(tiff []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write([]byte{0xFF, 0xD8})
+
+	buf.Write([]byte{0xFF, 0xE0})
+	binary.Write(&buf, binary.BigEndian, uint16(2+5))
+	buf.WriteString("JFIF\x00")
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	buf.Write([]byte{0xFF, 0xE1})
+	binary.Write(&buf, binary.BigEndian, uint16(2+len(segment)))
+	buf.Write(segment)
+
+	buf.Write([]byte{0xFF, 0xDA, 0x00, 0x02, 0xFF, 0xD9})
+
+	return buf.Bytes()
+}
+
+func writeTempFile(t *testing.T, pattern string, contents []byte) string {
+	file, err := ioutil.TempFile("", pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	_, err = file.Write(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return file.Name()
+}
+
+func TestReadExif(t *testing.T) {
+	Convey("Should read EXIF metadata from a JPEG", t, func() {
+		filePath := writeTempFile(t, "photo*.jpg", buildTestJPEG(
+			buildTestTIFF(binary.BigEndian, "Some Camera", "2024:06:11 10:15:00", ""),
+		))
+		defer os.Remove(filePath)
+
+		exif, err := readExif(filePath)
+
+		So(err, ShouldBeNil)
+		So(exif.model, ShouldEqual, "Some Camera")
+		So(exif.dateTimeOriginal, ShouldEqual, "2024:06:11 10:15:00")
+	})
+
+	Convey("Should read EXIF metadata from a TIFF", t, func() {
+		filePath := writeTempFile(t, "photo*.tif", buildTestTIFF(binary.LittleEndian, "X1", "2024:06:11 10:15:00", "+02:00"))
+		defer os.Remove(filePath)
+
+		exif, err := readExif(filePath)
+
+		So(err, ShouldBeNil)
+		So(exif.model, ShouldEqual, "X1")
+		So(exif.offsetTimeOriginal, ShouldEqual, "+02:00")
+
+		capturedAt, err := exif.capturedAt()
+
+		So(err, ShouldBeNil)
+		So(capturedAt.UTC().Format("2006-01-02T15:04"), ShouldEqual, "2024-06-11T08:15")
+	})
+
+	Convey("Should fail for files without EXIF metadata", t, func() {
+		jpegWithoutExif := writeTempFile(t, "photo*.jpg", []byte{0xFF, 0xD8, 0xFF, 0xDA, 0x00, 0x02, 0xFF, 0xD9})
+		defer os.Remove(jpegWithoutExif)
+
+		_, err := readExif(jpegWithoutExif)
+		So(err, ShouldNotBeNil)
+
+		textFile := writeTempFile(t, "notes*.txt", []byte("not a photo"))
+		defer os.Remove(textFile)
+
+		_, err = readExif(textFile)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should fail for truncated EXIF metadata", t, func() {
+		tiff := buildTestTIFF(binary.BigEndian, "Some Camera", "2024:06:11 10:15:00", "")
+		filePath := writeTempFile(t, "photo*.tif", tiff[:20])
+		defer os.Remove(filePath)
+
+		_, err := readExif(filePath)
+
+		So(err, ShouldNotBeNil)
+	})
+}
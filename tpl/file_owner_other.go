@@ -0,0 +1,17 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package tpl
+
+import (
+	"errors"
+	"os"
+)
+
+func fileOwner(fileInfo os.FileInfo) (string, error) {
+	return "", errors.New("file ownership not supported on this platform")
+}
+
+func fileGroup(fileInfo os.FileInfo) (string, error) {
+	return "", errors.New("file ownership not supported on this platform")
+}
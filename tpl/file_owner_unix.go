@@ -0,0 +1,44 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package tpl
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+func fileOwner(fileInfo os.FileInfo) (string, error) {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", errors.New("file ownership not available")
+	}
+
+	uid := strconv.FormatUint(uint64(stat.Uid), 10)
+
+	owner, err := user.LookupId(uid)
+	if err != nil {
+		return uid, nil
+	}
+
+	return owner.Username, nil
+}
+
+func fileGroup(fileInfo os.FileInfo) (string, error) {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", errors.New("file ownership not available")
+	}
+
+	gid := strconv.FormatUint(uint64(stat.Gid), 10)
+
+	group, err := user.LookupGroupId(gid)
+	if err != nil {
+		return gid, nil
+	}
+
+	return group.Name, nil
+}
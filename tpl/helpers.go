@@ -0,0 +1,100 @@
+package tpl
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// String helpers available to every key template. Where a helper has a
+// counterpart in the widely used sprig library, it has the same name and
+// argument order, so the value being transformed comes last and can be piped
+// in, eg. `{{ fileName | lower | replace " " "_" }}`.
+var helperFuncs = template.FuncMap{
+	"default":         defaultValue,
+	"lower":           strings.ToLower,
+	"regexReplace":    regexReplace,
+	"regexReplaceAll": regexReplaceAll,
+	"replace":         replace,
+	"slugify":         slugify,
+	"trimPrefix":      trimPrefix,
+	"trimSuffix":      trimSuffix,
+	"upper":           strings.ToUpper,
+}
+
+// Return the given value, unless it is empty, in which case return the default
+func defaultValue(defaultValue interface{}, given ...interface{}) interface{} {
+	if 0 == len(given) || isEmpty(given[0]) {
+		return defaultValue
+	}
+
+	return given[0]
+}
+
+func isEmpty(value interface{}) bool {
+	if nil == value {
+		return true
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return 0 == v.Len()
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	default:
+		return v.IsZero()
+	}
+}
+
+// Replace every match of a regular expression with the replacement, which may
+// refer to capture groups, eg. `{{ filePath | regexReplace "^logs/" "archive/" }}`
+func regexReplace(regex, replacement, s string) (string, error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return "", err
+	}
+
+	return re.ReplaceAllString(s, replacement), nil
+}
+
+// The sprig argument order of `regexReplace`
+func regexReplaceAll(regex, s, replacement string) (string, error) {
+	return regexReplace(regex, replacement, s)
+}
+
+func replace(old, new, s string) string {
+	return strings.Replace(s, old, new, -1)
+}
+
+// Lowercase a string and replace every run of characters other than letters and
+// digits with a single dash, eg. `My Photo (1).JPG` becomes `my-photo-1-jpg`
+func slugify(s string) string {
+	var b strings.Builder
+	pendingDash := false
+
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if pendingDash && b.Len() > 0 {
+				b.WriteRune('-')
+			}
+			pendingDash = false
+			b.WriteRune(r)
+			continue
+		}
+
+		pendingDash = true
+	}
+
+	return b.String()
+}
+
+func trimPrefix(prefix, s string) string {
+	return strings.TrimPrefix(s, prefix)
+}
+
+func trimSuffix(suffix, s string) string {
+	return strings.TrimSuffix(s, suffix)
+}
@@ -0,0 +1,48 @@
+package tpl
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestHelperFuncs(t *testing.T) {
+	Convey("default", t, func() {
+		So(defaultValue("fallback", ""), ShouldEqual, "fallback")
+		So(defaultValue("fallback", 0), ShouldEqual, "fallback")
+		So(defaultValue("fallback"), ShouldEqual, "fallback")
+		So(defaultValue("fallback", "given"), ShouldEqual, "given")
+	})
+
+	Convey("regexReplace", t, func() {
+		actual, err := regexReplace(`^logs/(\d+)/`, "archive/year=$1/", "logs/2024/x.log")
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, "archive/year=2024/x.log")
+
+		_, err = regexReplace("(", "", "x")
+
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("regexReplaceAll", t, func() {
+		actual, err := regexReplaceAll(`\s+`, "a  b c", "_")
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, "a_b_c")
+	})
+
+	Convey("replace", t, func() {
+		So(replace(" ", "_", "a b c"), ShouldEqual, "a_b_c")
+	})
+
+	Convey("slugify", t, func() {
+		So(slugify("My Photo (1).JPG"), ShouldEqual, "my-photo-1-jpg")
+		So(slugify("--Über  café--"), ShouldEqual, "über-café")
+		So(slugify(""), ShouldEqual, "")
+	})
+
+	Convey("trimPrefix and trimSuffix", t, func() {
+		So(trimPrefix("data/", "data/2024/x.csv"), ShouldEqual, "2024/x.csv")
+		So(trimSuffix(".csv", "data/2024/x.csv"), ShouldEqual, "data/2024/x")
+	})
+}
@@ -0,0 +1,285 @@
+package tpl
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// Template functions whose value is the same for every file in a run
+var runLevelFuncs = map[string]bool{
+	"dateWithFormat":  true,
+	"env":             true,
+	"hostname":        true,
+	"runId":           true,
+	"uploadTime":      true,
+	"uploadTimestamp": true,
+	"var":             true,
+}
+
+// Functions built into Go templates, whose value only depends on their
+// arguments
+var builtinFuncs = map[string]bool{
+	"and":      true,
+	"call":     true,
+	"eq":       true,
+	"ge":       true,
+	"gt":       true,
+	"html":     true,
+	"index":    true,
+	"js":       true,
+	"le":       true,
+	"len":      true,
+	"lt":       true,
+	"ne":       true,
+	"not":      true,
+	"or":       true,
+	"print":    true,
+	"printf":   true,
+	"println":  true,
+	"slice":    true,
+	"urlquery": true,
+}
+
+// Template functions that take a string argument which is easily mangled by a
+// shell stripping its quotes
+var stringArgumentFuncs = map[string]bool{
+	"birthTimeWithFormat":    true,
+	"datePartitions":         true,
+	"dateWithFormat":         true,
+	"env":                    true,
+	"exifDateTimeWithFormat": true,
+	"fileNameDate":           true,
+	"fileNameDateWithFormat": true,
+	"hivePartitions":         true,
+	"modTimeWithFormat":      true,
+	"pathCapture":            true,
+	"uploadTimestamp":        true,
+	"var":                    true,
+}
+
+var undefinedFunctionPattern = regexp.MustCompile(`function "([^"]+)" not defined`)
+
+// ReadTemplateText returns the template text given on the command line. Text
+// starting with `@` names a file to read the template from instead, eg.
+// `@keys.tmpl`, with any trailing newline removed.
+func ReadTemplateText(s string) (string, error) {
+	if !strings.HasPrefix(s, "@") {
+		return s, nil
+	}
+
+	b, err := ioutil.ReadFile(s[1:])
+	if err != nil {
+		return "", fmt.Errorf("failed to read template file: %s: %w", s[1:], err)
+	}
+
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// LintTemplate parses template text and returns warnings about mistakes that
+// would not stop it from rendering, but would likely render unintended keys.
+// Templates that cannot be parsed return an error, which suggests the closest
+// known function when the template calls an unknown one.
+func LintTemplate(templateText string) ([]string, error) {
+	escapedQuotesWarning := `template contains escaped quotes (\"), the backslashes were probably meant to be removed by your shell; quote the template with single quotes instead`
+	hasEscapedQuotes := strings.Contains(templateText, `\"`)
+
+	tmpl, err := template.New("key").Funcs(allFuncs()).Parse(templateText)
+	if err != nil && hasEscapedQuotes {
+		return nil, fmt.Errorf("%w: %s", explainParseError(err), escapedQuotesWarning)
+	}
+	if err != nil {
+		return nil, explainParseError(err)
+	}
+
+	var warnings []string
+
+	if hasEscapedQuotes {
+		warnings = append(warnings, escapedQuotesWarning)
+	}
+
+	linter := &templateLinter{}
+	linter.walk(tmpl.Tree.Root)
+
+	if linter.hasQuoteInText {
+		warnings = append(warnings, `text outside of {{ }} contains a quote, which becomes part of every key; check how your shell quotes the template`)
+	}
+
+	for _, name := range linter.unquotedArgumentFuncs {
+		warnings = append(warnings, fmt.Sprintf(
+			"argument to %s is not a quoted string, your shell may have removed its quotes",
+			name,
+		))
+	}
+
+	if !linter.hasPerFileValue {
+		warnings = append(warnings, "template does not refer to any value of the file, so every file gets the same key")
+	}
+
+	return warnings, nil
+}
+
+type templateLinter struct {
+	hasPerFileValue       bool
+	hasQuoteInText        bool
+	unquotedArgumentFuncs []string
+}
+
+func (l *templateLinter) walk(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			l.walk(child)
+		}
+	case *parse.TextNode:
+		if strings.ContainsAny(string(n.Text), `"'`) {
+			l.hasQuoteInText = true
+		}
+	case *parse.ActionNode:
+		l.walk(n.Pipe)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			l.walk(cmd)
+		}
+	case *parse.CommandNode:
+		if identifier, ok := n.Args[0].(*parse.IdentifierNode); ok && stringArgumentFuncs[identifier.Ident] {
+			for _, arg := range n.Args[1:] {
+				if _, ok := arg.(*parse.NumberNode); ok {
+					l.unquotedArgumentFuncs = append(l.unquotedArgumentFuncs, identifier.Ident)
+				}
+			}
+		}
+		for _, arg := range n.Args {
+			l.walk(arg)
+		}
+	case *parse.IdentifierNode:
+		// Builtins and string helpers only transform their arguments, so they
+		// only vary per file when one of their arguments does
+		if _, ok := helperFuncs[n.Ident]; !ok && !builtinFuncs[n.Ident] && !runLevelFuncs[n.Ident] {
+			l.hasPerFileValue = true
+		}
+	case *parse.FieldNode, *parse.DotNode:
+		l.hasPerFileValue = true
+	case *parse.ChainNode:
+		l.walk(n.Node)
+	case *parse.IfNode:
+		l.walkBranch(&n.BranchNode)
+	case *parse.RangeNode:
+		l.walkBranch(&n.BranchNode)
+	case *parse.WithNode:
+		l.walkBranch(&n.BranchNode)
+	case *parse.TemplateNode:
+		l.walk(n.Pipe)
+	}
+}
+
+func (l *templateLinter) walkBranch(n *parse.BranchNode) {
+	l.walk(n.Pipe)
+	l.walk(n.List)
+	l.walk(n.ElseList)
+}
+
+// Every function available to key templates, bound to an empty file, for
+// parsing templates without rendering them
+func allFuncs() template.FuncMap {
+	funcs := template.FuncMap{}
+	for name, f := range helperFuncs {
+		funcs[name] = f
+	}
+	for name, f := range (&keyTemplate{runContext: &RunContext{}}).funcMap(&tplFileData{}) {
+		funcs[name] = f
+	}
+
+	return funcs
+}
+
+// The names of every function available to key templates, including the ones
+// built into Go templates
+func knownFuncNames() []string {
+	var names []string
+	for name := range builtinFuncs {
+		names = append(names, name)
+	}
+	for name := range allFuncs() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Add a suggestion to errors about undefined functions
+func explainParseError(err error) error {
+	matches := undefinedFunctionPattern.FindStringSubmatch(err.Error())
+	if nil == matches {
+		return err
+	}
+
+	suggestion := closestName(matches[1], knownFuncNames())
+	if "" == suggestion {
+		return fmt.Errorf("%w: unknown template function %s", err, matches[1])
+	}
+
+	return fmt.Errorf("%w: unknown template function %s, did you mean %s?", err, matches[1], suggestion)
+}
+
+// Find the name closest to the given one, if any is close enough to be a likely
+// typo
+func closestName(name string, names []string) string {
+	closest := ""
+	closestDistance := len(name)/2 + 1
+
+	for _, candidate := range names {
+		distance := levenshtein(strings.ToLower(name), strings.ToLower(candidate))
+		if distance < closestDistance {
+			closest = candidate
+			closestDistance = distance
+		}
+	}
+
+	return closest
+}
+
+func levenshtein(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+func minInt(values ...int) int {
+	min := values[0]
+	for _, v := range values[1:] {
+		if v < min {
+			min = v
+		}
+	}
+
+	return min
+}
@@ -0,0 +1,127 @@
+package tpl
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReadTemplateText(t *testing.T) {
+	Convey("Should return template text as given", t, func() {
+		text, err := ReadTemplateText("{{ fileName }}")
+
+		So(err, ShouldBeNil)
+		So(text, ShouldEqual, "{{ fileName }}")
+	})
+
+	Convey("Should read template text from a file", t, func() {
+		file, err := ioutil.TempFile("", "keys.tmpl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(file.Name())
+
+		_, err = file.WriteString("{{ modTimeWithFormat \"2006\" }}/{{ fileName }}\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+
+		text, err := ReadTemplateText("@" + file.Name())
+
+		So(err, ShouldBeNil)
+		So(text, ShouldEqual, "{{ modTimeWithFormat \"2006\" }}/{{ fileName }}")
+	})
+
+	Convey("Should fail for template files that do not exist", t, func() {
+		_, err := ReadTemplateText("@does-not-exist.tmpl")
+
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestLintTemplate(t *testing.T) {
+	Convey("Should not warn about good templates", t, func() {
+		templates := []string{
+			"{{ filePath }}",
+			`{{ hostname }}/{{ if true }}{{ fileName | lower }}{{ end }}`,
+			`{{ uploadTimestamp "2006" }}/{{ .FileName }}`,
+			`{{ with relativeToRoot }}{{ . }}{{ end }}`,
+		}
+
+		for _, templateText := range templates {
+			warnings, err := LintTemplate(templateText)
+
+			So(err, ShouldBeNil)
+			So(warnings, ShouldBeEmpty)
+		}
+	})
+
+	Convey("Should warn about templates without any per-file value", t, func() {
+		warnings, err := LintTemplate(`backups/{{ hostname }}/{{ dateWithFormat "2006" | upper }}`)
+
+		So(err, ShouldBeNil)
+		So(warnings, ShouldHaveLength, 1)
+		So(warnings[0], ShouldContainSubstring, "every file gets the same key")
+	})
+
+	Convey("Should warn about templates made only of builtins and helpers", t, func() {
+		warnings, err := LintTemplate(`{{ printf "%s" runId | lower | replace "-" "" }}/{{ if eq (len hostname) 0 }}none{{ end }}`)
+
+		So(err, ShouldBeNil)
+		So(warnings, ShouldHaveLength, 1)
+		So(warnings[0], ShouldContainSubstring, "every file gets the same key")
+	})
+
+	Convey("Should not warn when a builtin is given a per-file value", t, func() {
+		warnings, err := LintTemplate(`{{ printf "%s/%s" runId fileName }}`)
+
+		So(err, ShouldBeNil)
+		So(warnings, ShouldBeEmpty)
+	})
+
+	Convey("Should warn about quotes the shell did not handle", t, func() {
+		warnings, err := LintTemplate(`"{{ fileName }}"`)
+		So(err, ShouldBeNil)
+		So(warnings, ShouldHaveLength, 1)
+		So(warnings[0], ShouldContainSubstring, "quote")
+
+		warnings, err = LintTemplate(`{{ dateWithFormat 2006 }}/{{ fileName }}`)
+		So(err, ShouldBeNil)
+		So(warnings, ShouldHaveLength, 1)
+		So(warnings[0], ShouldContainSubstring, "dateWithFormat")
+	})
+
+	Convey("Should warn about escaped quotes", t, func() {
+		_, err := LintTemplate(`{{ dateWithFormat \"2006\" }}/{{ fileName }}`)
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "escaped quotes")
+
+		warnings, err := LintTemplate(`\"{{ fileName }}\"`)
+
+		So(err, ShouldBeNil)
+		So(warnings[0], ShouldContainSubstring, "escaped quotes")
+	})
+
+	Convey("Should suggest the closest function for unknown functions", t, func() {
+		_, err := LintTemplate("{{ filename }}")
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "did you mean fileName?")
+
+		_, err = LintTemplate("{{ somethingElseEntirely }}")
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "unknown template function somethingElseEntirely")
+		So(err.Error(), ShouldNotContainSubstring, "did you mean")
+	})
+
+	Convey("Should suggest the closest function when creating a key template", t, func() {
+		_, err := NewKeyTemplate("{{ fileNmae }}", nil, &logger)
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "did you mean fileName?")
+	})
+}
@@ -0,0 +1,104 @@
+package tpl
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"text/template"
+	"time"
+)
+
+// DefaultManifestKeyTemplate puts the manifests of a run under a prefix of
+// their own, each in a directory that its `_SUCCESS` marker is uploaded to
+const DefaultManifestKeyTemplate = "_manifests/{{ uploadTimestamp }}/{{ manifestNumber }}/manifest.{{ manifestFormat }}"
+
+// ManifestKeyTemplate generates the keys of the manifests describing the files
+// uploaded in a run. Only the values shared by every file in the run are
+// available to it, along with the manifest's number and format.
+type ManifestKeyTemplate interface {
+	KeyForManifest(number int, format string) (string, error)
+}
+
+type manifestKeyTemplate struct {
+	runContext *RunContext
+	template   *template.Template
+}
+
+// NewManifestKeyTemplate creates an instance of a ManifestKeyTemplate, sharing
+// the run context of the run's key template
+func NewManifestKeyTemplate(templateText string, runContext *RunContext, logger *logrus.Logger) (ManifestKeyTemplate, error) {
+	if nil == runContext {
+		var err error
+		runContext, err = NewRunContext(nil, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	manifestKeyTemplate := &manifestKeyTemplate{runContext: runContext}
+
+	tmpl, err := template.New("manifest").
+		Funcs(helperFuncs).
+		Funcs(manifestKeyTemplate.funcMap(0, "")).
+		Parse(templateText)
+	if err != nil {
+		logger.Errorf("failed to parse manifest key template text: %v", err)
+		return nil, err
+	}
+
+	manifestKeyTemplate.template = tmpl
+
+	return manifestKeyTemplate, nil
+}
+
+// KeyForManifest renders the key of the manifest with the given number, counting
+// from 1 for the first manifest of the run
+func (m *manifestKeyTemplate) KeyForManifest(number int, format string) (string, error) {
+	tmpl, err := m.template.Clone()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate key for manifest: %d: %w", number, err)
+	}
+
+	var b bytes.Buffer
+	err = tmpl.Funcs(m.funcMap(number, format)).Execute(&b, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate key for manifest: %d: %w", number, err)
+	}
+
+	return b.String(), nil
+}
+
+// Build the template functions that refer to a single manifest
+func (m *manifestKeyTemplate) funcMap(number int, format string) template.FuncMap {
+	runContext := m.runContext
+
+	return template.FuncMap{
+		"dateWithFormat": func(layout string) string {
+			return time.Now().Format(layout)
+		},
+		"env": runContext.Env,
+		"hostname": func() string {
+			return runContext.Hostname
+		},
+		"manifestFormat": func() string {
+			return format
+		},
+		"manifestNumber": func() int {
+			return number
+		},
+		"runId": func() string {
+			return runContext.RunID
+		},
+		"uploadTime": func() time.Time {
+			return runContext.StartedAt
+		},
+		"uploadTimestamp": func(layout ...string) string {
+			if 0 == len(layout) {
+				return runContext.UploadTimestamp(DefaultUploadTimestampLayout)
+			}
+
+			return runContext.UploadTimestamp(layout[0])
+		},
+		"var": runContext.Var,
+	}
+}
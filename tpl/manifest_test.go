@@ -0,0 +1,42 @@
+package tpl
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestManifestKeyTemplate_KeyForManifest(t *testing.T) {
+	runContext, err := NewRunContext(map[string]string{"team": "sensors"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runContext.RunID = "some-run"
+	runContext.StartedAt = time.Date(2024, 6, 11, 10, 15, 0, 0, time.UTC)
+
+	Convey("Should render the default manifest key", t, func() {
+		tmpl, err := NewManifestKeyTemplate(DefaultManifestKeyTemplate, runContext, &logger)
+		So(err, ShouldBeNil)
+
+		key, err := tmpl.KeyForManifest(3, "jsonl")
+
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "_manifests/20240611T101500Z/3/manifest.jsonl")
+	})
+
+	Convey("Should render run level values", t, func() {
+		tmpl, err := NewManifestKeyTemplate(`{{ var "team" }}/{{ runId }}/{{ manifestNumber }}.{{ manifestFormat }}`, runContext, &logger)
+		So(err, ShouldBeNil)
+
+		key, err := tmpl.KeyForManifest(1, "csv")
+
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "sensors/some-run/1.csv")
+	})
+
+	Convey("Should fail to parse templates referring to files", t, func() {
+		_, err := NewManifestKeyTemplate("{{ fileName }}", runContext, &logger)
+
+		So(err, ShouldNotBeNil)
+	})
+}
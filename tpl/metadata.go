@@ -0,0 +1,125 @@
+package tpl
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"time"
+)
+
+// ExifCameraModel returns the model of the camera that took a photo, as
+// recorded in the EXIF metadata of a JPEG or TIFF file
+func (t *tplFileData) ExifCameraModel() (string, error) {
+	exif, err := t.readExif()
+	if err != nil {
+		return "", err
+	}
+
+	if "" == exif.model {
+		return "", fmt.Errorf("EXIF metadata has no camera model: %s", t.filePath)
+	}
+
+	return exif.model, nil
+}
+
+// ExifDateTimeWithFormat formats the time a photo was taken, as recorded in the
+// EXIF DateTimeOriginal of a JPEG or TIFF file, with the provided layout string
+func (t *tplFileData) ExifDateTimeWithFormat(layout string) (string, error) {
+	exif, err := t.readExif()
+	if err != nil {
+		return "", err
+	}
+
+	capturedAt, err := exif.capturedAt()
+	if err != nil {
+		return "", fmt.Errorf("failed to read capture time of file: %s: %w", t.filePath, err)
+	}
+
+	return capturedAt.Format(layout), nil
+}
+
+// FileNameDate finds a date in the file's name with a regular expression and
+// parses it with the `layout` it is written in. When the regular expression has
+// a capture group, only the first group is parsed, eg. `cam3_20240611T101500.jpg`
+// with the expression `_(\d{8}T\d{6})` and layout `20060102T150405`.
+func (t *tplFileData) FileNameDate(regex, layout string) (time.Time, error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	fileName := path.Base(cleanSlashPath(t.filePath))
+
+	match := re.FindStringSubmatch(fileName)
+	if nil == match {
+		return time.Time{}, fmt.Errorf("no date matching %s in file name: %s", regex, fileName)
+	}
+
+	dateText := match[0]
+	if len(match) > 1 {
+		dateText = match[1]
+	}
+
+	date, err := time.Parse(layout, dateText)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse date in file name: %s: %w", fileName, err)
+	}
+
+	return date, nil
+}
+
+// FileNameDateWithFormat finds a date in the file's name like FileNameDate, and
+// formats it with `outputLayout`
+func (t *tplFileData) FileNameDateWithFormat(regex, layout, outputLayout string) (string, error) {
+	date, err := t.FileNameDate(regex, layout)
+	if err != nil {
+		return "", err
+	}
+
+	return date.Format(outputLayout), nil
+}
+
+// PathCapture matches the file's path against a regular expression, returning
+// the text matched by the named capture group, eg. the expression
+// `(?P<camera>cam\d+)_` and the group `camera` capture `cam3` from the path
+// `photos/cam3_20240611T101500.jpg`
+func (t *tplFileData) PathCapture(regex, group string) (string, error) {
+	re, err := regexp.Compile(regex)
+	if err != nil {
+		return "", err
+	}
+
+	index := -1
+	for i, name := range re.SubexpNames() {
+		if name == group && "" != name {
+			index = i
+		}
+	}
+
+	if index < 0 {
+		return "", fmt.Errorf("regular expression has no capture group named %s: %s", group, regex)
+	}
+
+	filePath := cleanSlashPath(t.filePath)
+
+	match := re.FindStringSubmatch(filePath)
+	if nil == match {
+		return "", fmt.Errorf("path does not match %s: %s", regex, filePath)
+	}
+
+	return match[index], nil
+}
+
+// Read the file's EXIF metadata once, no matter how many times the template
+// refers to it
+func (t *tplFileData) readExif() (*exifData, error) {
+	if !t.exifRead {
+		t.exif, t.exifErr = readExif(t.filePath)
+		if t.exifErr != nil {
+			t.exifErr = fmt.Errorf("failed to read EXIF metadata of file: %s: %w", t.filePath, t.exifErr)
+		}
+		t.exifRead = true
+	}
+
+	return t.exif, t.exifErr
+}
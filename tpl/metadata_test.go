@@ -0,0 +1,95 @@
+package tpl
+
+import (
+	"encoding/binary"
+	. "github.com/smartystreets/goconvey/convey"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestTplFileData_FileNameDateWithFormat(t *testing.T) {
+	tplFileData := &tplFileData{filePath: "photos/cam3_20240611T101500.jpg"}
+
+	Convey("Should parse the first capture group", t, func() {
+		actual, err := tplFileData.FileNameDateWithFormat(`_(\d{8}T\d{6})`, "20060102T150405", "2006/01/02/15")
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, "2024/06/11/10")
+	})
+
+	Convey("Should parse the whole match without capture groups", t, func() {
+		actual, err := tplFileData.FileNameDateWithFormat(`\d{8}`, "20060102", "2006-01-02")
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, "2024-06-11")
+	})
+
+	Convey("Should fail when the file name has no date", t, func() {
+		_, err := tplFileData.FileNameDateWithFormat(`\d{14}`, "20060102150405", "2006")
+		So(err, ShouldNotBeNil)
+
+		_, err = tplFileData.FileNameDateWithFormat(`\d{8}`, "2006-01-02", "2006")
+		So(err, ShouldNotBeNil)
+
+		_, err = tplFileData.FileNameDateWithFormat(`(`, "2006", "2006")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestTplFileData_PathCapture(t *testing.T) {
+	tplFileData := &tplFileData{filePath: "./photos/cam3_20240611T101500.jpg"}
+
+	Convey("Should return a named capture group", t, func() {
+		actual, err := tplFileData.PathCapture(`^(?P<album>[^/]+)/(?P<camera>cam\d+)_`, "camera")
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, "cam3")
+	})
+
+	Convey("Should fail for unknown groups and paths that do not match", t, func() {
+		_, err := tplFileData.PathCapture(`(?P<camera>cam\d+)_`, "album")
+		So(err, ShouldNotBeNil)
+
+		_, err = tplFileData.PathCapture(`(?P<camera>video\d+)_`, "camera")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestKeyTemplate_Metadata(t *testing.T) {
+	dirname := path.Join(os.TempDir(), "photos")
+	err := os.MkdirAll(dirname, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirname)
+
+	filePath := path.Join(dirname, "cam3_20240611T101500.jpg")
+	f, err := os.Create(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(buildTestJPEG(buildTestTIFF(binary.BigEndian, "Some Camera", "2023:12:31 23:59:58", "")))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Should interpolate dates and fields from file names and EXIF metadata", t, func() {
+		tpl, err := NewKeyTemplate(
+			`{{ exifCameraModel | slugify }}/{{ exifDateTimeWithFormat "2006/01/02" }}/`+
+				`{{ fileNameDateWithFormat "_(\\d{8})T" "20060102" "2006-01-02" }}/`+
+				`{{ pathCapture "(?P<camera>cam\\d+)_" "camera" }}`,
+			nil,
+			&logger,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := tpl.KeyForFile(filePath)
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, "some-camera/2023/12/31/2024-06-11/cam3")
+	})
+}
@@ -0,0 +1,130 @@
+package tpl
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxKeyBytes is the longest key S3 accepts, in bytes of UTF-8
+const MaxKeyBytes = 1024
+
+// UnsafeCharacterPolicy decides what happens to characters in a key that S3
+// does not consider safe. S3 accepts any UTF-8 in keys, but only letters,
+// digits, `/` and `!-_.*'()` are safe to use everywhere without encoding.
+type UnsafeCharacterPolicy string
+
+const (
+	// KeepUnsafeCharacters leaves unsafe characters in keys as they are
+	KeepUnsafeCharacters UnsafeCharacterPolicy = "keep"
+	// ReplaceUnsafeCharacters replaces each unsafe character with `_`
+	ReplaceUnsafeCharacters UnsafeCharacterPolicy = "replace"
+	// RejectUnsafeCharacters fails to generate keys with unsafe characters
+	RejectUnsafeCharacters UnsafeCharacterPolicy = "reject"
+)
+
+// ParseUnsafeCharacterPolicy parses the name of an unsafe character policy
+func ParseUnsafeCharacterPolicy(s string) (UnsafeCharacterPolicy, error) {
+	switch policy := UnsafeCharacterPolicy(strings.ToLower(strings.TrimSpace(s))); policy {
+	case KeepUnsafeCharacters, ReplaceUnsafeCharacters, RejectUnsafeCharacters:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown unsafe character policy, expected keep, replace or reject: %s", s)
+	}
+}
+
+type normalizingKeyTemplate struct {
+	keyTemplate           KeyTemplate
+	unsafeCharacterPolicy UnsafeCharacterPolicy
+}
+
+// NewNormalizingKeyTemplate wraps a key template so that every key it generates
+// is normalized with `NormalizeKey`
+func NewNormalizingKeyTemplate(keyTemplate KeyTemplate, unsafeCharacterPolicy UnsafeCharacterPolicy) KeyTemplate {
+	return &normalizingKeyTemplate{
+		keyTemplate:           keyTemplate,
+		unsafeCharacterPolicy: unsafeCharacterPolicy,
+	}
+}
+
+// KeyForFile generates the key for a file and normalizes it
+func (n *normalizingKeyTemplate) KeyForFile(relativeFilePath string) (string, error) {
+	return n.KeyForFileInRoot("", relativeFilePath)
+}
+
+// KeyForFileInRoot generates the key for a file found in a root path and
+// normalizes it
+func (n *normalizingKeyTemplate) KeyForFileInRoot(rootPath string, relativeFilePath string) (string, error) {
+	key, err := n.keyTemplate.KeyForFileInRoot(rootPath, relativeFilePath)
+	if err != nil {
+		return "", err
+	}
+
+	normalizedKey, err := NormalizeKey(key, n.unsafeCharacterPolicy)
+	if err != nil {
+		return "", fmt.Errorf("invalid key for file: %s: %w", relativeFilePath, err)
+	}
+
+	return normalizedKey, nil
+}
+
+// NormalizeKey turns a rendered key into one S3 stores the way it reads:
+// backslashes become slashes, the path is cleaned of `.` and `..` segments and
+// repeated slashes, and leading slashes are stripped. Keys that are empty,
+// escape above their root with `..`, contain control characters or invalid
+// UTF-8, or are longer than `MaxKeyBytes` are rejected, as are keys with unsafe
+// characters when the policy says so.
+func NormalizeKey(key string, unsafeCharacterPolicy UnsafeCharacterPolicy) (string, error) {
+	if !utf8.ValidString(key) {
+		return "", fmt.Errorf("key is not valid UTF-8: %q", key)
+	}
+
+	for _, r := range key {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("key contains control character %U: %q", r, key)
+		}
+	}
+
+	normalizedKey := path.Clean(strings.Replace(key, "\\", "/", -1))
+	normalizedKey = strings.TrimLeft(normalizedKey, "/")
+
+	if "" == normalizedKey || "." == normalizedKey {
+		return "", fmt.Errorf("key is empty: %q", key)
+	}
+
+	if ".." == normalizedKey || strings.HasPrefix(normalizedKey, "../") {
+		return "", fmt.Errorf("key refers to a parent directory with ..: %q", key)
+	}
+
+	switch unsafeCharacterPolicy {
+	case ReplaceUnsafeCharacters:
+		normalizedKey = strings.Map(func(r rune) rune {
+			if isSafeKeyCharacter(r) {
+				return r
+			}
+			return '_'
+		}, normalizedKey)
+	case RejectUnsafeCharacters:
+		if i := strings.IndexFunc(normalizedKey, func(r rune) bool { return !isSafeKeyCharacter(r) }); i >= 0 {
+			r, _ := utf8.DecodeRuneInString(normalizedKey[i:])
+			return "", fmt.Errorf("key contains unsafe character %q: %q", r, normalizedKey)
+		}
+	}
+
+	if len(normalizedKey) > MaxKeyBytes {
+		return "", fmt.Errorf("key is %d bytes long, longer than the limit of %d bytes: %q", len(normalizedKey), MaxKeyBytes, normalizedKey)
+	}
+
+	return normalizedKey, nil
+}
+
+func isSafeKeyCharacter(r rune) bool {
+	switch {
+	case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9':
+		return true
+	}
+
+	return strings.ContainsRune("/!-_.*'()", r)
+}
@@ -0,0 +1,130 @@
+package tpl
+
+import (
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+)
+
+func TestParseUnsafeCharacterPolicy(t *testing.T) {
+	Convey("Should parse known policies", t, func() {
+		policy, err := ParseUnsafeCharacterPolicy(" Replace ")
+
+		So(err, ShouldBeNil)
+		So(policy, ShouldEqual, ReplaceUnsafeCharacters)
+	})
+
+	Convey("Should fail for unknown policies", t, func() {
+		_, err := ParseUnsafeCharacterPolicy("escape")
+
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestNormalizeKey(t *testing.T) {
+	Convey("Should clean keys", t, func() {
+		cases := map[string]string{
+			"./data/2024/x.csv":    "data/2024/x.csv",
+			"/text.txt":            "text.txt",
+			"//a//b/./c/":          "a/b/c",
+			"a/b/../c":             "a/c",
+			`logs\2024\x.log`:      "logs/2024/x.log",
+			"some dir/(1) ü.txt":   "some dir/(1) ü.txt",
+			"/absolute/path/x.txt": "absolute/path/x.txt",
+		}
+
+		for key, expected := range cases {
+			actual, err := NormalizeKey(key, KeepUnsafeCharacters)
+
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, expected)
+		}
+	})
+
+	Convey("Should reject invalid keys", t, func() {
+		invalidKeys := []string{
+			"",
+			"/",
+			"./",
+			"../x",
+			"a/../../x",
+			"a\x00b",
+			"a\nb",
+			"\xff",
+			strings.Repeat("a", MaxKeyBytes+1),
+		}
+
+		for _, key := range invalidKeys {
+			_, err := NormalizeKey(key, KeepUnsafeCharacters)
+
+			So(err, ShouldNotBeNil)
+		}
+	})
+
+	Convey("Should accept keys of exactly the maximum length", t, func() {
+		_, err := NormalizeKey(strings.Repeat("a", MaxKeyBytes), KeepUnsafeCharacters)
+
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Should replace unsafe characters", t, func() {
+		actual, err := NormalizeKey("some dir/(1) ü&x.txt", ReplaceUnsafeCharacters)
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, "some_dir/(1)___x.txt")
+	})
+
+	Convey("Should reject unsafe characters", t, func() {
+		_, err := NormalizeKey("some dir/x.txt", RejectUnsafeCharacters)
+		So(err, ShouldNotBeNil)
+
+		actual, err := NormalizeKey("some-dir/x_(1).txt", RejectUnsafeCharacters)
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, "some-dir/x_(1).txt")
+	})
+}
+
+type stubKeyTemplate struct {
+	key string
+	err error
+}
+
+// KeyForFile returns the stubbed key
+func (s *stubKeyTemplate) KeyForFile(relativeFilePath string) (string, error) {
+	return s.KeyForFileInRoot("", relativeFilePath)
+}
+
+// KeyForFileInRoot returns the stubbed key
+func (s *stubKeyTemplate) KeyForFileInRoot(rootPath string, relativeFilePath string) (string, error) {
+	return s.key, s.err
+}
+
+func TestNormalizingKeyTemplate(t *testing.T) {
+	Convey("Should normalize generated keys", t, func() {
+		keyTemplate := NewNormalizingKeyTemplate(&stubKeyTemplate{key: "./a//b"}, KeepUnsafeCharacters)
+
+		actual, err := keyTemplate.KeyForFile("some/file")
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, "a/b")
+	})
+
+	Convey("Should name the file when its key is invalid", t, func() {
+		keyTemplate := NewNormalizingKeyTemplate(&stubKeyTemplate{key: "../b"}, KeepUnsafeCharacters)
+
+		_, err := keyTemplate.KeyForFile("some/file")
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "some/file")
+	})
+
+	Convey("Should pass on template errors", t, func() {
+		expectedErr := errors.New("some error")
+		keyTemplate := NewNormalizingKeyTemplate(&stubKeyTemplate{err: expectedErr}, KeepUnsafeCharacters)
+
+		_, err := keyTemplate.KeyForFile("some/file")
+
+		So(err, ShouldEqual, expectedErr)
+	})
+}
@@ -0,0 +1,115 @@
+package tpl
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Partition styles for keys of data lake tables
+const (
+	// PartitionStyleHive names each partition, eg. `year=2024/month=06/day=11`
+	PartitionStyleHive = "hive"
+
+	// PartitionStylePlain only keeps the values, eg. `2024/06/11`
+	PartitionStylePlain = "plain"
+)
+
+// Partition granularities, from the coarsest to the finest
+var partitionGranularities = []string{"year", "month", "day", "hour"}
+
+// Layouts of the value of each partition
+var partitionLayouts = map[string]string{
+	"year":  "2006",
+	"month": "01",
+	"day":   "02",
+	"hour":  "15",
+}
+
+// PartitionPath builds the date partitions of a key in the given style, down to
+// the given granularity, eg. `year=2024/month=06/day=11/hour=10` for the Hive
+// style and the granularity `hour`. The time is converted to UTC first. When
+// the table name is not empty, it is the first partition, eg. `table=events`.
+func PartitionPath(style, table string, at time.Time, granularity string) (string, error) {
+	if style != PartitionStyleHive && style != PartitionStylePlain {
+		return "", fmt.Errorf(
+			"invalid partition style %s, must be one of: %s, %s",
+			style,
+			PartitionStyleHive,
+			PartitionStylePlain,
+		)
+	}
+
+	depth := -1
+	for i, name := range partitionGranularities {
+		if name == granularity {
+			depth = i
+		}
+	}
+
+	if depth < 0 {
+		return "", fmt.Errorf(
+			"invalid partition granularity %s, must be one of: %s",
+			granularity,
+			strings.Join(partitionGranularities, ", "),
+		)
+	}
+
+	var partitions []string
+	if "" != table {
+		partitions = append(partitions, partition(style, "table", table))
+	}
+
+	at = at.UTC()
+	for _, name := range partitionGranularities[:depth+1] {
+		partitions = append(partitions, partition(style, name, at.Format(partitionLayouts[name])))
+	}
+
+	return strings.Join(partitions, "/"), nil
+}
+
+func partition(style, name, value string) string {
+	if style == PartitionStyleHive {
+		return name + "=" + value
+	}
+
+	return value
+}
+
+// Build the template function for partitions in the given style. It takes
+// options in any order: the granularity (`day` by default), the time to
+// partition by (the upload time by default), and `table` to start with the name
+// of the directory containing the file.
+func partitionFunc(data *tplFileData, runContext *RunContext, style string) func(options ...interface{}) (string, error) {
+	return func(options ...interface{}) (string, error) {
+		granularity := "day"
+		at := runContext.StartedAt
+		withTable := false
+
+		for _, option := range options {
+			switch value := option.(type) {
+			case string:
+				if value == "table" {
+					withTable = true
+				} else {
+					granularity = value
+				}
+			case time.Time:
+				at = value
+			default:
+				return "", fmt.Errorf("invalid option for %s partitions: %v", style, option)
+			}
+		}
+
+		table := ""
+		if withTable {
+			var err error
+			table, err = data.SourceDirName()
+			if err != nil {
+				return "", err
+			}
+		}
+
+		return PartitionPath(style, table, at, granularity)
+	}
+}
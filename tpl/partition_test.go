@@ -0,0 +1,103 @@
+package tpl
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestPartitionPath(t *testing.T) {
+	at := time.Date(2024, time.June, 11, 12, 15, 0, 0, time.FixedZone("CEST", 2*60*60))
+
+	Convey("Should build Hive style partitions in UTC", t, func() {
+		actual, err := PartitionPath(PartitionStyleHive, "events", at, "hour")
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, "table=events/year=2024/month=06/day=11/hour=10")
+	})
+
+	Convey("Should build plain partitions down to the granularity", t, func() {
+		actual, err := PartitionPath(PartitionStylePlain, "", at, "month")
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, "2024/06")
+	})
+
+	Convey("Should fail for invalid styles and granularities", t, func() {
+		_, err := PartitionPath("sql", "", at, "day")
+		So(err, ShouldNotBeNil)
+
+		_, err = PartitionPath(PartitionStyleHive, "", at, "minute")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestKeyTemplate_Partitions(t *testing.T) {
+	dirname := path.Join(os.TempDir(), "events")
+	err := os.MkdirAll(dirname, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirname)
+
+	filePath := path.Join(dirname, "log_20240611T101500.parquet")
+	f, err := os.Create(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	modTime := time.Date(2023, time.December, 31, 23, 0, 0, 0, time.UTC)
+	err = os.Chtimes(filePath, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runContext, err := NewRunContext(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runContext.StartedAt = time.Date(2025, time.January, 2, 3, 4, 5, 0, time.UTC)
+
+	keyForFile := func(templateText string) (string, error) {
+		tpl, err := NewKeyTemplate(templateText, runContext, &logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return tpl.KeyForFile(filePath)
+	}
+
+	Convey("Should partition by upload time by default", t, func() {
+		actual, err := keyForFile(`{{ hivePartitions }}/{{ fileName }}`)
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, "year=2025/month=01/day=02/log_20240611T101500.parquet")
+	})
+
+	Convey("Should partition by the file's modification time", t, func() {
+		actual, err := keyForFile(`{{ datePartitions modTime "hour" }}`)
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, "2023/12/31/23")
+	})
+
+	Convey("Should partition by a date in the file name with the table name", t, func() {
+		actual, err := keyForFile(
+			`{{ hivePartitions "table" "hour" (fileNameDate "_(\\d{8}T\\d{6})" "20060102T150405") }}/{{ fileName }}`,
+		)
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, "table=events/year=2024/month=06/day=11/hour=10/log_20240611T101500.parquet")
+	})
+
+	Convey("Should fail for invalid options", t, func() {
+		_, err := keyForFile(`{{ hivePartitions 3 }}`)
+		So(err, ShouldNotBeNil)
+
+		_, err = keyForFile(`{{ datePartitions "week" }}`)
+		So(err, ShouldNotBeNil)
+	})
+}
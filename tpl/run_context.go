@@ -0,0 +1,142 @@
+package tpl
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultUploadTimestampLayout is the layout `uploadTimestamp` formats the
+// start of the run with when no layout is given, eg. `20240611T101500Z`
+const DefaultUploadTimestampLayout = "20060102T150405Z"
+
+// RunContext holds the values that are shared by the keys of every file
+// uploaded in a single run of funnel, eg. so that all files in a batch can be
+// prefixed with the same run ID or timestamp
+type RunContext struct {
+	RunID      string
+	StartedAt  time.Time
+	Hostname   string
+	Vars       map[string]string
+	AllowedEnv []string
+
+	mux      sync.Mutex
+	sequence uint64
+}
+
+// NewRunContext creates the context for a new run, with a random run ID and the
+// current time as its start. Only environment variables whose names match one
+// of the `allowedEnv` patterns (eg. `DEPLOY_ENV` or `CI_*`) can be read by key
+// templates.
+func NewRunContext(vars map[string]string, allowedEnv []string) (*RunContext, error) {
+	runID, err := newUUID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate run ID: %w", err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine hostname: %w", err)
+	}
+
+	for _, pattern := range allowedEnv {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed environment variable pattern: %s: %w", pattern, err)
+		}
+	}
+
+	if nil == vars {
+		vars = map[string]string{}
+	}
+
+	return &RunContext{
+		RunID:      runID,
+		StartedAt:  time.Now().UTC(),
+		Hostname:   hostname,
+		Vars:       vars,
+		AllowedEnv: allowedEnv,
+	}, nil
+}
+
+// ParseVars parses user defined template variables in the form `key=value`
+func ParseVars(pairs []string) (map[string]string, error) {
+	vars := make(map[string]string, len(pairs))
+
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || "" == parts[0] {
+			return nil, fmt.Errorf("invalid template variable, expected key=value: %s", pair)
+		}
+
+		vars[parts[0]] = parts[1]
+	}
+
+	return vars, nil
+}
+
+// Env returns the value of an environment variable, if its name is allowed
+func (r *RunContext) Env(name string) (string, error) {
+	for _, pattern := range r.AllowedEnv {
+		if matched, _ := path.Match(pattern, name); matched {
+			return os.Getenv(name), nil
+		}
+	}
+
+	return "", fmt.Errorf("environment variable is not allowed in key templates: %s", name)
+}
+
+// Sequence returns the next number in the order in which the run generates
+// keys, starting at 1
+func (r *RunContext) Sequence() uint64 {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	r.sequence++
+
+	return r.sequence
+}
+
+// UploadTimestamp formats the time the run started with the given layout
+func (r *RunContext) UploadTimestamp(layout string) string {
+	return r.StartedAt.Format(layout)
+}
+
+// UUID returns a new random UUID
+func (r *RunContext) UUID() (string, error) {
+	uuid, err := newUUID()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate UUID: %w", err)
+	}
+
+	return uuid, nil
+}
+
+// Var returns the value of a user defined template variable
+func (r *RunContext) Var(name string) (string, error) {
+	value, ok := r.Vars[name]
+	if !ok {
+		return "", fmt.Errorf("undefined template variable: %s", name)
+	}
+
+	return value, nil
+}
+
+// Generate a random (version 4) UUID
+func newUUID() (string, error) {
+	var b [16]byte
+
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", err
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
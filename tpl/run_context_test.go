@@ -0,0 +1,147 @@
+package tpl
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"os"
+	"path"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestNewRunContext(t *testing.T) {
+	Convey("Should create a run context", t, func() {
+		runContext, err := NewRunContext(nil, []string{"FUNNEL_*"})
+
+		So(err, ShouldBeNil)
+		So(runContext.RunID, ShouldNotBeEmpty)
+		So(runContext.Hostname, ShouldNotBeEmpty)
+		So(runContext.Vars, ShouldBeEmpty)
+		So(runContext.StartedAt, ShouldHappenWithin, time.Minute, time.Now())
+	})
+
+	Convey("Should fail for invalid allowed environment variable patterns", t, func() {
+		_, err := NewRunContext(nil, []string{"["})
+
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestParseVars(t *testing.T) {
+	Convey("Should parse key=value pairs", t, func() {
+		vars, err := ParseVars([]string{"team=data", "query=a=b", "empty="})
+
+		So(err, ShouldBeNil)
+		So(vars, ShouldResemble, map[string]string{
+			"team":  "data",
+			"query": "a=b",
+			"empty": "",
+		})
+	})
+
+	Convey("Should fail for pairs without a key", t, func() {
+		_, err := ParseVars([]string{"=value"})
+		So(err, ShouldNotBeNil)
+
+		_, err = ParseVars([]string{"novalue"})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestRunContext(t *testing.T) {
+	err := os.Setenv("FUNNEL_TEST_ENV", "staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("FUNNEL_TEST_ENV")
+
+	newRunContext := func() *RunContext {
+		runContext, err := NewRunContext(map[string]string{"team": "data"}, []string{"FUNNEL_TEST_*"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return runContext
+	}
+
+	Convey("Env", t, func() {
+		runContext := newRunContext()
+
+		value, err := runContext.Env("FUNNEL_TEST_ENV")
+		So(err, ShouldBeNil)
+		So(value, ShouldEqual, "staging")
+
+		_, err = runContext.Env("HOME")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Sequence", t, func() {
+		runContext := newRunContext()
+
+		So(runContext.Sequence(), ShouldEqual, 1)
+		So(runContext.Sequence(), ShouldEqual, 2)
+		So(runContext.Sequence(), ShouldEqual, 3)
+	})
+
+	Convey("UUID", t, func() {
+		runContext := newRunContext()
+
+		first, err := runContext.UUID()
+		So(err, ShouldBeNil)
+		So(first, ShouldHaveLength, 36)
+		So(regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(first), ShouldBeTrue)
+
+		other, err := runContext.UUID()
+		So(err, ShouldBeNil)
+		So(other, ShouldNotEqual, first)
+	})
+
+	Convey("Var", t, func() {
+		runContext := newRunContext()
+
+		value, err := runContext.Var("team")
+		So(err, ShouldBeNil)
+		So(value, ShouldEqual, "data")
+
+		_, err = runContext.Var("missing")
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should interpolate run context values in key templates", t, func() {
+		runContext := newRunContext()
+		runContext.RunID = "some-run"
+		runContext.Hostname = "some-host"
+		runContext.StartedAt = time.Date(2024, 6, 11, 10, 15, 0, 0, time.UTC)
+
+		tempFile, err := os.Create(path.Join(os.TempDir(), "somefile.csv"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(tempFile.Name())
+
+		tpl, err := NewKeyTemplate(
+			`{{ env "FUNNEL_TEST_ENV" }}/{{ hostname }}/{{ var "team" }}/{{ runId }}/{{ uploadTimestamp }}/{{ uploadTimestamp "2006/01/02" }}/{{ sequence }}-{{ fileName }}`,
+			runContext,
+			&logger,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := tpl.KeyForFile(tempFile.Name())
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, "staging/some-host/data/some-run/20240611T101500Z/2024/06/11/1-somefile.csv")
+
+		Convey("Should fail for environment variables that are not allowed", func() {
+			tpl, err := NewKeyTemplate(`{{ env "HOME" }}`, runContext, &logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = tpl.KeyForFile(tempFile.Name())
+
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -5,58 +5,45 @@ import (
 	"fmt"
 	"github.com/sirupsen/logrus"
 	"os"
-	"sync"
 	"text/template"
+	"time"
 )
 
-// KeyTemplate generates keys for S3 objects based on parsing of a template
+// KeyTemplate generates keys for S3 objects based on parsing of a template. It
+// is safe to generate keys for several files concurrently.
 type KeyTemplate interface {
 	KeyForFile(relativeFilePath string) (string, error)
+	KeyForFileInRoot(rootPath string, relativeFilePath string) (string, error)
 }
 
 type keyTemplate struct {
-	mux         sync.Mutex
-	tplFileData *tplFileData
-	template    *template.Template
+	runContext *RunContext
+	template   *template.Template
 }
 
-// NewKeyTemplate creates an instance of a KeyTemplate
-func NewKeyTemplate(templateText string, logger *logrus.Logger) (KeyTemplate, error) {
-	keyTemplate := &keyTemplate{mux: sync.Mutex{}}
-
-	funcMap := template.FuncMap{
-		"absoluteFilePath": func() string {
-			abspath, err := keyTemplate.tplFileData.AbsoluteFilePath()
-			if err != nil {
-				panic(fmt.Errorf(
-					"failed to parse absolute path for file: %s: %w",
-					keyTemplate.tplFileData.filePath,
-					err,
-				))
-			}
-
-			return abspath
-		},
-		"dateWithFormat": func(layout string) string {
-			return keyTemplate.tplFileData.DateWithFormat(layout)
-		},
-		"fileExtension": func() string {
-			return keyTemplate.tplFileData.FileExtension()
-		},
-		"fileName": func() string {
-			return keyTemplate.tplFileData.FileName()
-		},
-		"fileNameWithoutExtension": func() string {
-			return keyTemplate.tplFileData.FileNameWithoutExtension()
-		},
-		"filePath": func() string {
-			return keyTemplate.tplFileData.RelativeFilePath()
-		},
+// NewKeyTemplate creates an instance of a KeyTemplate. The run context holds the
+// values shared by the keys of every file in the run; when it is nil, a new run
+// context is created without any variables or allowed environment variables.
+func NewKeyTemplate(templateText string, runContext *RunContext, logger *logrus.Logger) (KeyTemplate, error) {
+	if nil == runContext {
+		var err error
+		runContext, err = NewRunContext(nil, nil)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	tmpl, err := template.New("key").Funcs(funcMap).Parse(templateText)
+	keyTemplate := &keyTemplate{runContext: runContext}
+
+	// Parsing only needs to know the names of the functions, each rendering
+	// binds them to the file it renders the key for
+	tmpl, err := template.New("key").
+		Funcs(helperFuncs).
+		Funcs(keyTemplate.funcMap(&tplFileData{})).
+		Parse(templateText)
 	if err != nil {
-		logger.Errorf("failed to parse template text: %w", err)
+		err = explainParseError(err)
+		logger.Errorf("failed to parse template text: %v", err)
 		return nil, err
 	}
 
@@ -68,23 +55,122 @@ func NewKeyTemplate(templateText string, logger *logrus.Logger) (KeyTemplate, er
 // KeyForFile takes the path provided by the caller and parses the template with
 // the provided path as template context
 func (k *keyTemplate) KeyForFile(relativeFilePath string) (string, error) {
+	return k.KeyForFileInRoot("", relativeFilePath)
+}
+
+// KeyForFileInRoot parses the template for a file found in the given root path,
+// eg. the directory the file was found in when walking it, so that templates
+// can refer to the file's path relative to the root
+func (k *keyTemplate) KeyForFileInRoot(rootPath string, relativeFilePath string) (string, error) {
 	info, err := os.Stat(relativeFilePath)
 	if err != nil {
-		panic(fmt.Errorf("failed to stat file: %s: %w", relativeFilePath, err))
+		return "", fmt.Errorf("failed to stat file: %s: %w", relativeFilePath, err)
 	}
 
-	k.mux.Lock()
-	defer k.mux.Unlock()
-	k.tplFileData = &tplFileData{
+	data := &tplFileData{
+		rootPath: rootPath,
 		filePath: relativeFilePath,
 		fileInfo: info,
 	}
 
+	tmpl, err := k.template.Clone()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate key for file: %s: %w", relativeFilePath, err)
+	}
+
 	var b bytes.Buffer
-	err = k.template.Execute(&b, k.tplFileData)
+	err = tmpl.Funcs(k.funcMap(data)).Execute(&b, data)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("failed to generate key for file: %s: %w", relativeFilePath, err)
 	}
 
 	return b.String(), nil
 }
+
+// Build the template functions that refer to a single file
+func (k *keyTemplate) funcMap(data *tplFileData) template.FuncMap {
+	runContext := k.runContext
+
+	// A key is rendered once per upload job, so a template that refers to
+	// `sequence` or `uuid` more than once gets the same value each time
+	var (
+		sequence uint64
+		uuid     string
+	)
+
+	return template.FuncMap{
+		"absoluteFilePath": func() (string, error) {
+			abspath, err := data.AbsoluteFilePath()
+			if err != nil {
+				return "", fmt.Errorf("failed to parse absolute path for file: %s: %w", data.filePath, err)
+			}
+
+			return abspath, nil
+		},
+		"birthTimeWithFormat":      data.BirthTimeWithFormat,
+		"datePartitions":           partitionFunc(data, runContext, PartitionStylePlain),
+		"dateWithFormat":           data.DateWithFormat,
+		"dirName":                  data.DirName,
+		"env":                      runContext.Env,
+		"exifCameraModel":          data.ExifCameraModel,
+		"exifDateTimeWithFormat":   data.ExifDateTimeWithFormat,
+		"fileExtension":            data.FileExtension,
+		"fileGroup":                data.FileGroup,
+		"fileMode":                 data.FileMode,
+		"fileName":                 data.FileName,
+		"fileNameDate":             data.FileNameDate,
+		"fileNameDateWithFormat":   data.FileNameDateWithFormat,
+		"fileNameWithoutExtension": data.FileNameWithoutExtension,
+		"fileOwner":                data.FileOwner,
+		"filePath":                 data.RelativeFilePath,
+		"filePermissions":          data.FilePermissions,
+		"fileSize":                 data.FileSize,
+		"fileSizeHuman":            data.FileSizeHuman,
+		"hivePartitions":           partitionFunc(data, runContext, PartitionStyleHive),
+		"hostname": func() string {
+			return runContext.Hostname
+		},
+		"md5":               digestFunc(data, "md5"),
+		"modTime":           data.ModTime,
+		"modTimeWithFormat": data.ModTimeWithFormat,
+		"pathCapture":       data.PathCapture,
+		"pathSegment":       data.PathSegment,
+		"relativeToRoot":    data.RelativeToRoot,
+		"runId": func() string {
+			return runContext.RunID
+		},
+		"sequence": func() uint64 {
+			if 0 == sequence {
+				sequence = runContext.Sequence()
+			}
+
+			return sequence
+		},
+		"sha1":          digestFunc(data, "sha1"),
+		"sha256":        digestFunc(data, "sha256"),
+		"sourceDirName": data.SourceDirName,
+		"uploadTime": func() time.Time {
+			return runContext.StartedAt
+		},
+		"uploadTimestamp": func(layout ...string) string {
+			if 0 == len(layout) {
+				return runContext.UploadTimestamp(DefaultUploadTimestampLayout)
+			}
+
+			return runContext.UploadTimestamp(layout[0])
+		},
+		"uuid": func() (string, error) {
+			if "" == uuid {
+				var err error
+				uuid, err = runContext.UUID()
+				if err != nil {
+					return "", err
+				}
+			}
+
+			return uuid, nil
+		},
+		"var":    runContext.Var,
+		"xxhash": digestFunc(data, "xxhash"),
+	}
+}
@@ -2,6 +2,8 @@
 package tpl
 
 import (
+	"fmt"
+	"github.com/timrourke/funnel/bytesize"
 	"os"
 	"path"
 	"path/filepath"
@@ -13,16 +15,40 @@ import (
 // for keys of S3 objects
 type TplFileData interface {
 	AbsoluteFilePath() (string, error)
+	BirthTimeWithFormat(layout string) (string, error)
 	DateWithFormat(layout string) string
+	DirName() string
+	Digest(algorithm, encoding string, length int) (string, error)
+	ExifCameraModel() (string, error)
+	ExifDateTimeWithFormat(layout string) (string, error)
 	FileExtension() string
+	FileGroup() (string, error)
+	FileMode() string
 	FileName() string
+	FileNameDate(regex, layout string) (time.Time, error)
+	FileNameDateWithFormat(regex, layout, outputLayout string) (string, error)
 	FileNameWithoutExtension() string
+	FileOwner() (string, error)
+	FilePermissions() string
+	FileSize() int64
+	FileSizeHuman() string
+	ModTime() time.Time
+	ModTimeWithFormat(layout string) string
+	PathCapture(regex, group string) (string, error)
+	PathSegment(n int) (string, error)
 	RelativeFilePath() string
+	RelativeToRoot() (string, error)
+	SourceDirName() (string, error)
 }
 
 type tplFileData struct {
+	rootPath string
 	filePath string
 	fileInfo os.FileInfo
+	digests  map[string][]byte
+	exif     *exifData
+	exifErr  error
+	exifRead bool
 }
 
 // AbsoluteFilePath determines the absolute file path on your local computer
@@ -40,6 +66,18 @@ func (t *tplFileData) AbsoluteFilePath() (string, error) {
 	return filepath.Abs(path.Join(cwd, t.filePath))
 }
 
+// BirthTimeWithFormat formats the time the file was created with the provided
+// layout string. Not every operating system and filesystem records this, in
+// which case an error is returned.
+func (t *tplFileData) BirthTimeWithFormat(layout string) (string, error) {
+	birthTime, err := fileBirthTime(t.filePath, t.fileInfo)
+	if err != nil {
+		return "", fmt.Errorf("failed to read birth time of file: %s: %w", t.filePath, err)
+	}
+
+	return birthTime.Format(layout), nil
+}
+
 // DateWithFormat formats the current time (eg. `time.Now()`) and formats it
 // with the provided layout string
 func (t *tplFileData) DateWithFormat(layout string) string {
@@ -47,11 +85,39 @@ func (t *tplFileData) DateWithFormat(layout string) string {
 	return now.Format(layout)
 }
 
+// DirName returns the directory containing the file, relative to the root path
+// the file was found in, eg. `2024/06` for `./data/2024/06/x.csv` found in
+// `./data`. Files directly in the root path have the dir name `.`.
+func (t *tplFileData) DirName() string {
+	relativePath, err := t.RelativeToRoot()
+	if err != nil {
+		relativePath = cleanSlashPath(t.filePath)
+	}
+
+	return path.Dir(relativePath)
+}
+
 // FileExtension returns the file extension, eg. `.txt`
 func (t *tplFileData) FileExtension() string {
 	return path.Ext(t.fileInfo.Name())
 }
 
+// FileGroup returns the name of the group that owns the file, or the group's ID
+// if it has no name
+func (t *tplFileData) FileGroup() (string, error) {
+	group, err := fileGroup(t.fileInfo)
+	if err != nil {
+		return "", fmt.Errorf("failed to read group of file: %s: %w", t.filePath, err)
+	}
+
+	return group, nil
+}
+
+// FileMode returns the file's mode in symbolic notation, eg. `-rw-r--r--`
+func (t *tplFileData) FileMode() string {
+	return t.fileInfo.Mode().String()
+}
+
 // FileName returns the whole filename, without preceding directories
 func (t *tplFileData) FileName() string {
 	return t.fileInfo.Name()
@@ -64,8 +130,116 @@ func (t *tplFileData) FileNameWithoutExtension() string {
 	return strings.TrimSuffix(t.fileInfo.Name(), ext)
 }
 
+// FileOwner returns the name of the user that owns the file, or the user's ID
+// if they have no name
+func (t *tplFileData) FileOwner() (string, error) {
+	owner, err := fileOwner(t.fileInfo)
+	if err != nil {
+		return "", fmt.Errorf("failed to read owner of file: %s: %w", t.filePath, err)
+	}
+
+	return owner, nil
+}
+
+// FilePermissions returns the file's permission bits in octal, eg. `0644`
+func (t *tplFileData) FilePermissions() string {
+	return fmt.Sprintf("%04o", t.fileInfo.Mode().Perm())
+}
+
+// FileSize returns the size of the file in bytes
+func (t *tplFileData) FileSize() int64 {
+	return t.fileInfo.Size()
+}
+
+// FileSizeHuman returns the size of the file in the largest fitting binary
+// unit, eg. `1.5MiB`
+func (t *tplFileData) FileSizeHuman() string {
+	return bytesize.Format(t.fileInfo.Size())
+}
+
+// ModTime returns the time the file was last modified
+func (t *tplFileData) ModTime() time.Time {
+	return t.fileInfo.ModTime()
+}
+
+// ModTimeWithFormat formats the time the file was last modified with the
+// provided layout string
+func (t *tplFileData) ModTimeWithFormat(layout string) string {
+	return t.fileInfo.ModTime().Format(layout)
+}
+
+// PathSegment returns the nth segment of the file's path relative to its root
+// path, counting from zero. Negative numbers count back from the file name, eg.
+// `-1` is the file name and `-2` the directory containing it.
+func (t *tplFileData) PathSegment(n int) (string, error) {
+	relativePath, err := t.RelativeToRoot()
+	if err != nil {
+		return "", err
+	}
+
+	segments := strings.Split(relativePath, "/")
+	index := n
+	if n < 0 {
+		index = len(segments) + n
+	}
+
+	if index < 0 || index >= len(segments) {
+		return "", fmt.Errorf(
+			"path segment %d out of range for path with %d segments: %s",
+			n,
+			len(segments),
+			relativePath,
+		)
+	}
+
+	return segments[index], nil
+}
+
 // RelativeFilePath returns the unmodified path as stored under the field `tplFileData.filePath`
 // TODO: Improve the name of this method
 func (t *tplFileData) RelativeFilePath() string {
 	return t.filePath
 }
+
+// RelativeToRoot returns the file's path relative to the root path it was found
+// in, eg. `2024/x.csv` for `./data/2024/x.csv` found in `./data`. Without a
+// root path, the file's path is returned without any leading `./`.
+func (t *tplFileData) RelativeToRoot() (string, error) {
+	if "" == t.rootPath {
+		return cleanSlashPath(t.filePath), nil
+	}
+
+	relativePath, err := filepath.Rel(t.rootPath, t.filePath)
+	if err != nil {
+		return "", fmt.Errorf(
+			"failed to find path of file relative to root: %s: %s: %w",
+			t.rootPath,
+			t.filePath,
+			err,
+		)
+	}
+
+	return cleanSlashPath(relativePath), nil
+}
+
+// SourceDirName returns the name of the directory containing the file, eg.
+// `events` for `./data/events/x.csv`, which is handy as a table name
+func (t *tplFileData) SourceDirName() (string, error) {
+	abspath, err := t.AbsoluteFilePath()
+	if err != nil {
+		return "", fmt.Errorf("failed to parse absolute path for file: %s: %w", t.filePath, err)
+	}
+
+	dirName := filepath.Base(filepath.Dir(abspath))
+	if dirName == string(filepath.Separator) {
+		return "", fmt.Errorf("file has no source directory: %s", t.filePath)
+	}
+
+	return dirName, nil
+}
+
+// Clean a path and convert it to forward slashes, which also strips any leading
+// `./`
+func cleanSlashPath(p string) string {
+	return filepath.ToSlash(filepath.Clean(p))
+}
@@ -3,7 +3,10 @@ package tpl
 import (
 	. "github.com/smartystreets/goconvey/convey"
 	"os"
+	"os/user"
 	"path"
+	"runtime"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -92,3 +95,168 @@ func TestTplFileData_AbsoluteFilePath(t *testing.T) {
 		So(actual, ShouldEqual, tempFile.Name())
 	})
 }
+
+func TestTplFileData_Metadata(t *testing.T) {
+	tempFile, err := os.Create(path.Join(os.TempDir(), "somefile.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.Write(make([]byte, 1536))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempFile.Close()
+
+	modTime := time.Date(2019, 11, 28, 13, 14, 15, 0, time.Local)
+	err = os.Chtimes(tempFile.Name(), modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.Chmod(tempFile.Name(), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fileInfo, err := os.Stat(tempFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tplFileData := &tplFileData{
+		filePath: tempFile.Name(),
+		fileInfo: fileInfo,
+	}
+
+	Convey("FileSize", t, func() {
+		So(tplFileData.FileSize(), ShouldEqual, 1536)
+	})
+
+	Convey("FileSizeHuman", t, func() {
+		So(tplFileData.FileSizeHuman(), ShouldEqual, "1.5KiB")
+	})
+
+	Convey("ModTimeWithFormat", t, func() {
+		So(tplFileData.ModTimeWithFormat("2006/01/02/15"), ShouldEqual, "2019/11/28/13")
+	})
+
+	Convey("FilePermissions", t, func() {
+		So(tplFileData.FilePermissions(), ShouldEqual, "0640")
+	})
+
+	Convey("FileMode", t, func() {
+		So(tplFileData.FileMode(), ShouldEqual, "-rw-r-----")
+	})
+
+	Convey("FileOwner", t, func() {
+		if runtime.GOOS == "windows" {
+			_, err := tplFileData.FileOwner()
+
+			So(err, ShouldNotBeNil)
+			return
+		}
+
+		currentUser, err := user.Current()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := tplFileData.FileOwner()
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldBeIn, []string{currentUser.Username, currentUser.Uid})
+	})
+
+	Convey("FileGroup", t, func() {
+		if runtime.GOOS == "windows" {
+			_, err := tplFileData.FileGroup()
+
+			So(err, ShouldNotBeNil)
+			return
+		}
+
+		actual, err := tplFileData.FileGroup()
+
+		So(err, ShouldBeNil)
+		So(actual, ShouldNotBeEmpty)
+
+		if _, err := strconv.Atoi(actual); err != nil {
+			_, err := user.LookupGroup(actual)
+			So(err, ShouldBeNil)
+		}
+	})
+
+	Convey("BirthTimeWithFormat", t, func() {
+		// Whether birth time is recorded depends on the platform and the
+		// filesystem, so only check it is sane when it is available
+		actual, err := tplFileData.BirthTimeWithFormat(time.RFC3339)
+		if err != nil {
+			So(actual, ShouldBeEmpty)
+			return
+		}
+
+		birthTime, err := time.Parse(time.RFC3339, actual)
+
+		So(err, ShouldBeNil)
+		So(birthTime, ShouldHappenBefore, time.Now().Add(time.Second))
+	})
+}
+
+func TestTplFileData_PathRelativeToRoot(t *testing.T) {
+	Convey("RelativeToRoot", t, func() {
+		Convey("Should strip the root path", func() {
+			tplFileData := &tplFileData{rootPath: "./data", filePath: "data/2024/x.csv"}
+
+			actual, err := tplFileData.RelativeToRoot()
+
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, "2024/x.csv")
+		})
+
+		Convey("Should strip a leading ./ without a root path", func() {
+			tplFileData := &tplFileData{filePath: "./data/2024/x.csv"}
+
+			actual, err := tplFileData.RelativeToRoot()
+
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, "data/2024/x.csv")
+		})
+
+		Convey("Should fail if the file is not relative to the root path", func() {
+			tplFileData := &tplFileData{rootPath: "/data", filePath: "data/2024/x.csv"}
+
+			_, err := tplFileData.RelativeToRoot()
+
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("DirName", t, func() {
+		So((&tplFileData{rootPath: "data", filePath: "data/2024/06/x.csv"}).DirName(), ShouldEqual, "2024/06")
+		So((&tplFileData{rootPath: "data", filePath: "data/x.csv"}).DirName(), ShouldEqual, ".")
+	})
+
+	Convey("PathSegment", t, func() {
+		tplFileData := &tplFileData{rootPath: "data", filePath: "data/2024/06/x.csv"}
+
+		first, err := tplFileData.PathSegment(0)
+		So(err, ShouldBeNil)
+		So(first, ShouldEqual, "2024")
+
+		last, err := tplFileData.PathSegment(-1)
+		So(err, ShouldBeNil)
+		So(last, ShouldEqual, "x.csv")
+
+		parent, err := tplFileData.PathSegment(-2)
+		So(err, ShouldBeNil)
+		So(parent, ShouldEqual, "06")
+
+		_, err = tplFileData.PathSegment(3)
+		So(err, ShouldNotBeNil)
+
+		_, err = tplFileData.PathSegment(-4)
+		So(err, ShouldNotBeNil)
+	})
+}
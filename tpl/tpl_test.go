@@ -3,23 +3,28 @@ package tpl
 import (
 	"github.com/sirupsen/logrus"
 	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
 	"os"
 	"path"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var logger logrus.Logger
 
 func TestNewKeyTemplate(t *testing.T) {
 	Convey("should fail if unable to parse template text", t, func() {
-		_, err := NewKeyTemplate("{{", &logger)
+		_, err := NewKeyTemplate("{{", nil, &logger)
 
 		So(err, ShouldNotBeNil)
 	})
 
 	Convey("should instantiate if template is valid", t, func() {
-		tpl, err := NewKeyTemplate("something valid", &logger)
+		tpl, err := NewKeyTemplate("something valid", nil, &logger)
 
 		So(err, ShouldBeNil)
 		So(tpl, ShouldNotBeNil)
@@ -35,7 +40,7 @@ func TestKeyTemplate_KeyForFile(t *testing.T) {
 
 	Convey("Template functions", t, func() {
 		Convey("should interpolate file's abs path", func() {
-			tpl, err := NewKeyTemplate("{{ absoluteFilePath }}", &logger)
+			tpl, err := NewKeyTemplate("{{ absoluteFilePath }}", nil, &logger)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -49,7 +54,7 @@ func TestKeyTemplate_KeyForFile(t *testing.T) {
 		})
 
 		Convey("should interpolate formatted date", func() {
-			tpl, err := NewKeyTemplate(`{{ dateWithFormat "2006-01-02" }}`, &logger)
+			tpl, err := NewKeyTemplate(`{{ dateWithFormat "2006-01-02" }}`, nil, &logger)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -69,7 +74,7 @@ func TestKeyTemplate_KeyForFile(t *testing.T) {
 		})
 
 		Convey("should interpolate file's extension", func() {
-			tpl, err := NewKeyTemplate("{{ fileExtension }}", &logger)
+			tpl, err := NewKeyTemplate("{{ fileExtension }}", nil, &logger)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -83,7 +88,7 @@ func TestKeyTemplate_KeyForFile(t *testing.T) {
 		})
 
 		Convey("should interpolate file's name", func() {
-			tpl, err := NewKeyTemplate("{{ fileName }}", &logger)
+			tpl, err := NewKeyTemplate("{{ fileName }}", nil, &logger)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -97,7 +102,7 @@ func TestKeyTemplate_KeyForFile(t *testing.T) {
 		})
 
 		Convey("should interpolate file's name without extension", func() {
-			tpl, err := NewKeyTemplate("{{ fileNameWithoutExtension }}", &logger)
+			tpl, err := NewKeyTemplate("{{ fileNameWithoutExtension }}", nil, &logger)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -111,7 +116,7 @@ func TestKeyTemplate_KeyForFile(t *testing.T) {
 		})
 
 		Convey("should interpolate file's path as originally provided", func() {
-			tpl, err := NewKeyTemplate("{{ filePath }}", &logger)
+			tpl, err := NewKeyTemplate("{{ filePath }}", nil, &logger)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -123,5 +128,178 @@ func TestKeyTemplate_KeyForFile(t *testing.T) {
 
 			So(actual, ShouldEqual, path.Join(os.TempDir(), "somefile.go"))
 		})
+
+		Convey("should interpolate file's size", func() {
+			tpl, err := NewKeyTemplate("{{ fileSize }}/{{ fileSizeHuman }}", nil, &logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual, err := tpl.KeyForFile(tempFile.Name())
+
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, "0/0B")
+		})
+
+		Convey("should interpolate file's modification time", func() {
+			modTime := time.Date(2019, 11, 28, 13, 14, 15, 0, time.Local)
+			err := os.Chtimes(tempFile.Name(), modTime, modTime)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tpl, err := NewKeyTemplate(`{{ modTimeWithFormat "2006/01/02" }}/{{ fileName }}`, nil, &logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual, err := tpl.KeyForFile(tempFile.Name())
+
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, "2019/11/28/somefile.go")
+		})
+
+		Convey("should interpolate file's permissions", func() {
+			err := os.Chmod(tempFile.Name(), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tpl, err := NewKeyTemplate("{{ filePermissions }} {{ fileMode }}", nil, &logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual, err := tpl.KeyForFile(tempFile.Name())
+
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, "0600 -rw-------")
+		})
+
+		Convey("should interpolate file's path relative to its root path", func() {
+			tpl, err := NewKeyTemplate(
+				`{{ relativeToRoot | upper }}|{{ dirName }}|{{ pathSegment -1 | trimSuffix ".go" | replace "some" "any" }}`,
+				nil,
+				&logger,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual, err := tpl.KeyForFileInRoot(os.TempDir(), tempFile.Name())
+
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, "SOMEFILE.GO|.|anyfile")
+		})
+
+		Convey("should fall back to default values", func() {
+			tpl, err := NewKeyTemplate(`{{ "" | default "unknown" }}/{{ printf "%05d" 42 }}`, nil, &logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual, err := tpl.KeyForFile(tempFile.Name())
+
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, "unknown/00042")
+		})
+
+		Convey("should generate a new sequence number and uuid each time a key is generated", func() {
+			tpl, err := NewKeyTemplate(`{{ sequence }}/{{ uuid }}/{{ sequence }}/{{ uuid }}`, nil, &logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			first, err := tpl.KeyForFile(tempFile.Name())
+			So(err, ShouldBeNil)
+
+			second, err := tpl.KeyForFile(tempFile.Name())
+			So(err, ShouldBeNil)
+
+			firstParts := strings.Split(first, "/")
+			secondParts := strings.Split(second, "/")
+
+			So(firstParts[0], ShouldEqual, "1")
+			So(firstParts[2], ShouldEqual, "1")
+			So(firstParts[3], ShouldEqual, firstParts[1])
+			So(secondParts[0], ShouldEqual, "2")
+			So(secondParts[1], ShouldNotEqual, firstParts[1])
+		})
+	})
+}
+
+func TestKeyTemplate_KeyForFileConcurrently(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "somedir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirname)
+
+	var filePaths []string
+	for i := 0; i < 20; i++ {
+		filePath := path.Join(dirname, "file"+strconv.Itoa(i))
+		err := ioutil.WriteFile(filePath, []byte(strconv.Itoa(i)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filePaths = append(filePaths, filePath)
+	}
+
+	Convey("Should render keys for different files concurrently", t, func() {
+		tpl, err := NewKeyTemplate(`{{ relativeToRoot }}/{{ fileSize }}/{{ md5 4 }}`, nil, &logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys := make([]string, len(filePaths))
+		errs := make([]error, len(filePaths))
+
+		var wg sync.WaitGroup
+		for i := range filePaths {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				keys[i], errs[i] = tpl.KeyForFileInRoot(dirname, filePaths[i])
+			}(i)
+		}
+		wg.Wait()
+
+		for i := range filePaths {
+			So(errs[i], ShouldBeNil)
+			So(keys[i], ShouldStartWith, "file"+strconv.Itoa(i)+"/"+strconv.Itoa(len(strconv.Itoa(i)))+"/")
+		}
+	})
+}
+
+func TestKeyTemplate_KeyForFileErrors(t *testing.T) {
+	Convey("Should fail without panicking for files that do not exist", t, func() {
+		tpl, err := NewKeyTemplate("{{ absoluteFilePath }}", nil, &logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = tpl.KeyForFile(path.Join(os.TempDir(), "does-not-exist"))
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, "does-not-exist")
+	})
+
+	Convey("Should name the file when a template function fails", t, func() {
+		tempFile, err := ioutil.TempFile("", "somefile")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(tempFile.Name())
+
+		tpl, err := NewKeyTemplate("{{ pathSegment 5 }}", nil, &logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = tpl.KeyForFile(tempFile.Name())
+
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldContainSubstring, tempFile.Name())
+		So(err.Error(), ShouldContainSubstring, "pathSegment")
 	})
 }
@@ -0,0 +1,303 @@
+package upload
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/timrourke/funnel/backend"
+	"io"
+	"os"
+)
+
+// Formats of archives bundling many files into a single object
+const (
+	ArchiveFormatTar   = "tar"
+	ArchiveFormatTarGz = "tar.gz"
+	ArchiveFormatZip   = "zip"
+)
+
+// ArchiveIndexSuffix is appended to the key of an archive for the key of its
+// index
+const ArchiveIndexSuffix = ".index.jsonl"
+
+// ParseArchiveFormat validates the format of archives
+func ParseArchiveFormat(format string) (string, error) {
+	switch format {
+	case ArchiveFormatTar, ArchiveFormatTarGz, ArchiveFormatZip:
+		return format, nil
+	default:
+		return "", fmt.Errorf(
+			"invalid archive format %s, must be one of: %s, %s, %s",
+			format,
+			ArchiveFormatTar,
+			ArchiveFormatTarGz,
+			ArchiveFormatZip,
+		)
+	}
+}
+
+// ArchiveExtension returns the file extension of archives in the given format,
+// eg. `.tar.gz`
+func ArchiveExtension(format string) string {
+	return "." + format
+}
+
+// ArchiveMember is a file to bundle into an archive under the given name
+type ArchiveMember struct {
+	Path string
+	Name string
+}
+
+// ArchiveIndexEntry describes where a member is found in an archive. For tar
+// archives the offset is that of the member's contents in the tar stream, before
+// any gzip compression. For zip archives it is that of the member's compressed
+// contents.
+type ArchiveIndexEntry struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Offset int64  `json:"offset"`
+	SHA256 string `json:"sha256"`
+}
+
+// ArchiveUploader bundles files into an archive that is streamed to a backend
+// as it is written, and uploads an index of its members alongside it
+type ArchiveUploader interface {
+	UploadArchive(members []ArchiveMember, key string, format string) error
+}
+
+type archiveUploader struct {
+	objectPutter backend.ObjectPutter
+	bodyWrappers []backend.BodyWrapper
+	logger       *logrus.Logger
+}
+
+// NewArchiveUploader creates a new archive uploader that puts archives in a
+// backend. Body wrappers are applied to each member's contents in order.
+func NewArchiveUploader(
+	objectPutter backend.ObjectPutter,
+	logger *logrus.Logger,
+	bodyWrappers ...backend.BodyWrapper,
+) ArchiveUploader {
+	return &archiveUploader{
+		objectPutter: objectPutter,
+		bodyWrappers: bodyWrappers,
+		logger:       logger,
+	}
+}
+
+// Forget an archive and its index once they will not be retried
+func (a *archiveUploader) Forget(key string) {
+	backend.Forget(a.objectPutter, key)
+	backend.Forget(a.objectPutter, key+ArchiveIndexSuffix)
+}
+
+// UploadArchive uploads the members as an archive with the given key, and then
+// its index with the key followed by `.index.jsonl`. The archive is only
+// complete once both were uploaded.
+func (a *archiveUploader) UploadArchive(members []ArchiveMember, key string, format string) error {
+	pipeReader, pipeWriter := io.Pipe()
+
+	var index []ArchiveIndexEntry
+	var writeErr error
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		index, writeErr = a.writeArchive(pipeWriter, members, format)
+		pipeWriter.CloseWithError(writeErr)
+	}()
+
+	err := a.objectPutter.PutObject(&backend.Object{
+		Key:  key,
+		Body: pipeReader,
+	})
+	pipeReader.CloseWithError(err)
+	<-done
+	if err != nil {
+		return fmt.Errorf("failed to upload archive: %s: %w", key, err)
+	}
+
+	// A backend that stopped reading early leaves the archive incomplete
+	if writeErr != nil {
+		return fmt.Errorf("failed to write archive: %s: %w", key, writeErr)
+	}
+
+	var indexBody bytes.Buffer
+	encoder := json.NewEncoder(&indexBody)
+	for _, entry := range index {
+		err = encoder.Encode(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = a.objectPutter.PutObject(&backend.Object{
+		Key:         key + ArchiveIndexSuffix,
+		Body:        &indexBody,
+		ContentType: "application/x-ndjson",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload archive index: %s: %w", key+ArchiveIndexSuffix, err)
+	}
+
+	a.logger.WithFields(logrus.Fields{
+		"key":     key,
+		"members": len(members),
+	}).Info(fmt.Sprintf("Uploaded archive %s with %d files", key, len(members)))
+
+	return nil
+}
+
+// archiveWriter adds members to an archive, with the position in the archive
+// at which each member's contents start
+type archiveWriter interface {
+	addMember(info os.FileInfo, name string) (io.Writer, error)
+	Close() error
+}
+
+func (a *archiveUploader) writeArchive(w io.Writer, members []ArchiveMember, format string) ([]ArchiveIndexEntry, error) {
+	var gzipWriter *gzip.Writer
+	if format == ArchiveFormatTarGz {
+		gzipWriter = gzip.NewWriter(w)
+		w = gzipWriter
+	}
+
+	counter := &countingWriter{writer: w}
+
+	var archive archiveWriter
+	switch format {
+	case ArchiveFormatTar, ArchiveFormatTarGz:
+		archive = &tarArchiveWriter{tar.NewWriter(counter)}
+	case ArchiveFormatZip:
+		archive = &zipArchiveWriter{zip.NewWriter(counter)}
+	default:
+		_, err := ParseArchiveFormat(format)
+		return nil, err
+	}
+
+	var index []ArchiveIndexEntry
+	for _, member := range members {
+		entry, err := a.addMember(archive, counter, member)
+		if err != nil {
+			return nil, err
+		}
+
+		index = append(index, entry)
+	}
+
+	err := archive.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if nil != gzipWriter {
+		err = gzipWriter.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return index, nil
+}
+
+func (a *archiveUploader) addMember(archive archiveWriter, counter *countingWriter, member ArchiveMember) (ArchiveIndexEntry, error) {
+	file, err := os.Open(member.Path)
+	if err != nil {
+		return ArchiveIndexEntry{}, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return ArchiveIndexEntry{}, err
+	}
+
+	w, err := archive.addMember(info, member.Name)
+	if err != nil {
+		return ArchiveIndexEntry{}, fmt.Errorf("failed to add file to archive: %s: %w", member.Path, err)
+	}
+
+	offset := counter.written
+	hash := sha256.New()
+
+	n, err := io.Copy(io.MultiWriter(w, hash), backend.WrapBody(member.Path, io.LimitReader(file, info.Size()), a.bodyWrappers))
+	if err != nil {
+		return ArchiveIndexEntry{}, fmt.Errorf("failed to add file to archive: %s: %w", member.Path, err)
+	}
+
+	if n != info.Size() {
+		return ArchiveIndexEntry{}, fmt.Errorf("file changed while adding it to archive: %s", member.Path)
+	}
+
+	return ArchiveIndexEntry{
+		Name:   member.Name,
+		Path:   member.Path,
+		Size:   n,
+		Offset: offset,
+		SHA256: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+type tarArchiveWriter struct {
+	*tar.Writer
+}
+
+func (t *tarArchiveWriter) addMember(info os.FileInfo, name string) (io.Writer, error) {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return nil, err
+	}
+	header.Name = name
+
+	// The header is written through right away, so the counted position is
+	// where the contents start
+	err = t.WriteHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+type zipArchiveWriter struct {
+	*zip.Writer
+}
+
+func (z *zipArchiveWriter) addMember(info os.FileInfo, name string) (io.Writer, error) {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return nil, err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+
+	w, err := z.CreateHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	// Flush the buffered header, so the counted position is where the contents
+	// start
+	return w, z.Flush()
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	writer  io.Writer
+	written int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	c.written += int64(n)
+
+	return n, err
+}
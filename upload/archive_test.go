@@ -0,0 +1,228 @@
+package upload
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/timrourke/funnel/backend"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readingObjectPutter reads the whole body of each object, as a backend would
+type readingObjectPutter struct {
+	objects []*backend.Object
+	bodies  [][]byte
+	err     error
+}
+
+func (r *readingObjectPutter) PutObject(object *backend.Object) error {
+	r.objects = append(r.objects, object)
+
+	if r.err != nil {
+		return r.err
+	}
+
+	body, err := ioutil.ReadAll(object.Body)
+	if err != nil {
+		return err
+	}
+	r.bodies = append(r.bodies, body)
+
+	return nil
+}
+
+// Read the entries of an uploaded archive index
+func readArchiveIndex(body []byte) []ArchiveIndexEntry {
+	var index []ArchiveIndexEntry
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		var entry ArchiveIndexEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			panic(err)
+		}
+		index = append(index, entry)
+	}
+
+	return index
+}
+
+func TestArchiveUploader_UploadArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	contents := map[string]string{
+		"sensors/a.json": `{"temperature":21.5}`,
+		"sensors/b.json": `{"temperature":19.25,"humidity":40}`,
+	}
+
+	var members []ArchiveMember
+	for _, name := range []string{"sensors/a.json", "sensors/b.json"} {
+		path := filepath.Join(dir, filepath.Base(name))
+		err := ioutil.WriteFile(path, []byte(contents[name]), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		members = append(members, ArchiveMember{Path: path, Name: name})
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	Convey("Should upload a tar archive and an index pointing at each member's contents", t, func() {
+		putter := &readingObjectPutter{}
+		uploader := NewArchiveUploader(putter, logger)
+
+		err := uploader.UploadArchive(members, "sensors/batch-1.tar", ArchiveFormatTar)
+
+		So(err, ShouldBeNil)
+		So(len(putter.objects), ShouldEqual, 2)
+		So(putter.objects[0].Key, ShouldEqual, "sensors/batch-1.tar")
+		So(putter.objects[1].Key, ShouldEqual, "sensors/batch-1.tar.index.jsonl")
+		So(putter.objects[1].ContentType, ShouldEqual, "application/x-ndjson")
+
+		archive := putter.bodies[0]
+		reader := tar.NewReader(bytes.NewReader(archive))
+		for _, member := range members {
+			header, err := reader.Next()
+			So(err, ShouldBeNil)
+			So(header.Name, ShouldEqual, member.Name)
+
+			body, err := ioutil.ReadAll(reader)
+			So(err, ShouldBeNil)
+			So(string(body), ShouldEqual, contents[member.Name])
+		}
+
+		index := readArchiveIndex(putter.bodies[1])
+		So(len(index), ShouldEqual, 2)
+		for i, entry := range index {
+			expected := contents[members[i].Name]
+			hash := sha256.Sum256([]byte(expected))
+
+			So(entry.Name, ShouldEqual, members[i].Name)
+			So(entry.Path, ShouldEqual, members[i].Path)
+			So(entry.Size, ShouldEqual, len(expected))
+			So(entry.SHA256, ShouldEqual, hex.EncodeToString(hash[:]))
+			So(string(archive[entry.Offset:entry.Offset+entry.Size]), ShouldEqual, expected)
+		}
+	})
+
+	Convey("Should upload a gzipped tar archive with offsets into the uncompressed tar stream", t, func() {
+		putter := &readingObjectPutter{}
+		uploader := NewArchiveUploader(putter, logger)
+
+		err := uploader.UploadArchive(members, "sensors/batch-1.tar.gz", ArchiveFormatTarGz)
+
+		So(err, ShouldBeNil)
+
+		gzipReader, err := gzip.NewReader(bytes.NewReader(putter.bodies[0]))
+		So(err, ShouldBeNil)
+		archive, err := ioutil.ReadAll(gzipReader)
+		So(err, ShouldBeNil)
+
+		for i, entry := range readArchiveIndex(putter.bodies[1]) {
+			So(string(archive[entry.Offset:entry.Offset+entry.Size]), ShouldEqual, contents[members[i].Name])
+		}
+	})
+
+	Convey("Should upload a zip archive", t, func() {
+		putter := &readingObjectPutter{}
+		uploader := NewArchiveUploader(putter, logger)
+
+		err := uploader.UploadArchive(members, "sensors/batch-1.zip", ArchiveFormatZip)
+
+		So(err, ShouldBeNil)
+
+		archive := putter.bodies[0]
+		reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+		So(err, ShouldBeNil)
+		So(len(reader.File), ShouldEqual, 2)
+
+		index := readArchiveIndex(putter.bodies[1])
+		for i, file := range reader.File {
+			So(file.Name, ShouldEqual, members[i].Name)
+
+			dataOffset, err := file.DataOffset()
+			So(err, ShouldBeNil)
+			So(index[i].Offset, ShouldEqual, dataOffset)
+
+			body, err := file.Open()
+			So(err, ShouldBeNil)
+			contentsRead, err := ioutil.ReadAll(body)
+			body.Close()
+			So(err, ShouldBeNil)
+			So(string(contentsRead), ShouldEqual, contents[members[i].Name])
+		}
+	})
+
+	Convey("Should apply body wrappers to each member's contents", t, func() {
+		putter := &readingObjectPutter{}
+		var wrapped []string
+		uploader := NewArchiveUploader(putter, logger, func(path string, body io.Reader) io.Reader {
+			wrapped = append(wrapped, path)
+			return body
+		})
+
+		err := uploader.UploadArchive(members, "sensors/batch-1.tar", ArchiveFormatTar)
+
+		So(err, ShouldBeNil)
+		So(wrapped, ShouldResemble, []string{members[0].Path, members[1].Path})
+	})
+
+	Convey("Should fail without uploading an index when a member is missing", t, func() {
+		putter := &readingObjectPutter{}
+		uploader := NewArchiveUploader(putter, logger)
+
+		missing := append([]ArchiveMember{}, members...)
+		missing = append(missing, ArchiveMember{Path: filepath.Join(dir, "missing.json"), Name: "sensors/missing.json"})
+
+		err := uploader.UploadArchive(missing, "sensors/batch-1.tar", ArchiveFormatTar)
+
+		So(err, ShouldNotBeNil)
+		So(len(putter.objects), ShouldEqual, 1)
+	})
+
+	Convey("Should fail when the archive fails to upload", t, func() {
+		putter := &readingObjectPutter{err: errors.New("some error")}
+		uploader := NewArchiveUploader(putter, logger)
+
+		err := uploader.UploadArchive(members, "sensors/batch-1.tar", ArchiveFormatTar)
+
+		So(err, ShouldNotBeNil)
+		So(len(putter.objects), ShouldEqual, 1)
+	})
+}
+
+func TestParseArchiveFormat(t *testing.T) {
+	Convey("Should accept supported archive formats", t, func() {
+		for _, format := range []string{ArchiveFormatTar, ArchiveFormatTarGz, ArchiveFormatZip} {
+			parsed, err := ParseArchiveFormat(format)
+
+			So(err, ShouldBeNil)
+			So(parsed, ShouldEqual, format)
+		}
+	})
+
+	Convey("Should reject unsupported archive formats", t, func() {
+		_, err := ParseArchiveFormat("rar")
+
+		So(err, ShouldNotBeNil)
+	})
+}
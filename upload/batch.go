@@ -0,0 +1,157 @@
+package upload
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BatchPolicy decides how files are grouped into archives. A batch is closed
+// and uploaded as soon as it reaches any of its limits, and otherwise once no
+// more files are found. Limits of zero do not apply.
+type BatchPolicy struct {
+	// Format of the archives, one of `ArchiveFormatTar`,
+	// `ArchiveFormatTarGz` or `ArchiveFormatZip`
+	Format string
+
+	// GroupByDir keeps files from different directories in different batches
+	GroupByDir bool
+
+	// MaxFiles is the largest number of files in a batch
+	MaxFiles int
+
+	// MaxBytes is the largest total size of the files in a batch. A single
+	// file larger than this is a batch of its own.
+	MaxBytes int64
+
+	// MaxWait is the longest time a batch stays open after its first file was
+	// added to it
+	MaxWait time.Duration
+}
+
+// batcher groups jobs into batches, which are sent off as archive jobs, each
+// with the next batch number
+type batcher struct {
+	policy     BatchPolicy
+	send       func(members []*fileUploadJob, number int)
+	mux        sync.Mutex
+	openByDir  map[string]*batch
+	numBatches int
+}
+
+type batch struct {
+	members []*fileUploadJob
+	size    int64
+	timer   *time.Timer
+}
+
+func newBatcher(policy BatchPolicy, send func(members []*fileUploadJob, number int)) *batcher {
+	return &batcher{
+		policy:    policy,
+		send:      send,
+		openByDir: make(map[string]*batch),
+	}
+}
+
+// Add a job to the open batch for its group, closing the batch when it is full
+func (b *batcher) add(job *fileUploadJob) {
+	group := ""
+	if b.policy.GroupByDir {
+		group = filepath.Dir(job.path)
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	open := b.openByDir[group]
+	if nil != open && b.policy.MaxBytes > 0 && open.size+job.size > b.policy.MaxBytes {
+		b.close(group, open)
+		open = nil
+	}
+
+	if nil == open {
+		open = &batch{}
+		b.openByDir[group] = open
+
+		if b.policy.MaxWait > 0 {
+			opened := open
+			open.timer = time.AfterFunc(b.policy.MaxWait, func() {
+				b.mux.Lock()
+				defer b.mux.Unlock()
+
+				b.close(group, opened)
+			})
+		}
+	}
+
+	open.members = append(open.members, job)
+	open.size += job.size
+
+	full := b.policy.MaxFiles > 0 && len(open.members) >= b.policy.MaxFiles
+	full = full || (b.policy.MaxBytes > 0 && open.size >= b.policy.MaxBytes)
+	if full {
+		b.close(group, open)
+	}
+}
+
+// Close every open batch, eg. once no more files will be found
+func (b *batcher) flush() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	for group, open := range b.openByDir {
+		b.close(group, open)
+	}
+}
+
+// Close a batch unless it was closed already. Must be called with the lock
+// held.
+func (b *batcher) close(group string, closing *batch) {
+	if b.openByDir[group] != closing {
+		return
+	}
+
+	delete(b.openByDir, group)
+	if nil != closing.timer {
+		closing.timer.Stop()
+	}
+
+	b.numBatches++
+	b.send(closing.members, b.numBatches)
+}
+
+// Generate the key of an archive: the directory its members' keys have in
+// common, followed by the time and number of the batch, eg.
+// `logs/batch-20240611T101500Z-3.tar.gz`
+func archiveKey(members []*fileUploadJob, closedAt time.Time, number int, format string) string {
+	var common []string
+	for i, member := range members {
+		dir := strings.Split(path.Dir(member.key), "/")
+		if "." == dir[0] {
+			dir = nil
+		}
+
+		if 0 == i {
+			common = dir
+			continue
+		}
+
+		n := 0
+		for n < len(common) && n < len(dir) && common[n] == dir[n] {
+			n++
+		}
+		common = common[:n]
+	}
+
+	name := fmt.Sprintf(
+		"batch-%s-%d%s",
+		closedAt.UTC().Format("20060102T150405Z"),
+		number,
+		ArchiveExtension(format),
+	)
+
+	return path.Join(append(common, name)...)
+}
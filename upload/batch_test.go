@@ -0,0 +1,266 @@
+package upload
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/timrourke/funnel/tpl"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingBatches records the batches a batcher sends off
+type recordingBatches struct {
+	mux     sync.Mutex
+	batches [][]string
+	numbers []int
+}
+
+func (r *recordingBatches) send(members []*fileUploadJob, number int) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	var paths []string
+	for _, member := range members {
+		paths = append(paths, member.path)
+	}
+	r.batches = append(r.batches, paths)
+	r.numbers = append(r.numbers, number)
+}
+
+func (r *recordingBatches) sent() [][]string {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	return append([][]string{}, r.batches...)
+}
+
+// recordingArchiveUploader records the archives handed to it, failing the first
+// few uploads when told to
+type recordingArchiveUploader struct {
+	mux       sync.Mutex
+	keys      []string
+	members   [][]ArchiveMember
+	failTimes int
+}
+
+func (r *recordingArchiveUploader) UploadArchive(members []ArchiveMember, key string, format string) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.failTimes > 0 {
+		r.failTimes--
+		return errors.New("some error")
+	}
+
+	r.keys = append(r.keys, key)
+	r.members = append(r.members, members)
+
+	return nil
+}
+
+func TestBatcher(t *testing.T) {
+	Convey("Should close a batch once it has the most files allowed", t, func() {
+		recorded := &recordingBatches{}
+		b := newBatcher(BatchPolicy{MaxFiles: 2}, recorded.send)
+
+		for _, path := range []string{"/a/1", "/a/2", "/a/3"} {
+			b.add(&fileUploadJob{path: path})
+		}
+
+		So(recorded.sent(), ShouldResemble, [][]string{{"/a/1", "/a/2"}})
+
+		b.flush()
+
+		So(recorded.sent(), ShouldResemble, [][]string{{"/a/1", "/a/2"}, {"/a/3"}})
+		So(recorded.numbers, ShouldResemble, []int{1, 2})
+	})
+
+	Convey("Should close a batch before it grows larger than allowed", t, func() {
+		recorded := &recordingBatches{}
+		b := newBatcher(BatchPolicy{MaxBytes: 10}, recorded.send)
+
+		b.add(&fileUploadJob{path: "/a/1", size: 4})
+		b.add(&fileUploadJob{path: "/a/2", size: 4})
+		b.add(&fileUploadJob{path: "/a/3", size: 4})
+		b.add(&fileUploadJob{path: "/a/4", size: 20})
+
+		So(recorded.sent(), ShouldResemble, [][]string{{"/a/1", "/a/2"}, {"/a/3"}, {"/a/4"}})
+	})
+
+	Convey("Should keep files from different directories apart when grouping by directory", t, func() {
+		recorded := &recordingBatches{}
+		b := newBatcher(BatchPolicy{GroupByDir: true}, recorded.send)
+
+		for _, path := range []string{"/a/1", "/b/1", "/a/2"} {
+			b.add(&fileUploadJob{path: path})
+		}
+		b.flush()
+
+		sent := recorded.sent()
+		sort.Slice(sent, func(i, j int) bool {
+			return sent[i][0] < sent[j][0]
+		})
+
+		So(sent, ShouldResemble, [][]string{{"/a/1", "/a/2"}, {"/b/1"}})
+	})
+
+	Convey("Should close a batch once it was open for the longest time allowed", t, func() {
+		recorded := &recordingBatches{}
+		b := newBatcher(BatchPolicy{MaxWait: 10 * time.Millisecond}, recorded.send)
+
+		b.add(&fileUploadJob{path: "/a/1"})
+
+		So(recorded.sent(), ShouldBeEmpty)
+
+		time.Sleep(100 * time.Millisecond)
+
+		So(recorded.sent(), ShouldResemble, [][]string{{"/a/1"}})
+
+		b.flush()
+
+		So(len(recorded.sent()), ShouldEqual, 1)
+	})
+}
+
+func TestArchiveKey(t *testing.T) {
+	closedAt := time.Date(2024, 6, 11, 10, 15, 0, 0, time.UTC)
+
+	Convey("Should put the archive in the directory its members' keys have in common", t, func() {
+		members := []*fileUploadJob{
+			{key: "logs/app/1.log"},
+			{key: "logs/app/2.log"},
+			{key: "logs/web/1.log"},
+		}
+
+		So(archiveKey(members, closedAt, 3, ArchiveFormatTarGz), ShouldEqual, "logs/batch-20240611T101500Z-3.tar.gz")
+	})
+
+	Convey("Should put the archive at the top level when its members have no directory in common", t, func() {
+		members := []*fileUploadJob{
+			{key: "1.log"},
+			{key: "logs/2.log"},
+		}
+
+		So(archiveKey(members, closedAt, 1, ArchiveFormatZip), ShouldEqual, "batch-20240611T101500Z-1.zip")
+	})
+}
+
+func TestBatchingUploader(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	keyTemplate, err := tpl.NewKeyTemplate("sensors/{{ fileName }}", nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createFiles := func(n int) (string, []string) {
+		dir, err := ioutil.TempDir("", "batch")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var paths []string
+		for i := 0; i < n; i++ {
+			path := filepath.Join(dir, string(rune('a'+i))+".json")
+			err := ioutil.WriteFile(path, []byte("{}"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			paths = append(paths, path)
+		}
+
+		return dir, paths
+	}
+
+	Convey("Should upload files in archives and delete them once their archive was uploaded", t, func() {
+		dir, paths := createFiles(5)
+		defer os.RemoveAll(dir)
+
+		archiveUploader := &recordingArchiveUploader{}
+		observer := &recordingObserver{}
+		uploader := NewBatchingUploader(
+			true,
+			false,
+			2,
+			archiveUploader,
+			BatchPolicy{Format: ArchiveFormatTar, MaxFiles: 2},
+			keyTemplate,
+			FailOnCollision,
+			logger,
+			observer,
+		)
+
+		err := uploader.UploadFilesFromPathToBucket([]string{dir})
+
+		So(err, ShouldBeNil)
+		So(len(archiveUploader.keys), ShouldEqual, 3)
+
+		var names []string
+		for i, key := range archiveUploader.keys {
+			So(key, ShouldStartWith, "sensors/batch-")
+			So(key, ShouldEndWith, ".tar")
+			for _, member := range archiveUploader.members[i] {
+				names = append(names, member.Name)
+			}
+		}
+		sort.Strings(names)
+		So(names, ShouldResemble, []string{
+			"sensors/a.json",
+			"sensors/b.json",
+			"sensors/c.json",
+			"sensors/d.json",
+			"sensors/e.json",
+		})
+
+		for _, path := range paths {
+			_, err := os.Stat(path)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		}
+
+		uploaded := 0
+		for _, eventType := range observer.eventTypes() {
+			if FileUploaded == eventType {
+				uploaded++
+			}
+		}
+		So(uploaded, ShouldEqual, 5)
+	})
+
+	Convey("Should retry a failed archive and keep its files until it was uploaded", t, func() {
+		dir, paths := createFiles(2)
+		defer os.RemoveAll(dir)
+
+		archiveUploader := &recordingArchiveUploader{failTimes: 1}
+		observer := &recordingObserver{}
+		uploader := NewBatchingUploader(
+			false,
+			false,
+			1,
+			archiveUploader,
+			BatchPolicy{Format: ArchiveFormatZip},
+			keyTemplate,
+			FailOnCollision,
+			logger,
+			observer,
+		)
+
+		err := uploader.UploadFilesFromPathToBucket([]string{dir})
+
+		So(err, ShouldBeNil)
+		So(len(archiveUploader.keys), ShouldEqual, 1)
+		So(len(archiveUploader.members[0]), ShouldEqual, 2)
+		So(observer.eventTypes(), ShouldContain, FileUploadRetried)
+
+		for _, path := range paths {
+			_, err := os.Stat(path)
+			So(err, ShouldBeNil)
+		}
+	})
+}
@@ -0,0 +1,229 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CollisionPolicy decides what happens when a file's key is the same as the key
+// of a different file uploaded earlier in the same run
+type CollisionPolicy string
+
+const (
+	// FailOnCollision fails to upload every file whose key is already taken
+	FailOnCollision CollisionPolicy = "fail"
+	// SkipOnCollision skips every file whose key is already taken
+	SkipOnCollision CollisionPolicy = "skip"
+	// SuffixOnCollision adds a numeric suffix to a key that is already taken,
+	// eg. `text-1.txt`
+	SuffixOnCollision CollisionPolicy = "suffix"
+	// HashSuffixOnCollision adds a suffix derived from the file's path to a key
+	// that is already taken, eg. `text-3f2a9c1b.txt`
+	HashSuffixOnCollision CollisionPolicy = "hash-suffix"
+	// OverwriteOnCollision uploads every file regardless, so the object ends up
+	// with the contents of whichever file was uploaded last
+	OverwriteOnCollision CollisionPolicy = "overwrite"
+)
+
+// ParseCollisionPolicy parses the name of a collision policy
+func ParseCollisionPolicy(s string) (CollisionPolicy, error) {
+	switch policy := CollisionPolicy(strings.ToLower(strings.TrimSpace(s))); policy {
+	case FailOnCollision, SkipOnCollision, SuffixOnCollision, HashSuffixOnCollision, OverwriteOnCollision:
+		return policy, nil
+	default:
+		return "", fmt.Errorf(
+			"unknown collision policy, expected fail, skip, suffix, hash-suffix or overwrite: %s",
+			s,
+		)
+	}
+}
+
+// KeyCollisionError is the error of a file whose key is already taken by a
+// different file
+type KeyCollisionError struct {
+	Key       string
+	Path      string
+	OwnerPath string
+}
+
+// Error describes the collision, naming both files
+func (k *KeyCollisionError) Error() string {
+	return fmt.Sprintf("key %s of file %s is already used by file %s", k.Key, k.Path, k.OwnerPath)
+}
+
+// keyRegistry keeps track of which file claimed each key in a run, applying a
+// collision policy when a second file claims the same key. A key stays claimed
+// by its file for the whole run, or while the file is still found when watching
+// paths. Every file found colliding on a key is recorded, to be reported all at
+// once.
+type keyRegistry struct {
+	mux        sync.Mutex
+	policy     CollisionPolicy
+	logger     *logrus.Logger
+	owners     map[string]string
+	collisions map[string][]string
+	unreported map[string]bool
+}
+
+func newKeyRegistry(policy CollisionPolicy, logger *logrus.Logger) *keyRegistry {
+	return &keyRegistry{
+		policy:     policy,
+		logger:     logger,
+		owners:     make(map[string]string),
+		collisions: make(map[string][]string),
+		unreported: make(map[string]bool),
+	}
+}
+
+// Claim a key for a file, returning the key the file should be uploaded to.
+// The returned key is empty when the file should be skipped. The same file may
+// claim the same key any number of times, eg. when watching paths.
+func (k *keyRegistry) claim(key, filePath string) (string, error) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	if k.tryClaim(key, filePath) {
+		return key, nil
+	}
+
+	owner := k.owners[key]
+
+	if !containsString(k.collisions[key], filePath) {
+		if 0 == len(k.collisions[key]) {
+			k.collisions[key] = []string{owner}
+		}
+		k.collisions[key] = append(k.collisions[key], filePath)
+		k.unreported[key] = true
+
+		k.logger.WithFields(logrus.Fields{
+			"key":             key,
+			"filename":        filePath,
+			"ownerFilename":   owner,
+			"collisionPolicy": string(k.policy),
+		}).Debug(fmt.Sprintf("File %s has the same key %s as file %s", filePath, key, owner))
+	}
+
+	switch k.policy {
+	case SkipOnCollision:
+		return "", nil
+	case SuffixOnCollision:
+		return k.claimWithSuffix(key, filePath, 1), nil
+	case HashSuffixOnCollision:
+		pathHash := sha256.Sum256([]byte(filePath))
+		hashedKey := keyWithSuffix(key, hex.EncodeToString(pathHash[:4]))
+		if k.tryClaim(hashedKey, filePath) {
+			return hashedKey, nil
+		}
+		return k.claimWithSuffix(hashedKey, filePath, 1), nil
+	case OverwriteOnCollision:
+		return key, nil
+	default:
+		return "", &KeyCollisionError{Key: key, Path: filePath, OwnerPath: owner}
+	}
+}
+
+// Log every key that more files collided on since the last report, naming all
+// of the files
+func (k *keyRegistry) report() {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	keys := make([]string, 0, len(k.unreported))
+	for key := range k.unreported {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		k.logger.WithFields(logrus.Fields{
+			"key":             key,
+			"filenames":       k.collisions[key],
+			"collisionPolicy": string(k.policy),
+		}).Warn(fmt.Sprintf("%d files have the same key %s: %s", len(k.collisions[key]), key, strings.Join(k.collisions[key], ", ")))
+	}
+
+	k.unreported = make(map[string]bool)
+}
+
+// Forget the keys of files that are no longer found, eg. after being uploaded
+// and deleted, so that the keys kept when watching paths are bounded by the
+// files being watched. Their keys are free for other files again.
+func (k *keyRegistry) retain(found map[string]bool) {
+	k.mux.Lock()
+	defer k.mux.Unlock()
+
+	for key, owner := range k.owners {
+		if !found[owner] {
+			delete(k.owners, key)
+		}
+	}
+
+	for key, paths := range k.collisions {
+		var remaining []string
+		for _, filePath := range paths {
+			if found[filePath] {
+				remaining = append(remaining, filePath)
+			}
+		}
+
+		if len(remaining) < 2 {
+			delete(k.collisions, key)
+			delete(k.unreported, key)
+		} else {
+			k.collisions[key] = remaining
+		}
+	}
+}
+
+// Claim a key if it is free, or already claimed by the same file. Callers must
+// hold the registry's lock.
+func (k *keyRegistry) tryClaim(key, filePath string) bool {
+	owner, ok := k.owners[key]
+	if !ok {
+		k.owners[key] = filePath
+		return true
+	}
+
+	return owner == filePath
+}
+
+// Claim the first numbered variant of a key that is free, or already claimed by
+// the same file. Callers must hold the registry's lock.
+func (k *keyRegistry) claimWithSuffix(key, filePath string, n int) string {
+	for ; ; n++ {
+		suffixedKey := keyWithSuffix(key, fmt.Sprintf("%d", n))
+		if k.tryClaim(suffixedKey, filePath) {
+			return suffixedKey
+		}
+	}
+}
+
+// Insert a suffix into a key before the extension of its file name, eg. `a/b.tar.gz`
+// becomes `a/b-1.tar.gz`
+func keyWithSuffix(key, suffix string) string {
+	dir, name := path.Split(key)
+
+	i := strings.Index(strings.TrimLeft(name, "."), ".")
+	if i < 0 {
+		return dir + name + "-" + suffix
+	}
+	i += len(name) - len(strings.TrimLeft(name, "."))
+
+	return dir + name[:i] + "-" + suffix + name[i:]
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,198 @@
+package upload
+
+import (
+	"bytes"
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestParseCollisionPolicy(t *testing.T) {
+	Convey("Should parse known policies", t, func() {
+		policy, err := ParseCollisionPolicy("Hash-Suffix")
+
+		So(err, ShouldBeNil)
+		So(policy, ShouldEqual, HashSuffixOnCollision)
+	})
+
+	Convey("Should fail for unknown policies", t, func() {
+		_, err := ParseCollisionPolicy("rename")
+
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestKeyRegistry_claim(t *testing.T) {
+	Convey("Should let the same file claim its key again", t, func() {
+		registry := newKeyRegistry(FailOnCollision, logrus.New())
+
+		first, err := registry.claim("a/text.txt", "one/text.txt")
+		So(err, ShouldBeNil)
+		So(first, ShouldEqual, "a/text.txt")
+
+		again, err := registry.claim("a/text.txt", "one/text.txt")
+		So(err, ShouldBeNil)
+		So(again, ShouldEqual, "a/text.txt")
+		So(registry.owners, ShouldResemble, map[string]string{"a/text.txt": "one/text.txt"})
+	})
+
+	Convey("Should fail colliding files", t, func() {
+		registry := newKeyRegistry(FailOnCollision, logrus.New())
+		registry.claim("a/text.txt", "one/text.txt")
+
+		_, err := registry.claim("a/text.txt", "two/text.txt")
+
+		So(err, ShouldResemble, &KeyCollisionError{
+			Key:       "a/text.txt",
+			Path:      "two/text.txt",
+			OwnerPath: "one/text.txt",
+		})
+		So(err.Error(), ShouldContainSubstring, "one/text.txt")
+		So(err.Error(), ShouldContainSubstring, "two/text.txt")
+	})
+
+	Convey("Should skip colliding files", t, func() {
+		registry := newKeyRegistry(SkipOnCollision, logrus.New())
+		registry.claim("a/text.txt", "one/text.txt")
+
+		key, err := registry.claim("a/text.txt", "two/text.txt")
+
+		So(err, ShouldBeNil)
+		So(key, ShouldBeEmpty)
+	})
+
+	Convey("Should add numeric suffixes to colliding keys", t, func() {
+		registry := newKeyRegistry(SuffixOnCollision, logrus.New())
+		registry.claim("a/text.txt", "one/text.txt")
+		registry.claim("a/text-2.txt", "other/text-2.txt")
+
+		second, err := registry.claim("a/text.txt", "two/text.txt")
+		So(err, ShouldBeNil)
+		So(second, ShouldEqual, "a/text-1.txt")
+
+		third, err := registry.claim("a/text.txt", "three/text.txt")
+		So(err, ShouldBeNil)
+		So(third, ShouldEqual, "a/text-3.txt")
+
+		secondAgain, err := registry.claim("a/text.txt", "two/text.txt")
+		So(err, ShouldBeNil)
+		So(secondAgain, ShouldEqual, "a/text-1.txt")
+	})
+
+	Convey("Should add hash suffixes to colliding keys", t, func() {
+		registry := newKeyRegistry(HashSuffixOnCollision, logrus.New())
+		registry.claim("a/text.txt", "one/text.txt")
+
+		key, err := registry.claim("a/text.txt", "two/text.txt")
+
+		So(err, ShouldBeNil)
+		So(key, ShouldNotEqual, "a/text.txt")
+		So(key, ShouldStartWith, "a/text-")
+		So(key, ShouldEndWith, ".txt")
+		So(len(key), ShouldEqual, len("a/text-12345678.txt"))
+	})
+
+	Convey("Should overwrite colliding keys", t, func() {
+		registry := newKeyRegistry(OverwriteOnCollision, logrus.New())
+		registry.claim("a/text.txt", "one/text.txt")
+
+		key, err := registry.claim("a/text.txt", "two/text.txt")
+
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "a/text.txt")
+	})
+}
+
+func TestKeyRegistry_retain(t *testing.T) {
+	Convey("Should keep the keys of files that are still found", t, func() {
+		registry := newKeyRegistry(FailOnCollision, logrus.New())
+		registry.claim("a/text.txt", "one/text.txt")
+
+		registry.retain(map[string]bool{"one/text.txt": true})
+		_, err := registry.claim("a/text.txt", "two/text.txt")
+
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should keep the suffixed keys of colliding files that are still found", t, func() {
+		registry := newKeyRegistry(SuffixOnCollision, logrus.New())
+		registry.claim("a/text.txt", "one/text.txt")
+		registry.claim("a/text.txt", "two/text.txt")
+
+		registry.retain(map[string]bool{"one/text.txt": true, "two/text.txt": true})
+		registry.claim("a/text.txt", "three/text.txt")
+		key, err := registry.claim("a/text.txt", "two/text.txt")
+
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "a/text-1.txt")
+	})
+
+	Convey("Should free the keys of files that are no longer found", t, func() {
+		registry := newKeyRegistry(FailOnCollision, logrus.New())
+		registry.claim("a/text.txt", "one/text.txt")
+		registry.claim("a/text.txt", "two/text.txt")
+
+		registry.retain(map[string]bool{"two/text.txt": true})
+		key, err := registry.claim("a/text.txt", "two/text.txt")
+
+		So(err, ShouldBeNil)
+		So(key, ShouldEqual, "a/text.txt")
+		So(registry.owners, ShouldHaveLength, 1)
+		So(registry.collisions, ShouldBeEmpty)
+	})
+}
+
+func TestKeyRegistry_report(t *testing.T) {
+	Convey("Should report every file that collided on a key, grouped by key", t, func() {
+		logs := &bytes.Buffer{}
+		logger := logrus.New()
+		logger.SetOutput(logs)
+		logger.SetFormatter(&logrus.JSONFormatter{})
+
+		registry := newKeyRegistry(OverwriteOnCollision, logger)
+		registry.claim("a/text.txt", "one/text.txt")
+		registry.claim("b/text.txt", "four/text.txt")
+		registry.claim("a/text.txt", "two/text.txt")
+		registry.claim("a/text.txt", "three/text.txt")
+		registry.claim("a/text.txt", "two/text.txt")
+		So(logs.String(), ShouldBeEmpty)
+
+		registry.report()
+
+		So(logs.String(), ShouldContainSubstring, `"filenames":["one/text.txt","two/text.txt","three/text.txt"]`)
+		So(logs.String(), ShouldContainSubstring, `"key":"a/text.txt"`)
+		So(logs.String(), ShouldContainSubstring, "3 files have the same key a/text.txt")
+		So(logs.String(), ShouldNotContainSubstring, "four/text.txt")
+	})
+
+	Convey("Should only report keys that more files collided on since the last report", t, func() {
+		logs := &bytes.Buffer{}
+		logger := logrus.New()
+		logger.SetOutput(logs)
+		logger.SetFormatter(&logrus.JSONFormatter{})
+
+		registry := newKeyRegistry(SkipOnCollision, logger)
+		registry.claim("a/text.txt", "one/text.txt")
+		registry.claim("a/text.txt", "two/text.txt")
+		registry.report()
+		logs.Reset()
+
+		registry.claim("a/text.txt", "two/text.txt")
+		registry.report()
+		So(logs.String(), ShouldBeEmpty)
+
+		registry.claim("a/text.txt", "three/text.txt")
+		registry.report()
+		So(logs.String(), ShouldContainSubstring, `"filenames":["one/text.txt","two/text.txt","three/text.txt"]`)
+	})
+}
+
+func TestKeyWithSuffix(t *testing.T) {
+	Convey("Should insert suffixes before the file extension", t, func() {
+		So(keyWithSuffix("a/b.txt", "1"), ShouldEqual, "a/b-1.txt")
+		So(keyWithSuffix("a/b.tar.gz", "1"), ShouldEqual, "a/b-1.tar.gz")
+		So(keyWithSuffix("a/b", "1"), ShouldEqual, "a/b-1")
+		So(keyWithSuffix(".env", "1"), ShouldEqual, ".env-1")
+		So(keyWithSuffix("a/.b.txt", "1"), ShouldEqual, "a/.b-1.txt")
+	})
+}
@@ -0,0 +1,258 @@
+package upload
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxRecentlyFailedJobs caps how many failed jobs are remembered for inspection
+// and retrying
+const maxRecentlyFailedJobs = 100
+
+// Controller inspects and adjusts an uploader while it is running
+type Controller interface {
+	Pause()
+	Resume()
+	IsPaused() bool
+	Concurrency() int
+	SetConcurrency(numConcurrentUploads int) error
+	Jobs() Jobs
+	RetryFailed() (int, error)
+}
+
+// Jobs lists the upload jobs that are waiting for a worker, being uploaded,
+// and that recently failed
+type Jobs struct {
+	Queued   []JobInfo `json:"queued"`
+	InFlight []JobInfo `json:"inFlight"`
+	Failed   []JobInfo `json:"failed"`
+}
+
+// JobInfo describes a single upload job
+type JobInfo struct {
+	ID         uint64    `json:"id"`
+	Path       string    `json:"filename"`
+	Key        string    `json:"key,omitempty"`
+	Size       int64     `json:"size"`
+	EnqueuedAt time.Time `json:"enqueuedAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+	Attempts   int       `json:"attempts"`
+	Errors     []string  `json:"errors,omitempty"`
+}
+
+// Pause stops workers from picking up new jobs. Uploads already in flight are
+// allowed to finish.
+func (u *uploader) Pause() {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	if u.paused {
+		return
+	}
+
+	u.paused = true
+	u.resumed = make(chan struct{})
+}
+
+// Resume lets workers pick up new jobs again after being paused
+func (u *uploader) Resume() {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	if !u.paused {
+		return
+	}
+
+	u.paused = false
+	close(u.resumed)
+}
+
+// IsPaused reports whether workers are currently paused
+func (u *uploader) IsPaused() bool {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	return u.paused
+}
+
+// Concurrency returns the number of upload workers
+func (u *uploader) Concurrency() int {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	return u.numConcurrentUploads
+}
+
+// SetConcurrency changes the number of upload workers. When lowering the
+// number of workers, busy workers exit once their current upload is done.
+func (u *uploader) SetConcurrency(numConcurrentUploads int) error {
+	if numConcurrentUploads <= 0 || numConcurrentUploads > 100 {
+		return errors.New("number of concurrent uploads must be within the range 1-100")
+	}
+
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	difference := numConcurrentUploads - u.numConcurrentUploads
+	u.numConcurrentUploads = numConcurrentUploads
+
+	if !u.running {
+		return nil
+	}
+
+	for i := 0; i < difference; i++ {
+		go u.handlePending(u.pending, u.completed, u.failed)
+	}
+
+	if difference < 0 {
+		go func() {
+			for i := 0; i < -difference; i++ {
+				u.quit <- struct{}{}
+			}
+		}()
+	}
+
+	return nil
+}
+
+// Jobs lists the jobs currently queued and in flight, and those that failed
+// recently
+func (u *uploader) Jobs() Jobs {
+	return u.jobs.snapshot()
+}
+
+// RetryFailed enqueues every recently failed job again, with a fresh set of
+// attempts, returning the number of jobs enqueued. Once every file was found,
+// retrying is only possible while other jobs are still outstanding.
+func (u *uploader) RetryFailed() (int, error) {
+	u.mux.Lock()
+	if !u.running {
+		u.mux.Unlock()
+		return 0, errors.New("cannot retry failed uploads when no uploads are running")
+	}
+	if u.draining && 0 == u.outstanding {
+		u.mux.Unlock()
+		return 0, errors.New("cannot retry failed uploads, the last uploads have finished")
+	}
+
+	// The jobs are added to the wait group under the same lock the run takes
+	// before waiting, so that they are never added once waiting is over
+	pending, wg := u.pending, u.wg
+	failedJobs := u.jobs.takeFailed()
+	u.outstanding += len(failedJobs)
+	wg.Add(len(failedJobs))
+	u.mux.Unlock()
+
+	go func() {
+		for _, job := range failedJobs {
+			u.enqueueJob(job.Path, job.Size, pending)
+		}
+		u.flushBatches()
+	}()
+
+	return len(failedJobs), nil
+}
+
+// Wait until the uploader is not paused
+func (u *uploader) resumedSignal() <-chan struct{} {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	return u.resumed
+}
+
+// jobTracker observes upload events to keep track of the state of every job
+type jobTracker struct {
+	mux       sync.Mutex
+	queued    map[uint64]JobInfo
+	inFlight  map[uint64]JobInfo
+	failed    []JobInfo
+	maxFailed int
+}
+
+func newJobTracker(maxFailed int) *jobTracker {
+	return &jobTracker{
+		queued:    make(map[uint64]JobInfo),
+		inFlight:  make(map[uint64]JobInfo),
+		maxFailed: maxFailed,
+	}
+}
+
+// Observe moves a job between queued, in flight and failed as events occur
+func (j *jobTracker) Observe(event Event) {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	info := JobInfo{
+		ID:         event.JobID,
+		Path:       event.Path,
+		Key:        event.Key,
+		Size:       event.Size,
+		EnqueuedAt: event.StartedAt,
+		UpdatedAt:  event.At,
+		Attempts:   len(event.Errors),
+	}
+	for _, err := range event.Errors {
+		info.Errors = append(info.Errors, err.Error())
+	}
+
+	switch event.Type {
+	case FileEnqueued:
+		j.queued[event.JobID] = info
+	case FileUploadStarted:
+		info.Attempts++
+		delete(j.queued, event.JobID)
+		j.inFlight[event.JobID] = info
+	case FileUploaded:
+		delete(j.inFlight, event.JobID)
+	case FileUploadRetried:
+		delete(j.inFlight, event.JobID)
+		j.queued[event.JobID] = info
+	case FileUploadFailed:
+		delete(j.inFlight, event.JobID)
+		j.failed = append(j.failed, info)
+		if len(j.failed) > j.maxFailed {
+			j.failed = j.failed[len(j.failed)-j.maxFailed:]
+		}
+	case FileKeyFailed:
+		// Retrying would fail to generate the key again
+		delete(j.queued, event.JobID)
+	}
+}
+
+func (j *jobTracker) snapshot() Jobs {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	return Jobs{
+		Queued:   sortedJobInfo(j.queued),
+		InFlight: sortedJobInfo(j.inFlight),
+		Failed:   append([]JobInfo{}, j.failed...),
+	}
+}
+
+// Forget the recently failed jobs, returning them
+func (j *jobTracker) takeFailed() []JobInfo {
+	j.mux.Lock()
+	defer j.mux.Unlock()
+
+	failed := j.failed
+	j.failed = nil
+
+	return failed
+}
+
+func sortedJobInfo(jobs map[uint64]JobInfo) []JobInfo {
+	sorted := []JobInfo{}
+	for _, info := range jobs {
+		sorted = append(sorted, info)
+	}
+
+	sort.Slice(sorted, func(i, k int) bool {
+		return sorted[i].ID < sorted[k].ID
+	})
+
+	return sorted
+}
@@ -0,0 +1,238 @@
+package upload
+
+import (
+	"errors"
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"github.com/timrourke/funnel/tpl"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// funcS3Uploader adapts a function to the `backend.Uploader` interface
+type funcS3Uploader func(path string, key string) error
+
+// Upload calls the adapted function
+func (f funcS3Uploader) Upload(path string, key string) error {
+	return f(path, key)
+}
+
+func newControlTestUploader(t *testing.T, s3Uploader funcS3Uploader) Uploader {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	keyTemplate, err := tpl.NewKeyTemplate("{{ filePath }}", nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewUploader(false, false, 2, s3Uploader, keyTemplate, FailOnCollision, logger)
+}
+
+func newControlTestFile(t *testing.T) string {
+	file, err := ioutil.TempFile("", "somefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	return file.Name()
+}
+
+func TestUploader_Pause(t *testing.T) {
+	Convey("Should not pick up jobs while paused", t, func(c C) {
+		filePath := newControlTestFile(t)
+		defer os.Remove(filePath)
+
+		var mux sync.Mutex
+		var uploadedPaths []string
+		uploader := newControlTestUploader(t, func(path string, key string) error {
+			mux.Lock()
+			defer mux.Unlock()
+			uploadedPaths = append(uploadedPaths, path)
+			return nil
+		})
+
+		uploader.Pause()
+		So(uploader.IsPaused(), ShouldBeTrue)
+
+		done := make(chan error)
+		go func() {
+			done <- uploader.UploadFilesFromPathToBucket([]string{filePath})
+		}()
+
+		time.Sleep(50 * time.Millisecond)
+
+		mux.Lock()
+		So(uploadedPaths, ShouldBeEmpty)
+		mux.Unlock()
+		So(len(uploader.Jobs().Queued), ShouldEqual, 1)
+
+		uploader.Resume()
+		So(uploader.IsPaused(), ShouldBeFalse)
+
+		So(<-done, ShouldBeNil)
+		So(uploadedPaths, ShouldResemble, []string{filePath})
+		So(uploader.Jobs().Queued, ShouldBeEmpty)
+	})
+}
+
+func TestUploader_SetConcurrency(t *testing.T) {
+	Convey("Should change the number of workers", t, func() {
+		uploader := newControlTestUploader(t, func(path string, key string) error {
+			return nil
+		})
+
+		err := uploader.SetConcurrency(20)
+
+		So(err, ShouldBeNil)
+		So(uploader.Concurrency(), ShouldEqual, 20)
+	})
+
+	Convey("Should reject out of range numbers of workers", t, func() {
+		uploader := newControlTestUploader(t, func(path string, key string) error {
+			return nil
+		})
+
+		So(uploader.SetConcurrency(0), ShouldNotBeNil)
+		So(uploader.SetConcurrency(101), ShouldNotBeNil)
+		So(uploader.Concurrency(), ShouldEqual, 2)
+	})
+
+	Convey("Should keep uploading after workers are added and removed", t, func() {
+		dirname, err := ioutil.TempDir("", "somedir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dirname)
+
+		for _, name := range []string{"a", "b", "c", "d"} {
+			err := ioutil.WriteFile(dirname+"/"+name, nil, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var uploader Uploader
+		var mux sync.Mutex
+		numUploaded := 0
+		uploader = newControlTestUploader(t, func(path string, key string) error {
+			mux.Lock()
+			defer mux.Unlock()
+
+			numUploaded++
+			if 1 == numUploaded {
+				uploader.SetConcurrency(5)
+			}
+			if 2 == numUploaded {
+				uploader.SetConcurrency(1)
+			}
+
+			return nil
+		})
+
+		err = uploader.UploadFilesFromPathToBucket([]string{dirname})
+
+		So(err, ShouldBeNil)
+		So(numUploaded, ShouldEqual, 4)
+		So(uploader.Concurrency(), ShouldEqual, 1)
+	})
+}
+
+func TestUploader_RetryFailed(t *testing.T) {
+	Convey("Should refuse to retry when not running", t, func() {
+		uploader := newControlTestUploader(t, func(path string, key string) error {
+			return nil
+		})
+
+		_, err := uploader.RetryFailed()
+
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should refuse to retry once the last uploads have finished", t, func() {
+		uploader := newControlTestUploader(t, func(path string, key string) error {
+			return nil
+		}).(*uploader)
+		uploader.running = true
+		uploader.draining = true
+		uploader.wg = &sync.WaitGroup{}
+
+		_, err := uploader.RetryFailed()
+
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Should enqueue recently failed jobs again", t, func(c C) {
+		failingPath := newControlTestFile(t)
+		defer os.Remove(failingPath)
+
+		blockingPath := newControlTestFile(t)
+		defer os.Remove(blockingPath)
+
+		var mux sync.Mutex
+		attempts := map[string]int{}
+		shouldFail := true
+		release := make(chan struct{})
+
+		uploader := newControlTestUploader(t, func(path string, key string) error {
+			mux.Lock()
+			attempts[path]++
+			failing := shouldFail
+			mux.Unlock()
+
+			if path == blockingPath {
+				<-release
+				return nil
+			}
+
+			if failing {
+				return errors.New("connection reset")
+			}
+
+			return nil
+		})
+
+		done := make(chan error)
+		go func() {
+			done <- uploader.UploadFilesFromPathToBucket([]string{failingPath, blockingPath})
+		}()
+
+		for 0 == len(uploader.Jobs().Failed) {
+			time.Sleep(time.Millisecond)
+		}
+
+		failed := uploader.Jobs().Failed
+		So(failed[0].Path, ShouldEqual, failingPath)
+		So(failed[0].Attempts, ShouldEqual, 5)
+		So(len(failed[0].Errors), ShouldEqual, 5)
+
+		mux.Lock()
+		shouldFail = false
+		mux.Unlock()
+
+		numRetried, err := uploader.RetryFailed()
+
+		So(err, ShouldBeNil)
+		So(numRetried, ShouldEqual, 1)
+		So(uploader.Jobs().Failed, ShouldBeEmpty)
+
+		for {
+			mux.Lock()
+			numAttempts := attempts[failingPath]
+			mux.Unlock()
+			if 6 == numAttempts {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		close(release)
+
+		So(<-done, ShouldBeNil)
+		So(uploader.Jobs().Failed, ShouldBeEmpty)
+	})
+}
@@ -0,0 +1,94 @@
+package upload
+
+import (
+	"sync"
+)
+
+// keyStage generates the keys of files in parallel, as rendering a template may
+// read a whole file, eg. to hash it. The keys are claimed one after another in
+// the order the files were added, so that when files collide on a key the first
+// file found is the one that keeps it.
+type keyStage struct {
+	render func(job *fileUploadJob)
+	claim  func(job *fileUploadJob) bool
+
+	// Every file holds a slot from being added until it was dispatched, which
+	// bounds the files being rendered or waiting for their turn to claim
+	slots chan struct{}
+
+	mux      sync.Mutex
+	added    uint64
+	claimed  uint64
+	rendered map[uint64]*fileUploadJob
+}
+
+// Create a stage rendering up to a number of keys at once. The claim function
+// is called in order and tells whether a file should be dispatched at all.
+func newKeyStage(
+	concurrency int,
+	render func(job *fileUploadJob),
+	claim func(job *fileUploadJob) bool,
+) *keyStage {
+	return &keyStage{
+		render:   render,
+		claim:    claim,
+		slots:    make(chan struct{}, concurrency),
+		rendered: make(map[uint64]*fileUploadJob),
+	}
+}
+
+// Generate and claim the key of a file, then dispatch it. Blocks while too many
+// files are in the stage already.
+func (s *keyStage) add(job *fileUploadJob, dispatch func(job *fileUploadJob)) {
+	s.slots <- struct{}{}
+
+	s.mux.Lock()
+	position := s.added
+	s.added++
+	s.mux.Unlock()
+
+	go func() {
+		s.render(job)
+
+		for _, ready := range s.claimInOrder(position, job) {
+			dispatch(ready)
+			<-s.slots
+		}
+	}()
+}
+
+// Claim the keys of every rendered file whose turn it is, returning the files
+// to dispatch. Files skipped by the claim give up their slot right away.
+func (s *keyStage) claimInOrder(position uint64, job *fileUploadJob) []*fileUploadJob {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.rendered[position] = job
+
+	var ready []*fileUploadJob
+	for {
+		next, ok := s.rendered[s.claimed]
+		if !ok {
+			return ready
+		}
+
+		delete(s.rendered, s.claimed)
+		s.claimed++
+
+		if s.claim(next) {
+			ready = append(ready, next)
+		} else {
+			<-s.slots
+		}
+	}
+}
+
+// Wait until every file added so far was dispatched
+func (s *keyStage) wait() {
+	for i := 0; i < cap(s.slots); i++ {
+		s.slots <- struct{}{}
+	}
+	for i := 0; i < cap(s.slots); i++ {
+		<-s.slots
+	}
+}
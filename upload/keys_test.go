@@ -0,0 +1,114 @@
+package upload
+
+import (
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// funcKeyTemplate generates keys with a function
+type funcKeyTemplate func(filePath string) (string, error)
+
+func (f funcKeyTemplate) KeyForFile(filePath string) (string, error) {
+	return f(filePath)
+}
+
+func (f funcKeyTemplate) KeyForFileInRoot(rootPath string, filePath string) (string, error) {
+	return f(filePath)
+}
+
+func TestUploader_generatesKeys(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	newDir := func(names ...string) string {
+		dir, err := ioutil.TempDir("", "keys")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, name := range names {
+			err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return dir
+	}
+
+	var mux sync.Mutex
+	uploadedKeys := map[string]string{}
+	fileUploader := funcS3Uploader(func(path string, key string) error {
+		mux.Lock()
+		defer mux.Unlock()
+		uploadedKeys[filepath.Base(path)] = key
+		return nil
+	})
+
+	Convey("Should generate the keys of different files at the same time", t, func() {
+		dir := newDir("a.txt", "b.txt")
+		defer os.RemoveAll(dir)
+
+		var renderMux sync.Mutex
+		rendering, mostRendering := 0, 0
+		keyTemplate := funcKeyTemplate(func(filePath string) (string, error) {
+			renderMux.Lock()
+			rendering++
+			if rendering > mostRendering {
+				mostRendering = rendering
+			}
+			renderMux.Unlock()
+
+			// Wait a while for the other file to be rendered at the same time
+			for i := 0; i < 100; i++ {
+				renderMux.Lock()
+				both := 2 == mostRendering
+				renderMux.Unlock()
+				if both {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			renderMux.Lock()
+			rendering--
+			renderMux.Unlock()
+
+			return filepath.Base(filePath), nil
+		})
+
+		uploader := NewUploader(false, false, 2, fileUploader, keyTemplate, FailOnCollision, logger)
+
+		So(uploader.UploadFilesFromPathToBucket([]string{dir}), ShouldBeNil)
+		So(mostRendering, ShouldEqual, 2)
+	})
+
+	Convey("Should claim keys in the order files are found, however long generating them takes", t, func() {
+		dir := newDir("a.txt", "b.txt", "c.txt")
+		defer os.RemoveAll(dir)
+
+		uploadedKeys = map[string]string{}
+		keyTemplate := funcKeyTemplate(func(filePath string) (string, error) {
+			if "a.txt" == filepath.Base(filePath) {
+				time.Sleep(50 * time.Millisecond)
+			}
+
+			return "same.txt", nil
+		})
+
+		uploader := NewUploader(false, false, 3, fileUploader, keyTemplate, SuffixOnCollision, logger)
+
+		So(uploader.UploadFilesFromPathToBucket([]string{dir}), ShouldBeNil)
+		So(uploadedKeys, ShouldResemble, map[string]string{
+			"a.txt": "same.txt",
+			"b.txt": "same-1.txt",
+			"c.txt": "same-2.txt",
+		})
+	})
+}
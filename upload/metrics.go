@@ -0,0 +1,196 @@
+package upload
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
+)
+
+// Metrics is an observer that exposes the state of the upload pipeline as
+// Prometheus metrics, for monitoring long running `--watch` daemons
+type Metrics struct {
+	mux             sync.Mutex
+	attemptsStarted map[string][]float64
+
+	filesEnqueued        prometheus.Counter
+	filesUploaded        prometheus.Counter
+	filesFailed          prometheus.Counter
+	filesRetried         prometheus.Counter
+	filesSkipped         prometheus.Counter
+	bytesUploaded        prometheus.Counter
+	uploadDuration       prometheus.Histogram
+	queueDepth           prometheus.Gauge
+	activeWorkers        prometheus.Gauge
+	lastSuccessfulUpload prometheus.Gauge
+	uncompressedBytes    *prometheus.CounterVec
+	compressedBytes      *prometheus.CounterVec
+	destinationUploads   *prometheus.CounterVec
+}
+
+// NewMetrics creates the upload metrics and registers them with the given
+// registerer
+func NewMetrics(registerer prometheus.Registerer) (*Metrics, error) {
+	m := &Metrics{
+		attemptsStarted: make(map[string][]float64),
+		filesEnqueued: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "funnel_files_enqueued_total",
+			Help: "Number of files found and queued for upload.",
+		}),
+		filesUploaded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "funnel_files_uploaded_total",
+			Help: "Number of files uploaded successfully.",
+		}),
+		filesFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "funnel_files_failed_total",
+			Help: "Number of files that could not be uploaded after exhausting every attempt, or for which no key could be generated.",
+		}),
+		filesRetried: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "funnel_file_upload_retries_total",
+			Help: "Number of failed upload attempts that were queued to be tried again.",
+		}),
+		filesSkipped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "funnel_files_skipped_total",
+			Help: "Number of files not uploaded because their key was already used by another file.",
+		}),
+		bytesUploaded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "funnel_bytes_uploaded_total",
+			Help: "Number of bytes in files uploaded successfully.",
+		}),
+		uploadDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "funnel_upload_duration_seconds",
+			Help:    "Time taken by each successful upload attempt.",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 16),
+		}),
+		queueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "funnel_upload_queue_depth",
+			Help: "Number of files waiting in the pending queue for a worker.",
+		}),
+		activeWorkers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "funnel_upload_active_workers",
+			Help: "Number of workers currently uploading a file.",
+		}),
+		lastSuccessfulUpload: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "funnel_last_successful_upload_timestamp_seconds",
+			Help: "Unix time at which the most recent successful upload finished.",
+		}),
+		uncompressedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "funnel_compression_uncompressed_bytes_total",
+			Help: "Number of bytes in files compressed while they were uploaded, before compression.",
+		}, []string{"algorithm"}),
+		compressedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "funnel_compression_compressed_bytes_total",
+			Help: "Number of bytes in files compressed while they were uploaded, after compression.",
+		}, []string{"algorithm"}),
+		destinationUploads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "funnel_destination_uploads_total",
+			Help: "Number of attempts at uploading a file or object to each of the destinations it is fanned out to, by result.",
+		}, []string{"destination", "result"}),
+	}
+
+	collectors := []prometheus.Collector{
+		m.filesEnqueued,
+		m.filesUploaded,
+		m.filesFailed,
+		m.filesRetried,
+		m.filesSkipped,
+		m.bytesUploaded,
+		m.uploadDuration,
+		m.queueDepth,
+		m.activeWorkers,
+		m.lastSuccessfulUpload,
+		m.uncompressedBytes,
+		m.compressedBytes,
+		m.destinationUploads,
+	}
+
+	for _, collector := range collectors {
+		err := registerer.Register(collector)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// Observe updates the metrics affected by an upload event
+func (m *Metrics) Observe(event Event) {
+	switch event.Type {
+	case FileEnqueued:
+		m.filesEnqueued.Inc()
+		m.queueDepth.Inc()
+	case FileUploadStarted:
+		m.queueDepth.Dec()
+		m.activeWorkers.Inc()
+		m.startAttempt(event)
+	case FileUploaded:
+		m.activeWorkers.Dec()
+		m.filesUploaded.Inc()
+		m.bytesUploaded.Add(float64(event.Size))
+		m.uploadDuration.Observe(float64(event.At.UnixNano())/1e9 - m.finishAttempt(event))
+		m.lastSuccessfulUpload.Set(float64(event.At.UnixNano()) / 1e9)
+	case FileUploadRetried:
+		m.activeWorkers.Dec()
+		m.queueDepth.Inc()
+		m.filesRetried.Inc()
+		m.finishAttempt(event)
+	case FileUploadFailed:
+		m.activeWorkers.Dec()
+		m.filesFailed.Inc()
+		m.finishAttempt(event)
+	case FileSkipped:
+		m.filesSkipped.Inc()
+	case FileKeyFailed:
+		m.queueDepth.Dec()
+		m.filesFailed.Inc()
+	}
+}
+
+// ObserveCompression counts the bytes in a file before and after it was
+// compressed
+func (m *Metrics) ObserveCompression(algorithm string, uncompressedSize int64, compressedSize int64) {
+	m.uncompressedBytes.WithLabelValues(algorithm).Add(float64(uncompressedSize))
+	m.compressedBytes.WithLabelValues(algorithm).Add(float64(compressedSize))
+}
+
+// ObserveDestination counts the attempts at uploading to one of the
+// destinations of a fan-out that succeeded or failed
+func (m *Metrics) ObserveDestination(destination string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	m.destinationUploads.WithLabelValues(destination, result).Inc()
+}
+
+// Record when an attempt at uploading a path started. The same path may be in
+// flight more than once, eg. when watching a path re-enqueues it.
+func (m *Metrics) startAttempt(event Event) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.attemptsStarted[event.Path] = append(
+		m.attemptsStarted[event.Path],
+		float64(event.At.UnixNano())/1e9,
+	)
+}
+
+// Forget the oldest attempt in flight for a path, returning the Unix time at
+// which it started
+func (m *Metrics) finishAttempt(event Event) float64 {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	attempts := m.attemptsStarted[event.Path]
+	if 0 == len(attempts) {
+		return float64(event.At.UnixNano()) / 1e9
+	}
+
+	if 1 == len(attempts) {
+		delete(m.attemptsStarted, event.Path)
+	} else {
+		m.attemptsStarted[event.Path] = attempts[1:]
+	}
+
+	return attempts[0]
+}
@@ -0,0 +1,109 @@
+package upload
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+func TestNewMetrics(t *testing.T) {
+	Convey("Should register metrics", t, func() {
+		registry := prometheus.NewRegistry()
+
+		metrics, err := NewMetrics(registry)
+
+		So(err, ShouldBeNil)
+		So(metrics, ShouldNotBeNil)
+
+		Convey("Should fail to register metrics twice", func() {
+			_, err := NewMetrics(registry)
+
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestMetrics_Observe(t *testing.T) {
+	Convey("Should track files through the upload pipeline", t, func() {
+		metrics, err := NewMetrics(prometheus.NewRegistry())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		startedAt := time.Unix(1000, 0)
+
+		metrics.Observe(Event{Type: FileEnqueued, Path: "a", Size: 10, At: startedAt})
+		metrics.Observe(Event{Type: FileEnqueued, Path: "b", Size: 20, At: startedAt})
+
+		So(testutil.ToFloat64(metrics.filesEnqueued), ShouldEqual, 2)
+		So(testutil.ToFloat64(metrics.queueDepth), ShouldEqual, 2)
+
+		metrics.Observe(Event{Type: FileUploadStarted, Path: "a", Size: 10, At: startedAt})
+		metrics.Observe(Event{Type: FileUploadStarted, Path: "b", Size: 20, At: startedAt})
+
+		So(testutil.ToFloat64(metrics.queueDepth), ShouldEqual, 0)
+		So(testutil.ToFloat64(metrics.activeWorkers), ShouldEqual, 2)
+
+		metrics.Observe(Event{Type: FileUploaded, Path: "a", Size: 10, At: startedAt.Add(2 * time.Second)})
+		metrics.Observe(Event{Type: FileUploadRetried, Path: "b", Size: 20, At: startedAt.Add(3 * time.Second)})
+
+		So(testutil.ToFloat64(metrics.filesUploaded), ShouldEqual, 1)
+		So(testutil.ToFloat64(metrics.bytesUploaded), ShouldEqual, 10)
+		So(testutil.ToFloat64(metrics.filesRetried), ShouldEqual, 1)
+		So(testutil.ToFloat64(metrics.queueDepth), ShouldEqual, 1)
+		So(testutil.ToFloat64(metrics.activeWorkers), ShouldEqual, 0)
+		So(testutil.ToFloat64(metrics.lastSuccessfulUpload), ShouldEqual, 1002)
+
+		metrics.Observe(Event{Type: FileUploadStarted, Path: "b", Size: 20, At: startedAt.Add(4 * time.Second)})
+		metrics.Observe(Event{Type: FileUploadFailed, Path: "b", Size: 20, At: startedAt.Add(5 * time.Second)})
+
+		So(testutil.ToFloat64(metrics.filesFailed), ShouldEqual, 1)
+		So(testutil.ToFloat64(metrics.activeWorkers), ShouldEqual, 0)
+		So(testutil.ToFloat64(metrics.queueDepth), ShouldEqual, 0)
+		So(metrics.attemptsStarted, ShouldBeEmpty)
+
+		metrics.Observe(Event{Type: FileEnqueued, Path: "c", Size: 30, At: startedAt.Add(6 * time.Second)})
+		metrics.Observe(Event{Type: FileKeyFailed, Path: "c", Size: 30, At: startedAt.Add(6 * time.Second)})
+
+		So(testutil.ToFloat64(metrics.filesFailed), ShouldEqual, 2)
+		So(testutil.ToFloat64(metrics.activeWorkers), ShouldEqual, 0)
+		So(testutil.ToFloat64(metrics.queueDepth), ShouldEqual, 0)
+	})
+}
+
+func TestMetrics_ObserveCompression(t *testing.T) {
+	Convey("Should count bytes before and after compression per algorithm", t, func() {
+		metrics, err := NewMetrics(prometheus.NewRegistry())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		metrics.ObserveCompression("gzip", 100, 10)
+		metrics.ObserveCompression("gzip", 50, 5)
+		metrics.ObserveCompression("zstd", 30, 3)
+
+		So(testutil.ToFloat64(metrics.uncompressedBytes.WithLabelValues("gzip")), ShouldEqual, 150)
+		So(testutil.ToFloat64(metrics.compressedBytes.WithLabelValues("gzip")), ShouldEqual, 15)
+		So(testutil.ToFloat64(metrics.compressedBytes.WithLabelValues("zstd")), ShouldEqual, 3)
+	})
+}
+
+func TestMetrics_ObserveDestination(t *testing.T) {
+	Convey("Should count attempts at uploading to each destination by result", t, func() {
+		metrics, err := NewMetrics(prometheus.NewRegistry())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		metrics.ObserveDestination("s3://some-bucket", nil)
+		metrics.ObserveDestination("file:///mnt/nas", errors.New("some error"))
+		metrics.ObserveDestination("file:///mnt/nas", nil)
+
+		So(testutil.ToFloat64(metrics.destinationUploads.WithLabelValues("s3://some-bucket", "success")), ShouldEqual, 1)
+		So(testutil.ToFloat64(metrics.destinationUploads.WithLabelValues("file:///mnt/nas", "failure")), ShouldEqual, 1)
+		So(testutil.ToFloat64(metrics.destinationUploads.WithLabelValues("file:///mnt/nas", "success")), ShouldEqual, 1)
+	})
+}
@@ -0,0 +1,69 @@
+package upload
+
+import (
+	"time"
+)
+
+// EventType identifies a step in the life of a file upload job
+type EventType int
+
+const (
+	// FileEnqueued is emitted when a file is found and queued for upload
+	FileEnqueued EventType = iota
+	// FileUploadStarted is emitted when a worker begins uploading a file
+	FileUploadStarted
+	// FileUploaded is emitted when a file was uploaded successfully
+	FileUploaded
+	// FileUploadRetried is emitted when an attempt failed and the file was
+	// queued to be tried again
+	FileUploadRetried
+	// FileUploadFailed is emitted when a file could not be uploaded after
+	// exhausting all of its attempts
+	FileUploadFailed
+	// FileSkipped is emitted instead of FileEnqueued when a file is not
+	// uploaded because its key is already used by another file
+	FileSkipped
+	// FileKeyFailed is emitted when a file is not uploaded because no key
+	// could be generated for it. Trying again would fail the same way, so it
+	// is not retried.
+	FileKeyFailed
+)
+
+// Event describes a change in the state of a single file upload job
+type Event struct {
+	Type      EventType
+	JobID     uint64
+	Path      string
+	Size      int64
+	Key       string
+	StartedAt time.Time
+	At        time.Time
+	Errors    []error
+}
+
+// Observer is notified of every event in the upload pipeline, eg. to report
+// progress or collect metrics. Observers are called from the upload workers'
+// goroutines, so they must be safe for concurrent use and should return
+// quickly.
+type Observer interface {
+	Observe(event Event)
+}
+
+func (u *uploader) notify(eventType EventType, job *fileUploadJob, key string) {
+	event := Event{
+		Type:      eventType,
+		JobID:     job.id,
+		Path:      job.path,
+		Size:      job.size,
+		Key:       key,
+		StartedAt: job.startedAt,
+		At:        time.Now(),
+		Errors:    job.errors,
+	}
+
+	u.jobs.Observe(event)
+
+	for _, observer := range u.observers {
+		observer.Observe(event)
+	}
+}
@@ -1,55 +1,126 @@
-// Package upload defines a service for uploading one or more file paths to AWS
-// S3. Uploading each individual file should happen in a non-blocking manner.
-// The work of actually calling to the AWS SDK for S3 is delegated to the `s3`
-// package.
+// Package upload defines a service for uploading one or more file paths to a
+// storage backend. Uploading each individual file should happen in a
+// non-blocking manner. The work of actually storing files is delegated to the
+// backend, eg. the one in the `s3` package.
 package upload
 
 import (
 	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
-	"github.com/timrourke/funnel/s3"
+	"github.com/timrourke/funnel/backend"
+	"github.com/timrourke/funnel/retry"
 	"github.com/timrourke/funnel/tpl"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
 
-// Uploader uploads files from one or more local paths to AWS S3
+// Uploader uploads files from one or more local paths to a backend. While files
+// are being uploaded, the uploader can be inspected and controlled.
 type Uploader interface {
+	Controller
 	UploadFilesFromPathToBucket(filePaths []string) error
 }
 
 type uploader struct {
+	archiveUploader             ArchiveUploader
+	batchPolicy                 BatchPolicy
+	collisionPolicy             CollisionPolicy
 	keyTemplate                 tpl.KeyTemplate
 	logger                      *logrus.Logger
 	numConcurrentUploads        int
+	observers                   []Observer
 	shouldDeleteFileAfterUpload bool
 	shouldWatchPaths            bool
-	s3Uploader                  s3.S3Uploader
+	fileUploader                backend.Uploader
+
+	mux         sync.Mutex
+	batcher     *batcher
+	jobs        *jobTracker
+	keys        *keyRegistry
+	keyStage    *keyStage
+	nextJobID   uint64
+	paused      bool
+	roots       []string
+	resumed     chan struct{}
+	quit        chan struct{}
+	running     bool
+	draining    bool
+	outstanding int
+	pending     chan *fileUploadJob
+	completed   chan *fileUploadJob
+	failed      chan *fileUploadJob
+	wg          *sync.WaitGroup
 }
 
-// NewUploader creates a new service to upload files to S3
+// NewUploader creates a new service to upload files to a backend. The
+// collision policy decides what happens to files whose key is already used by
+// another file in the same run. Observers are notified as each file moves
+// through the upload pipeline.
 func NewUploader(
 	shouldDeleteFileAfterUpload bool,
 	shouldWatchPaths bool,
 	numConcurrentUploads int,
-	s3Uploader s3.S3Uploader,
+	fileUploader backend.Uploader,
 	keyTemplate tpl.KeyTemplate,
+	collisionPolicy CollisionPolicy,
 	logger *logrus.Logger,
+	observers ...Observer,
 ) Uploader {
+	resumed := make(chan struct{})
+	close(resumed)
+
 	return &uploader{
+		collisionPolicy:             collisionPolicy,
 		keyTemplate:                 keyTemplate,
 		logger:                      logger,
 		numConcurrentUploads:        numConcurrentUploads,
+		observers:                   observers,
 		shouldDeleteFileAfterUpload: shouldDeleteFileAfterUpload,
 		shouldWatchPaths:            shouldWatchPaths,
-		s3Uploader:                  s3Uploader,
+		fileUploader:                fileUploader,
+		jobs:                        newJobTracker(maxRecentlyFailedJobs),
+		resumed:                     resumed,
+		quit:                        make(chan struct{}),
 	}
 }
 
-// UploadFilesFromPathToBucket uploads a list of files at the given paths to AWS S3
+// NewBatchingUploader creates a new service that bundles files into archives
+// before uploading them, grouped as the batch policy says. Each file is
+// still reported to observers on its own, and when files are deleted after
+// upload, that only happens once the whole archive was uploaded.
+func NewBatchingUploader(
+	shouldDeleteFileAfterUpload bool,
+	shouldWatchPaths bool,
+	numConcurrentUploads int,
+	archiveUploader ArchiveUploader,
+	batchPolicy BatchPolicy,
+	keyTemplate tpl.KeyTemplate,
+	collisionPolicy CollisionPolicy,
+	logger *logrus.Logger,
+	observers ...Observer,
+) Uploader {
+	u := NewUploader(
+		shouldDeleteFileAfterUpload,
+		shouldWatchPaths,
+		numConcurrentUploads,
+		nil,
+		keyTemplate,
+		collisionPolicy,
+		logger,
+		observers...,
+	).(*uploader)
+
+	u.archiveUploader = archiveUploader
+	u.batchPolicy = batchPolicy
+
+	return u
+}
+
+// UploadFilesFromPathToBucket uploads a list of files at the given paths to the backend
 func (u *uploader) UploadFilesFromPathToBucket(filePaths []string) error {
 	if 0 == len(filePaths) {
 		return errors.New("must provide at least one path to a file or directory to upload to AWS S3")
@@ -59,9 +130,26 @@ func (u *uploader) UploadFilesFromPathToBucket(filePaths []string) error {
 
 	pending, completed, failed := make(chan *fileUploadJob), make(chan *fileUploadJob), make(chan *fileUploadJob)
 
+	u.mux.Lock()
+	u.running = true
+	u.draining = false
+	u.outstanding = 0
+	u.roots = RootPaths(filePaths)
+	u.keys = newKeyRegistry(u.collisionPolicy, u.logger)
+	u.keyStage = newKeyStage(u.numConcurrentUploads, u.renderKey, u.claimKey)
+	u.pending = pending
+	u.completed = completed
+	u.failed = failed
+	u.wg = &wg
+	if nil != u.archiveUploader {
+		u.batcher = newBatcher(u.batchPolicy, func(members []*fileUploadJob, number int) {
+			u.enqueueBatch(members, number, pending)
+		})
+	}
 	for i := 0; i < u.numConcurrentUploads; i++ {
 		go u.handlePending(pending, completed, failed)
 	}
+	u.mux.Unlock()
 
 	go func() {
 		for output := range completed {
@@ -76,12 +164,22 @@ func (u *uploader) UploadFilesFromPathToBucket(filePaths []string) error {
 				"durationNanoseconds": uploadDuration.Nanoseconds(),
 			}).Info(fmt.Sprintf("Uploaded file %s", output.path))
 
-			wg.Done()
+			u.jobDone(&wg)
 		}
 	}()
 
 	go func() {
 		for failure := range failed {
+			if nil != failure.keyErr {
+				u.logger.WithFields(logrus.Fields{
+					"filename": failure.path,
+					"error":    failure.keyErr.Error(),
+				}).Error(fmt.Sprintf("Failed to generate object key for file %s", failure.path))
+
+				u.jobDone(&wg)
+				continue
+			}
+
 			now := time.Now()
 			failedDuration := now.Sub(failure.startedAt)
 			var errorStrings []string
@@ -99,7 +197,7 @@ func (u *uploader) UploadFilesFromPathToBucket(filePaths []string) error {
 				"errors":              errorStrings,
 			}).Info(fmt.Sprintf("Failed to upload file %s", failure.path))
 
-			wg.Done()
+			u.jobDone(&wg)
 		}
 	}()
 
@@ -119,71 +217,339 @@ func (u *uploader) UploadFilesFromPathToBucket(filePaths []string) error {
 		}
 	}
 
+	u.flushBatches()
+
+	// From here on, failed jobs can only be retried while other jobs are still
+	// outstanding, so that no job is added once waiting is over
+	u.mux.Lock()
+	u.draining = true
+	u.mux.Unlock()
+
 	wg.Wait()
 
+	u.mux.Lock()
+	u.running = false
+	u.draining = false
+	keys := u.keys
+	u.mux.Unlock()
+
+	keys.report()
+
 	return nil
 }
 
-// Attempt to upload each pending filepath to AWS S3
+// Attempt to upload each pending filepath, until told to quit. No new
+// jobs are picked up while the uploader is paused.
 func (u *uploader) handlePending(
 	pending chan *fileUploadJob,
 	completed chan<- *fileUploadJob,
 	failed chan<- *fileUploadJob,
 ) {
-	for input := range pending {
-		key, err := u.keyTemplate.KeyForFile(input.path)
-		if err != nil {
-			u.logger.WithFields(logrus.Fields{
-				"filename": input.path,
-				"error":    err,
-			}).Errorf("Failed to parse template for S3 object key: %w", err)
+	for {
+		select {
+		case <-u.quit:
+			return
+		case <-u.resumedSignal():
 		}
 
-		err = u.s3Uploader.Upload(input.path, key)
-		if err == nil && u.shouldDeleteFileAfterUpload {
-			err = os.Remove(input.path)
-			if err != nil && errors.Is(err, os.ErrNotExist) {
-				u.logger.WithFields(logrus.Fields{
-					"filename": input.path,
-					"error":    err.Error(),
-				}).Warnf(
-					"Attempted to delete a file that no longer exists, did something else already delete it?: %s: %w",
-					input.path,
-					err,
-				)
-				completed <- input
-				continue
-			}
-			if err != nil {
-				u.logger.WithFields(logrus.Fields{
-					"filename": input.path,
-					"error":    err.Error(),
-				}).Fatal(fmt.Sprintf("Failed to delete file after upload: %s", input.path))
+		select {
+		case <-u.quit:
+			return
+		case input := <-pending:
+			u.handleJob(input, pending, completed, failed)
+		}
+	}
+}
+
+// Attempt to upload a single pending filepath
+func (u *uploader) handleJob(
+	input *fileUploadJob,
+	pending chan *fileUploadJob,
+	completed chan<- *fileUploadJob,
+	failed chan<- *fileUploadJob,
+) {
+	if nil != input.members {
+		u.handleBatchJob(input, pending, completed, failed)
+		return
+	}
+
+	key := input.key
+	if input.keyErr != nil {
+		// Generating the key again would fail the same way, so give up on the
+		// file without uploading it
+		input.errors = append(input.errors, input.keyErr)
+		u.notify(FileKeyFailed, input, "")
+		failed <- input
+		return
+	}
+
+	u.notify(FileUploadStarted, input, key)
+
+	err := u.fileUploader.Upload(input.path, key)
+	if err == nil {
+		if u.shouldDeleteFileAfterUpload {
+			u.deleteUploadedFile(input.path)
+		}
+
+		backend.Forget(u.fileUploader, key)
+		u.notify(FileUploaded, input, key)
+		completed <- input
+		return
+	}
+
+	input.errors = append(input.errors, err)
+
+	if retry.ShouldRetry(len(input.errors)) {
+		u.notify(FileUploadRetried, input, key)
+		u.requeueAfterDelay(input, pending)
+	} else {
+		backend.Forget(u.fileUploader, key)
+		u.notify(FileUploadFailed, input, key)
+		failed <- input
+	}
+}
+
+// Upload the members of a batch as a single archive, retrying the whole archive
+// when it fails. Every member shares the fate of the archive.
+func (u *uploader) handleBatchJob(
+	input *fileUploadJob,
+	pending chan *fileUploadJob,
+	completed chan<- *fileUploadJob,
+	failed chan<- *fileUploadJob,
+) {
+	var members []ArchiveMember
+	for _, member := range input.members {
+		u.notify(FileUploadStarted, member, member.key)
+		members = append(members, ArchiveMember{Path: member.path, Name: member.key})
+	}
+
+	err := u.archiveUploader.UploadArchive(members, input.key, u.batchPolicy.Format)
+	if err == nil {
+		backend.Forget(u.archiveUploader, input.key)
+		for _, member := range input.members {
+			if u.shouldDeleteFileAfterUpload {
+				u.deleteUploadedFile(member.path)
 			}
+
+			u.notify(FileUploaded, member, member.key)
+			completed <- member
+		}
+		return
+	}
+
+	input.errors = append(input.errors, err)
+	for _, member := range input.members {
+		member.errors = append(member.errors, err)
+	}
+
+	if retry.ShouldRetry(len(input.errors)) {
+		for _, member := range input.members {
+			u.notify(FileUploadRetried, member, member.key)
+		}
+		u.requeueAfterDelay(input, pending)
+	} else {
+		backend.Forget(u.archiveUploader, input.key)
+		for _, member := range input.members {
+			u.notify(FileUploadFailed, member, member.key)
+			failed <- member
 		}
-		if err == nil {
-			completed <- input
+	}
+}
+
+// Queue a failed job again once a delay that grows with each attempt passed
+func (u *uploader) requeueAfterDelay(input *fileUploadJob, pending chan *fileUploadJob) {
+	retry.After(retry.Delay(len(input.errors)), nil, func() {
+		pending <- input
+	}, nil)
+}
+
+// Delete a file once it was uploaded. A file that is already gone is only
+// warned about, while failing to delete one is fatal.
+func (u *uploader) deleteUploadedFile(filePath string) {
+	err := os.Remove(filePath)
+	if err != nil && errors.Is(err, os.ErrNotExist) {
+		u.logger.WithFields(logrus.Fields{
+			"filename": filePath,
+			"error":    err.Error(),
+		}).Warnf(
+			"Attempted to delete a file that no longer exists, did something else already delete it?: %s: %v",
+			filePath,
+			err,
+		)
+		return
+	}
+	if err != nil {
+		u.logger.WithFields(logrus.Fields{
+			"filename": filePath,
+			"error":    err.Error(),
+		}).Fatal(fmt.Sprintf("Failed to delete file after upload: %s", filePath))
+	}
+}
+
+// Find the root path a file was found in
+func (u *uploader) rootForPath(filePath string) string {
+	u.mux.Lock()
+	roots := u.roots
+	u.mux.Unlock()
+
+	return RootForPath(roots, filePath)
+}
+
+// RootForPath finds the root path, among those RootPaths determined, that a
+// file was found in, preferring the most specific root when paths overlap. It
+// is empty for a file outside every root.
+func RootForPath(roots []string, filePath string) string {
+	root := ""
+	for _, candidate := range roots {
+		relativePath, err := filepath.Rel(candidate, filePath)
+		if err != nil || ".." == relativePath || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
 			continue
 		}
 
-		input.errors = append(input.errors, err)
+		if len(candidate) > len(root) {
+			root = candidate
+		}
+	}
 
-		if len(input.errors) < 5 {
-			go func() {
-				pending <- input
-			}()
-		} else {
-			failed <- input
+	return root
+}
+
+// Count a job as done. The count of outstanding jobs is kept under the
+// uploader's lock, next to the wait group, for the sake of RetryFailed.
+func (u *uploader) jobDone(wg *sync.WaitGroup) {
+	u.mux.Lock()
+	u.outstanding--
+	u.mux.Unlock()
+
+	wg.Done()
+}
+
+// Enqueue a single file for uploading
+func (u *uploader) enqueue(
+	filePath string,
+	size int64,
+	pending chan *fileUploadJob,
+	wg *sync.WaitGroup,
+) {
+	u.mux.Lock()
+	u.outstanding++
+	wg.Add(1)
+	u.mux.Unlock()
+
+	u.enqueueJob(filePath, size, pending)
+}
+
+// Enqueue a single file whose job has already been added to the wait group.
+// The file's key is generated in parallel with the keys of other files, and
+// claimed in the order files are found.
+func (u *uploader) enqueueJob(
+	filePath string,
+	size int64,
+	pending chan *fileUploadJob,
+) {
+	u.mux.Lock()
+	u.nextJobID++
+	id := u.nextJobID
+	keyStage := u.keyStage
+	u.mux.Unlock()
+
+	job := &fileUploadJob{
+		id:        id,
+		path:      filePath,
+		size:      size,
+		errors:    []error{},
+		startedAt: time.Now(),
+	}
+
+	keyStage.add(job, func(job *fileUploadJob) {
+		u.notify(FileEnqueued, job, job.key)
+
+		// Files whose key failed go on their own, to fail without an archive
+		u.mux.Lock()
+		batcher := u.batcher
+		u.mux.Unlock()
+		if nil != batcher && nil == job.keyErr {
+			batcher.add(job)
+			return
 		}
+
+		pending <- job
+	})
+}
+
+// Generate the key of a file from the key template
+func (u *uploader) renderKey(job *fileUploadJob) {
+	job.key, job.keyErr = u.keyTemplate.KeyForFileInRoot(u.rootForPath(job.path), job.path)
+}
+
+// Claim the key of a file, applying the collision policy. It returns whether
+// the file should be uploaded, rather than skipped.
+func (u *uploader) claimKey(job *fileUploadJob) bool {
+	if nil != job.keyErr {
+		return true
 	}
+
+	requestedKey := job.key
+	job.key, job.keyErr = u.keys.claim(requestedKey, job.path)
+
+	if nil == job.keyErr && "" == job.key {
+		u.logger.WithFields(logrus.Fields{
+			"filename": job.path,
+			"key":      requestedKey,
+		}).Warn(fmt.Sprintf("Skipped file %s, its key is already used by another file", job.path))
+		u.notify(FileSkipped, job, requestedKey)
+
+		u.mux.Lock()
+		wg := u.wg
+		u.mux.Unlock()
+		u.jobDone(wg)
+		return false
+	}
+
+	return true
 }
 
-// Enqueue the contents of a directory for uploading to AWS S3
+// Enqueue a batch of files for uploading as a single archive. Its
+// members were already added to the wait group and enqueued on their own.
+func (u *uploader) enqueueBatch(members []*fileUploadJob, number int, pending chan *fileUploadJob) {
+	key := archiveKey(members, time.Now(), number, u.batchPolicy.Format)
+
+	u.logger.WithFields(logrus.Fields{
+		"key":     key,
+		"members": len(members),
+	}).Debug("Closed batch of files")
+
+	pending <- &fileUploadJob{
+		path:      key,
+		key:       key,
+		members:   members,
+		errors:    []error{},
+		startedAt: time.Now(),
+	}
+}
+
+// Send off every open batch, once no more files are about to be found
+func (u *uploader) flushBatches() {
+	u.mux.Lock()
+	batcher := u.batcher
+	keyStage := u.keyStage
+	u.mux.Unlock()
+
+	if nil != batcher {
+		keyStage.wait()
+		batcher.flush()
+	}
+}
+
+// Enqueue the contents of a directory for uploading, returning the paths of the
+// files found
 func (u *uploader) enqueueDirContents(
 	dirPathToWatch string,
 	pending chan *fileUploadJob,
 	wg *sync.WaitGroup,
-) {
+) map[string]bool {
+	found := make(map[string]bool)
+
 	err := filepath.Walk(dirPathToWatch, func(path string, info os.FileInfo, err error) error {
 		if dirPathToWatch == path {
 			return nil
@@ -193,18 +559,16 @@ func (u *uploader) enqueueDirContents(
 			return nil
 		}
 
-		wg.Add(1)
-		pending <- &fileUploadJob{
-			path:      path,
-			errors:    []error{},
-			startedAt: time.Now(),
-		}
+		found[path] = true
+		u.enqueue(path, info.Size(), pending, wg)
 
 		return nil
 	})
 	if err != nil {
 		u.logger.Fatal(err)
 	}
+
+	return found
 }
 
 func (u *uploader) uploadDir(
@@ -214,7 +578,16 @@ func (u *uploader) uploadDir(
 ) {
 	if u.shouldWatchPaths {
 		for {
-			u.enqueueDirContents(filePath, pending, wg)
+			found := u.enqueueDirContents(filePath, pending, wg)
+
+			// Files keep their keys while they are found, even once uploaded,
+			// and watching never ends, so collisions are reported as they are
+			// found
+			u.mux.Lock()
+			keys := u.keys
+			u.mux.Unlock()
+			keys.retain(found)
+			keys.report()
 
 			time.Sleep(1 * time.Second)
 		}
@@ -238,22 +611,12 @@ func (u *uploader) processSingleFilePath(
 	} else {
 		if u.shouldWatchPaths {
 			for {
-				wg.Add(1)
-				pending <- &fileUploadJob{
-					path:      filePath,
-					errors:    []error{},
-					startedAt: time.Now(),
-				}
+				u.enqueue(filePath, filePathInfo.Size(), pending, wg)
 
 				time.Sleep(1 * time.Second)
 			}
 		} else {
-			wg.Add(1)
-			pending <- &fileUploadJob{
-				path:      filePath,
-				errors:    []error{},
-				startedAt: time.Now(),
-			}
+			u.enqueue(filePath, filePathInfo.Size(), pending, wg)
 		}
 	}
 
@@ -274,12 +637,7 @@ func (u *uploader) processMultipleFilePaths(
 		if filePathInfo.IsDir() {
 			u.uploadDir(filePath, pending, wg)
 		} else {
-			wg.Add(1)
-			pending <- &fileUploadJob{
-				path:      filePath,
-				errors:    []error{},
-				startedAt: time.Now(),
-			}
+			u.enqueue(filePath, filePathInfo.Size(), pending, wg)
 		}
 	}
 
@@ -287,7 +645,37 @@ func (u *uploader) processMultipleFilePaths(
 }
 
 type fileUploadJob struct {
+	id        uint64
 	path      string
+	size      int64
+	key       string
+	keyErr    error
 	errors    []error
 	startedAt time.Time
+
+	// Members of a batch uploaded as a single archive
+	members []*fileUploadJob
+}
+
+// RootPaths determines the root path of each path to upload: a directory is the
+// root of the files found in it, and a single file's root is the directory
+// containing it. Paths that cannot be read are skipped here and reported when
+// uploading.
+func RootPaths(filePaths []string) []string {
+	var roots []string
+
+	for _, filePath := range filePaths {
+		info, err := os.Stat(filePath)
+		if err != nil {
+			continue
+		}
+
+		if info.IsDir() {
+			roots = append(roots, filePath)
+		} else {
+			roots = append(roots, filepath.Dir(filePath))
+		}
+	}
+
+	return roots
 }
@@ -1,16 +1,30 @@
 package upload
 
 import (
+	"bytes"
+	"errors"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/sirupsen/logrus"
 	. "github.com/smartystreets/goconvey/convey"
+	"github.com/timrourke/funnel/backend"
+	"github.com/timrourke/funnel/localfs"
+	"github.com/timrourke/funnel/retry"
 	"github.com/timrourke/funnel/s3"
 	"github.com/timrourke/funnel/tpl"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
+// Failed uploads are retried without waiting long, so tests of failures finish
+// quickly
+func init() {
+	retry.BaseDelay = time.Millisecond
+}
+
 type stubS3ManagerUploader struct {
 	inputsPassed         chan *s3manager.UploadInput
 	expectedReturnValues chan *s3manager.UploadOutput
@@ -24,6 +38,30 @@ func (s *stubS3ManagerUploader) Upload(input *s3manager.UploadInput, options ...
 	return <-s.expectedReturnValues, <-s.expectedErrorValues
 }
 
+type recordingObserver struct {
+	mux    sync.Mutex
+	events []Event
+}
+
+// Observe records every event it is notified of
+func (r *recordingObserver) Observe(event Event) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *recordingObserver) eventTypes() []EventType {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	var eventTypes []EventType
+	for _, event := range r.events {
+		eventTypes = append(eventTypes, event.Type)
+	}
+
+	return eventTypes
+}
+
 func TestNewUploader(t *testing.T) {
 	Convey("Should create a new uploader", t, func() {
 		stub := &stubS3ManagerUploader{
@@ -36,12 +74,12 @@ func TestNewUploader(t *testing.T) {
 
 		s3Uploader := s3.NewS3Uploader(stub, "unimportant", logger)
 
-		keyTemplate, err := tpl.NewKeyTemplate("{{ filePath }}", logger)
+		keyTemplate, err := tpl.NewKeyTemplate("{{ filePath }}", nil, logger)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		uploader := NewUploader(false, false, 10, s3Uploader, keyTemplate, logger)
+		uploader := NewUploader(false, false, 10, s3Uploader, keyTemplate, FailOnCollision, logger)
 
 		So(uploader, ShouldNotBeNil)
 		So(uploader, ShouldHaveSameTypeAs, uploader)
@@ -73,12 +111,12 @@ func TestUploadFilesFromPathToBucket(t *testing.T) {
 
 		s3Uploader := s3.NewS3Uploader(stub, "unimportant", logger)
 
-		keyTemplate, err := tpl.NewKeyTemplate("{{ filePath }}", logger)
+		keyTemplate, err := tpl.NewKeyTemplate("{{ filePath }}", nil, logger)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		uploader := NewUploader(false, false, 10, s3Uploader, keyTemplate, logger)
+		uploader := NewUploader(false, false, 10, s3Uploader, keyTemplate, FailOnCollision, logger)
 
 		err = uploader.UploadFilesFromPathToBucket([]string{file.Name()})
 
@@ -108,12 +146,12 @@ func TestUploadFilesFromPathToBucket(t *testing.T) {
 
 		s3Uploader := s3.NewS3Uploader(stub, "unimportant", logger)
 
-		keyTemplate, err := tpl.NewKeyTemplate("{{ filePath }}", logger)
+		keyTemplate, err := tpl.NewKeyTemplate("{{ filePath }}", nil, logger)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		uploader := NewUploader(true, false, 10, s3Uploader, keyTemplate, logger)
+		uploader := NewUploader(true, false, 10, s3Uploader, keyTemplate, FailOnCollision, logger)
 
 		err = uploader.UploadFilesFromPathToBucket([]string{file.Name()})
 
@@ -170,12 +208,12 @@ func TestUploadFilesFromPathToBucket(t *testing.T) {
 
 		s3Uploader := s3.NewS3Uploader(stub, "unimportant", logger)
 
-		keyTemplate, err := tpl.NewKeyTemplate("{{ filePath }}", logger)
+		keyTemplate, err := tpl.NewKeyTemplate("{{ filePath }}", nil, logger)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		uploader := NewUploader(false, false, 10, s3Uploader, keyTemplate, logger)
+		uploader := NewUploader(false, false, 10, s3Uploader, keyTemplate, FailOnCollision, logger)
 
 		err = uploader.UploadFilesFromPathToBucket([]string{dirname})
 
@@ -224,18 +262,249 @@ func TestUploadFilesFromPathToBucket(t *testing.T) {
 
 		s3Uploader := s3.NewS3Uploader(stub, "unimportant", logger)
 
-		keyTemplate, err := tpl.NewKeyTemplate("{{ filePath }}", logger)
+		keyTemplate, err := tpl.NewKeyTemplate("{{ filePath }}", nil, logger)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		uploader := NewUploader(false, false, 10, s3Uploader, keyTemplate, logger)
+		uploader := NewUploader(false, false, 10, s3Uploader, keyTemplate, FailOnCollision, logger)
 
 		err = uploader.UploadFilesFromPathToBucket([]string{expectedFilePath1, expectedFilePath2})
 
 		c.So(err, ShouldBeNil)
 	})
 
+	Convey("Should notify observers as a file is uploaded", t, func(c C) {
+		file, err := ioutil.TempFile("", "somefile")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(file.Name())
+
+		stub := &stubS3ManagerUploader{
+			inputsPassed:         make(chan *s3manager.UploadInput),
+			expectedReturnValues: make(chan *s3manager.UploadOutput),
+			expectedErrorValues:  make(chan error),
+		}
+
+		go func() {
+			<-stub.inputsPassed
+			stub.expectedReturnValues <- nil
+			stub.expectedErrorValues <- errors.New("connection reset")
+
+			<-stub.inputsPassed
+			stub.expectedReturnValues <- nil
+			stub.expectedErrorValues <- nil
+		}()
+
+		logger := logrus.New()
+
+		s3Uploader := s3.NewS3Uploader(stub, "unimportant", logger)
+
+		keyTemplate, err := tpl.NewKeyTemplate("{{ filePath }}", nil, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		observer := &recordingObserver{}
+
+		uploader := NewUploader(false, false, 10, s3Uploader, keyTemplate, FailOnCollision, logger, observer)
+
+		err = uploader.UploadFilesFromPathToBucket([]string{file.Name()})
+
+		c.So(err, ShouldBeNil)
+		c.So(observer.eventTypes(), ShouldResemble, []EventType{
+			FileEnqueued,
+			FileUploadStarted,
+			FileUploadRetried,
+			FileUploadStarted,
+			FileUploaded,
+		})
+		c.So(observer.events[4].Key, ShouldEqual, file.Name())
+		c.So(len(observer.events[4].Errors), ShouldEqual, 1)
+	})
+
+	Convey("Should fail a file without uploading it when its key cannot be generated", t, func() {
+		file, err := ioutil.TempFile("", "somefile")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(file.Name())
+
+		logger := logrus.New()
+		logger.SetOutput(ioutil.Discard)
+
+		uploadAttempts := 0
+		s3Uploader := funcS3Uploader(func(path string, key string) error {
+			uploadAttempts++
+			return nil
+		})
+
+		keyTemplate, err := tpl.NewKeyTemplate(`{{ var "missing" }}`, nil, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		observer := &recordingObserver{}
+
+		uploader := NewUploader(false, false, 10, s3Uploader, keyTemplate, FailOnCollision, logger, observer)
+
+		err = uploader.UploadFilesFromPathToBucket([]string{file.Name()})
+
+		So(err, ShouldBeNil)
+		So(uploadAttempts, ShouldEqual, 0)
+		So(observer.eventTypes(), ShouldResemble, []EventType{
+			FileEnqueued,
+			FileKeyFailed,
+		})
+		So(observer.events[1].Errors[0].Error(), ShouldContainSubstring, "missing")
+		So(uploader.Jobs().Queued, ShouldBeEmpty)
+		So(uploader.Jobs().Failed, ShouldBeEmpty)
+	})
+
+	Convey("Should delete a file as soon as it is stored in enough destinations", t, func() {
+		logger := logrus.New()
+		logger.SetOutput(ioutil.Discard)
+
+		keyTemplate, err := tpl.NewKeyTemplate("{{ fileName }}", nil, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A destination below a regular file fails every upload
+		broken, err := ioutil.TempFile("", "broken")
+		if err != nil {
+			t.Fatal(err)
+		}
+		broken.Close()
+		defer os.Remove(broken.Name())
+
+		for quorum, stored := range map[int]bool{1: true, 2: false} {
+			file, err := ioutil.TempFile("", "somefile")
+			if err != nil {
+				t.Fatal(err)
+			}
+			file.Close()
+			defer os.Remove(file.Name())
+
+			outputDir, err := ioutil.TempDir("", "required")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(outputDir)
+
+			fanOut := backend.NewFanOut([]backend.Destination{
+				{Name: "file://" + outputDir, Backend: localfs.NewBackend(outputDir, logger), Required: true},
+				{Name: "file://" + broken.Name(), Backend: localfs.NewBackend(filepath.Join(broken.Name(), "nas"), logger)},
+			}, quorum, backend.FanOutParallel, logger)
+
+			uploader := NewUploader(true, false, 10, fanOut, keyTemplate, FailOnCollision, logger)
+
+			err = uploader.UploadFilesFromPathToBucket([]string{file.Name()})
+			backend.Wait(fanOut)
+
+			So(err, ShouldBeNil)
+			So(uploader.Jobs().Failed, ShouldHaveLength, map[bool]int{true: 0, false: 1}[stored])
+
+			_, err = os.Stat(filepath.Join(outputDir, filepath.Base(file.Name())))
+			So(err, ShouldBeNil)
+
+			_, err = os.Stat(file.Name())
+			So(os.IsNotExist(err), ShouldEqual, stored)
+		}
+	})
+
+	Convey("Should apply the collision policy to files with the same key", t, func() {
+		firstDirname, err := ioutil.TempDir("", "firstdir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(firstDirname)
+
+		secondDirname, err := ioutil.TempDir("", "seconddir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(secondDirname)
+
+		for _, dirname := range []string{firstDirname, secondDirname} {
+			err = ioutil.WriteFile(filepath.Join(dirname, "same.txt"), nil, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		logger := logrus.New()
+		logger.SetOutput(ioutil.Discard)
+
+		keyTemplate, err := tpl.NewKeyTemplate("{{ fileName }}", nil, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var mux sync.Mutex
+		uploadedKeys := map[string]string{}
+		s3Uploader := funcS3Uploader(func(path string, key string) error {
+			mux.Lock()
+			defer mux.Unlock()
+			uploadedKeys[path] = key
+			return nil
+		})
+
+		Convey("Should add a suffix to the key of the file found last", func() {
+			uploader := NewUploader(false, false, 10, s3Uploader, keyTemplate, SuffixOnCollision, logger)
+
+			err := uploader.UploadFilesFromPathToBucket([]string{firstDirname, secondDirname})
+
+			So(err, ShouldBeNil)
+			So(uploadedKeys, ShouldResemble, map[string]string{
+				filepath.Join(firstDirname, "same.txt"):  "same.txt",
+				filepath.Join(secondDirname, "same.txt"): "same-1.txt",
+			})
+		})
+
+		Convey("Should skip the file found last", func() {
+			observer := &recordingObserver{}
+			uploader := NewUploader(false, false, 10, s3Uploader, keyTemplate, SkipOnCollision, logger, observer)
+
+			err := uploader.UploadFilesFromPathToBucket([]string{firstDirname, secondDirname})
+
+			So(err, ShouldBeNil)
+			So(uploadedKeys, ShouldResemble, map[string]string{
+				filepath.Join(firstDirname, "same.txt"): "same.txt",
+			})
+			So(observer.eventTypes(), ShouldContain, FileSkipped)
+		})
+
+		Convey("Should fail the file found last", func() {
+			uploader := NewUploader(false, false, 10, s3Uploader, keyTemplate, FailOnCollision, logger)
+
+			err := uploader.UploadFilesFromPathToBucket([]string{firstDirname, secondDirname})
+
+			So(err, ShouldBeNil)
+			So(uploadedKeys, ShouldResemble, map[string]string{
+				filepath.Join(firstDirname, "same.txt"): "same.txt",
+			})
+			So(uploader.Jobs().Failed, ShouldBeEmpty)
+		})
+
+		Convey("Should report every colliding file once the run is over", func() {
+			logs := &bytes.Buffer{}
+			reportLogger := logrus.New()
+			reportLogger.SetOutput(logs)
+			reportLogger.SetFormatter(&logrus.JSONFormatter{})
+
+			uploader := NewUploader(false, false, 10, s3Uploader, keyTemplate, SkipOnCollision, reportLogger)
+
+			err := uploader.UploadFilesFromPathToBucket([]string{firstDirname, secondDirname})
+
+			So(err, ShouldBeNil)
+			So(logs.String(), ShouldContainSubstring, "2 files have the same key same.txt")
+			So(logs.String(), ShouldContainSubstring, filepath.Join(firstDirname, "same.txt"))
+			So(logs.String(), ShouldContainSubstring, filepath.Join(secondDirname, "same.txt"))
+		})
+	})
+
 	Convey("Should fail if no file paths provided", t, func() {
 		stub := &stubS3ManagerUploader{
 			inputsPassed:         nil,
@@ -247,12 +516,12 @@ func TestUploadFilesFromPathToBucket(t *testing.T) {
 
 		s3Uploader := s3.NewS3Uploader(stub, "unimportant", logger)
 
-		keyTemplate, err := tpl.NewKeyTemplate("{{ filePath }}", logger)
+		keyTemplate, err := tpl.NewKeyTemplate("{{ filePath }}", nil, logger)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		uploader := NewUploader(false, false, 10, s3Uploader, keyTemplate, logger)
+		uploader := NewUploader(false, false, 10, s3Uploader, keyTemplate, FailOnCollision, logger)
 
 		err = uploader.UploadFilesFromPathToBucket([]string{})
 
@@ -271,12 +540,12 @@ func TestUploadFilesFromPathToBucket(t *testing.T) {
 
 		s3Uploader := s3.NewS3Uploader(stub, "unimportant", logger)
 
-		keyTemplate, err := tpl.NewKeyTemplate("{{ filePath }}", logger)
+		keyTemplate, err := tpl.NewKeyTemplate("{{ filePath }}", nil, logger)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		uploader := NewUploader(false, true, 10, s3Uploader, keyTemplate, logger)
+		uploader := NewUploader(false, true, 10, s3Uploader, keyTemplate, FailOnCollision, logger)
 
 		err = uploader.UploadFilesFromPathToBucket([]string{"foo", "bar"})
 
@@ -284,3 +553,85 @@ func TestUploadFilesFromPathToBucket(t *testing.T) {
 		So(err.Error(), ShouldEqual, "watching multiple paths not supported")
 	})
 }
+
+func TestUploader_rootForPath(t *testing.T) {
+	dirname, err := ioutil.TempDir("", "somedir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dirname)
+
+	nestedDirname := filepath.Join(dirname, "nested")
+	err = os.Mkdir(nestedDirname, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	singleFilePath := filepath.Join(nestedDirname, "single")
+	err = ioutil.WriteFile(singleFilePath, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Convey("Should find the root path each file was found in", t, func() {
+		u := &uploader{
+			roots: RootPaths([]string{dirname, singleFilePath, "does-not-exist"}),
+		}
+
+		So(u.roots, ShouldResemble, []string{dirname, nestedDirname})
+		So(u.rootForPath(filepath.Join(dirname, "a", "b")), ShouldEqual, dirname)
+		So(u.rootForPath(singleFilePath), ShouldEqual, nestedDirname)
+		So(u.rootForPath("elsewhere"), ShouldEqual, "")
+	})
+}
+
+// forgettingUploader records the keys it is told to forget
+type forgettingUploader struct {
+	funcS3Uploader
+
+	mux       sync.Mutex
+	forgotten []string
+}
+
+// Forget records the forgotten key
+func (f *forgettingUploader) Forget(key string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+
+	f.forgotten = append(f.forgotten, key)
+}
+
+func TestUploader_forgetsKeys(t *testing.T) {
+	Convey("Should let the backend forget keys once they will not be retried", t, func() {
+		uploadedPath := newControlTestFile(t)
+		defer os.Remove(uploadedPath)
+
+		failingPath := newControlTestFile(t)
+		defer os.Remove(failingPath)
+
+		fileUploader := &forgettingUploader{funcS3Uploader: func(path string, key string) error {
+			if path == failingPath {
+				return errors.New("connection reset")
+			}
+
+			return nil
+		}}
+
+		logger := logrus.New()
+		logger.SetOutput(ioutil.Discard)
+
+		keyTemplate, err := tpl.NewKeyTemplate("{{ filePath }}", nil, logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		uploader := NewUploader(false, false, 2, fileUploader, keyTemplate, FailOnCollision, logger)
+
+		err = uploader.UploadFilesFromPathToBucket([]string{uploadedPath, failingPath})
+
+		So(err, ShouldBeNil)
+		So(fileUploader.forgotten, ShouldHaveLength, 2)
+		So(fileUploader.forgotten, ShouldContain, uploadedPath)
+		So(fileUploader.forgotten, ShouldContain, failingPath)
+	})
+}